@@ -0,0 +1,87 @@
+package application
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/singchia/go-timer/v2"
+)
+
+// OptionAckAggregation batches the acks of the received messages, the
+// pending acks are flushed once count of them pending, or interval passed
+// since the first pending, or the stream closing. A count under 2 means no
+// count bound, and a 0 interval means no time bound. Error acks are never
+// batched. The producer must know the batched acks.
+func OptionAckAggregation(count int, interval time.Duration) EndOption {
+	return func(end *End) {
+		end.ackCount = count
+		end.ackInterval = interval
+	}
+}
+
+// pending acks of a stream
+type ackBatch struct {
+	mtx     sync.Mutex
+	pending []uint64
+	tick    timer.Tick
+}
+
+func (sm *stream) ackAggregated() bool {
+	return sm.ackCount > 1 || sm.ackInterval > 0
+}
+
+func (sm *stream) batchAck(pktID uint64) error {
+	sm.mtx.RLock()
+	defer sm.mtx.RUnlock()
+	if !sm.streamOK {
+		return io.EOF
+	}
+	sm.acks.mtx.Lock()
+	defer sm.acks.mtx.Unlock()
+	sm.acks.pending = append(sm.acks.pending, pktID)
+	if sm.ackCount > 1 && len(sm.acks.pending) >= sm.ackCount {
+		sm.writeAcks(sm.acks.take())
+		return nil
+	}
+	if len(sm.acks.pending) == 1 && sm.ackInterval > 0 {
+		sm.acks.tick = sm.tmr.Add(sm.ackInterval, timer.WithHandler(func(_ *timer.Event) {
+			sm.flushAcks()
+		}))
+	}
+	return nil
+}
+
+func (sm *stream) flushAcks() error {
+	sm.mtx.RLock()
+	defer sm.mtx.RUnlock()
+	if !sm.streamOK {
+		return io.EOF
+	}
+	sm.acks.mtx.Lock()
+	defer sm.acks.mtx.Unlock()
+	sm.writeAcks(sm.acks.take())
+	return nil
+}
+
+// take must be called with mtx held
+func (batch *ackBatch) take() []uint64 {
+	if batch.tick != nil {
+		batch.tick.Cancel()
+		batch.tick = nil
+	}
+	pktIDs := batch.pending
+	batch.pending = nil
+	return pktIDs
+}
+
+// the first packetID is acked as a plain ack and the rest are carried along,
+// it must be called with the stream's mtx held
+func (sm *stream) writeAcks(pktIDs []uint64) {
+	if len(pktIDs) == 0 {
+		return
+	}
+	pkt := sm.pf.NewMessageAckPacketWithSessionID(sm.dg.DialogueID(), pktIDs[0], nil)
+	pkt.Data.Acks = pktIDs[1:]
+	sm.writeInCh <- pkt
+}
@@ -0,0 +1,104 @@
+package application
+
+import (
+	"container/list"
+	"sync"
+)
+
+// ackOrder tracks the messages published at least once in order, for the
+// acked prefix of them
+type ackOrder struct {
+	mtx sync.Mutex
+	// nil until AckStream called, nothing is tracked before
+	ch     chan uint64
+	closed bool
+	// published and not advanced past yet, in publishing order
+	pending *list.List
+	elems   map[uint64]*list.Element
+}
+
+type orderedMessage struct {
+	id    uint64
+	acked bool
+}
+
+// AckStream yields the highest ID of the messages published at least once
+// on the default stream, that all messages published before it are acked
+// too. It never passes a message not acked, a failed one must be published
+// again to advance. Since the latest ID covers the former ones, IDs not taken
+// in time are replaced by the latest. Only messages published after the first
+// call are tracked, and the channel is closed once the End closed.
+func (end *End) AckStream() <-chan uint64 {
+	return end.stream.ackStream()
+}
+
+func (sm *stream) ackStream() <-chan uint64 {
+	sm.ackOrder.mtx.Lock()
+	defer sm.ackOrder.mtx.Unlock()
+	if sm.ackOrder.ch == nil {
+		sm.ackOrder.ch = make(chan uint64, 1)
+		sm.ackOrder.pending = list.New()
+		sm.ackOrder.elems = make(map[uint64]*list.Element)
+		if sm.ackOrder.closed {
+			close(sm.ackOrder.ch)
+		}
+	}
+	return sm.ackOrder.ch
+}
+
+func (order *ackOrder) publish(id uint64) {
+	order.mtx.Lock()
+	defer order.mtx.Unlock()
+	if order.ch == nil || order.closed {
+		return
+	}
+	// published again keeps the position
+	if _, ok := order.elems[id]; ok {
+		return
+	}
+	order.elems[id] = order.pending.PushBack(&orderedMessage{id: id})
+}
+
+func (order *ackOrder) ack(id uint64) {
+	order.mtx.Lock()
+	defer order.mtx.Unlock()
+	if order.ch == nil || order.closed {
+		return
+	}
+	elem, ok := order.elems[id]
+	if !ok {
+		return
+	}
+	elem.Value.(*orderedMessage).acked = true
+	advanced, last := false, uint64(0)
+	for front := order.pending.Front(); front != nil; front = order.pending.Front() {
+		msg := front.Value.(*orderedMessage)
+		if !msg.acked {
+			break
+		}
+		advanced, last = true, msg.id
+		order.pending.Remove(front)
+		delete(order.elems, msg.id)
+	}
+	if !advanced {
+		return
+	}
+	// replace the one not taken, we're the only sender
+	select {
+	case <-order.ch:
+	default:
+	}
+	order.ch <- last
+}
+
+func (order *ackOrder) close() {
+	order.mtx.Lock()
+	defer order.mtx.Unlock()
+	if order.closed {
+		return
+	}
+	order.closed = true
+	if order.ch != nil {
+		close(order.ch)
+	}
+}
@@ -0,0 +1,35 @@
+package application
+
+import (
+	"errors"
+
+	"github.com/singchia/geminio/packet"
+)
+
+// ErrForbidden is returned to the caller whose RPC is rejected by the
+// authorizer.
+var ErrForbidden = errors.New("forbidden")
+
+// OptionAuthorizer consults authorize before dispatching every local RPC,
+// hijacked ones included, the calls it returns error are answered with
+// ErrForbidden and never reach the handlers.
+func OptionAuthorizer(authorize func(clientID uint64, method string) error) EndOption {
+	return func(end *End) {
+		end.authorize = authorize
+	}
+}
+
+// authorized returns false if the request is rejected and answered
+func (sm *stream) authorized(pkt *packet.RequestPacket, method string) (bool, error) {
+	if sm.authorize == nil {
+		return true, nil
+	}
+	err := sm.authorize(sm.cn.ClientID(), method)
+	if err == nil {
+		return true, nil
+	}
+	sm.log.Debugf("request forbidden: %s, clientID: %d, dialogueID: %d, packetID: %d, method: %s",
+		err, sm.cn.ClientID(), sm.dg.DialogueID(), pkt.ID(), method)
+	rspPkt := sm.pf.NewResponsePacket(pkt.ID(), []byte(method), nil, ErrForbidden)
+	return false, sm.dg.Write(rspPkt)
+}
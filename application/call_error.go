@@ -0,0 +1,97 @@
+package application
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jumboframes/armorigo/synchub"
+)
+
+// the kinds of CallError
+var (
+	// the response didn't come in the timeout or the ctx's deadline, or the
+	// callee didn't return in the request's timeout
+	ErrCallTimeout = errors.New("call timeout")
+	// the ctx canceled before the response came
+	ErrCallCanceled = errors.New("call canceled")
+	// the stream or the conn broke before the response came
+	ErrCallTransport = errors.New("call transport")
+	// the callee returned an error
+	ErrCallRemote = errors.New("call remote")
+	// the method isn't registered at the callee
+	ErrCallMethodNotFound = errors.New("call method not found")
+)
+
+// ErrNoSuchRPC is the callee's reply to the method not registered
+var ErrNoSuchRPC = errors.New("no such rpc")
+
+// CallError is returned by Call and CallAsync, both the Kind, one of the
+// ErrCall errors, and the underlying Err are reachable by errors.Is.
+type CallError struct {
+	Kind error
+	Err  error
+}
+
+func (err *CallError) Error() string {
+	return err.Kind.Error() + ": " + err.Err.Error()
+}
+
+func (err *CallError) Unwrap() []error {
+	return []error{err.Kind, err.Err}
+}
+
+// newCallError classifies the err of a local failure, the callee's errors
+// are CallErrors already, and the misuses are returned as is
+func newCallError(err error) error {
+	if err == ErrMismatchClientID || err == ErrMismatchStreamID {
+		return err
+	}
+	if _, ok := err.(*CallError); ok {
+		return err
+	}
+	kind := ErrCallTransport
+	switch {
+	case errors.Is(err, synchub.ErrSyncTimeout), errors.Is(err, context.DeadlineExceeded):
+		kind = ErrCallTimeout
+	case errors.Is(err, context.Canceled):
+		kind = ErrCallCanceled
+	case errors.Is(err, ErrRemoteRPCUnregistered):
+		kind = ErrCallMethodNotFound
+	}
+	return &CallError{Kind: kind, Err: err}
+}
+
+// remoteCallError restores the callee's error by the reason, the known ones
+// are kept for comparison
+func remoteCallError(reason string) *CallError {
+	kind := ErrCallRemote
+	var err error
+	switch {
+	// to let the caller tell the busy and quiescing apart
+	case reason == ErrServerBusy.Error():
+		err = ErrServerBusy
+	case reason == ErrQuiescing.Error():
+		err = ErrQuiescing
+	case reason == ErrForbidden.Error():
+		err = ErrForbidden
+	case reason == ErrRequestTimeout.Error():
+		kind, err = ErrCallTimeout, ErrRequestTimeout
+	case strings.HasPrefix(reason, ErrNoSuchRPC.Error()+": "):
+		kind = ErrCallMethodNotFound
+		err = fmt.Errorf("%w%s", ErrNoSuchRPC, strings.TrimPrefix(reason, ErrNoSuchRPC.Error()))
+	default:
+		err = errors.New(reason)
+	}
+	return &CallError{Kind: kind, Err: err}
+}
+
+// callCause returns the callee's error as is, for the calls other than Call
+// and CallAsync
+func callCause(err error) error {
+	if callErr, ok := err.(*CallError); ok {
+		return callErr.Err
+	}
+	return err
+}
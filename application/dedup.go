@@ -0,0 +1,110 @@
+package application
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/singchia/geminio"
+	"github.com/singchia/geminio/options"
+)
+
+const (
+	defaultMessageDedupTTL = time.Minute
+)
+
+// dedupCache remembers idempotency keys of received messages for the ttl
+type dedupCache struct {
+	mtx       sync.Mutex
+	ttl       time.Duration
+	keys      map[string]time.Time // key: idempotency key, value: expiration
+	lastSweep time.Time
+}
+
+func newDedupCache(ttl time.Duration) *dedupCache {
+	return &dedupCache{
+		ttl:       ttl,
+		keys:      make(map[string]time.Time),
+		lastSweep: time.Now(),
+	}
+}
+
+// seen returns true if the key was seen in the ttl, or else records the key
+func (dc *dedupCache) seen(key string) bool {
+	dc.mtx.Lock()
+	defer dc.mtx.Unlock()
+
+	now := time.Now()
+	if now.Sub(dc.lastSweep) >= dc.ttl {
+		// sweep expired keys at most once a ttl
+		for key, expiration := range dc.keys {
+			if now.After(expiration) {
+				delete(dc.keys, key)
+			}
+		}
+		dc.lastSweep = now
+	}
+	expiration, ok := dc.keys[key]
+	if ok && !now.After(expiration) {
+		return true
+	}
+	dc.keys[key] = now.Add(dc.ttl)
+	return false
+}
+
+// flight is a call in flight shared by the identical requests
+type flight struct {
+	done chan struct{}
+	rsp  geminio.Response
+	err  error
+}
+
+// flightGroup coalesces identical calls in flight into one
+type flightGroup struct {
+	mtx     sync.Mutex
+	flights map[string]*flight // key: method and hash of the body
+}
+
+// do calls fn only if no identical call in flight, or else waits for the
+// one in flight until ctx done
+func (fg *flightGroup) do(ctx context.Context, key string, fn func() (geminio.Response, error)) (geminio.Response, error) {
+	fg.mtx.Lock()
+	if fg.flights == nil {
+		fg.flights = make(map[string]*flight)
+	}
+	fl, ok := fg.flights[key]
+	if ok {
+		fg.mtx.Unlock()
+		select {
+		case <-fl.done:
+			return fl.rsp, fl.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	fl = &flight{done: make(chan struct{})}
+	fg.flights[key] = fl
+	fg.mtx.Unlock()
+
+	fl.rsp, fl.err = fn()
+	// calls after this one go to the wire again
+	fg.mtx.Lock()
+	delete(fg.flights, key)
+	fg.mtx.Unlock()
+	close(fl.done)
+	return fl.rsp, fl.err
+}
+
+// CallDedup is Call but identical requests in flight, the same method and
+// body, are sent only once and share the response. The shared call is bound
+// to the ctx of the first caller, and the response shouldn't be modified.
+func (end *End) CallDedup(ctx context.Context, method string, req geminio.Request,
+	opts ...*options.CallOptions) (geminio.Response, error) {
+	hash := sha256.Sum256(req.Data())
+	key := method + "/" + hex.EncodeToString(hash[:])
+	return end.flights.do(ctx, key, func() (geminio.Response, error) {
+		return end.Call(ctx, method, req, opts...)
+	})
+}
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/jumboframes/armorigo/log"
 	"github.com/jumboframes/armorigo/synchub"
@@ -35,6 +37,28 @@ type opts struct {
 	// callback funcs
 	acceptStreamFunc func(geminio.Stream)
 	closedStreamFunc func(geminio.Stream)
+	// application keepalive, 0 interval means disabled
+	keepaliveInterval time.Duration
+	keepaliveTimeout  time.Duration
+	keepalivePayload  []byte
+	// worker pool for local RPCs, 0 size means a goroutine for each request
+	workerPoolSize   int
+	workerPoolQueue  int
+	workerPoolPolicy WorkerPoolPolicy
+	// how long idempotency keys of received messages are kept
+	messageDedupTTL time.Duration
+	// how long buffered data can be drained after the stream dismissed
+	finiGrace time.Duration
+	// observer of packets dropped intentionally
+	dropObserver packet.DropObserver
+	// ack aggregation of received messages
+	ackCount    int
+	ackInterval time.Duration
+	// retransmission of unacked messages, 0 interval means disabled
+	retransmitInterval time.Duration
+	retransmitAttempts int
+	// consulted before dispatching local RPCs, nil means all allowed
+	authorize func(clientID uint64, method string) error
 }
 
 type EndOption func(*End)
@@ -98,6 +122,55 @@ func OptionClosedStreamFunc(fn func(geminio.Stream)) EndOption {
 	}
 }
 
+// OptionKeepalive sets the End to call a lightweight RPC with the payload
+// after being idle for the interval, and aborts the conn if no reply in the
+// timeout, which is the interval if 0.
+func OptionKeepalive(interval, timeout time.Duration, payload []byte) EndOption {
+	return func(end *End) {
+		end.keepaliveInterval = interval
+		end.keepaliveTimeout = timeout
+		if timeout == 0 {
+			end.keepaliveTimeout = interval
+		}
+		end.keepalivePayload = payload
+	}
+}
+
+// OptionWorkerPool sets local RPCs from the End and all streams to be run by
+// the bounded workers, and requests are queued while all workers are busy,
+// the policy decides what to do when the queue is full.
+func OptionWorkerPool(size, queue int, policy WorkerPoolPolicy) EndOption {
+	return func(end *End) {
+		end.workerPoolSize = size
+		end.workerPoolQueue = queue
+		end.workerPoolPolicy = policy
+	}
+}
+
+// OptionMessageDedupTTL sets how long a received message's idempotency key
+// is kept, duplicates in the ttl are acked and dropped, default is a minute.
+func OptionMessageDedupTTL(ttl time.Duration) EndOption {
+	return func(end *End) {
+		end.messageDedupTTL = ttl
+	}
+}
+
+// OptionFiniGrace keeps channels of a dismissed stream valid for at most
+// grace, or until all buffered data read, before the stream finishes.
+func OptionFiniGrace(grace time.Duration) EndOption {
+	return func(end *End) {
+		end.finiGrace = grace
+	}
+}
+
+// OptionDropObserver sets the observer notified of every packet the streams
+// drop intentionally.
+func OptionDropObserver(observer packet.DropObserver) EndOption {
+	return func(end *End) {
+		end.dropObserver = observer
+	}
+}
+
 type End struct {
 	// options for packet factory, log and timer
 	*opts
@@ -105,9 +178,33 @@ type End struct {
 	cn          conn.Conn
 	multiplexer multiplexer.Multiplexer
 	streams     sync.Map
+	// key: method, value: *methodStat
+	methodStats sync.Map
 	// End holds the default stream
 	*stream
 	onceClose *sync.Once
+
+	// keepalive
+	lastActive int64
+	pinging    int32
+	kaTick     timer.Tick
+	kaMtx      sync.Mutex
+	// bounded workers for local RPCs, nil if not set
+	pool *workerPool
+	// 1 if quiescing
+	quiescing int32
+	// nanoseconds, for requests without their own timeout, 0 means no timeout
+	defaultRequestTimeout int64
+	// outgoing calls of the End and its streams waiting for responses
+	calls int64
+	// identical calls in flight by CallDedup
+	flights flightGroup
+
+	// conn idle, 0 timeout means disabled
+	connIdleTimeout time.Duration
+	lastStreamed    int64
+	ciTick          timer.Tick
+	ciMtx           sync.Mutex
 }
 
 func NewEnd(cn conn.Conn, multiplexer multiplexer.Multiplexer, options ...EndOption) (
@@ -135,6 +232,12 @@ func NewEnd(cn conn.Conn, multiplexer multiplexer.Multiplexer, options ...EndOpt
 	if end.log == nil {
 		end.log = log.DefaultLog
 	}
+	if end.messageDedupTTL <= 0 {
+		end.messageDedupTTL = defaultMessageDedupTTL
+	}
+	if end.workerPoolSize > 0 {
+		end.pool = newWorkerPool(end.workerPoolSize, end.workerPoolQueue, end.workerPoolPolicy)
+	}
 
 	// set default stream whose streamID is 1 for the End
 	// newStream start to roll the stream
@@ -175,8 +278,17 @@ func NewEnd(cn conn.Conn, multiplexer multiplexer.Multiplexer, options ...EndOpt
 			}
 		}
 	}
+	if end.keepaliveInterval > 0 {
+		end.startKeepalive()
+	}
+	if end.connIdleTimeout > 0 {
+		end.startConnIdle()
+	}
 	return end, nil
 ERR:
+	if end.pool != nil {
+		end.pool.close()
+	}
 	if end.tmrOwner == end {
 		end.tmr.Close()
 	}
@@ -191,7 +303,17 @@ func (end *End) OpenStream(opts ...*options.OpenStreamOptions) (
 	if oo.Peer != nil {
 		peer = *oo.Peer
 	}
-	dg, err := end.multiplexer.OpenDialogue(oo.Meta, peer)
+	dgOpts := []multiplexer.DialogueOption{}
+	if oo.Interactive != nil && *oo.Interactive {
+		dgOpts = append(dgOpts, multiplexer.OptionDialogueInteractive())
+	}
+	if oo.Namespace != nil {
+		dgOpts = append(dgOpts, multiplexer.OptionDialogueNamespace(*oo.Namespace))
+	}
+	if oo.Resume != nil {
+		dgOpts = append(dgOpts, multiplexer.OptionDialogueResume(*oo.Resume))
+	}
+	dg, err := end.multiplexer.OpenDialogue(oo.Meta, peer, dgOpts...)
 	if err != nil {
 		return nil, err
 	}
@@ -202,6 +324,7 @@ func (end *End) OpenStream(opts ...*options.OpenStreamOptions) (
 
 func (end *End) delStream(streamID uint64) {
 	end.streams.Delete(streamID)
+	end.touchStreams()
 }
 
 func (end *End) AcceptStream() (geminio.Stream, error) {
@@ -227,12 +350,42 @@ func (end *End) ListStreams() []geminio.Stream {
 	return streams
 }
 
+// CloseDialoguesWhere closes all dialogues which match the function and returns
+// the number of dialogues closed, the default dialogue is never matched.
+func (end *End) CloseDialoguesWhere(match func(multiplexer.DialogueDescriber) bool) int {
+	return end.multiplexer.CloseDialoguesWhere(match)
+}
+
+// SetDefaultRequestTimeout sets the timeout for requests of the End and its
+// streams which don't set their own, zero means no timeout.
+func (end *End) SetDefaultRequestTimeout(timeout time.Duration) {
+	atomic.StoreInt64(&end.defaultRequestTimeout, int64(timeout))
+}
+
+func (end *End) requestTimeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&end.defaultRequestTimeout))
+}
+
+// Quiesce rejects new streams from peer and requests on the default stream
+// with ErrQuiescing, and existing streams keep working.
+func (end *End) Quiesce() {
+	atomic.StoreInt32(&end.quiescing, 1)
+	end.multiplexer.Quiesce()
+}
+
+func (end *End) Unquiesce() {
+	end.multiplexer.Unquiesce()
+	atomic.StoreInt32(&end.quiescing, 0)
+}
+
 func (end *End) Addr() net.Addr {
 	return end.LocalAddr()
 }
 
 func (end *End) Close() error {
 	end.onceClose.Do(func() {
+		end.stopKeepalive()
+		end.stopConnIdle()
 		end.multiplexer.Close()
 		end.cn.Close()
 		if end.tmrOwner == end {
@@ -244,6 +397,11 @@ func (end *End) Close() error {
 
 func (end *End) fini() {
 	end.log.Debugf("end finishing, clientID: %d", end.cn.ClientID())
+	end.stopKeepalive()
+	end.stopConnIdle()
+	if end.pool != nil {
+		end.pool.close()
+	}
 	if end.tmrOwner == end {
 		end.tmr.Close()
 	}
@@ -0,0 +1,66 @@
+package application
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/singchia/go-timer/v2"
+)
+
+// OptionConnIdleTimeout closes the conn after it has had no streams except
+// the default one, and no traffic for the timeout, the conn's delegate is
+// notified ConnOffline as usual.
+func OptionConnIdleTimeout(timeout time.Duration) EndOption {
+	return func(end *End) {
+		end.connIdleTimeout = timeout
+	}
+}
+
+// a stream seen or closed counts as the last activity, so the idle time of
+// the conn starts from it
+func (end *End) touchStreams() {
+	atomic.StoreInt64(&end.lastStreamed, time.Now().UnixNano())
+}
+
+func (end *End) startConnIdle() {
+	end.touchStreams()
+	end.ciTick = end.tmr.Add(end.connIdleTimeout/2,
+		timer.WithHandler(end.connIdle), timer.WithCyclically())
+}
+
+func (end *End) stopConnIdle() {
+	end.ciMtx.Lock()
+	defer end.ciMtx.Unlock()
+	if end.ciTick != nil {
+		end.ciTick.Cancel()
+		end.ciTick = nil
+	}
+}
+
+func (end *End) connIdle(_ *timer.Event) {
+	defaultID := end.stream.dg.DialogueID()
+	for _, dg := range end.multiplexer.ListDialogues() {
+		if dg.DialogueID() != defaultID {
+			// streams not accepted yet count too
+			end.touchStreams()
+			return
+		}
+	}
+	latest := time.Unix(0, atomic.LoadInt64(&end.lastStreamed))
+	stats := end.stream.dg.Stats()
+	for _, active := range []time.Time{
+		time.Unix(0, atomic.LoadInt64(&end.lastActive)), stats.LastReadAt, stats.LastWriteAt} {
+		if active.After(latest) {
+			latest = active
+		}
+	}
+	idle := time.Since(latest)
+	if idle < end.connIdleTimeout {
+		return
+	}
+	end.log.Infof("conn idle timeout, close the conn, clientID: %d, idle: %s",
+		end.cn.ClientID(), idle)
+	end.stopConnIdle()
+	// don't block the timer
+	go end.cn.Close()
+}
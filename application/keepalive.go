@@ -0,0 +1,85 @@
+package application
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/jumboframes/armorigo/synchub"
+	"github.com/singchia/geminio"
+	"github.com/singchia/geminio/options"
+	"github.com/singchia/go-timer/v2"
+)
+
+const (
+	// keepaliveMethod is served by every End, and echoes the payload back
+	keepaliveMethod = "__ping"
+)
+
+func keepaliveRPC(_ context.Context, _ string, req geminio.Request, rsp geminio.Response) {
+	rsp.SetData(req.Data())
+}
+
+// touch records the End is active, any incoming packet of any stream counts
+func (end *End) touch() {
+	atomic.StoreInt64(&end.lastActive, time.Now().UnixNano())
+}
+
+func (end *End) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&end.lastActive)))
+}
+
+func (end *End) startKeepalive() {
+	end.touch()
+	end.kaMtx.Lock()
+	defer end.kaMtx.Unlock()
+	end.kaTick = end.tmr.Add(end.keepaliveInterval,
+		timer.WithHandler(end.keepalive), timer.WithCyclically())
+}
+
+func (end *End) stopKeepalive() {
+	end.kaMtx.Lock()
+	defer end.kaMtx.Unlock()
+	if end.kaTick != nil {
+		end.kaTick.Cancel()
+		end.kaTick = nil
+	}
+}
+
+func (end *End) keepalive(_ *timer.Event) {
+	if end.idle() < end.keepaliveInterval {
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&end.pinging, 0, 1) {
+		// the last ping is still waiting for the reply
+		return
+	}
+	// don't block the timer
+	go func() {
+		defer atomic.StoreInt32(&end.pinging, 0)
+		end.ping()
+	}()
+}
+
+func (end *End) ping() {
+	ctx := context.Background()
+	opt := options.Call()
+	opt.SetTimeout(end.keepaliveTimeout)
+	req := end.stream.NewRequest(end.keepalivePayload)
+	_, err := end.stream.Call(ctx, keepaliveMethod, req, opt)
+	if err == nil {
+		end.log.Tracef("keepalive succeed, clientID: %d", end.cn.ClientID())
+		return
+	}
+	if !errors.Is(err, synchub.ErrSyncTimeout) {
+		// an error replied or the End is closed, the peer is still there
+		// or we don't care any more
+		end.log.Debugf("keepalive err: %s, clientID: %d", err, end.cn.ClientID())
+		return
+	}
+	end.log.Infof("keepalive timeout, abort the conn, clientID: %d, idle: %s",
+		end.cn.ClientID(), end.idle())
+	// the conn's offline leads to the reconnect of RetryEnd
+	end.cn.Abort()
+}
@@ -3,6 +3,7 @@ package application
 import (
 	"context"
 	"io"
+	"sync/atomic"
 	"time"
 
 	"github.com/jumboframes/armorigo/synchub"
@@ -35,6 +36,9 @@ func (sm *stream) NewMessage(data []byte, opts ...*options.NewMessageOptions) ge
 }
 
 func (sm *stream) ackMessage(pktID uint64, err error) error {
+	if err == nil && sm.ackAggregated() {
+		return sm.batchAck(pktID)
+	}
 	sm.mtx.RLock()
 	if !sm.streamOK {
 		sm.mtx.RUnlock()
@@ -72,6 +76,7 @@ func (sm *stream) Publish(ctx context.Context, msg geminio.Message, opts ...*opt
 	}
 	pkt.Data.Topic = msg.Topic()
 	pkt.Data.Custom = msg.Custom()
+	pkt.Data.IdempotencyKey = msg.IdempotencyKey()
 
 	deadline, ok := ctx.Deadline()
 	if ok {
@@ -84,6 +89,9 @@ func (sm *stream) Publish(ctx context.Context, msg geminio.Message, opts ...*opt
 		sm.mtx.RUnlock()
 		return nil
 	}
+	// in flight until acked, see Drain
+	atomic.AddInt64(&sm.end.calls, 1)
+	defer atomic.AddInt64(&sm.end.calls, -1)
 	var sync synchub.Sync
 	syncOpts := []synchub.SyncOption{synchub.WithContext(ctx)}
 	if msg.Timeout() != 0 {
@@ -91,10 +99,13 @@ func (sm *stream) Publish(ctx context.Context, msg geminio.Message, opts ...*opt
 		syncOpts = append(syncOpts, synchub.WithTimeout(msg.Timeout()))
 	}
 	sync = sm.shub.New(msg.ID(), syncOpts...)
+	sm.ackOrder.publish(msg.ID())
+	sm.watchRetransmit(pkt)
 	sm.writeInCh <- pkt
 	sm.mtx.RUnlock()
 
 	event := <-sync.C()
+	sm.stopRetransmit(msg.ID())
 	if event.Error != nil {
 		sm.log.Debugf("message return err: %s, clientID: %d, dialogueID: %d, packetID: %d, packetType: %s",
 			event.Error, sm.cn.ClientID(), sm.dg.DialogueID(), pkt.ID(), pkt.Type().String())
@@ -133,6 +144,7 @@ func (sm *stream) PublishAsync(ctx context.Context, msg geminio.Message, ch chan
 	}
 	pkt.Data.Topic = msg.Topic()
 	pkt.Data.Custom = msg.Custom()
+	pkt.Data.IdempotencyKey = msg.IdempotencyKey()
 
 	deadline, ok := ctx.Deadline()
 	if ok {
@@ -154,7 +166,11 @@ func (sm *stream) PublishAsync(ctx context.Context, msg geminio.Message, ch chan
 		Done:    ch,
 	}
 	// deadline and timeout for local
+	// in flight until acked, see Drain
+	atomic.AddInt64(&sm.end.calls, 1)
 	syncOpts := []synchub.SyncOption{synchub.WithContext(ctx), synchub.WithCallback(func(event *synchub.Event) {
+		defer atomic.AddInt64(&sm.end.calls, -1)
+		sm.stopRetransmit(pkt.ID())
 		if event.Error != nil {
 			sm.log.Debugf("message packet err: %s, clientID: %d, dialogueID: %d, packetID: %d, packetType: %s",
 				event.Error, sm.cn.ClientID(), sm.dg.DialogueID(), pkt.ID(), pkt.Type().String())
@@ -173,13 +189,16 @@ func (sm *stream) PublishAsync(ctx context.Context, msg geminio.Message, ch chan
 	}
 	// Add a new sync for the async publish
 	sm.shub.New(pkt.ID(), syncOpts...)
+	sm.ackOrder.publish(pkt.ID())
+	sm.watchRetransmit(pkt)
 	sm.writeInCh <- pkt
 	sm.mtx.RUnlock()
 	return publish, nil
 }
 
 // return EOF means the stream is closed
-func (sm *stream) Receive(ctx context.Context) (geminio.Message, error) {
+func (sm *stream) Receive(ctx context.Context, opts ...*options.ReceiveOptions) (geminio.Message, error) {
+	opt := options.MergeReceiveOptions(opts...)
 	select {
 	case pkt, ok := <-sm.messageCh:
 		if !ok {
@@ -188,15 +207,19 @@ func (sm *stream) Receive(ctx context.Context) (geminio.Message, error) {
 			return nil, io.EOF
 		}
 		msg := &message{
-			timeout:  pkt.Data.Timeout,
-			cnss:     options.Cnss(pkt.Cnss),
-			data:     pkt.Data.Value,
-			topic:    pkt.Data.Topic,
-			custom:   pkt.Data.Custom,
-			id:       pkt.PacketID,
-			clientID: sm.cn.ClientID(),
-			streamID: sm.dg.DialogueID(),
-			sm:       sm,
+			timeout:        pkt.Data.Timeout,
+			cnss:           options.Cnss(pkt.Cnss),
+			data:           pkt.Data.Value,
+			topic:          pkt.Data.Topic,
+			custom:         pkt.Data.Custom,
+			idempotencyKey: pkt.Data.IdempotencyKey,
+			id:             pkt.PacketID,
+			clientID:       sm.cn.ClientID(),
+			streamID:       sm.dg.DialogueID(),
+			sm:             sm,
+		}
+		if opt.Visibility != nil && msg.cnss != options.CnssAtMostOnce {
+			msg.peek = sm.peekMessage(pkt, *opt.Visibility)
 		}
 		return msg, nil
 	case <-ctx.Done():
@@ -7,3 +7,11 @@ func strings2interfaces(strs ...string) []interface{} {
 	}
 	return ifs
 }
+
+// emptyIfNil makes sure nil body decoded from the wire is seen as empty
+func emptyIfNil(data []byte) []byte {
+	if data == nil {
+		return []byte{}
+	}
+	return data
+}
@@ -5,7 +5,9 @@
 package mock
 
 import (
+	context "context"
 	reflect "reflect"
+	time "time"
 
 	gomock "github.com/golang/mock/gomock"
 	geminio "github.com/singchia/geminio"
@@ -63,6 +65,20 @@ func (mr *MockMultiplexerMockRecorder) Close() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Close", reflect.TypeOf((*MockMultiplexer)(nil).Close))
 }
 
+// CloseDialoguesWhere mocks base method.
+func (m *MockMultiplexer) CloseDialoguesWhere(match func(multiplexer.DialogueDescriber) bool) int {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CloseDialoguesWhere", match)
+	ret0, _ := ret[0].(int)
+	return ret0
+}
+
+// CloseDialoguesWhere indicates an expected call of CloseDialoguesWhere.
+func (mr *MockMultiplexerMockRecorder) CloseDialoguesWhere(match interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CloseDialoguesWhere", reflect.TypeOf((*MockMultiplexer)(nil).CloseDialoguesWhere), match)
+}
+
 // ClosedDialogue mocks base method.
 func (m *MockMultiplexer) ClosedDialogue() (multiplexer.Dialogue, error) {
 	m.ctrl.T.Helper()
@@ -108,18 +124,81 @@ func (mr *MockMultiplexerMockRecorder) ListDialogues() *gomock.Call {
 }
 
 // OpenDialogue mocks base method.
-func (m *MockMultiplexer) OpenDialogue(meta []byte, peer string) (multiplexer.Dialogue, error) {
+func (m *MockMultiplexer) OpenDialogue(meta []byte, peer string, opts ...multiplexer.DialogueOption) (multiplexer.Dialogue, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "OpenDialogue", meta, peer)
+	varargs := []interface{}{meta, peer}
+	for _, a := range opts {
+		varargs = append(varargs, a)
+	}
+	ret := m.ctrl.Call(m, "OpenDialogue", varargs...)
 	ret0, _ := ret[0].(multiplexer.Dialogue)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // OpenDialogue indicates an expected call of OpenDialogue.
-func (mr *MockMultiplexerMockRecorder) OpenDialogue(meta, peer interface{}) *gomock.Call {
+func (mr *MockMultiplexerMockRecorder) OpenDialogue(meta, peer interface{}, opts ...interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	varargs := append([]interface{}{meta, peer}, opts...)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "OpenDialogue", reflect.TypeOf((*MockMultiplexer)(nil).OpenDialogue), varargs...)
+}
+
+// OpenDialogues mocks base method.
+func (m *MockMultiplexer) OpenDialogues(n int, meta []byte, peer string, opts ...multiplexer.DialogueOption) ([]multiplexer.Dialogue, error) {
+	m.ctrl.T.Helper()
+	varargs := []interface{}{n, meta, peer}
+	for _, a := range opts {
+		varargs = append(varargs, a)
+	}
+	ret := m.ctrl.Call(m, "OpenDialogues", varargs...)
+	ret0, _ := ret[0].([]multiplexer.Dialogue)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// OpenDialogues indicates an expected call of OpenDialogues.
+func (mr *MockMultiplexerMockRecorder) OpenDialogues(n, meta, peer interface{}, opts ...interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	varargs := append([]interface{}{n, meta, peer}, opts...)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "OpenDialogues", reflect.TypeOf((*MockMultiplexer)(nil).OpenDialogues), varargs...)
+}
+
+// Quiesce mocks base method.
+func (m *MockMultiplexer) Quiesce() {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "Quiesce")
+}
+
+// Quiesce indicates an expected call of Quiesce.
+func (mr *MockMultiplexerMockRecorder) Quiesce() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Quiesce", reflect.TypeOf((*MockMultiplexer)(nil).Quiesce))
+}
+
+// TimerFallbacks mocks base method.
+func (m *MockMultiplexer) TimerFallbacks() uint64 {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "TimerFallbacks")
+	ret0, _ := ret[0].(uint64)
+	return ret0
+}
+
+// TimerFallbacks indicates an expected call of TimerFallbacks.
+func (mr *MockMultiplexerMockRecorder) TimerFallbacks() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "TimerFallbacks", reflect.TypeOf((*MockMultiplexer)(nil).TimerFallbacks))
+}
+
+// Unquiesce mocks base method.
+func (m *MockMultiplexer) Unquiesce() {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "Unquiesce")
+}
+
+// Unquiesce indicates an expected call of Unquiesce.
+func (mr *MockMultiplexerMockRecorder) Unquiesce() *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "OpenDialogue", reflect.TypeOf((*MockMultiplexer)(nil).OpenDialogue), meta, peer)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Unquiesce", reflect.TypeOf((*MockMultiplexer)(nil).Unquiesce))
 }
 
 // MockReader is a mock of Reader interface.
@@ -160,6 +239,21 @@ func (mr *MockReaderMockRecorder) Read() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Read", reflect.TypeOf((*MockReader)(nil).Read))
 }
 
+// ReadBatch mocks base method.
+func (m *MockReader) ReadBatch(max int) ([]packet.Packet, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ReadBatch", max)
+	ret0, _ := ret[0].([]packet.Packet)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ReadBatch indicates an expected call of ReadBatch.
+func (mr *MockReaderMockRecorder) ReadBatch(max interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ReadBatch", reflect.TypeOf((*MockReader)(nil).ReadBatch), max)
+}
+
 // ReadC mocks base method.
 func (m *MockReader) ReadC() <-chan packet.Packet {
 	m.ctrl.T.Helper()
@@ -174,6 +268,51 @@ func (mr *MockReaderMockRecorder) ReadC() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ReadC", reflect.TypeOf((*MockReader)(nil).ReadC))
 }
 
+// ReadContext mocks base method.
+func (m *MockReader) ReadContext(ctx context.Context) (packet.Packet, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ReadContext", ctx)
+	ret0, _ := ret[0].(packet.Packet)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ReadContext indicates an expected call of ReadContext.
+func (mr *MockReaderMockRecorder) ReadContext(ctx interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ReadContext", reflect.TypeOf((*MockReader)(nil).ReadContext), ctx)
+}
+
+// ReadWithContext mocks base method.
+func (m *MockReader) ReadWithContext(ctx context.Context) (packet.Packet, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ReadWithContext", ctx)
+	ret0, _ := ret[0].(packet.Packet)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ReadWithContext indicates an expected call of ReadWithContext.
+func (mr *MockReaderMockRecorder) ReadWithContext(ctx interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ReadWithContext", reflect.TypeOf((*MockReader)(nil).ReadWithContext), ctx)
+}
+
+// TryRead mocks base method.
+func (m *MockReader) TryRead() (packet.Packet, bool) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "TryRead")
+	ret0, _ := ret[0].(packet.Packet)
+	ret1, _ := ret[1].(bool)
+	return ret0, ret1
+}
+
+// TryRead indicates an expected call of TryRead.
+func (mr *MockReaderMockRecorder) TryRead() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "TryRead", reflect.TypeOf((*MockReader)(nil).TryRead))
+}
+
 // MockWriter is a mock of Writer interface.
 type MockWriter struct {
 	ctrl     *gomock.Controller
@@ -211,6 +350,20 @@ func (mr *MockWriterMockRecorder) Write(pkt interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Write", reflect.TypeOf((*MockWriter)(nil).Write), pkt)
 }
 
+// WritePriority mocks base method.
+func (m *MockWriter) WritePriority(pkt packet.Packet, priority uint8) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "WritePriority", pkt, priority)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// WritePriority indicates an expected call of WritePriority.
+func (mr *MockWriterMockRecorder) WritePriority(pkt, priority interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "WritePriority", reflect.TypeOf((*MockWriter)(nil).WritePriority), pkt, priority)
+}
+
 // MockCloser is a mock of Closer interface.
 type MockCloser struct {
 	ctrl     *gomock.Controller
@@ -325,6 +478,20 @@ func (mr *MockDialogueDescriberMockRecorder) NegotiatingID() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "NegotiatingID", reflect.TypeOf((*MockDialogueDescriber)(nil).NegotiatingID))
 }
 
+// PeerInitiated mocks base method.
+func (m *MockDialogueDescriber) PeerInitiated() bool {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "PeerInitiated")
+	ret0, _ := ret[0].(bool)
+	return ret0
+}
+
+// PeerInitiated indicates an expected call of PeerInitiated.
+func (mr *MockDialogueDescriberMockRecorder) PeerInitiated() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PeerInitiated", reflect.TypeOf((*MockDialogueDescriber)(nil).PeerInitiated))
+}
+
 // Side mocks base method.
 func (m *MockDialogueDescriber) Side() geminio.Side {
 	m.ctrl.T.Helper()
@@ -362,6 +529,23 @@ func (m *MockDialogue) EXPECT() *MockDialogueMockRecorder {
 	return m.recorder
 }
 
+// BufferCaps mocks base method.
+func (m *MockDialogue) BufferCaps() (int, int, int, int) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "BufferCaps")
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(int)
+	ret2, _ := ret[2].(int)
+	ret3, _ := ret[3].(int)
+	return ret0, ret1, ret2, ret3
+}
+
+// BufferCaps indicates an expected call of BufferCaps.
+func (mr *MockDialogueMockRecorder) BufferCaps() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "BufferCaps", reflect.TypeOf((*MockDialogue)(nil).BufferCaps))
+}
+
 // ClientID mocks base method.
 func (m *MockDialogue) ClientID() uint64 {
 	m.ctrl.T.Helper()
@@ -388,6 +572,74 @@ func (mr *MockDialogueMockRecorder) Close() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Close", reflect.TypeOf((*MockDialogue)(nil).Close))
 }
 
+// CloseAfterDrain mocks base method.
+func (m *MockDialogue) CloseAfterDrain(ctx context.Context) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CloseAfterDrain", ctx)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// CloseAfterDrain indicates an expected call of CloseAfterDrain.
+func (mr *MockDialogueMockRecorder) CloseAfterDrain(ctx interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CloseAfterDrain", reflect.TypeOf((*MockDialogue)(nil).CloseAfterDrain), ctx)
+}
+
+// CloseReason mocks base method.
+func (m *MockDialogue) CloseReason() multiplexer.CloseReason {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CloseReason")
+	ret0, _ := ret[0].(multiplexer.CloseReason)
+	return ret0
+}
+
+// CloseReason indicates an expected call of CloseReason.
+func (mr *MockDialogueMockRecorder) CloseReason() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CloseReason", reflect.TypeOf((*MockDialogue)(nil).CloseReason))
+}
+
+// CloseWaitContext mocks base method.
+func (m *MockDialogue) CloseWaitContext(ctx context.Context) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CloseWaitContext", ctx)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// CloseWaitContext indicates an expected call of CloseWaitContext.
+func (mr *MockDialogueMockRecorder) CloseWaitContext(ctx interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CloseWaitContext", reflect.TypeOf((*MockDialogue)(nil).CloseWaitContext), ctx)
+}
+
+// CloseWithReason mocks base method.
+func (m *MockDialogue) CloseWithReason(reason string) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "CloseWithReason", reason)
+}
+
+// CloseWithReason indicates an expected call of CloseWithReason.
+func (mr *MockDialogueMockRecorder) CloseWithReason(reason interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CloseWithReason", reflect.TypeOf((*MockDialogue)(nil).CloseWithReason), reason)
+}
+
+// Congested mocks base method.
+func (m *MockDialogue) Congested() bool {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Congested")
+	ret0, _ := ret[0].(bool)
+	return ret0
+}
+
+// Congested indicates an expected call of Congested.
+func (mr *MockDialogueMockRecorder) Congested() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Congested", reflect.TypeOf((*MockDialogue)(nil).Congested))
+}
+
 // DialogueID mocks base method.
 func (m *MockDialogue) DialogueID() uint64 {
 	m.ctrl.T.Helper()
@@ -402,6 +654,48 @@ func (mr *MockDialogueMockRecorder) DialogueID() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DialogueID", reflect.TypeOf((*MockDialogue)(nil).DialogueID))
 }
 
+// DismissReason mocks base method.
+func (m *MockDialogue) DismissReason() string {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DismissReason")
+	ret0, _ := ret[0].(string)
+	return ret0
+}
+
+// DismissReason indicates an expected call of DismissReason.
+func (mr *MockDialogueMockRecorder) DismissReason() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DismissReason", reflect.TypeOf((*MockDialogue)(nil).DismissReason))
+}
+
+// HandshakeRTT mocks base method.
+func (m *MockDialogue) HandshakeRTT() time.Duration {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "HandshakeRTT")
+	ret0, _ := ret[0].(time.Duration)
+	return ret0
+}
+
+// HandshakeRTT indicates an expected call of HandshakeRTT.
+func (mr *MockDialogueMockRecorder) HandshakeRTT() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "HandshakeRTT", reflect.TypeOf((*MockDialogue)(nil).HandshakeRTT))
+}
+
+// MaxPacketSize mocks base method.
+func (m *MockDialogue) MaxPacketSize() int {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "MaxPacketSize")
+	ret0, _ := ret[0].(int)
+	return ret0
+}
+
+// MaxPacketSize indicates an expected call of MaxPacketSize.
+func (mr *MockDialogueMockRecorder) MaxPacketSize() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "MaxPacketSize", reflect.TypeOf((*MockDialogue)(nil).MaxPacketSize))
+}
+
 // Meta mocks base method.
 func (m *MockDialogue) Meta() []byte {
 	m.ctrl.T.Helper()
@@ -444,6 +738,48 @@ func (mr *MockDialogueMockRecorder) Peer() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Peer", reflect.TypeOf((*MockDialogue)(nil).Peer))
 }
 
+// PeerInitiated mocks base method.
+func (m *MockDialogue) PeerInitiated() bool {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "PeerInitiated")
+	ret0, _ := ret[0].(bool)
+	return ret0
+}
+
+// PeerInitiated indicates an expected call of PeerInitiated.
+func (mr *MockDialogueMockRecorder) PeerInitiated() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PeerInitiated", reflect.TypeOf((*MockDialogue)(nil).PeerInitiated))
+}
+
+// QoS mocks base method.
+func (m *MockDialogue) QoS() int8 {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "QoS")
+	ret0, _ := ret[0].(int8)
+	return ret0
+}
+
+// QoS indicates an expected call of QoS.
+func (mr *MockDialogueMockRecorder) QoS() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "QoS", reflect.TypeOf((*MockDialogue)(nil).QoS))
+}
+
+// RTT mocks base method.
+func (m *MockDialogue) RTT() time.Duration {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RTT")
+	ret0, _ := ret[0].(time.Duration)
+	return ret0
+}
+
+// RTT indicates an expected call of RTT.
+func (mr *MockDialogueMockRecorder) RTT() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RTT", reflect.TypeOf((*MockDialogue)(nil).RTT))
+}
+
 // Read mocks base method.
 func (m *MockDialogue) Read() (packet.Packet, error) {
 	m.ctrl.T.Helper()
@@ -459,6 +795,35 @@ func (mr *MockDialogueMockRecorder) Read() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Read", reflect.TypeOf((*MockDialogue)(nil).Read))
 }
 
+// ReadBatch mocks base method.
+func (m *MockDialogue) ReadBatch(max int) ([]packet.Packet, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ReadBatch", max)
+	ret0, _ := ret[0].([]packet.Packet)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ReadBatch indicates an expected call of ReadBatch.
+func (mr *MockDialogueMockRecorder) ReadBatch(max interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ReadBatch", reflect.TypeOf((*MockDialogue)(nil).ReadBatch), max)
+}
+
+// ReadBytes mocks base method.
+func (m *MockDialogue) ReadBytes() uint64 {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ReadBytes")
+	ret0, _ := ret[0].(uint64)
+	return ret0
+}
+
+// ReadBytes indicates an expected call of ReadBytes.
+func (mr *MockDialogueMockRecorder) ReadBytes() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ReadBytes", reflect.TypeOf((*MockDialogue)(nil).ReadBytes))
+}
+
 // ReadC mocks base method.
 func (m *MockDialogue) ReadC() <-chan packet.Packet {
 	m.ctrl.T.Helper()
@@ -473,6 +838,62 @@ func (mr *MockDialogueMockRecorder) ReadC() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ReadC", reflect.TypeOf((*MockDialogue)(nil).ReadC))
 }
 
+// ReadContext mocks base method.
+func (m *MockDialogue) ReadContext(ctx context.Context) (packet.Packet, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ReadContext", ctx)
+	ret0, _ := ret[0].(packet.Packet)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ReadContext indicates an expected call of ReadContext.
+func (mr *MockDialogueMockRecorder) ReadContext(ctx interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ReadContext", reflect.TypeOf((*MockDialogue)(nil).ReadContext), ctx)
+}
+
+// ReadWithContext mocks base method.
+func (m *MockDialogue) ReadWithContext(ctx context.Context) (packet.Packet, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ReadWithContext", ctx)
+	ret0, _ := ret[0].(packet.Packet)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ReadWithContext indicates an expected call of ReadWithContext.
+func (mr *MockDialogueMockRecorder) ReadWithContext(ctx interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ReadWithContext", reflect.TypeOf((*MockDialogue)(nil).ReadWithContext), ctx)
+}
+
+// RecentPackets mocks base method.
+func (m *MockDialogue) RecentPackets() []multiplexer.RecordedPacket {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RecentPackets")
+	ret0, _ := ret[0].([]multiplexer.RecordedPacket)
+	return ret0
+}
+
+// RecentPackets indicates an expected call of RecentPackets.
+func (mr *MockDialogueMockRecorder) RecentPackets() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RecentPackets", reflect.TypeOf((*MockDialogue)(nil).RecentPackets))
+}
+
+// Reset mocks base method.
+func (m *MockDialogue) Reset() {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "Reset")
+}
+
+// Reset indicates an expected call of Reset.
+func (mr *MockDialogueMockRecorder) Reset() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Reset", reflect.TypeOf((*MockDialogue)(nil).Reset))
+}
+
 // Side mocks base method.
 func (m *MockDialogue) Side() geminio.Side {
 	m.ctrl.T.Helper()
@@ -487,6 +908,77 @@ func (mr *MockDialogueMockRecorder) Side() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Side", reflect.TypeOf((*MockDialogue)(nil).Side))
 }
 
+// State mocks base method.
+func (m *MockDialogue) State() string {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "State")
+	ret0, _ := ret[0].(string)
+	return ret0
+}
+
+// State indicates an expected call of State.
+func (mr *MockDialogueMockRecorder) State() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "State", reflect.TypeOf((*MockDialogue)(nil).State))
+}
+
+// Stats mocks base method.
+func (m *MockDialogue) Stats() multiplexer.DialogueStats {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Stats")
+	ret0, _ := ret[0].(multiplexer.DialogueStats)
+	return ret0
+}
+
+// Stats indicates an expected call of Stats.
+func (mr *MockDialogueMockRecorder) Stats() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Stats", reflect.TypeOf((*MockDialogue)(nil).Stats))
+}
+
+// Synced mocks base method.
+func (m *MockDialogue) Synced() error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Synced")
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Synced indicates an expected call of Synced.
+func (mr *MockDialogueMockRecorder) Synced() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Synced", reflect.TypeOf((*MockDialogue)(nil).Synced))
+}
+
+// TryRead mocks base method.
+func (m *MockDialogue) TryRead() (packet.Packet, bool) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "TryRead")
+	ret0, _ := ret[0].(packet.Packet)
+	ret1, _ := ret[1].(bool)
+	return ret0, ret1
+}
+
+// TryRead indicates an expected call of TryRead.
+func (mr *MockDialogueMockRecorder) TryRead() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "TryRead", reflect.TypeOf((*MockDialogue)(nil).TryRead))
+}
+
+// WritableSignal mocks base method.
+func (m *MockDialogue) WritableSignal() <-chan struct{} {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "WritableSignal")
+	ret0, _ := ret[0].(<-chan struct{})
+	return ret0
+}
+
+// WritableSignal indicates an expected call of WritableSignal.
+func (mr *MockDialogueMockRecorder) WritableSignal() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "WritableSignal", reflect.TypeOf((*MockDialogue)(nil).WritableSignal))
+}
+
 // Write mocks base method.
 func (m *MockDialogue) Write(pkt packet.Packet) error {
 	m.ctrl.T.Helper()
@@ -500,3 +992,31 @@ func (mr *MockDialogueMockRecorder) Write(pkt interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Write", reflect.TypeOf((*MockDialogue)(nil).Write), pkt)
 }
+
+// WriteBytes mocks base method.
+func (m *MockDialogue) WriteBytes() uint64 {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "WriteBytes")
+	ret0, _ := ret[0].(uint64)
+	return ret0
+}
+
+// WriteBytes indicates an expected call of WriteBytes.
+func (mr *MockDialogueMockRecorder) WriteBytes() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "WriteBytes", reflect.TypeOf((*MockDialogue)(nil).WriteBytes))
+}
+
+// WritePriority mocks base method.
+func (m *MockDialogue) WritePriority(pkt packet.Packet, priority uint8) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "WritePriority", pkt, priority)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// WritePriority indicates an expected call of WritePriority.
+func (mr *MockDialogueMockRecorder) WritePriority(pkt, priority interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "WritePriority", reflect.TypeOf((*MockDialogue)(nil).WritePriority), pkt, priority)
+}
@@ -0,0 +1,70 @@
+package application
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/singchia/geminio/packet"
+	"github.com/singchia/go-timer/v2"
+)
+
+var ErrVisibilityExpired = errors.New("visibility expired")
+
+// peek is the deferred ack of a received message, either settled by Done or
+// Error or expired by the visibility timeout
+type peek struct {
+	mtx     sync.Mutex
+	settled bool
+	tick    timer.Tick
+}
+
+// settle returns false if the visibility already expired
+func (pk *peek) settle() bool {
+	pk.mtx.Lock()
+	defer pk.mtx.Unlock()
+	if pk.settled {
+		return false
+	}
+	pk.settled = true
+	if pk.tick != nil {
+		pk.tick.Cancel()
+	}
+	return true
+}
+
+// peekMessage redelivers the message packet if it's not settled in the
+// visibility, nil is returned if the stream is closing
+func (sm *stream) peekMessage(pkt *packet.MessagePacket, visibility time.Duration) *peek {
+	sm.mtx.RLock()
+	defer sm.mtx.RUnlock()
+	if !sm.streamOK {
+		return nil
+	}
+	pk := &peek{}
+	pk.mtx.Lock()
+	defer pk.mtx.Unlock()
+	pk.tick = sm.tmr.Add(visibility, timer.WithHandler(func(_ *timer.Event) {
+		if !pk.settle() {
+			return
+		}
+		sm.redeliverMessage(pkt)
+	}))
+	return pk
+}
+
+func (sm *stream) redeliverMessage(pkt *packet.MessagePacket) {
+	sm.mtx.RLock()
+	defer sm.mtx.RUnlock()
+	if !sm.streamOK {
+		// the messageCh is closed after
+		return
+	}
+	sm.log.Debugf("redeliver message packet, clientID: %d, dialogueID: %d, packetID: %d, packetType: %s",
+		sm.cn.ClientID(), sm.dg.DialogueID(), pkt.ID(), pkt.Type().String())
+	select {
+	case sm.messageCh <- pkt:
+	default:
+		packet.NotifyDrop(sm.opts.dropObserver, pkt, packet.DropReasonBufferFull, packet.DirectionIn)
+	}
+}
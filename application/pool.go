@@ -0,0 +1,91 @@
+package application
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+var (
+	ErrServerBusy = errors.New("server busy")
+)
+
+// WorkerPoolPolicy decides what to do with a request when all workers are
+// busy and the queue is full.
+type WorkerPoolPolicy int
+
+const (
+	// wait for a free worker, which also stops the stream from reading
+	WorkerPoolBlock WorkerPoolPolicy = iota
+	// reply the request with ErrServerBusy
+	WorkerPoolReject
+)
+
+func (policy WorkerPoolPolicy) String() string {
+	switch policy {
+	case WorkerPoolBlock:
+		return "block"
+	case WorkerPoolReject:
+		return "reject"
+	}
+	return "unknown"
+}
+
+// workerPool runs local RPCs of an End and all streams from the End with
+// bounded goroutines
+type workerPool struct {
+	policy    WorkerPoolPolicy
+	taskCh    chan func()
+	closeCh   chan struct{}
+	closeOnce *sync.Once
+}
+
+func newWorkerPool(size, queue int, policy WorkerPoolPolicy) *workerPool {
+	pool := &workerPool{
+		policy:    policy,
+		taskCh:    make(chan func(), queue),
+		closeCh:   make(chan struct{}),
+		closeOnce: new(sync.Once),
+	}
+	for i := 0; i < size; i++ {
+		go pool.work()
+	}
+	return pool
+}
+
+func (pool *workerPool) work() {
+	for {
+		select {
+		case task := <-pool.taskCh:
+			task()
+		case <-pool.closeCh:
+			return
+		}
+	}
+}
+
+func (pool *workerPool) submit(task func()) error {
+	if pool.policy == WorkerPoolReject {
+		select {
+		case pool.taskCh <- task:
+			return nil
+		case <-pool.closeCh:
+			return io.EOF
+		default:
+			return ErrServerBusy
+		}
+	}
+	select {
+	case pool.taskCh <- task:
+		return nil
+	case <-pool.closeCh:
+		return io.EOF
+	}
+}
+
+// close stops all workers, tasks still in queue are abandoned.
+func (pool *workerPool) close() {
+	pool.closeOnce.Do(func() {
+		close(pool.closeCh)
+	})
+}
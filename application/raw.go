@@ -15,9 +15,11 @@ const (
 )
 
 // geminio.Raw
+// An empty data packet from peer is read as 0 with nil error, which is
+// distinct from io.EOF returned after the stream closed.
 func (sm *stream) Read(b []byte) (int, error) {
 	sm.mtx.RLock()
-	if !sm.streamOK {
+	if !sm.streamOK && !sm.draining {
 		sm.mtx.RUnlock()
 		return 0, io.EOF
 	}
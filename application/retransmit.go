@@ -0,0 +1,113 @@
+package application
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/singchia/geminio/packet"
+	"github.com/singchia/go-timer/v2"
+)
+
+var ErrRetransmitExhausted = errors.New("retransmit exhausted")
+
+// OptionMessageRetransmit resends the at-least-once messages not acked in
+// interval, until acked or sent attempts times in total, then the publish
+// fails with ErrRetransmitExhausted. A non-positive attempts means no limit
+// but the publish's timeout. The consumer may see a message more than once,
+// set the idempotency key to have the duplicates dropped.
+func OptionMessageRetransmit(interval time.Duration, attempts int) EndOption {
+	return func(end *End) {
+		end.retransmitInterval = interval
+		end.retransmitAttempts = attempts
+	}
+}
+
+// unacked messages of a stream, key: packetID
+type retransmitSet struct {
+	mtx     sync.Mutex
+	pending map[uint64]*retransmit
+}
+
+type retransmit struct {
+	pkt  *packet.MessagePacket
+	sent int
+	tick timer.Tick
+}
+
+// watchRetransmit must be called with the stream's mtx held
+func (sm *stream) watchRetransmit(pkt *packet.MessagePacket) {
+	if sm.retransmitInterval <= 0 {
+		return
+	}
+	sm.retransmits.mtx.Lock()
+	defer sm.retransmits.mtx.Unlock()
+	if sm.retransmits.pending == nil {
+		sm.retransmits.pending = make(map[uint64]*retransmit)
+	}
+	sm.retransmits.pending[pkt.ID()] = &retransmit{
+		pkt:  pkt,
+		sent: 1,
+		tick: sm.retransmitAfter(pkt.ID()),
+	}
+}
+
+// must be called with the retransmits' mtx held
+func (sm *stream) retransmitAfter(pktID uint64) timer.Tick {
+	return sm.tmr.Add(sm.retransmitInterval, timer.WithHandler(func(_ *timer.Event) {
+		sm.retransmitMessage(pktID)
+	}))
+}
+
+// stopRetransmit is called once the publish completed, acked or not
+func (sm *stream) stopRetransmit(pktID uint64) {
+	if sm.retransmitInterval <= 0 {
+		return
+	}
+	sm.retransmits.mtx.Lock()
+	defer sm.retransmits.mtx.Unlock()
+	if rt, ok := sm.retransmits.pending[pktID]; ok {
+		rt.tick.Cancel()
+		delete(sm.retransmits.pending, pktID)
+	}
+}
+
+func (sm *stream) retransmitMessage(pktID uint64) {
+	sm.mtx.RLock()
+	defer sm.mtx.RUnlock()
+	if !sm.streamOK {
+		return
+	}
+	sm.retransmits.mtx.Lock()
+	rt, ok := sm.retransmits.pending[pktID]
+	if !ok {
+		sm.retransmits.mtx.Unlock()
+		return
+	}
+	if sm.retransmitAttempts > 0 && rt.sent >= sm.retransmitAttempts {
+		delete(sm.retransmits.pending, pktID)
+		sm.retransmits.mtx.Unlock()
+		sm.log.Debugf("message packet unacked after retransmits, clientID: %d, dialogueID: %d, packetID: %d, sent: %d",
+			sm.cn.ClientID(), sm.dg.DialogueID(), pktID, rt.sent)
+		sm.shub.Error(pktID, ErrRetransmitExhausted)
+		return
+	}
+	rt.sent++
+	sent := rt.sent
+	rt.tick = sm.retransmitAfter(pktID)
+	sm.retransmits.mtx.Unlock()
+
+	sm.log.Debugf("retransmit message packet, clientID: %d, dialogueID: %d, packetID: %d, sent: %d",
+		sm.cn.ClientID(), sm.dg.DialogueID(), pktID, sent)
+	sm.writeInCh <- rt.pkt
+}
+
+// the publishes are failed by the closing shub, only the ticks left
+func (set *retransmitSet) stop() {
+	set.mtx.Lock()
+	defer set.mtx.Unlock()
+	for pktID, rt := range set.pending {
+		rt.tick.Cancel()
+		delete(set.pending, pktID)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"io"
 	"regexp"
+	"sync/atomic"
 	"time"
 
 	"github.com/jumboframes/armorigo/synchub"
@@ -27,6 +28,16 @@ func (sm *stream) NewRequest(data []byte, opts ...*options.NewRequestOptions) ge
 	return req
 }
 
+// the End's default timeout is for requests without their own
+func (sm *stream) setDefaultTimeout(req geminio.Request) {
+	if req.Timeout() != 0 {
+		return
+	}
+	if timeout := sm.end.requestTimeout(); timeout > 0 {
+		req.SetTimeout(timeout)
+	}
+}
+
 func (sm *stream) addLocalRPC(method string, rpc geminio.RPC) {
 	sm.rpcMtx.Lock()
 	defer sm.rpcMtx.Unlock()
@@ -41,12 +52,20 @@ func (sm *stream) delLocalRPC(method string) {
 
 // Register will overwrite the old method if exists.
 func (sm *stream) Register(ctx context.Context, method string, rpc geminio.RPC) error {
+	return sm.register(ctx, method,
+		func() { sm.addLocalRPC(method, rpc) },
+		func() { sm.delLocalRPC(method) })
+}
+
+// register adds the local rpc by add, and removes it by del if the peer
+// didn't ack
+func (sm *stream) register(ctx context.Context, method string, add, del func()) error {
 	sm.mtx.RLock()
 	if !sm.streamOK {
 		sm.mtx.RUnlock()
 		return io.EOF
 	}
-	sm.addLocalRPC(method, rpc)
+	add()
 	pkt := sm.pf.NewRegisterPacketWithSessionID(sm.dg.DialogueID(), []byte(method))
 	sync := sm.shub.New(pkt.ID())
 	sm.writeInCh <- pkt
@@ -56,17 +75,26 @@ func (sm *stream) Register(ctx context.Context, method string, rpc geminio.RPC)
 		if event.Error != nil {
 			sm.log.Debugf("register err: %s, clientID: %d, dialogueID: %d, packetID: %d",
 				event.Error, sm.cn.ClientID(), sm.dg.DialogueID(), pkt.ID())
-			sm.delLocalRPC(method)
+			del()
 			return event.Error
 		}
 	case <-ctx.Done():
-		sm.delLocalRPC(method)
+		del()
 		return ctx.Err()
 	}
 	return nil
 }
 
+// Call returns a CallError if failed, except the misuse of the request
 func (sm *stream) Call(ctx context.Context, method string, req geminio.Request, opts ...*options.CallOptions) (geminio.Response, error) {
+	rsp, err := sm.call(ctx, method, req, opts...)
+	if err != nil {
+		return nil, newCallError(err)
+	}
+	return rsp, nil
+}
+
+func (sm *stream) call(ctx context.Context, method string, req geminio.Request, opts ...*options.CallOptions) (geminio.Response, error) {
 	if req.ClientID() != sm.cn.ClientID() {
 		return nil, ErrMismatchClientID
 	}
@@ -77,6 +105,7 @@ func (sm *stream) Call(ctx context.Context, method string, req geminio.Request,
 	if opt.Timeout != nil {
 		req.SetTimeout(*opt.Timeout)
 	}
+	sm.setDefaultTimeout(req)
 
 	sm.mtx.RLock()
 	if !sm.streamOK {
@@ -84,7 +113,7 @@ func (sm *stream) Call(ctx context.Context, method string, req geminio.Request,
 		return nil, io.EOF
 	}
 
-	if sm.opts.remoteMethodCheck {
+	if sm.opts.remoteMethodCheck && method != keepaliveMethod {
 		// check remote RPC exists
 		sm.rpcMtx.RLock()
 		_, ok := sm.remoteRPCs[method]
@@ -99,6 +128,7 @@ func (sm *stream) Call(ctx context.Context, method string, req geminio.Request,
 	if req.Timeout() != 0 {
 		// if timeout exists, we should deliver it
 		pkt.Data.Deadline = time.Now().Add(req.Timeout())
+		pkt.Data.Timeout = req.Timeout()
 	}
 	pkt.Data.Custom = req.Custom()
 
@@ -114,6 +144,8 @@ func (sm *stream) Call(ctx context.Context, method string, req geminio.Request,
 		syncOpts = append(syncOpts, synchub.WithTimeout(req.Timeout()))
 	}
 	sync = sm.shub.New(req.ID(), syncOpts...)
+	atomic.AddInt64(&sm.end.calls, 1)
+	defer atomic.AddInt64(&sm.end.calls, -1)
 	sm.writeInCh <- pkt
 	sm.mtx.RUnlock()
 
@@ -126,16 +158,10 @@ func (sm *stream) Call(ctx context.Context, method string, req geminio.Request,
 			// we don't deliver deadline exceeded since the pkt already has it
 			return nil, ctx.Err()
 		}
-		sm.mtx.RLock()
-		if !sm.streamOK {
-			sm.mtx.RUnlock()
-			return nil, io.EOF
-		}
 		// notify peer if context Canceled
-		cancelType := packet.RequestCancelTypeCanceled
-		cancelPkt := sm.pf.NewRequestCancelPacketWithIDAndSessionID(pkt.ID(), sm.dg.DialogueID(), cancelType)
-		sm.writeInCh <- cancelPkt
-		sm.mtx.RUnlock()
+		if err := sm.cancelRequest(pkt.ID()); err != nil {
+			return nil, err
+		}
 		return nil, ctx.Err()
 
 	case event := <-sync.C():
@@ -149,6 +175,126 @@ func (sm *stream) Call(ctx context.Context, method string, req geminio.Request,
 	}
 }
 
+// CallTo streams the response body into w as chunks arrive, the full body is
+// never held in memory at the caller side, nor at the callee side if the rpc
+// writes the body by the Response's Write rather than SetData.
+func (sm *stream) CallTo(ctx context.Context, method string, req geminio.Request, w io.Writer, opts ...*options.CallOptions) error {
+	if req.ClientID() != sm.cn.ClientID() {
+		return ErrMismatchClientID
+	}
+	if req.StreamID() != sm.dg.DialogueID() {
+		return ErrMismatchStreamID
+	}
+	opt := options.MergeCallOptions(opts...)
+	if opt.Timeout != nil {
+		req.SetTimeout(*opt.Timeout)
+	}
+	sm.setDefaultTimeout(req)
+
+	sm.mtx.RLock()
+	if !sm.streamOK {
+		sm.mtx.RUnlock()
+		return io.EOF
+	}
+	if sm.opts.remoteMethodCheck && !sm.hasRemoteRPC(method) {
+		sm.mtx.RUnlock()
+		return ErrRemoteRPCUnregistered
+	}
+	pkt := sm.pf.NewRequestPacketWithIDAndSessionID(req.ID(), sm.dg.DialogueID(), []byte(method), req.Data())
+	if req.Timeout() != 0 {
+		pkt.Data.Deadline = time.Now().Add(req.Timeout())
+		pkt.Data.Timeout = req.Timeout()
+	}
+	pkt.Data.Custom = req.Custom()
+	// ask the peer to respond in chunks
+	pkt.Data.Chunked = true
+
+	deadline, ok := ctx.Deadline()
+	if ok {
+		pkt.Data.Context.Deadline = deadline
+	}
+	sink := newChunkSink(make(chan struct{}))
+	sm.rpcMtx.Lock()
+	sm.chunkSinks[req.ID()] = sink
+	sm.rpcMtx.Unlock()
+	release := func() {
+		sm.rpcMtx.Lock()
+		defer sm.rpcMtx.Unlock()
+		if _, ok := sm.chunkSinks[req.ID()]; ok {
+			delete(sm.chunkSinks, req.ID())
+			close(sink.done)
+		}
+	}
+	defer release()
+
+	syncOpts := []synchub.SyncOption{}
+	if req.Timeout() != 0 {
+		syncOpts = append(syncOpts, synchub.WithTimeout(req.Timeout()))
+	}
+	sync := sm.shub.New(req.ID(), syncOpts...)
+	atomic.AddInt64(&sm.end.calls, 1)
+	defer atomic.AddInt64(&sm.end.calls, -1)
+	sm.writeInCh <- pkt
+	sm.mtx.RUnlock()
+
+	for {
+		select {
+		case <-ctx.Done():
+			sync.Cancel(false)
+			if ctx.Err() == context.DeadlineExceeded {
+				return ctx.Err()
+			}
+			release()
+			if err := sm.cancelRequest(pkt.ID()); err != nil {
+				return err
+			}
+			return ctx.Err()
+
+		case <-sink.ready:
+			chunk, ok := sink.pop()
+			if !ok {
+				continue
+			}
+			if _, err := w.Write(chunk); err != nil {
+				// no need to transfer the rest
+				sync.Cancel(false)
+				release()
+				sm.cancelRequest(pkt.ID())
+				return err
+			}
+
+		case event := <-sync.C():
+			if event.Error != nil {
+				sm.log.Debugf("request return err: %s, clientID: %d, dialogueID: %d, reqID: %d",
+					event.Error, sm.cn.ClientID(), sm.dg.DialogueID(), req.ID())
+				return callCause(event.Error)
+			}
+			// chunks are delivered before the last response, drain them first
+			for chunk, ok := sink.pop(); ok; chunk, ok = sink.pop() {
+				if _, err := w.Write(chunk); err != nil {
+					return err
+				}
+			}
+			rsp := event.Ack.(*response)
+			_, err := w.Write(rsp.data)
+			return err
+		}
+	}
+}
+
+// notify peer the request is canceled
+func (sm *stream) cancelRequest(id uint64) error {
+	sm.mtx.RLock()
+	defer sm.mtx.RUnlock()
+	if !sm.streamOK {
+		return io.EOF
+	}
+	cancelType := packet.RequestCancelTypeCanceled
+	cancelPkt := sm.pf.NewRequestCancelPacketWithIDAndSessionID(id, sm.dg.DialogueID(), cancelType)
+	sm.writeInCh <- cancelPkt
+	return nil
+}
+
 func (sm *stream) CallAsync(ctx context.Context, method string, req geminio.Request, ch chan *geminio.Call, opts ...*options.CallOptions) (*geminio.Call, error) {
 	if req.ClientID() != sm.cn.ClientID() {
 		return nil, ErrMismatchClientID
@@ -156,15 +302,21 @@ func (sm *stream) CallAsync(ctx context.Context, method string, req geminio.Requ
 	if req.StreamID() != sm.dg.DialogueID() {
 		return nil, ErrMismatchStreamID
 	}
+	opt := options.MergeCallOptions(opts...)
+	if opt.Timeout != nil {
+		req.SetTimeout(*opt.Timeout)
+	}
+	sm.setDefaultTimeout(req)
 	sm.mtx.RLock()
 	if !sm.streamOK {
 		sm.mtx.RUnlock()
-		return nil, io.EOF
+		return nil, newCallError(io.EOF)
 	}
 	pkt := sm.pf.NewRequestPacketWithIDAndSessionID(req.ID(), sm.dg.DialogueID(), []byte(method), req.Data())
 	// deadline and timeout for peer
 	if req.Timeout() != 0 {
 		pkt.Data.Deadline = time.Now().Add(req.Timeout())
+		pkt.Data.Timeout = req.Timeout()
 	}
 	pkt.Data.Custom = req.Custom()
 
@@ -183,10 +335,11 @@ func (sm *stream) CallAsync(ctx context.Context, method string, req geminio.Requ
 	// deadline and timeout for local
 	syncOpts := []synchub.SyncOption{synchub.WithContext(ctx),
 		synchub.WithCallback(func(event *synchub.Event) {
+			atomic.AddInt64(&sm.end.calls, -1)
 			if event.Error != nil {
 				sm.log.Debugf("request packet err: %s, clientID: %d, dialogueID: %d, packetID: %d, packetType: %s",
 					event.Error, sm.cn.ClientID(), sm.dg.DialogueID(), pkt.ID(), pkt.Type().String())
-				call.Error = event.Error
+				call.Error = newCallError(event.Error)
 				ch <- call
 				return
 			}
@@ -199,6 +352,7 @@ func (sm *stream) CallAsync(ctx context.Context, method string, req geminio.Requ
 		syncOpts = append(syncOpts, synchub.WithTimeout(req.Timeout()))
 	}
 	// Add a new sync for the async call
+	atomic.AddInt64(&sm.end.calls, 1)
 	sm.shub.New(pkt.ID(), syncOpts...)
 	sm.writeInCh <- pkt
 	sm.mtx.RUnlock()
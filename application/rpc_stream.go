@@ -0,0 +1,347 @@
+package application
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jumboframes/armorigo/synchub"
+	"github.com/singchia/geminio"
+	"github.com/singchia/geminio/options"
+	"github.com/singchia/geminio/packet"
+)
+
+// A streaming call is opened by a request with streaming set, then the
+// messages of both sides follow with the same request ID, the caller's as
+// requests with more set and the callee's as response chunks. The callee's
+// last response ends the call.
+
+var ErrSendClosed = errors.New("send closed")
+
+func (sm *stream) addLocalStreamRPC(method string, rpc geminio.StreamRPC) {
+	sm.rpcMtx.Lock()
+	defer sm.rpcMtx.Unlock()
+	sm.localStreamRPCs[method] = rpc
+}
+
+func (sm *stream) delLocalStreamRPC(method string) {
+	sm.rpcMtx.Lock()
+	defer sm.rpcMtx.Unlock()
+	delete(sm.localStreamRPCs, method)
+}
+
+// RegisterStream will overwrite the old streaming method if exists, the
+// peer sees it as any registered method.
+func (sm *stream) RegisterStream(ctx context.Context, method string, rpc geminio.StreamRPC) error {
+	return sm.register(ctx, method,
+		func() { sm.addLocalStreamRPC(method, rpc) },
+		func() { sm.delLocalStreamRPC(method) })
+}
+
+func (sm *stream) CallStream(ctx context.Context, method string, opts ...*options.CallOptions) (geminio.StreamRequest, error) {
+	opt := options.MergeCallOptions(opts...)
+
+	sm.mtx.RLock()
+	if !sm.streamOK {
+		sm.mtx.RUnlock()
+		return nil, io.EOF
+	}
+	if sm.opts.remoteMethodCheck && !sm.hasRemoteRPC(method) {
+		sm.mtx.RUnlock()
+		return nil, ErrRemoteRPCUnregistered
+	}
+	id := sm.pf.NewPacketID()
+	pkt := sm.pf.NewRequestPacketWithIDAndSessionID(id, sm.dg.DialogueID(), []byte(method), nil)
+	pkt.Data.Streaming = true
+	syncOpts := []synchub.SyncOption{}
+	if opt.Timeout != nil && *opt.Timeout != 0 {
+		pkt.Data.Deadline = time.Now().Add(*opt.Timeout)
+		syncOpts = append(syncOpts, synchub.WithTimeout(*opt.Timeout))
+	}
+	deadline, ok := ctx.Deadline()
+	if ok {
+		pkt.Data.Context.Deadline = deadline
+	}
+	sink := newChunkSink(make(chan struct{}))
+	sm.rpcMtx.Lock()
+	sm.chunkSinks[id] = sink
+	sm.rpcMtx.Unlock()
+
+	sr := &streamRequest{
+		sm:     sm,
+		ctx:    ctx,
+		id:     id,
+		method: method,
+		sink:   sink,
+		sync:   sm.shub.New(id, syncOpts...),
+	}
+	atomic.AddInt64(&sm.end.calls, 1)
+	sm.writeInCh <- pkt
+	sm.mtx.RUnlock()
+	return sr, nil
+}
+
+// streamRequest is the caller side of a streaming call
+type streamRequest struct {
+	sm     *stream
+	ctx    context.Context
+	id     uint64
+	method string
+	sink   *chunkSink
+	sync   synchub.Sync
+
+	mtx        sync.Mutex
+	sendClosed bool
+	// set once the call ended
+	err error
+}
+
+func (sr *streamRequest) Method() string {
+	return sr.method
+}
+
+func (sr *streamRequest) SendMsg(data []byte) error {
+	return sr.send(data, false)
+}
+
+func (sr *streamRequest) CloseSend() error {
+	return sr.send(nil, true)
+}
+
+func (sr *streamRequest) send(data []byte, end bool) error {
+	sr.mtx.Lock()
+	if sr.err != nil {
+		sr.mtx.Unlock()
+		return sr.err
+	}
+	if sr.sendClosed {
+		sr.mtx.Unlock()
+		return ErrSendClosed
+	}
+	sr.sendClosed = end
+	sr.mtx.Unlock()
+
+	sm := sr.sm
+	sm.mtx.RLock()
+	defer sm.mtx.RUnlock()
+	if !sm.streamOK {
+		return io.EOF
+	}
+	pkt := sm.pf.NewRequestPacketWithIDAndSessionID(sr.id, sm.dg.DialogueID(), []byte(sr.method), data)
+	pkt.Data.Streaming = true
+	if end {
+		pkt.Data.End = true
+	} else {
+		pkt.Data.More = true
+	}
+	sm.writeInCh <- pkt
+	return nil
+}
+
+// RecvMsg returns io.EOF after the callee returned nil, and keeps returning
+// the same error after the call ended.
+func (sr *streamRequest) RecvMsg() ([]byte, error) {
+	sr.mtx.Lock()
+	err := sr.err
+	sr.mtx.Unlock()
+	if err != nil {
+		// messages are delivered before the last response, drain them first
+		if data, ok := sr.sink.pop(); ok {
+			return data, nil
+		}
+		return nil, err
+	}
+
+	select {
+	case <-sr.ctx.Done():
+		sr.sync.Cancel(false)
+		sr.release()
+		if sr.ctx.Err() != context.DeadlineExceeded {
+			sr.sm.cancelRequest(sr.id)
+		}
+		return nil, sr.finish(sr.ctx.Err())
+
+	case <-sr.sink.ready:
+		if data, ok := sr.sink.pop(); ok {
+			return data, nil
+		}
+		return sr.RecvMsg()
+
+	case event := <-sr.sync.C():
+		if event.Error != nil {
+			sr.sm.log.Debugf("stream request return err: %s, clientID: %d, dialogueID: %d, reqID: %d",
+				event.Error, sr.sm.cn.ClientID(), sr.sm.dg.DialogueID(), sr.id)
+			sr.release()
+			return nil, sr.finish(callCause(event.Error))
+		}
+		sr.release()
+		sr.finish(io.EOF)
+		return sr.RecvMsg()
+	}
+}
+
+func (sr *streamRequest) release() {
+	sm := sr.sm
+	sm.rpcMtx.Lock()
+	defer sm.rpcMtx.Unlock()
+	if _, ok := sm.chunkSinks[sr.id]; ok {
+		delete(sm.chunkSinks, sr.id)
+		close(sr.sink.done)
+	}
+}
+
+func (sr *streamRequest) finish(err error) error {
+	sr.mtx.Lock()
+	defer sr.mtx.Unlock()
+	if sr.err == nil {
+		sr.err = err
+		atomic.AddInt64(&sr.sm.end.calls, -1)
+	}
+	return sr.err
+}
+
+// serverStream is the callee side of a streaming call
+type serverStream struct {
+	sm     *stream
+	ctx    context.Context
+	id     uint64
+	method string
+	sink   *chunkSink
+	// closed at caller's CloseSend
+	ended chan struct{}
+	// closed after the rpc returned
+	done chan struct{}
+
+	mtx sync.Mutex
+	// set once the last response sent
+	closed bool
+}
+
+func (ss *serverStream) Method() string {
+	return ss.method
+}
+
+func (ss *serverStream) SendMsg(data []byte) error {
+	// held while writing, no chunk follows the last response
+	ss.mtx.Lock()
+	defer ss.mtx.Unlock()
+	if ss.closed {
+		return ErrSendClosed
+	}
+	select {
+	case <-ss.done:
+		return io.EOF
+	default:
+	}
+	rspPkt := ss.sm.pf.NewResponsePacket(ss.id, []byte(ss.method), data, nil)
+	rspPkt.Data.More = true
+	return ss.sm.dg.Write(rspPkt)
+}
+
+func (ss *serverStream) Close(err error) error {
+	return ss.finish(err)
+}
+
+// finish sends the last response, which ends the caller's call with err or
+// io.EOF if nil
+func (ss *serverStream) finish(err error) error {
+	ss.mtx.Lock()
+	defer ss.mtx.Unlock()
+	if ss.closed {
+		return ErrSendClosed
+	}
+	ss.closed = true
+	rspPkt := ss.sm.pf.NewResponsePacket(ss.id, []byte(ss.method), nil, err)
+	return ss.sm.dg.Write(rspPkt)
+}
+
+func (ss *serverStream) RecvMsg() ([]byte, error) {
+	for {
+		select {
+		case <-ss.sink.ready:
+			if data, ok := ss.sink.pop(); ok {
+				return data, nil
+			}
+		case <-ss.ended:
+			// messages are queued before the end
+			if data, ok := ss.sink.pop(); ok {
+				return data, nil
+			}
+			return nil, io.EOF
+		case <-ss.ctx.Done():
+			return nil, ss.ctx.Err()
+		case <-ss.sm.closeCh:
+			return nil, io.EOF
+		}
+	}
+}
+
+// the rpc runs in its own goroutine rather than the worker pool, since it
+// lives as long as the call
+func (sm *stream) doStreamRPC(pkt *packet.RequestPacket, rpc geminio.StreamRPC, method string, ctx context.Context) {
+	done := make(chan struct{})
+	ss := &serverStream{
+		sm:     sm,
+		ctx:    ctx,
+		id:     pkt.ID(),
+		method: method,
+		sink:   newChunkSink(done),
+		ended:  make(chan struct{}),
+		done:   done,
+	}
+	sm.rpcMtx.Lock()
+	sm.streamCalls[pkt.ID()] = ss
+	sm.rpcMtx.Unlock()
+
+	stat := sm.end.getMethodStat(method)
+	atomic.AddInt64(&stat.inflight, 1)
+	go func() {
+		err := rpc(ctx, ss)
+		atomic.AddUint64(&stat.total, 1)
+		if err != nil {
+			atomic.AddUint64(&stat.errors, 1)
+		}
+		atomic.AddInt64(&stat.inflight, -1)
+
+		sm.rpcMtx.Lock()
+		delete(sm.streamCalls, pkt.ID())
+		close(ss.done)
+		cancel, ok := sm.rpcCancels[pkt.ID()]
+		if ok {
+			delete(sm.rpcCancels, pkt.ID())
+			cancel()
+		}
+		sm.rpcMtx.Unlock()
+
+		// a closed call already sent its last response
+		if err := ss.finish(err); err != nil && err != ErrSendClosed {
+			sm.log.Debugf("write stream response packet err: %s, clientID: %d, dialogueID: %d, packetID: %d, packetType: %s, method: %s",
+				err, sm.cn.ClientID(), sm.dg.DialogueID(), pkt.ID(), pkt.Type().String(), method)
+		}
+	}()
+}
+
+// the caller's messages after the opening request
+func (sm *stream) handleInStreamRequest(pkt *packet.RequestPacket) {
+	sm.rpcMtx.RLock()
+	ss, ok := sm.streamCalls[pkt.ID()]
+	sm.rpcMtx.RUnlock()
+	if !ok {
+		// the rpc already returned, drop the message
+		packet.NotifyDrop(sm.opts.dropObserver, pkt, packet.DropReasonNoWaiting, packet.DirectionIn)
+		return
+	}
+	if pkt.Data.End {
+		// only the handlePkt goroutine closes it
+		select {
+		case <-ss.ended:
+		default:
+			close(ss.ended)
+		}
+		return
+	}
+	ss.sink.push(emptyIfNil(pkt.Data.Value))
+}
@@ -0,0 +1,70 @@
+package application
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/singchia/geminio"
+)
+
+type methodStat struct {
+	total    uint64
+	errors   uint64
+	inflight int64
+}
+
+func (end *End) getMethodStat(method string) *methodStat {
+	value, ok := end.methodStats.Load(method)
+	if !ok {
+		value, _ = end.methodStats.LoadOrStore(method, &methodStat{})
+	}
+	return value.(*methodStat)
+}
+
+// Drain blocks until the outgoing calls, the messages published waiting for
+// acks and the served RPCs of the End and its streams are all finished, or
+// the ctx is done.
+func (end *End) Drain(ctx context.Context) error {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for !end.drained() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+func (end *End) drained() bool {
+	if atomic.LoadInt64(&end.calls) > 0 {
+		return false
+	}
+	drained := true
+	end.methodStats.Range(func(_, value interface{}) bool {
+		drained = atomic.LoadInt64(&value.(*methodStat).inflight) == 0
+		return drained
+	})
+	return drained
+}
+
+// MethodStats returns a snapshot of statistics of all methods served, the
+// internal keepalive excluded
+func (end *End) MethodStats() map[string]geminio.MethodStat {
+	stats := map[string]geminio.MethodStat{}
+	end.methodStats.Range(func(key, value interface{}) bool {
+		if key.(string) == keepaliveMethod {
+			return true
+		}
+		stat := value.(*methodStat)
+		stats[key.(string)] = geminio.MethodStat{
+			Total:    atomic.LoadUint64(&stat.total),
+			Errors:   atomic.LoadUint64(&stat.errors),
+			InFlight: atomic.LoadInt64(&stat.inflight),
+		}
+		return true
+	})
+	return stats
+}
@@ -7,26 +7,44 @@ import (
 	"fmt"
 	"regexp"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/jumboframes/armorigo/synchub"
 	"github.com/singchia/geminio"
 	"github.com/singchia/geminio/conn"
 	"github.com/singchia/geminio/multiplexer"
+	"github.com/singchia/geminio/options"
 	"github.com/singchia/geminio/packet"
 	"github.com/singchia/geminio/pkg/iodefine"
 	gnet "github.com/singchia/geminio/pkg/net"
 	gsync "github.com/singchia/geminio/pkg/sync"
+	"github.com/singchia/go-timer/v2"
 )
 
 var (
 	ErrMismatchStreamID      = errors.New("mismatch streamID")
 	ErrMismatchClientID      = errors.New("mismatch clientID")
 	ErrRemoteRPCUnregistered = errors.New("remote rpc unregistered")
+	ErrRequestTimeout        = errors.New("request timeout")
+	ErrQuiescing             = multiplexer.ErrQuiescing
+)
+
+// OpenError is returned by OpenStream if the stream failed to negotiate,
+// Kind tells whether it's rejected by peer, transport broken or timeout.
+type OpenError = multiplexer.OpenError
+
+const (
+	OpenErrorRejected  = multiplexer.OpenErrorRejected
+	OpenErrorTransport = multiplexer.OpenErrorTransport
+	OpenErrorTimeout   = multiplexer.OpenErrorTimeout
 )
 
 const (
 	registrationFormat = "%d-%d-registration"
+
+	// chunk size of the response for CallTo
+	responseChunkSize = 64 * 1024
 )
 
 type patternRPC struct {
@@ -37,6 +55,59 @@ type patternRPC struct {
 
 type methodRPC geminio.HijackRPC
 
+// chunkSink queues the chunks of a call without bound, so that a slow
+// consumer of one call never blocks the handlePkt of the whole stream
+type chunkSink struct {
+	mtx    sync.Mutex
+	chunks [][]byte
+	// notified once chunks queued
+	ready chan struct{}
+	// closed once the call released, chunks after are dropped
+	done chan struct{}
+}
+
+func newChunkSink(done chan struct{}) *chunkSink {
+	return &chunkSink{
+		ready: make(chan struct{}, 1),
+		done:  done,
+	}
+}
+
+func (sink *chunkSink) push(chunk []byte) {
+	select {
+	case <-sink.done:
+		return
+	default:
+	}
+	sink.mtx.Lock()
+	sink.chunks = append(sink.chunks, chunk)
+	sink.mtx.Unlock()
+	sink.notify()
+}
+
+// pop returns false if no chunk queued
+func (sink *chunkSink) pop() ([]byte, bool) {
+	sink.mtx.Lock()
+	defer sink.mtx.Unlock()
+	if len(sink.chunks) == 0 {
+		return nil, false
+	}
+	chunk := sink.chunks[0]
+	sink.chunks[0] = nil
+	sink.chunks = sink.chunks[1:]
+	if len(sink.chunks) > 0 {
+		sink.notify()
+	}
+	return chunk, true
+}
+
+func (sink *chunkSink) notify() {
+	select {
+	case sink.ready <- struct{}{}:
+	default:
+	}
+}
+
 type stream struct {
 	*gnet.UnimplementedConn
 	// options for End and stream, remember stream dones't own opts
@@ -56,14 +127,22 @@ type stream struct {
 	rpcCancels map[uint64]context.CancelFunc
 	// key: method value: RPC
 	localRPCs map[string]geminio.RPC
+	// key: method value: StreamRPC
+	localStreamRPCs map[string]geminio.StreamRPC
+	// key: requestID, value: the inflight streaming call at callee side
+	streamCalls map[uint64]*serverStream
 	// key: method value: placeholder
 	remoteRPCs map[string]struct{}
 	// hijack
 	hijackRPC *patternRPC
+	// key: requestID, value: chunks of the inflight CallTo
+	chunkSinks map[uint64]*chunkSink
 
 	// mtx protects follows
-	mtx       sync.RWMutex
-	streamOK  bool
+	mtx      sync.RWMutex
+	streamOK bool
+	// buffered data is still readable in the fini grace period
+	draining  bool
 	closeOnce *gsync.Once
 
 	// app layer messages
@@ -84,6 +163,15 @@ type stream struct {
 	// io
 	writeInCh chan packet.Packet // for multiple message types
 
+	// idempotency keys of received messages
+	dedup *dedupCache
+	// acks to be batched
+	acks ackBatch
+	// acked prefix of the published messages
+	ackOrder ackOrder
+	// published messages waiting for acks to be retransmitted
+	retransmits retransmitSet
+
 	// close channel
 	closeCh chan struct{}
 }
@@ -99,7 +187,10 @@ func newStream(end *End, cn conn.Conn, dg multiplexer.Dialogue, opts *opts) *str
 		dg:                dg,
 		rpcCancels:        make(map[uint64]context.CancelFunc),
 		localRPCs:         make(map[string]geminio.RPC),
+		localStreamRPCs:   make(map[string]geminio.StreamRPC),
+		streamCalls:       make(map[uint64]*serverStream),
 		remoteRPCs:        make(map[string]struct{}),
+		chunkSinks:        make(map[uint64]*chunkSink),
 		streamOK:          true,
 		closeOnce:         new(gsync.Once),
 		messageCh:         make(chan *packet.MessagePacket, 1024),
@@ -109,6 +200,7 @@ func newStream(end *End, cn conn.Conn, dg multiplexer.Dialogue, opts *opts) *str
 		dlWriteChList:     list.New(),
 		writeInCh:         make(chan packet.Packet),
 		closeCh:           make(chan struct{}),
+		dedup:             newDedupCache(opts.messageDedupTTL),
 	}
 	go sm.handlePkt()
 	return sm
@@ -155,6 +247,7 @@ func (sm *stream) handlePkt() {
 			}
 			sm.log.Tracef("stream read in packet, clientID: %d, dialogueID: %d, packetID: %d, packetType: %s",
 				sm.cn.ClientID(), sm.dg.DialogueID(), pkt.ID(), pkt.Type().String())
+			sm.end.touch()
 			ret := sm.handleIn(pkt)
 			switch ret {
 			case iodefine.IOSuccess:
@@ -230,10 +323,28 @@ func (sm *stream) handleOut(pkt packet.Packet) iodefine.IORet {
 func (sm *stream) handleInMessagePacket(pkt *packet.MessagePacket) iodefine.IORet {
 	sm.log.Tracef("read message packet, clientID: %d, dialogueID: %d, packetID: %d, packetType: %s",
 		sm.cn.ClientID(), sm.dg.DialogueID(), pkt.ID(), pkt.Type().String())
+	if pkt.Data.IdempotencyKey != "" && sm.dedup.seen(pkt.Data.IdempotencyKey) {
+		sm.log.Debugf("read duplicate message packet, clientID: %d, dialogueID: %d, packetID: %d, packetType: %s, idempotencyKey: %s",
+			sm.cn.ClientID(), sm.dg.DialogueID(), pkt.ID(), pkt.Type().String(), pkt.Data.IdempotencyKey)
+		packet.NotifyDrop(sm.opts.dropObserver, pkt, packet.DropReasonDuplicate, packet.DirectionIn)
+		if options.Cnss(pkt.Cnss) == options.CnssAtMostOnce {
+			return iodefine.IOSuccess
+		}
+		// the duplicate is acked, so that the producer won't wait for it
+		retPkt := sm.pf.NewMessageAckPacketWithSessionID(sm.dg.DialogueID(), pkt.ID(), nil)
+		err := sm.dg.Write(retPkt)
+		if err != nil {
+			sm.log.Debugf("write duplicate message ack packet err: %s, clientID: %d, dialogueID: %d, packetID: %d, packetType: %s",
+				err, sm.cn.ClientID(), sm.dg.DialogueID(), pkt.ID(), pkt.Type().String())
+			return iodefine.IOErr
+		}
+		return iodefine.IOSuccess
+	}
 	// we don't want block here.
 	select {
 	case sm.messageCh <- pkt:
 	default:
+		packet.NotifyDrop(sm.opts.dropObserver, pkt, packet.DropReasonBufferFull, packet.DirectionIn)
 		return iodefine.IODiscard
 	}
 	return iodefine.IOSuccess
@@ -252,21 +363,46 @@ func (sm *stream) handleInMessageAckPacket(pkt *packet.MessageAckPacket) iodefin
 	acked := sm.shub.Ack(pkt.ID(), nil)
 	sm.log.Tracef("message ack packet acked: %t, clientID: %d, dialogueID: %d, packetID: %d, packetType: %s",
 		acked, sm.cn.ClientID(), sm.dg.DialogueID(), pkt.ID(), pkt.Type().String())
+	sm.ackOrder.ack(pkt.ID())
+	// the batched acks
+	for _, pktID := range pkt.Data.Acks {
+		sm.shub.Ack(pktID, nil)
+		sm.ackOrder.ack(pktID)
+	}
 	return iodefine.IOSuccess
 }
 
+// peerDeadline returns the earlier one of the deadlines the peer set, in our
+// clock by the skew of the peer's
+func peerDeadline(data *packet.MessageData, skew time.Duration) (time.Time, bool) {
+	deadline := data.Deadline
+	if deadline.IsZero() || (!data.Context.Deadline.IsZero() &&
+		data.Context.Deadline.Before(deadline)) {
+		deadline = data.Context.Deadline
+	}
+	if deadline.IsZero() {
+		return deadline, false
+	}
+	return deadline.Add(-skew), true
+}
+
 func (sm *stream) handleInRequestPacket(pkt *packet.RequestPacket) iodefine.IORet {
 	method := string(pkt.Data.Key)
 	sm.log.Tracef("read request packet, clientID: %d, dialogueID: %d, packetID: %d, packetType: %s, method: %s",
 		sm.cn.ClientID(), sm.dg.DialogueID(), pkt.ID(), pkt.Type().String(), method)
+	if pkt.Data.Streaming && (pkt.Data.More || pkt.Data.End) {
+		sm.handleInStreamRequest(pkt)
+		return iodefine.IOSuccess
+	}
 	// we use Data.Key as method
 	req, rsp :=
 		&request{
-			// we use Data.Value as data
-			data:     pkt.Data.Value,
+			// we use Data.Value as data, nil body is seen as empty
+			data:     emptyIfNil(pkt.Data.Value),
 			id:       pkt.PacketID,
 			method:   method,
 			custom:   pkt.Data.Custom,
+			timeout:  pkt.Data.Timeout,
 			clientID: sm.cn.ClientID(),
 			streamID: sm.dg.DialogueID(),
 		},
@@ -276,22 +412,46 @@ func (sm *stream) handleInRequestPacket(pkt *packet.RequestPacket) iodefine.IORe
 			clientID:  sm.cn.ClientID(),
 			streamID:  sm.dg.DialogueID(),
 		}
+	// no new work on the default stream while quiescing
+	if sm.dg.DialogueID() == packet.SessionID1 && method != keepaliveMethod &&
+		atomic.LoadInt32(&sm.end.quiescing) == 1 {
+		rspPkt := sm.pf.NewResponsePacket(pkt.ID(), []byte(method), nil, ErrQuiescing)
+		err := sm.dg.Write(rspPkt)
+		if err != nil {
+			sm.log.Debugf("write quiescing response packet err: %s, clientID: %d, dialogueID: %d, packetID: %d, packetType: %s, method: %s",
+				err, sm.cn.ClientID(), sm.dg.DialogueID(), pkt.ID(), pkt.Type().String(), method)
+			return iodefine.IOErr
+		}
+		return iodefine.IOSuccess
+	}
+	// keepalive is never forbidden
+	if method != keepaliveMethod {
+		ok, err := sm.authorized(pkt, method)
+		if err != nil {
+			sm.log.Debugf("write forbidden response packet err: %s, clientID: %d, dialogueID: %d, packetID: %d, packetType: %s, method: %s",
+				err, sm.cn.ClientID(), sm.dg.DialogueID(), pkt.ID(), pkt.Type().String(), method)
+			return iodefine.IOErr
+		}
+		if !ok {
+			return iodefine.IOSuccess
+		}
+	}
 	// setup context
 	ctx, cancel := context.Background(), context.CancelFunc(nil)
-	if !pkt.Data.Deadline.IsZero() || !pkt.Data.Context.Deadline.IsZero() {
-		deadline := pkt.Data.Deadline
-		if deadline.IsZero() || (!deadline.IsZero() &&
-			!pkt.Data.Context.Deadline.IsZero() &&
-			pkt.Data.Context.Deadline.Before(deadline)) {
-			deadline = pkt.Data.Context.Deadline
-		}
+	if deadline, ok := peerDeadline(pkt.Data, sm.cn.PeerClockSkew()); ok {
 		ctx, cancel = context.WithDeadline(ctx, deadline)
 		sm.rpcMtx.Lock()
 		sm.rpcCancels[pkt.ID()] = cancel
 		sm.rpcMtx.Unlock()
 	}
-	// hijack exist
-	if sm.hijackRPC != nil {
+	// the built-in keepalive echoes the payload, prior to hijack
+	if method == keepaliveMethod {
+		// it's light enough to be done in place, and never waits for workers
+		sm.doRPC(pkt, keepaliveRPC, method, ctx, req, rsp, false)
+		return iodefine.IOSuccess
+	}
+	// hijack exist, streaming calls are never hijacked
+	if sm.hijackRPC != nil && !pkt.Data.Streaming {
 		if sm.hijackRPC.pattern == nil {
 			sm.doRPC(pkt, methodRPC(sm.hijackRPC.rpc), method, ctx, req, rsp, true)
 			return iodefine.IOSuccess
@@ -306,8 +466,21 @@ func (sm *stream) handleInRequestPacket(pkt *packet.RequestPacket) iodefine.IORe
 	// registered RPC lookup and call
 	sm.rpcMtx.RLock()
 	rpc, ok := sm.localRPCs[method]
+	streamRPC, streamOK := sm.localStreamRPCs[method]
 	sm.rpcMtx.RUnlock()
-	if ok {
+	if pkt.Data.Streaming {
+		if streamOK {
+			// the caller cancels the call at any time
+			if cancel == nil {
+				ctx, cancel = context.WithCancel(ctx)
+				sm.rpcMtx.Lock()
+				sm.rpcCancels[pkt.ID()] = cancel
+				sm.rpcMtx.Unlock()
+			}
+			sm.doStreamRPC(pkt, streamRPC, method, ctx)
+			return iodefine.IOSuccess
+		}
+	} else if ok {
 		wrapperRPC := func(ctx context.Context, _ string, req geminio.Request, rsp geminio.Response) {
 			rpc(ctx, req, rsp)
 		}
@@ -325,7 +498,7 @@ func (sm *stream) handleInRequestPacket(pkt *packet.RequestPacket) iodefine.IORe
 	}
 
 	// no rpc found, return to call error, note that this error is not set to response error
-	err := fmt.Errorf("no such rpc: %s", method)
+	err := fmt.Errorf("%w: %s", ErrNoSuchRPC, method)
 	rspPkt := sm.pf.NewResponsePacket(pkt.ID(), []byte(method), nil, err)
 	err = sm.dg.Write(rspPkt)
 	if err != nil {
@@ -348,8 +521,11 @@ func (sm *stream) handleInRequestCancelPacket(pkt *packet.RequestCancelPacket) i
 }
 
 func (sm *stream) handleInResponsePacket(pkt *packet.ResponsePacket) iodefine.IORet {
+	if pkt.Data.More {
+		return sm.handleInResponseChunk(pkt)
+	}
 	if pkt.Data.Error != "" {
-		err := errors.New(pkt.Data.Error)
+		err := remoteCallError(pkt.Data.Error)
 		errored := sm.shub.Error(pkt.ID(), err)
 		sm.log.Tracef("read response packet with err: %s, clientID: %d, dialogueID: %d, packetID: %d, packetType: %s, errored: %t",
 			err, sm.cn.ClientID(), sm.dg.DialogueID(), pkt.ID(), pkt.Type().String(), errored)
@@ -358,14 +534,30 @@ func (sm *stream) handleInResponsePacket(pkt *packet.ResponsePacket) iodefine.IO
 	sm.log.Tracef("read response packet, clientID: %d, dialogueID: %d, packetID: %d, packetType: %s",
 		sm.cn.ClientID(), sm.dg.DialogueID(), pkt.ID(), pkt.Type().String())
 	rsp := &response{
-		data:      pkt.Data.Value,
+		data:      emptyIfNil(pkt.Data.Value),
 		requestID: pkt.ID(),
 		clientID:  sm.cn.ClientID(),
 		streamID:  sm.dg.DialogueID(),
 	}
-	// the return is ignored for now
 	// TODO consistency optimize
-	_ = sm.shub.Ack(pkt.ID(), rsp)
+	if !sm.shub.Ack(pkt.ID(), rsp) {
+		packet.NotifyDrop(sm.opts.dropObserver, pkt, packet.DropReasonNoWaiting, packet.DirectionIn)
+	}
+	return iodefine.IOSuccess
+}
+
+func (sm *stream) handleInResponseChunk(pkt *packet.ResponsePacket) iodefine.IORet {
+	sm.log.Tracef("read response chunk, clientID: %d, dialogueID: %d, packetID: %d, packetType: %s, length: %d",
+		sm.cn.ClientID(), sm.dg.DialogueID(), pkt.ID(), pkt.Type().String(), len(pkt.Data.Value))
+	sm.rpcMtx.RLock()
+	sink, ok := sm.chunkSinks[pkt.ID()]
+	sm.rpcMtx.RUnlock()
+	if !ok {
+		// the caller already returned, drop the chunk
+		packet.NotifyDrop(sm.opts.dropObserver, pkt, packet.DropReasonNoWaiting, packet.DirectionIn)
+		return iodefine.IOSuccess
+	}
+	sink.push(pkt.Data.Value)
 	return iodefine.IOSuccess
 }
 
@@ -412,7 +604,8 @@ func (sm *stream) handleInStreamPacket(pkt *packet.StreamPacket) iodefine.IORet
 	select {
 	case sm.streamCh <- pkt:
 	default:
-		// TODO drop the packet, we don't want block here
+		// drop the packet, we don't want block here
+		packet.NotifyDrop(sm.opts.dropObserver, pkt, packet.DropReasonBufferFull, packet.DirectionIn)
 		return iodefine.IODiscard
 	}
 	return iodefine.IOSuccess
@@ -476,8 +669,39 @@ func (sm *stream) handleOutStreamPacket(pkt *packet.StreamPacket) iodefine.IORet
 
 // doRPC provide generic rpc call
 func (sm *stream) doRPC(pkt *packet.RequestPacket, rpc methodRPC, method string, ctx context.Context, req *request, rsp *response, async bool) {
+	stat := sm.end.getMethodStat(method)
+	atomic.AddInt64(&stat.inflight, 1)
+	// the rpc not returned in the request's timeout is responded with
+	// ErrRequestTimeout, and its late response is dropped
+	responded := int32(0)
+	var tick timer.Tick
+	if req.timeout > 0 {
+		tick = sm.tmr.Add(req.timeout, timer.WithHandler(func(_ *timer.Event) {
+			if atomic.CompareAndSwapInt32(&responded, 0, 1) {
+				sm.timeoutRPC(pkt, method)
+			}
+		}))
+	}
+	if pkt.Data.Chunked {
+		// the chunks written by the rpc go out as they fill
+		rsp.writeChunk = func(chunk []byte) error {
+			if atomic.LoadInt32(&responded) == 1 {
+				return ErrRequestTimeout
+			}
+			return sm.writeResponseChunk(pkt, method, chunk)
+		}
+	}
 	prog := func() {
 		rpc(ctx, method, req, rsp)
+		timedout := !atomic.CompareAndSwapInt32(&responded, 0, 1)
+		if tick != nil {
+			tick.Cancel()
+		}
+		atomic.AddUint64(&stat.total, 1)
+		if rsp.err != nil || timedout {
+			atomic.AddUint64(&stat.errors, 1)
+		}
+		atomic.AddInt64(&stat.inflight, -1)
 		// once the rpc complete, we should cancel the context
 		sm.rpcMtx.Lock()
 		cancel, ok := sm.rpcCancels[pkt.ID()]
@@ -486,8 +710,29 @@ func (sm *stream) doRPC(pkt *packet.RequestPacket, rpc methodRPC, method string,
 			cancel()
 		}
 		sm.rpcMtx.Unlock()
+		if timedout {
+			sm.log.Debugf("drop response after request timeout, clientID: %d, dialogueID: %d, packetID: %d, packetType: %s, method: %s",
+				sm.cn.ClientID(), sm.dg.DialogueID(), pkt.ID(), pkt.Type().String(), method)
+			return
+		}
 
-		rspPkt := sm.pf.NewResponsePacket(pkt.ID(), []byte(req.method), rsp.data, rsp.err)
+		data, rspErr := rsp.data, rsp.err
+		if rsp.chunkErr != nil {
+			// the chunks written are incomplete, end the call with the err
+			// rather than leaving the caller waiting
+			data, rspErr = nil, rsp.chunkErr
+		}
+		if pkt.Data.Chunked && rspErr == nil {
+			// the caller accepts chunks, write all but the last one with more set
+			for len(data) > responseChunkSize {
+				if err := sm.writeResponseChunk(pkt, method, data[:responseChunkSize]); err != nil {
+					data, rspErr = nil, err
+					break
+				}
+				data = data[responseChunkSize:]
+			}
+		}
+		rspPkt := sm.pf.NewResponsePacket(pkt.ID(), []byte(req.method), data, rspErr)
 		err := sm.dg.Write(rspPkt)
 		if err != nil {
 			// Write error, the response cannot be delivered, so should be debuged
@@ -500,15 +745,78 @@ func (sm *stream) doRPC(pkt *packet.RequestPacket, rpc methodRPC, method string,
 		sm.log.Tracef("write response succeed, clientID: %d, dialogueID: %d, packetID: %d, packetType: %s, method: %s",
 			sm.cn.ClientID(), sm.dg.DialogueID(), pkt.ID(), pkt.Type().String(), method)
 	}
-	if async {
-		go prog()
-	} else {
+	if !async {
 		prog()
+		return
+	}
+	if sm.end.pool == nil {
+		go prog()
+		return
+	}
+	err := sm.end.pool.submit(prog)
+	if err == nil {
+		return
+	}
+	// the rpc is never called
+	atomic.StoreInt32(&responded, 1)
+	if tick != nil {
+		tick.Cancel()
+	}
+	atomic.AddInt64(&stat.inflight, -1)
+	sm.rpcMtx.Lock()
+	cancel, ok := sm.rpcCancels[pkt.ID()]
+	if ok {
+		delete(sm.rpcCancels, pkt.ID())
+		cancel()
+	}
+	sm.rpcMtx.Unlock()
+	if err != ErrServerBusy {
+		return
+	}
+	sm.log.Debugf("worker pool busy, reject the request, clientID: %d, dialogueID: %d, packetID: %d, packetType: %s, method: %s",
+		sm.cn.ClientID(), sm.dg.DialogueID(), pkt.ID(), pkt.Type().String(), method)
+	rspPkt := sm.pf.NewResponsePacket(pkt.ID(), []byte(req.method), nil, err)
+	err = sm.dg.Write(rspPkt)
+	if err != nil {
+		sm.log.Debugf("write server busy response packet err: %s, clientID: %d, dialogueID: %d, packetID: %d, packetType: %s, method: %s",
+			err, sm.cn.ClientID(), sm.dg.DialogueID(), pkt.ID(), pkt.Type().String(), method)
+	}
+}
+
+func (sm *stream) writeResponseChunk(pkt *packet.RequestPacket, method string, chunk []byte) error {
+	rspPkt := sm.pf.NewResponsePacket(pkt.ID(), []byte(method), chunk, nil)
+	rspPkt.Data.More = true
+	err := sm.dg.Write(rspPkt)
+	if err != nil {
+		sm.log.Debugf("write response chunk err: %s, clientID: %d, dialogueID: %d, packetID: %d, packetType: %s, method: %s",
+			err, sm.cn.ClientID(), sm.dg.DialogueID(), pkt.ID(), pkt.Type().String(), method)
+	}
+	return err
+}
+
+// timeoutRPC responds in place of the rpc still running, the rpc's context
+// is canceled as well
+func (sm *stream) timeoutRPC(pkt *packet.RequestPacket, method string) {
+	sm.rpcMtx.Lock()
+	cancel, ok := sm.rpcCancels[pkt.ID()]
+	if ok {
+		delete(sm.rpcCancels, pkt.ID())
+		cancel()
+	}
+	sm.rpcMtx.Unlock()
+	sm.log.Debugf("request timeout, clientID: %d, dialogueID: %d, packetID: %d, packetType: %s, method: %s",
+		sm.cn.ClientID(), sm.dg.DialogueID(), pkt.ID(), pkt.Type().String(), method)
+	rspPkt := sm.pf.NewResponsePacket(pkt.ID(), []byte(method), nil, ErrRequestTimeout)
+	if err := sm.dg.Write(rspPkt); err != nil {
+		sm.log.Debugf("write request timeout response packet err: %s, clientID: %d, dialogueID: %d, packetID: %d, packetType: %s, method: %s",
+			err, sm.cn.ClientID(), sm.dg.DialogueID(), pkt.ID(), pkt.Type().String(), method)
 	}
 }
 
 func (sm *stream) Close() error {
 	sm.closeOnce.Do(func() {
+		// the pending acks go ahead of the dismiss
+		sm.flushAcks()
 		sm.mtx.RLock()
 		defer sm.mtx.RUnlock()
 		if !sm.streamOK {
@@ -524,6 +832,25 @@ func (sm *stream) Close() error {
 }
 
 // finish and reclaim resources
+// drain waits for buffered data to be read until the fini grace elapses
+func (sm *stream) drain() {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	deadline := time.Now().Add(sm.finiGrace)
+	for time.Now().Before(deadline) {
+		sm.cacheMtx.Lock()
+		cached := len(sm.cache)
+		sm.cacheMtx.Unlock()
+		if cached == 0 && len(sm.streamCh) == 0 && len(sm.messageCh) == 0 {
+			break
+		}
+		<-ticker.C
+	}
+	sm.mtx.Lock()
+	sm.draining = false
+	sm.mtx.Unlock()
+}
+
 func (sm *stream) fini() {
 	sm.log.Debugf("stream finishing, clientID: %d, dialogueID: %d",
 		sm.cn.ClientID(), sm.dg.DialogueID())
@@ -534,7 +861,14 @@ func (sm *stream) fini() {
 	sm.shub = nil
 
 	sm.streamOK = false
+	sm.draining = sm.finiGrace > 0
 	close(sm.writeInCh)
+	// the acks not flushed yet are given up
+	sm.acks.mtx.Lock()
+	sm.acks.take()
+	sm.acks.mtx.Unlock()
+	sm.ackOrder.close()
+	sm.retransmits.stop()
 	sm.mtx.Unlock()
 
 	for range sm.writeInCh {
@@ -543,6 +877,10 @@ func (sm *stream) fini() {
 	// collect channels
 	sm.writeInCh = nil
 
+	if sm.finiGrace > 0 {
+		sm.drain()
+	}
+
 	// the outside should care about message and stream channel status
 	close(sm.messageCh)
 	close(sm.streamCh)
@@ -0,0 +1,33 @@
+package application
+
+import (
+	"testing"
+	"time"
+
+	"github.com/singchia/geminio/packet"
+)
+
+func TestPeerDeadline(t *testing.T) {
+	// the peer's clock is an hour behind, its deadline is expired in ours
+	skew := -time.Hour
+	data := &packet.MessageData{}
+	if _, ok := peerDeadline(data, skew); ok {
+		t.Error("deadline without the peer set")
+	}
+	data.Deadline = time.Now().Add(skew).Add(time.Second)
+	data.Context.Deadline = time.Now().Add(skew).Add(2 * time.Second)
+	deadline, ok := peerDeadline(data, skew)
+	if !ok {
+		t.Error("deadline not set")
+		return
+	}
+	if remain := time.Until(deadline); remain <= 0 || remain > time.Second {
+		t.Errorf("unexpected deadline corrected, remain: %s", remain)
+	}
+	// the earlier one goes
+	data.Deadline = time.Time{}
+	deadline, _ = peerDeadline(data, skew)
+	if remain := time.Until(deadline); remain <= time.Second || remain > 2*time.Second {
+		t.Errorf("unexpected context deadline corrected, remain: %s", remain)
+	}
+}
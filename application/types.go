@@ -78,6 +78,9 @@ type response struct {
 	requestID uint64
 	clientID  uint64
 	streamID  uint64
+	// writes a chunk out if the caller accepts chunks, nil if not
+	writeChunk func([]byte) error
+	chunkErr   error
 }
 
 func (rsp *response) Error() error {
@@ -117,6 +120,27 @@ func (rsp *response) SetData(data []byte) {
 	rsp.data = data
 }
 
+// Write appends to the data, and for the caller of CallTo the full chunks
+// are written out as they fill, so that the body is never held as a whole.
+func (rsp *response) Write(p []byte) (int, error) {
+	if rsp.chunkErr != nil {
+		return 0, rsp.chunkErr
+	}
+	rsp.data = append(rsp.data, p...)
+	if rsp.writeChunk == nil {
+		return len(p), nil
+	}
+	for len(rsp.data) > responseChunkSize {
+		if err := rsp.writeChunk(rsp.data[:responseChunkSize]); err != nil {
+			rsp.chunkErr = err
+			return 0, err
+		}
+		// the chunk written still refers to the old array
+		rsp.data = append([]byte(nil), rsp.data[responseChunkSize:]...)
+	}
+	return len(p), nil
+}
+
 func (rsp *response) SetCustom(data []byte) {
 	rsp.custom = data
 }
@@ -139,16 +163,22 @@ type message struct {
 	streamID uint64
 	topic    string
 	// meta
-	timeout time.Duration
-	cnss    options.Cnss
+	timeout        time.Duration
+	cnss           options.Cnss
+	idempotencyKey string
 	// we need stream to handle ack
 	sm *stream
+	// set if received with visibility
+	peek *peek
 }
 
 func (msg *message) Error(err error) error {
 	if msg.sm == nil {
 		return errors.New("message' stream is nil")
 	}
+	if msg.peek != nil && !msg.peek.settle() {
+		return ErrVisibilityExpired
+	}
 	return msg.sm.ackMessage(msg.id, err)
 }
 
@@ -156,6 +186,9 @@ func (msg *message) Done() error {
 	if msg.sm == nil {
 		return errors.New("message' stream is nil")
 	}
+	if msg.peek != nil && !msg.peek.settle() {
+		return ErrVisibilityExpired
+	}
 	return msg.sm.ackMessage(msg.id, nil)
 }
 
@@ -191,6 +224,10 @@ func (msg *message) Custom() []byte {
 	return msg.custom
 }
 
+func (msg *message) IdempotencyKey() string {
+	return msg.idempotencyKey
+}
+
 func (msg *message) SetTimeout(timeout time.Duration) {
 	msg.timeout = timeout
 }
@@ -203,6 +240,10 @@ func (msg *message) SetTopic(topic string) {
 	msg.topic = topic
 }
 
+func (msg *message) SetIdempotencyKey(key string) {
+	msg.idempotencyKey = key
+}
+
 func (msg *message) SetClientID(clientID uint64) {
 	msg.clientID = clientID
 }
@@ -0,0 +1,25 @@
+package client
+
+import (
+	"crypto/tls"
+	"net"
+)
+
+// NewTLSDialer returns a Dialer dialing TLS connections with the config,
+// if resumption is true, session tickets are cached and shared by all
+// connections from the Dialer, so that reconnects of RetryEnd resume the
+// previous TLS session rather than doing a full handshake.
+func NewTLSDialer(network, address string, config *tls.Config, resumption bool) Dialer {
+	cfg := &tls.Config{}
+	if config != nil {
+		cfg = config.Clone()
+	}
+	if !resumption {
+		cfg.ClientSessionCache = nil
+	} else if cfg.ClientSessionCache == nil {
+		cfg.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+	}
+	return func() (net.Conn, error) {
+		return tls.Dial(network, address, cfg)
+	}
+}
@@ -1,13 +1,14 @@
 package client
 
 import (
+	"crypto/tls"
 	"net"
+	"time"
 
 	"github.com/singchia/geminio"
 	"github.com/singchia/geminio/application"
 	"github.com/singchia/geminio/conn"
 	"github.com/singchia/geminio/multiplexer"
-	"github.com/singchia/go-timer/v2"
 )
 
 type Dialer func() (net.Conn, error)
@@ -15,9 +16,31 @@ type Dialer func() (net.Conn, error)
 type clientEnd struct {
 	// we need the opts to hold resources to close
 	opts *EndOptions
+	// to tell which conn goes offline
+	cn conn.Conn
 	geminio.End
 }
 
+// PeerVersion returns the protocol version the server advertised
+func (end *clientEnd) PeerVersion() int {
+	return end.cn.PeerVersion()
+}
+
+// PeerCapabilities returns the capabilities the server advertised
+func (end *clientEnd) PeerCapabilities() []string {
+	return end.cn.PeerCapabilities()
+}
+
+// PeerClockSkew returns how far the server's clock is ahead of ours
+func (end *clientEnd) PeerClockSkew() time.Duration {
+	return end.cn.PeerClockSkew()
+}
+
+// Compression returns the name of the compressor negotiated with the server
+func (end *clientEnd) Compression() string {
+	return end.cn.Compression()
+}
+
 func NewEnd(network, address string, opts ...*EndOptions) (geminio.End, error) {
 	// connection
 	netcn, err := net.Dial(network, address)
@@ -35,6 +58,12 @@ func NewEndWithDialer(dialer Dialer, opts ...*EndOptions) (geminio.End, error) {
 	return new(netcn, opts...)
 }
 
+// NewEndWithTLS dials the TLS connection with the config, and the End is
+// established after the TLS handshake.
+func NewEndWithTLS(network, address string, config *tls.Config, opts ...*EndOptions) (geminio.End, error) {
+	return NewEndWithDialer(NewTLSDialer(network, address, config, false), opts...)
+}
+
 func NewEndWithConn(conn net.Conn, opts ...*EndOptions) (geminio.End, error) {
 	return new(conn, opts...)
 }
@@ -47,7 +76,7 @@ func new(netcn net.Conn, opts ...*EndOptions) (geminio.End, error) {
 		opts: eo,
 	}
 	if eo.Timer == nil {
-		eo.Timer = timer.NewTimer()
+		eo.Timer = eo.newTimer()
 		eo.TimerOwner = ce
 	}
 
@@ -65,6 +94,10 @@ func new(netcn net.Conn, opts ...*EndOptions) (geminio.End, error) {
 	)
 	// we share packet factory, log, timer and delegate for follow 3 layers.
 
+	if eo.MetaFunc != nil {
+		// the latest meta for every connecting
+		eo.Meta = eo.MetaFunc()
+	}
 	// connection layer
 	cnOpts = []conn.ClientConnOption{
 		conn.OptionClientConnPacketFactory(eo.PacketFactory),
@@ -76,6 +109,20 @@ func new(netcn net.Conn, opts ...*EndOptions) (geminio.End, error) {
 	if eo.ClientID != nil {
 		cnOpts = append(cnOpts, conn.OptionClientConnClientID(*eo.ClientID))
 	}
+	if eo.BandwidthLimit != nil {
+		cnOpts = append(cnOpts, conn.OptionClientConnBandwidthLimit(
+			eo.BandwidthLimit.BytesPerSec, eo.BandwidthLimit.Burst))
+	}
+	if eo.DropObserver != nil {
+		cnOpts = append(cnOpts, conn.OptionClientConnDropObserver(eo.DropObserver))
+	}
+	if eo.Capabilities != nil {
+		cnOpts = append(cnOpts, conn.OptionClientConnCapabilities(eo.Capabilities...))
+	}
+	if eo.Compression != nil {
+		cnOpts = append(cnOpts, conn.OptionClientConnCompression(eo.Compression.Threshold,
+			eo.Compression.Compressors...))
+	}
 	cn, err = conn.NewClientConn(netcn, cnOpts...)
 	if err != nil {
 		goto ERR
@@ -88,6 +135,16 @@ func new(netcn net.Conn, opts ...*EndOptions) (geminio.End, error) {
 		multiplexer.OptionTimer(eo.Timer),
 		multiplexer.OptionMultiplexerAcceptDialogue(),
 	}
+	if eo.WriteCoalesce != nil {
+		mpOpts = append(mpOpts, multiplexer.OptionMultiplexerWriteCoalesce(
+			eo.WriteCoalesce.Delay, eo.WriteCoalesce.Size))
+	}
+	if eo.AuditSink != nil {
+		mpOpts = append(mpOpts, multiplexer.OptionMultiplexerAuditSink(eo.AuditSink))
+	}
+	if eo.DropObserver != nil {
+		mpOpts = append(mpOpts, multiplexer.OptionMultiplexerDropObserver(eo.DropObserver))
+	}
 	mp, err = multiplexer.NewDialogueMgr(cn, mpOpts...)
 	if err != nil {
 		goto ERR
@@ -104,11 +161,34 @@ func new(netcn net.Conn, opts ...*EndOptions) (geminio.End, error) {
 	if eo.RemoteMethodCheck {
 		epOpts = append(epOpts, application.OptionWithRemoteRPCCheck())
 	}
+	if eo.Keepalive != nil {
+		epOpts = append(epOpts, application.OptionKeepalive(eo.Keepalive.Interval,
+			eo.Keepalive.Timeout, eo.Keepalive.Payload))
+	}
+	if eo.WorkerPool != nil {
+		epOpts = append(epOpts, application.OptionWorkerPool(eo.WorkerPool.Size,
+			eo.WorkerPool.Queue, eo.WorkerPool.Policy))
+	}
+	if eo.FiniGrace != nil {
+		epOpts = append(epOpts, application.OptionFiniGrace(*eo.FiniGrace))
+	}
+	if eo.DropObserver != nil {
+		epOpts = append(epOpts, application.OptionDropObserver(eo.DropObserver))
+	}
+	if eo.AckAggregation != nil {
+		epOpts = append(epOpts, application.OptionAckAggregation(eo.AckAggregation.Count,
+			eo.AckAggregation.Interval))
+	}
+	if eo.MessageRetransmit != nil {
+		epOpts = append(epOpts, application.OptionMessageRetransmit(eo.MessageRetransmit.Interval,
+			eo.MessageRetransmit.Attempts))
+	}
 	ep, err = application.NewEnd(cn, mp, epOpts...)
 	if err != nil {
 		goto ERR
 	}
 	// client
+	ce.cn = cn
 	ce.End = ep
 	return ce, nil
 ERR:
@@ -1,10 +1,14 @@
 package client
 
 import (
+	"time"
+
 	"github.com/jumboframes/armorigo/log"
 
 	"github.com/singchia/geminio"
+	"github.com/singchia/geminio/application"
 	"github.com/singchia/geminio/delegate"
+	"github.com/singchia/geminio/multiplexer"
 	"github.com/singchia/geminio/packet"
 	"github.com/singchia/geminio/pkg/id"
 	"github.com/singchia/go-timer/v2"
@@ -19,9 +23,72 @@ type EndOptions struct {
 	delegate          delegate.ClientDelegate
 	ClientID          *uint64
 	Meta              []byte
+	MetaFunc          func() []byte
 	RemoteMethods     []string
 	RemoteMethodCheck bool
 	LocalMethods      []*geminio.MethodRPC
+	Keepalive         *Keepalive
+	WorkerPool        *WorkerPool
+	WriteCoalesce     *WriteCoalesce
+	FiniGrace         *time.Duration
+	BandwidthLimit    *BandwidthLimit
+	TimerGranularity  *time.Duration
+	AuditSink         multiplexer.AuditSink
+	DropObserver      packet.DropObserver
+	AckAggregation    *AckAggregation
+	MessageRetransmit *MessageRetransmit
+	Capabilities      []string
+	Compression       *Compression
+}
+
+// AckAggregation batches the acks of received messages, they are flushed
+// once Count of them pending or Interval passed since the first pending.
+type AckAggregation struct {
+	Count    int
+	Interval time.Duration
+}
+
+// MessageRetransmit resends the unacked messages every Interval, until sent
+// Attempts times in total.
+type MessageRetransmit struct {
+	Interval time.Duration
+	Attempts int
+}
+
+// Compression is negotiated with the peer at connecting, the best of the
+// Compressors in common compresses the message data reaching Threshold.
+type Compression struct {
+	Threshold   int
+	Compressors []byte
+}
+
+// WriteCoalesce holds data packets of the bulk streams for at most Delay,
+// and writes them down together, Size limits the packets of a batch.
+type WriteCoalesce struct {
+	Delay time.Duration
+	Size  int
+}
+
+// BandwidthLimit caps the bytes written per second of the conn, Burst is
+// the bytes allowed at once.
+type BandwidthLimit struct {
+	BytesPerSec int
+	Burst       int
+}
+
+// WorkerPool bounds the goroutines running local RPCs
+type WorkerPool struct {
+	Size   int
+	Queue  int
+	Policy application.WorkerPoolPolicy
+}
+
+// Keepalive is the application level keepalive, which is distinct from the
+// conn heartbeat, for middleboxes requiring application layer traffic.
+type Keepalive struct {
+	Interval time.Duration
+	Timeout  time.Duration
+	Payload  []byte
 }
 
 func (eo *EndOptions) SetTimer(timer timer.Timer) {
@@ -29,6 +96,20 @@ func (eo *EndOptions) SetTimer(timer timer.Timer) {
 	eo.TimerOwner = nil
 }
 
+// SetTimerGranularity sets the tick granularity of the timer created by the
+// End, the default is 10ms, it takes no effect with SetTimer. Timeouts are
+// rounded up to whole ticks and fire within one tick past due.
+func (eo *EndOptions) SetTimerGranularity(granularity time.Duration) {
+	eo.TimerGranularity = &granularity
+}
+
+func (eo *EndOptions) newTimer() timer.Timer {
+	if eo.TimerGranularity == nil || *eo.TimerGranularity <= 0 {
+		return timer.NewTimer()
+	}
+	return timer.NewTimer(timer.WithTimeInterval(*eo.TimerGranularity))
+}
+
 func (eo *EndOptions) setTimer(timer timer.Timer, owner interface{}) {
 	eo.Timer = timer
 	eo.TimerOwner = owner
@@ -54,6 +135,12 @@ func (eo *EndOptions) SetMeta(meta []byte) {
 	eo.Meta = meta
 }
 
+// SetMetaFunc sets the function to get meta at every connecting, including
+// reconnecting of RetryEnd, it's prior to SetMeta.
+func (eo *EndOptions) SetMetaFunc(fn func() []byte) {
+	eo.MetaFunc = fn
+}
+
 func (eo *EndOptions) SetWaitRemoteRPCs(methods ...string) {
 	eo.RemoteMethods = methods
 }
@@ -66,6 +153,103 @@ func (eo *EndOptions) SetRegisterLocalRPCs(methodRPCs ...*geminio.MethodRPC) {
 	eo.LocalMethods = methodRPCs
 }
 
+// SetKeepalive sets the End to call a lightweight RPC with the payload after
+// being idle for the interval, a missing reply in the timeout is seen as a
+// failed connection, and RetryEnd would reconnect.
+func (eo *EndOptions) SetKeepalive(interval, timeout time.Duration, payload []byte) {
+	eo.Keepalive = &Keepalive{
+		Interval: interval,
+		Timeout:  timeout,
+		Payload:  payload,
+	}
+}
+
+// SetWorkerPool sets local RPCs to be run by size workers, at most queue
+// requests wait for a free worker, and the policy decides whether to block
+// the stream or reply application.ErrServerBusy when the queue is full.
+func (eo *EndOptions) SetWorkerPool(size, queue int, policy application.WorkerPoolPolicy) {
+	eo.WorkerPool = &WorkerPool{
+		Size:   size,
+		Queue:  queue,
+		Policy: policy,
+	}
+}
+
+// SetAckAggregation batches the acks of received messages into one ack
+// packet, the batch is flushed once count acks pending or interval passed
+// since the first pending, whichever comes first. The peer must know the
+// batched acks.
+func (eo *EndOptions) SetAckAggregation(count int, interval time.Duration) {
+	eo.AckAggregation = &AckAggregation{
+		Count:    count,
+		Interval: interval,
+	}
+}
+
+// SetMessageRetransmit resends the at-least-once messages not acked in
+// interval, the publish fails after attempts sends in total, a non-positive
+// attempts means no limit but the publish's timeout. The consumer may see
+// a message more than once.
+func (eo *EndOptions) SetMessageRetransmit(interval time.Duration, attempts int) {
+	eo.MessageRetransmit = &MessageRetransmit{
+		Interval: interval,
+		Attempts: attempts,
+	}
+}
+
+// SetWriteCoalesce sets data packets of streams to be held for at most delay
+// and written down together, a batch reaching size packets is written at
+// once, streams opened with SetInteractive are never coalesced.
+func (eo *EndOptions) SetWriteCoalesce(delay time.Duration, size int) {
+	eo.WriteCoalesce = &WriteCoalesce{
+		Delay: delay,
+		Size:  size,
+	}
+}
+
+// SetBandwidthLimit caps the aggregate bytes written per second across all
+// streams of the End, conn and session control packets are exempt.
+func (eo *EndOptions) SetBandwidthLimit(bytesPerSec, burst int) {
+	eo.BandwidthLimit = &BandwidthLimit{
+		BytesPerSec: bytesPerSec,
+		Burst:       burst,
+	}
+}
+
+// SetAuditSink records every stream opened and closed of the End to sink,
+// the default stream excluded, it's off by default.
+func (eo *EndOptions) SetAuditSink(sink multiplexer.AuditSink) {
+	eo.AuditSink = sink
+}
+
+// SetDropObserver notifies observer of every packet dropped intentionally,
+// along with the reason, direction and streamID.
+func (eo *EndOptions) SetDropObserver(observer packet.DropObserver) {
+	eo.DropObserver = observer
+}
+
+// SetCapabilities advertises the capabilities to the server at connecting,
+// the server's delegate may reject the End by them.
+func (eo *EndOptions) SetCapabilities(capabilities ...string) {
+	eo.Capabilities = capabilities
+}
+
+// SetCompression compresses the message data reaching threshold by the best
+// of the compressors the server supports too, it's advertised along with
+// the capabilities. See the End's Compression for the one negotiated.
+func (eo *EndOptions) SetCompression(threshold int, compressors ...byte) {
+	eo.Compression = &Compression{
+		Threshold:   threshold,
+		Compressors: compressors,
+	}
+}
+
+// SetFiniGrace keeps buffered data of a dismissed stream readable for at
+// most grace before the stream finishes.
+func (eo *EndOptions) SetFiniGrace(grace time.Duration) {
+	eo.FiniGrace = &grace
+}
+
 func NewEndOptions() *EndOptions {
 	return &EndOptions{}
 }
@@ -93,6 +277,9 @@ func MergeEndOptions(opts ...*EndOptions) *EndOptions {
 		if opt.Meta != nil {
 			eo.Meta = opt.Meta
 		}
+		if opt.MetaFunc != nil {
+			eo.MetaFunc = opt.MetaFunc
+		}
 		if opt.ClientID != nil {
 			eo.ClientID = opt.ClientID
 		}
@@ -102,6 +289,42 @@ func MergeEndOptions(opts ...*EndOptions) *EndOptions {
 		if opt.LocalMethods != nil {
 			eo.LocalMethods = opt.LocalMethods
 		}
+		if opt.Keepalive != nil {
+			eo.Keepalive = opt.Keepalive
+		}
+		if opt.WorkerPool != nil {
+			eo.WorkerPool = opt.WorkerPool
+		}
+		if opt.WriteCoalesce != nil {
+			eo.WriteCoalesce = opt.WriteCoalesce
+		}
+		if opt.AckAggregation != nil {
+			eo.AckAggregation = opt.AckAggregation
+		}
+		if opt.MessageRetransmit != nil {
+			eo.MessageRetransmit = opt.MessageRetransmit
+		}
+		if opt.FiniGrace != nil {
+			eo.FiniGrace = opt.FiniGrace
+		}
+		if opt.BandwidthLimit != nil {
+			eo.BandwidthLimit = opt.BandwidthLimit
+		}
+		if opt.TimerGranularity != nil {
+			eo.TimerGranularity = opt.TimerGranularity
+		}
+		if opt.AuditSink != nil {
+			eo.AuditSink = opt.AuditSink
+		}
+		if opt.DropObserver != nil {
+			eo.DropObserver = opt.DropObserver
+		}
+		if opt.Capabilities != nil {
+			eo.Capabilities = opt.Capabilities
+		}
+		if opt.Compression != nil {
+			eo.Compression = opt.Compression
+		}
 	}
 	return eo
 }
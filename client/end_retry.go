@@ -2,6 +2,7 @@ package client
 
 import (
 	"context"
+	"errors"
 	"io"
 	"net"
 	"sync"
@@ -10,9 +11,9 @@ import (
 	"unsafe"
 
 	"github.com/singchia/geminio"
+	"github.com/singchia/geminio/application"
 	"github.com/singchia/geminio/delegate"
 	"github.com/singchia/geminio/options"
-	"github.com/singchia/go-timer/v2"
 )
 
 type RetryEnd struct {
@@ -29,11 +30,21 @@ type RetryEnd struct {
 	dialer Dialer
 
 	// rpcs for re-register
-	rpcs   map[string]geminio.RPC
-	rpcMtx sync.RWMutex
+	rpcs       map[string]geminio.RPC
+	streamRPCs map[string]geminio.StreamRPC
+	rpcMtx     sync.RWMutex
 	// hijack
 	hijackRPCOpts *options.HijackOptions
 	hijackRPC     geminio.HijackRPC
+	// quiesce state to keep after reconnected
+	quiescing int32
+	// default request timeout in nanoseconds to keep after reconnected
+	defaultRequestTimeout int64
+	// *error the ReconnectDecider gave up at
+	giveup unsafe.Pointer
+	// streams to reopen after reconnected or migrated, key: streamID
+	streams   map[uint64]*options.OpenStreamOptions
+	streamMtx sync.Mutex
 }
 
 func NewRetryEndWithDialer(dialer Dialer, opts ...*RetryEndOptions) (geminio.End, error) {
@@ -48,9 +59,11 @@ func NewRetryEndWithDialer(dialer Dialer, opts ...*RetryEndOptions) (geminio.End
 		ok:                    &ok,
 		onceClose:             &sync.Once{},
 		rpcs:                  make(map[string]geminio.RPC),
+		streamRPCs:            make(map[string]geminio.StreamRPC),
+		streams:               make(map[uint64]*options.OpenStreamOptions),
 	}
 	if eo.Timer == nil {
-		eo.Timer = timer.NewTimer()
+		eo.Timer = eo.newTimer()
 		eo.TimerOwner = re
 	}
 
@@ -76,10 +89,11 @@ func (re *RetryEnd) getEnd() (*clientEnd, error) {
 	if err != nil {
 		return nil, err
 	}
+	new := end.(*clientEnd)
 	if re.opts.delegate != nil {
-		re.opts.delegate.ConnOnline(end)
+		re.opts.delegate.ConnOnline(new)
 	}
-	return end.(*clientEnd), nil
+	return new, nil
 }
 
 func (re *RetryEnd) reinit(old *clientEnd) error {
@@ -87,6 +101,9 @@ func (re *RetryEnd) reinit(old *clientEnd) error {
 	re.retry.Lock()
 	defer re.retry.Unlock()
 
+	if giveup := atomic.LoadPointer(&re.giveup); giveup != nil {
+		return *(*error)(giveup)
+	}
 	cur := (*clientEnd)(atomic.LoadPointer(&re.end))
 	if cur != old {
 		// already reinited
@@ -105,15 +122,53 @@ func (re *RetryEnd) reinit(old *clientEnd) error {
 	if err != nil {
 		// if we still get end error, deliver the error to user, but it
 		// doesn't mean to close the end
+		if re.opts.ReconnectDecider != nil && !re.opts.ReconnectDecider(err) {
+			re.opts.Log.Infof("retry client gives up reconnecting: %s", err)
+			atomic.StorePointer(&re.giveup, unsafe.Pointer(&err))
+		}
 		return err
 	}
 	atomic.StorePointer(&re.end, unsafe.Pointer(new))
 	// TODO optimize rests
 	time.Sleep(1 * time.Second)
 
+	// TODO inconsistency for the context
+	err = re.replay(context.TODO(), new)
+	if err != nil {
+		return err
+	}
+	streams := re.takeStreams()
+	if re.opts.ResumeStreams {
+		re.resume(new, streams)
+	}
+	// after retry the end succeed, after hijack and register legacy functions,
+	// the brand new end online
+	if re.opts.delegate != nil {
+		re.opts.delegate.EndReOnline(new)
+	}
+	return nil
+}
+
+func (re *RetryEnd) givenUp() bool {
+	return atomic.LoadPointer(&re.giveup) != nil
+}
+
+// unusable returns io.EOF after closed, or the error given up reconnecting at
+func (re *RetryEnd) unusable() error {
+	if atomic.LoadInt32(re.ok) != 1 {
+		return io.EOF
+	}
+	if giveup := atomic.LoadPointer(&re.giveup); giveup != nil {
+		return *(*error)(giveup)
+	}
+	return nil
+}
+
+// replay the hijack, legacy functions and states to the new end
+func (re *RetryEnd) replay(ctx context.Context, new *clientEnd) error {
 	// hijack
 	if re.hijackRPC != nil {
-		err = new.Hijack(re.hijackRPC, re.hijackRPCOpts)
+		err := new.Hijack(re.hijackRPC, re.hijackRPCOpts)
 		if err != nil {
 			return err
 		}
@@ -121,21 +176,97 @@ func (re *RetryEnd) reinit(old *clientEnd) error {
 	// register legacy functions
 	re.rpcMtx.RLock()
 	for method, rpc := range re.rpcs {
-		// TODO inconsistency for the context
-		err = re.register(context.TODO(), method, rpc, false)
+		err := new.Register(ctx, method, rpc)
+		if err != nil {
+			re.rpcMtx.RUnlock()
+			return err
+		}
+	}
+	for method, rpc := range re.streamRPCs {
+		err := new.RegisterStream(ctx, method, rpc)
 		if err != nil {
 			re.rpcMtx.RUnlock()
 			return err
 		}
 	}
 	re.rpcMtx.RUnlock()
+	if atomic.LoadInt32(&re.quiescing) == 1 {
+		new.Quiesce()
+	}
+	new.SetDefaultRequestTimeout(time.Duration(atomic.LoadInt64(&re.defaultRequestTimeout)))
+	return nil
+}
 
-	// after retry the end succeed, after hijack and register legacy functions,
-	// the brand new end online
+// takeStreams hands the streams tracked out and tracks those of the new end,
+// so that the old streams going offline don't untrack the reopened ones
+func (re *RetryEnd) takeStreams() map[uint64]*options.OpenStreamOptions {
+	re.streamMtx.Lock()
+	defer re.streamMtx.Unlock()
+	streams := re.streams
+	re.streams = make(map[uint64]*options.OpenStreamOptions)
+	return streams
+}
+
+// resume reopens the streams with their streamIDs to the new end
+func (re *RetryEnd) resume(new *clientEnd, streams map[uint64]*options.OpenStreamOptions) {
+	re.streamMtx.Lock()
+	defer re.streamMtx.Unlock()
+	for streamID, oo := range streams {
+		resume := options.OpenStream()
+		resume.SetResume(streamID)
+		sm, err := new.OpenStream(oo, resume)
+		if err != nil {
+			re.opts.Log.Infof("retry client resume stream err: %s, streamID: %d", err, streamID)
+			continue
+		}
+		if sm.StreamID() != streamID {
+			re.opts.Log.Infof("retry client stream resumed to a new streamID: %d, old streamID: %d",
+				sm.StreamID(), streamID)
+		}
+		re.streams[sm.StreamID()] = oo
+	}
+}
+
+// Migrate hands the End off to a new conn from dialer without dropping
+// in-flight work. The hijack, registrations and states are replayed to the
+// new conn before new calls go to it, then the old conn is closed after its
+// in-flight requests drained and the data written to its streams flushed.
+// The streams opened by the End are reopened to the new conn as ResumeStreams
+// does, get them by ListStreams after EndReOnline. The dialer is kept for the
+// later reconnections.
+func (re *RetryEnd) Migrate(ctx context.Context, dialer Dialer) error {
+	if atomic.LoadInt32(re.ok) != 1 {
+		return io.EOF
+	}
+	re.retry.Lock()
+	defer re.retry.Unlock()
+
+	end, err := NewEndWithDialer(dialer, re.opts.EndOptions)
+	if err != nil {
+		return err
+	}
+	new := end.(*clientEnd)
+	if re.opts.delegate != nil {
+		re.opts.delegate.ConnOnline(new)
+	}
+	err = re.replay(ctx, new)
+	if err != nil {
+		new.Close()
+		return err
+	}
+	re.dialer = dialer
+	// a new dialer deserves reconnecting again
+	atomic.StorePointer(&re.giveup, nil)
+	old := (*clientEnd)(atomic.SwapPointer(&re.end, unsafe.Pointer(new)))
+	// the old conn keeps serving until the in-flight requests done
+	err = old.End.(*application.End).Drain(ctx)
+	streams := re.takeStreams()
+	old.Close()
+	re.resume(new, streams)
 	if re.opts.delegate != nil {
 		re.opts.delegate.EndReOnline(new)
 	}
-	return nil
+	return err
 }
 
 // wrappered delegate
@@ -148,6 +279,8 @@ func (re *RetryEnd) ConnOnline(conn delegate.ConnDescriber) error {
 }
 
 func (re *RetryEnd) ConnOffline(conn delegate.ConnDescriber) error {
+	cur := (*clientEnd)(atomic.LoadPointer(&re.end))
+	migrated := cur != nil && delegate.ConnDescriber(cur.cn) != conn
 	delegate := re.opts.delegate
 	if delegate != nil {
 		// The offline is just a notification, we're still keep on trying reconnct
@@ -156,12 +289,19 @@ func (re *RetryEnd) ConnOffline(conn delegate.ConnDescriber) error {
 			return err
 		}
 	}
+	if migrated {
+		// the End already moved to another conn, no need to retry
+		return nil
+	}
 	fn := func() {
 		for atomic.LoadInt32(re.ok) == 1 {
 			end := (*clientEnd)(atomic.LoadPointer(&re.end))
 			err := re.reinit(end)
 			if err != nil {
 				re.opts.Log.Infof("retry client offline and retry failed: %s", err)
+				if re.givenUp() {
+					return
+				}
 				continue
 			}
 			re.opts.Log.Infof("retry client offline and retry succeed")
@@ -181,10 +321,14 @@ func (re *RetryEnd) DialogueOnline(dialogue delegate.DialogueDescriber) error {
 	return nil
 }
 
-func (re *RetryEnd) DialogueOffline(dialogue delegate.DialogueDescriber) error {
+func (re *RetryEnd) DialogueOffline(dialogue delegate.DialogueDescriber, reason delegate.DialogueCloseReason) error {
+	// closed rather than broken with the conn, which never comes here
+	re.streamMtx.Lock()
+	delete(re.streams, dialogue.DialogueID())
+	re.streamMtx.Unlock()
 	delegate := re.opts.delegate
 	if delegate != nil {
-		return delegate.DialogueOffline(dialogue)
+		return delegate.DialogueOffline(dialogue, reason)
 	}
 	return nil
 }
@@ -201,19 +345,18 @@ func (re *RetryEnd) GetClientID(meta []byte) (uint64, error) { return 0, nil }
 
 // Multiplexer
 func (re *RetryEnd) OpenStream(opts ...*options.OpenStreamOptions) (geminio.Stream, error) {
-	if atomic.LoadInt32(re.ok) != 1 {
-		// TODO optimize the error
-		return nil, io.EOF
+	if err := re.unusable(); err != nil {
+		return nil, err
 	}
 	cur := (*clientEnd)(atomic.LoadPointer(&re.end))
 	sm, oerr := cur.OpenStream(opts...)
 	if oerr != nil {
-		if oerr == io.EOF && atomic.LoadInt32(re.ok) == 1 {
+		if errors.Is(oerr, io.EOF) && atomic.LoadInt32(re.ok) == 1 {
 			// under layer EOF but not closed, we should retry the end,
 			// pass the old end for comparition
 			ierr := re.reinit(cur)
 			if ierr != nil {
-				if ierr == io.EOF {
+				if errors.Is(ierr, io.EOF) {
 					// reinit should only return io.EOF aflter RetryEnd Close
 					re.opts.Log.Infof("reinit got io.EOF after Call err: %s", oerr)
 					return nil, ierr
@@ -226,23 +369,26 @@ func (re *RetryEnd) OpenStream(opts ...*options.OpenStreamOptions) (geminio.Stre
 		}
 		return nil, oerr
 	}
+	// tracked for Migrate even if not resumed after reconnected
+	re.streamMtx.Lock()
+	re.streams[sm.StreamID()] = options.MergeOpenStreamOptions(opts...)
+	re.streamMtx.Unlock()
 	return sm, nil
 }
 
 func (re *RetryEnd) AcceptStream() (geminio.Stream, error) {
-	if atomic.LoadInt32(re.ok) != 1 {
-		// TODO optimize the error
-		return nil, io.EOF
+	if err := re.unusable(); err != nil {
+		return nil, err
 	}
 	cur := (*clientEnd)(atomic.LoadPointer(&re.end))
 	sm, aerr := cur.AcceptStream()
 	if aerr != nil {
-		if aerr == io.EOF && atomic.LoadInt32(re.ok) == 1 {
+		if errors.Is(aerr, io.EOF) && atomic.LoadInt32(re.ok) == 1 {
 			// under layer EOF but not closed, we should retry the end,
 			// pass the old end for comparition
 			ierr := re.reinit(cur)
 			if ierr != nil {
-				if ierr == io.EOF {
+				if errors.Is(ierr, io.EOF) {
 					// reinit should only return io.EOF aflter RetryEnd Close
 					re.opts.Log.Infof("reinit got io.EOF after AcceptStream err: %s", aerr)
 					return nil, ierr
@@ -279,19 +425,18 @@ func (re *RetryEnd) NewRequest(data []byte, opts ...*options.NewRequestOptions)
 
 func (re *RetryEnd) Call(ctx context.Context, method string, req geminio.Request,
 	opts ...*options.CallOptions) (geminio.Response, error) {
-	if atomic.LoadInt32(re.ok) != 1 {
-		// TODO optimize the error
-		return nil, io.EOF
+	if err := re.unusable(); err != nil {
+		return nil, err
 	}
 	cur := (*clientEnd)(atomic.LoadPointer(&re.end))
 	rsp, cerr := cur.Call(ctx, method, req, opts...)
 	if cerr != nil {
-		if cerr == io.EOF && atomic.LoadInt32(re.ok) == 1 {
+		if errors.Is(cerr, io.EOF) && atomic.LoadInt32(re.ok) == 1 {
 			// under layer EOF but not closed, we should retry the end,
 			// pass the old end for comparition
 			ierr := re.reinit(cur)
 			if ierr != nil {
-				if ierr == io.EOF {
+				if errors.Is(ierr, io.EOF) {
 					// reinit should only return io.EOF aflter RetryEnd Close
 					re.opts.Log.Infof("reinit got io.EOF after Call err: %s", cerr)
 					return nil, ierr
@@ -307,21 +452,107 @@ func (re *RetryEnd) Call(ctx context.Context, method string, req geminio.Request
 	return rsp, nil
 }
 
-func (re *RetryEnd) CallAsync(ctx context.Context, method string, req geminio.Request, ch chan *geminio.Call,
-	opts ...*options.CallOptions) (*geminio.Call, error) {
+func (re *RetryEnd) CallDedup(ctx context.Context, method string, req geminio.Request,
+	opts ...*options.CallOptions) (geminio.Response, error) {
 	if atomic.LoadInt32(re.ok) != 1 {
-		// TODO optimize the error
 		return nil, io.EOF
 	}
 	cur := (*clientEnd)(atomic.LoadPointer(&re.end))
+	rsp, cerr := cur.CallDedup(ctx, method, req, opts...)
+	if cerr != nil {
+		if errors.Is(cerr, io.EOF) && atomic.LoadInt32(re.ok) == 1 {
+			// the same as Call, retry after the end reinited
+			ierr := re.reinit(cur)
+			if ierr != nil {
+				return nil, ierr
+			}
+			return re.CallDedup(ctx, method, req, opts...)
+		}
+		return nil, cerr
+	}
+	return rsp, nil
+}
+
+// countWriter counts the written bytes to tell if CallTo can be retried
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+func (re *RetryEnd) CallTo(ctx context.Context, method string, req geminio.Request, w io.Writer,
+	opts ...*options.CallOptions) error {
+	if err := re.unusable(); err != nil {
+		return err
+	}
+	cur := (*clientEnd)(atomic.LoadPointer(&re.end))
+	cw := &countWriter{w: w}
+	cerr := cur.CallTo(ctx, method, req, cw, opts...)
+	// a partially written response cannot be retried
+	if errors.Is(cerr, io.EOF) && cw.n == 0 && atomic.LoadInt32(re.ok) == 1 {
+		// under layer EOF but not closed, we should retry the end,
+		// pass the old end for comparition
+		ierr := re.reinit(cur)
+		if ierr != nil {
+			if errors.Is(ierr, io.EOF) {
+				// reinit should only return io.EOF aflter RetryEnd Close
+				re.opts.Log.Infof("reinit got io.EOF after CallTo err: %s", cerr)
+			}
+			// some other error, maybe ErrInvalidConn, ErrClosed
+			return ierr
+		}
+		// retry succeed, recursive the CallTo
+		return re.CallTo(ctx, method, req, w, opts...)
+	}
+	return cerr
+}
+
+// CallStream is never retried once opened, the streams of a broken conn end
+// with its error.
+func (re *RetryEnd) CallStream(ctx context.Context, method string,
+	opts ...*options.CallOptions) (geminio.StreamRequest, error) {
+	if err := re.unusable(); err != nil {
+		return nil, err
+	}
+	cur := (*clientEnd)(atomic.LoadPointer(&re.end))
+	sr, cerr := cur.CallStream(ctx, method, opts...)
+	if errors.Is(cerr, io.EOF) && atomic.LoadInt32(re.ok) == 1 {
+		// under layer EOF but not closed, we should retry the end,
+		// pass the old end for comparition
+		ierr := re.reinit(cur)
+		if ierr != nil {
+			if errors.Is(ierr, io.EOF) {
+				// reinit should only return io.EOF aflter RetryEnd Close
+				re.opts.Log.Infof("reinit got io.EOF after CallStream err: %s", cerr)
+			}
+			// some other error, maybe ErrInvalidConn, ErrClosed
+			return nil, ierr
+		}
+		// retry succeed, recursive the CallStream
+		return re.CallStream(ctx, method, opts...)
+	}
+	return sr, cerr
+}
+
+func (re *RetryEnd) CallAsync(ctx context.Context, method string, req geminio.Request, ch chan *geminio.Call,
+	opts ...*options.CallOptions) (*geminio.Call, error) {
+	if err := re.unusable(); err != nil {
+		return nil, err
+	}
+	cur := (*clientEnd)(atomic.LoadPointer(&re.end))
 	call, cerr := cur.CallAsync(ctx, method, req, ch, opts...)
 	if cerr != nil {
-		if cerr == io.EOF && atomic.LoadInt32(re.ok) == 1 {
+		if errors.Is(cerr, io.EOF) && atomic.LoadInt32(re.ok) == 1 {
 			// under layer EOF but not closed, we should retry the end,
 			// pass the old end for comparition
 			ierr := re.reinit(cur)
 			if ierr != nil {
-				if ierr == io.EOF {
+				if errors.Is(ierr, io.EOF) {
 					// reinit should only return io.EOF aflter RetryEnd Close
 					re.opts.Log.Infof("reinit got io.EOF after Callasync err: %s", cerr)
 					return nil, ierr
@@ -343,19 +574,18 @@ func (re *RetryEnd) Register(ctx context.Context, method string, rpc geminio.RPC
 
 func (re *RetryEnd) register(ctx context.Context, method string, rpc geminio.RPC,
 	memorize bool) error {
-	if atomic.LoadInt32(re.ok) != 1 {
-		// TODO optimize the error
-		return io.EOF
+	if err := re.unusable(); err != nil {
+		return err
 	}
 	cur := (*clientEnd)(atomic.LoadPointer(&re.end))
 	rerr := cur.Register(ctx, method, rpc)
 	if rerr != nil {
-		if rerr == io.EOF && atomic.LoadInt32(re.ok) == 1 {
+		if errors.Is(rerr, io.EOF) && atomic.LoadInt32(re.ok) == 1 {
 			// under layer EOF but not closed, we should retry the end,
 			// pass the old end for comparition
 			ierr := re.reinit(cur)
 			if ierr != nil {
-				if ierr == io.EOF {
+				if errors.Is(ierr, io.EOF) {
 					// reinit should only return io.EOF aflter RetryEnd Close
 					re.opts.Log.Infof("reinit got io.EOF after register err: %s", rerr)
 					return ierr
@@ -377,20 +607,50 @@ func (re *RetryEnd) register(ctx context.Context, method string, rpc geminio.RPC
 	return nil
 }
 
+func (re *RetryEnd) RegisterStream(ctx context.Context, method string, rpc geminio.StreamRPC) error {
+	if err := re.unusable(); err != nil {
+		return err
+	}
+	cur := (*clientEnd)(atomic.LoadPointer(&re.end))
+	rerr := cur.RegisterStream(ctx, method, rpc)
+	if rerr != nil {
+		if errors.Is(rerr, io.EOF) && atomic.LoadInt32(re.ok) == 1 {
+			// under layer EOF but not closed, we should retry the end,
+			// pass the old end for comparition
+			ierr := re.reinit(cur)
+			if ierr != nil {
+				if errors.Is(ierr, io.EOF) {
+					// reinit should only return io.EOF aflter RetryEnd Close
+					re.opts.Log.Infof("reinit got io.EOF after register stream err: %s", rerr)
+				}
+				// some other error, maybe ErrInvalidConn, ErrClosed
+				return ierr
+			}
+			// retry succeed, recursive the RegisterStream
+			return re.RegisterStream(ctx, method, rpc)
+		}
+		return rerr
+	}
+	// memorize the rpc in case of retry
+	re.rpcMtx.Lock()
+	re.streamRPCs[method] = rpc
+	re.rpcMtx.Unlock()
+	return nil
+}
+
 func (re *RetryEnd) Hijack(rpc geminio.HijackRPC, opts ...*options.HijackOptions) error {
-	if atomic.LoadInt32(re.ok) != 1 {
-		// TODO optimize the error
-		return io.EOF
+	if err := re.unusable(); err != nil {
+		return err
 	}
 	cur := (*clientEnd)(atomic.LoadPointer(&re.end))
 	herr := cur.Hijack(rpc, opts...)
 	if herr != nil {
-		if herr == io.EOF && atomic.LoadInt32(re.ok) == 1 {
+		if errors.Is(herr, io.EOF) && atomic.LoadInt32(re.ok) == 1 {
 			// under layer EOF but not closed, we should retry the end,
 			// pass the old end for comparition
 			ierr := re.reinit(cur)
 			if ierr != nil {
-				if ierr == io.EOF {
+				if errors.Is(ierr, io.EOF) {
 					// reinit should only return io.EOF aflter RetryEnd Close
 					re.opts.Log.Infof("reinit got io.EOF after Hijack err: %s", herr)
 					return ierr
@@ -416,19 +676,18 @@ func (re *RetryEnd) NewMessage(data []byte, opts ...*options.NewMessageOptions)
 
 func (re *RetryEnd) Publish(ctx context.Context, msg geminio.Message,
 	opts ...*options.PublishOptions) error {
-	if atomic.LoadInt32(re.ok) != 1 {
-		// TODO optimize the error
-		return io.EOF
+	if err := re.unusable(); err != nil {
+		return err
 	}
 	cur := (*clientEnd)(atomic.LoadPointer(&re.end))
 	perr := cur.Publish(ctx, msg, opts...)
 	if perr != nil {
-		if perr == io.EOF && atomic.LoadInt32(re.ok) == 1 {
+		if errors.Is(perr, io.EOF) && atomic.LoadInt32(re.ok) == 1 {
 			// under layer EOF but not closed, we should retry the end,
 			// pass the old end for comparition
 			ierr := re.reinit(cur)
 			if ierr != nil {
-				if ierr == io.EOF {
+				if errors.Is(ierr, io.EOF) {
 					// reinit should only return io.EOF aflter RetryEnd Close
 					re.opts.Log.Infof("reinit got io.EOF after Publish err: %s", perr)
 					return ierr
@@ -445,19 +704,18 @@ func (re *RetryEnd) Publish(ctx context.Context, msg geminio.Message,
 
 func (re *RetryEnd) PublishAsync(ctx context.Context, msg geminio.Message, ch chan *geminio.Publish,
 	opts ...*options.PublishOptions) (*geminio.Publish, error) {
-	if atomic.LoadInt32(re.ok) != 1 {
-		// TODO optimize the error
-		return nil, io.EOF
+	if err := re.unusable(); err != nil {
+		return nil, err
 	}
 	cur := (*clientEnd)(atomic.LoadPointer(&re.end))
 	pub, perr := cur.PublishAsync(ctx, msg, ch, opts...)
 	if perr != nil {
-		if perr == io.EOF && atomic.LoadInt32(re.ok) == 1 {
+		if errors.Is(perr, io.EOF) && atomic.LoadInt32(re.ok) == 1 {
 			// under layer EOF but not closed, we should retry the end,
 			// pass the old end for comparition
 			ierr := re.reinit(cur)
 			if ierr != nil {
-				if ierr == io.EOF {
+				if errors.Is(ierr, io.EOF) {
 					// reinit should only return io.EOF aflter RetryEnd Close
 					re.opts.Log.Infof("reinit got io.EOF after PublishAsync err: %s", perr)
 					return nil, ierr
@@ -472,20 +730,19 @@ func (re *RetryEnd) PublishAsync(ctx context.Context, msg geminio.Message, ch ch
 	return pub, nil
 }
 
-func (re *RetryEnd) Receive(ctx context.Context) (geminio.Message, error) {
-	if atomic.LoadInt32(re.ok) != 1 {
-		// TODO optimize the error
-		return nil, io.EOF
+func (re *RetryEnd) Receive(ctx context.Context, opts ...*options.ReceiveOptions) (geminio.Message, error) {
+	if err := re.unusable(); err != nil {
+		return nil, err
 	}
 	cur := (*clientEnd)(atomic.LoadPointer(&re.end))
-	msg, rerr := cur.Receive(ctx)
+	msg, rerr := cur.Receive(ctx, opts...)
 	if rerr != nil {
-		if rerr == io.EOF && atomic.LoadInt32(re.ok) == 1 {
+		if errors.Is(rerr, io.EOF) && atomic.LoadInt32(re.ok) == 1 {
 			// under layer EOF but not closed, we should retry the end,
 			// pass the old end for comparition
 			ierr := re.reinit(cur)
 			if ierr != nil {
-				if ierr == io.EOF {
+				if errors.Is(ierr, io.EOF) {
 					// reinit should only return io.EOF aflter RetryEnd Close
 					re.opts.Log.Infof("reinit got io.EOF after Receive err: %s", rerr)
 					return nil, ierr
@@ -493,7 +750,7 @@ func (re *RetryEnd) Receive(ctx context.Context) (geminio.Message, error) {
 				return nil, ierr
 			}
 			// retry succeed, recursive the Receive
-			return re.Receive(ctx)
+			return re.Receive(ctx, opts...)
 		}
 		return nil, rerr
 	}
@@ -502,19 +759,18 @@ func (re *RetryEnd) Receive(ctx context.Context) (geminio.Message, error) {
 
 // Raw
 func (re *RetryEnd) Read(b []byte) (int, error) {
-	if atomic.LoadInt32(re.ok) != 1 {
-		// TODO optimize the error
-		return 0, io.EOF
+	if err := re.unusable(); err != nil {
+		return 0, err
 	}
 	cur := (*clientEnd)(atomic.LoadPointer(&re.end))
 	n, rerr := cur.Read(b)
 	if rerr != nil {
-		if rerr == io.EOF && atomic.LoadInt32(re.ok) == 1 {
+		if errors.Is(rerr, io.EOF) && atomic.LoadInt32(re.ok) == 1 {
 			// under layer EOF but not closed, we should retry the end,
 			// pass the old end for comparition
 			ierr := re.reinit(cur)
 			if ierr != nil {
-				if ierr == io.EOF {
+				if errors.Is(ierr, io.EOF) {
 					// reinit should only return io.EOF aflter RetryEnd Close
 					re.opts.Log.Infof("reinit got io.EOF after Read err: %s", rerr)
 					return 0, ierr
@@ -530,19 +786,18 @@ func (re *RetryEnd) Read(b []byte) (int, error) {
 }
 
 func (re *RetryEnd) Write(b []byte) (int, error) {
-	if atomic.LoadInt32(re.ok) != 1 {
-		// TODO optimize the error
-		return 0, io.EOF
+	if err := re.unusable(); err != nil {
+		return 0, err
 	}
 	cur := (*clientEnd)(atomic.LoadPointer(&re.end))
 	n, werr := cur.Write(b)
 	if werr != nil {
-		if werr == io.EOF && atomic.LoadInt32(re.ok) == 1 {
+		if errors.Is(werr, io.EOF) && atomic.LoadInt32(re.ok) == 1 {
 			// under layer EOF but not closed, we should retry the end,
 			// pass the old end for comparition
 			ierr := re.reinit(cur)
 			if ierr != nil {
-				if ierr == io.EOF {
+				if errors.Is(ierr, io.EOF) {
 					// reinit should only return io.EOF aflter RetryEnd Close
 					re.opts.Log.Infof("reinit got io.EOF after Write err: %s", werr)
 					return 0, ierr
@@ -571,6 +826,40 @@ func (re *RetryEnd) Close() error {
 	return err
 }
 
+// AckStream returns the ack stream of the current End, which is closed after
+// reconnected, call it again for the new one
+func (re *RetryEnd) AckStream() <-chan uint64 {
+	cur := (*clientEnd)(atomic.LoadPointer(&re.end))
+	return cur.AckStream()
+}
+
+// MethodStats returns statistics of the current End, which is reset after reconnected
+func (re *RetryEnd) MethodStats() map[string]geminio.MethodStat {
+	cur := (*clientEnd)(atomic.LoadPointer(&re.end))
+	return cur.MethodStats()
+}
+
+// Quiesce quiesces the current End, and the End after reconnected
+func (re *RetryEnd) Quiesce() {
+	atomic.StoreInt32(&re.quiescing, 1)
+	cur := (*clientEnd)(atomic.LoadPointer(&re.end))
+	cur.Quiesce()
+}
+
+func (re *RetryEnd) Unquiesce() {
+	atomic.StoreInt32(&re.quiescing, 0)
+	cur := (*clientEnd)(atomic.LoadPointer(&re.end))
+	cur.Unquiesce()
+}
+
+// SetDefaultRequestTimeout sets the timeout to the current End, and the End
+// after reconnected
+func (re *RetryEnd) SetDefaultRequestTimeout(timeout time.Duration) {
+	atomic.StoreInt64(&re.defaultRequestTimeout, int64(timeout))
+	cur := (*clientEnd)(atomic.LoadPointer(&re.end))
+	cur.SetDefaultRequestTimeout(timeout)
+}
+
 func (re *RetryEnd) Addr() net.Addr {
 	return re.LocalAddr()
 }
@@ -592,27 +881,24 @@ func (re *RetryEnd) RemoteAddr() net.Addr {
 }
 
 func (re *RetryEnd) SetDeadline(t time.Time) error {
-	if atomic.LoadInt32(re.ok) != 1 {
-		// TODO optimize the error
-		return io.EOF
+	if err := re.unusable(); err != nil {
+		return err
 	}
 	cur := (*clientEnd)(atomic.LoadPointer(&re.end))
 	return cur.SetDeadline(t)
 }
 
 func (re *RetryEnd) SetReadDeadline(t time.Time) error {
-	if atomic.LoadInt32(re.ok) != 1 {
-		// TODO optimize the error
-		return io.EOF
+	if err := re.unusable(); err != nil {
+		return err
 	}
 	cur := (*clientEnd)(atomic.LoadPointer(&re.end))
 	return cur.SetReadDeadline(t)
 }
 
 func (re *RetryEnd) SetWriteDeadline(t time.Time) error {
-	if atomic.LoadInt32(re.ok) != 1 {
-		// TODO optimize the error
-		return io.EOF
+	if err := re.unusable(); err != nil {
+		return err
 	}
 	cur := (*clientEnd)(atomic.LoadPointer(&re.end))
 	return cur.SetWriteDeadline(t)
@@ -8,6 +8,26 @@ import (
 
 type RetryEndOptions struct {
 	*EndOptions
+	// ReconnectDecider is consulted before every next reconnect attempt
+	ReconnectDecider func(err error) bool
+	// ResumeStreams reopens the streams after reconnected
+	ResumeStreams bool
+}
+
+// SetReconnectDecider tells whether reconnecting is worth trying again after
+// a reconnect attempt failed with err, returning false stops retrying and the
+// err is returned by the End's calls then on, until it's closed. Without it
+// the End retries any errors.
+func (eo *RetryEndOptions) SetReconnectDecider(decider func(err error) bool) {
+	eo.ReconnectDecider = decider
+}
+
+// SetResumeStreams reopens the streams opened by the End after reconnected,
+// asking the server to keep their streamIDs, which are decided by the server
+// delegate's ResumeDialogue. Get the reopened streams by ListStreams after
+// EndReOnline, the ones closed before the conn broke are not reopened.
+func (eo *RetryEndOptions) SetResumeStreams(resume bool) {
+	eo.ResumeStreams = resume
 }
 
 func NewRetryEndOptions() *RetryEndOptions {
@@ -41,6 +61,9 @@ func MergeRetryEndOptions(opts ...*RetryEndOptions) *RetryEndOptions {
 		if opt.Meta != nil {
 			eo.Meta = opt.Meta
 		}
+		if opt.MetaFunc != nil {
+			eo.MetaFunc = opt.MetaFunc
+		}
 		if opt.ClientID != nil {
 			eo.ClientID = opt.ClientID
 		}
@@ -50,6 +73,48 @@ func MergeRetryEndOptions(opts ...*RetryEndOptions) *RetryEndOptions {
 		if opt.LocalMethods != nil {
 			eo.LocalMethods = opt.LocalMethods
 		}
+		if opt.Keepalive != nil {
+			eo.Keepalive = opt.Keepalive
+		}
+		if opt.WorkerPool != nil {
+			eo.WorkerPool = opt.WorkerPool
+		}
+		if opt.WriteCoalesce != nil {
+			eo.WriteCoalesce = opt.WriteCoalesce
+		}
+		if opt.AckAggregation != nil {
+			eo.AckAggregation = opt.AckAggregation
+		}
+		if opt.MessageRetransmit != nil {
+			eo.MessageRetransmit = opt.MessageRetransmit
+		}
+		if opt.FiniGrace != nil {
+			eo.FiniGrace = opt.FiniGrace
+		}
+		if opt.BandwidthLimit != nil {
+			eo.BandwidthLimit = opt.BandwidthLimit
+		}
+		if opt.TimerGranularity != nil {
+			eo.TimerGranularity = opt.TimerGranularity
+		}
+		if opt.AuditSink != nil {
+			eo.AuditSink = opt.AuditSink
+		}
+		if opt.DropObserver != nil {
+			eo.DropObserver = opt.DropObserver
+		}
+		if opt.Capabilities != nil {
+			eo.Capabilities = opt.Capabilities
+		}
+		if opt.Compression != nil {
+			eo.Compression = opt.Compression
+		}
+		if opt.ReconnectDecider != nil {
+			eo.ReconnectDecider = opt.ReconnectDecider
+		}
+		if opt.ResumeStreams {
+			eo.ResumeStreams = true
+		}
 	}
 	return eo
 }
@@ -0,0 +1,57 @@
+package conn
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// tokenBucket limits the bytes per second, a write larger than the tokens
+// left goes into debt and the writer sleeps until the debt is paid.
+type tokenBucket struct {
+	mtx    sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(bytesPerSec, burst int) *tokenBucket {
+	if burst <= 0 {
+		burst = bytesPerSec
+	}
+	return &tokenBucket{
+		rate:   float64(bytesPerSec),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+func (tb *tokenBucket) wait(n int) {
+	tb.mtx.Lock()
+	now := time.Now()
+	tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+	if tb.tokens > tb.burst {
+		tb.tokens = tb.burst
+	}
+	tb.last = now
+	tb.tokens -= float64(n)
+	debt := tb.tokens
+	tb.mtx.Unlock()
+	if debt < 0 {
+		time.Sleep(time.Duration(-debt / tb.rate * float64(time.Second)))
+	}
+}
+
+// limitedWriter charges the bucket for every write
+type limitedWriter struct {
+	w  io.Writer
+	tb *tokenBucket
+}
+
+func (lw *limitedWriter) Write(p []byte) (int, error) {
+	n, err := lw.w.Write(p)
+	lw.tb.wait(n)
+	return n, err
+}
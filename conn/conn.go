@@ -2,6 +2,7 @@ package conn
 
 import (
 	"net"
+	"time"
 
 	"github.com/singchia/geminio"
 	"github.com/singchia/geminio/packet"
@@ -23,12 +24,40 @@ type Closer interface {
 	Close()
 }
 
+type Flusher interface {
+	// Flush writes the buffered packets down to the net.Conn, it's a no-op
+	// without the write buffer.
+	Flush() error
+}
+
+type Aborter interface {
+	// Abort closes the under layer net.Conn without the close handshake,
+	// for a peer which is gone silently.
+	Abort()
+}
+
+// ProtocolVersion is advertised to the peer at connecting, it increases when
+// the peers need to tell the behaviors apart
+const ProtocolVersion = 1
+
+// the peer's clock skewed more than it is warned at connecting
+const clockSkewWarning = time.Second
+
 type ConnDescriber interface {
 	ClientID() uint64
 	Meta() []byte
 	LocalAddr() net.Addr
 	RemoteAddr() net.Addr
 	Side() geminio.Side
+	// the protocol version and capabilities the peer advertised at connecting
+	PeerVersion() int
+	PeerCapabilities() []string
+	// PeerClockSkew returns how far the peer's clock is ahead of ours,
+	// estimated at connecting, 0 if the peer didn't tell its time
+	PeerClockSkew() time.Duration
+	// Compression returns the name of the compressor negotiated at
+	// connecting, CompressionNone if none in common
+	Compression() string
 }
 
 type Conn interface {
@@ -36,6 +65,8 @@ type Conn interface {
 	ChannelReader
 	Writer
 	Closer
+	Aborter
+	Flusher
 
 	// meta
 	ConnDescriber
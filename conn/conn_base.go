@@ -1,9 +1,12 @@
 package conn
 
 import (
+	"bufio"
+	"errors"
 	"io"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/jumboframes/armorigo/log"
 	"github.com/jumboframes/armorigo/synchub"
@@ -35,6 +38,39 @@ const (
 	ET_FINI      = "fini"
 )
 
+var (
+	ErrWriteQueueOverflow = errors.New("write queue overflow")
+	ErrInvalidHighWater   = errors.New("high-water mark beyond the write queue")
+)
+
+// the read-ahead buffer size if not set
+const defaultReadBufferSize = 4096
+
+// OverflowPolicy decides what to do when the conn's write queue reaches
+// the high-water mark.
+type OverflowPolicy int
+
+const (
+	// block the writer until the queue drains, the default behavior
+	OverflowBlock OverflowPolicy = iota
+	// drop data packets but keep conn and session control packets
+	OverflowDropData
+	// disconnect the conn
+	OverflowDisconnect
+)
+
+func (policy OverflowPolicy) String() string {
+	switch policy {
+	case OverflowBlock:
+		return "block"
+	case OverflowDropData:
+		return "drop-data-keep-control"
+	case OverflowDisconnect:
+		return "disconnect"
+	}
+	return "unknown"
+}
+
 type connOpts struct {
 	clientID uint64
 	// timer
@@ -46,6 +82,24 @@ type connOpts struct {
 	meta        []byte
 	pf          packet.PacketFactory
 	log         log.Logger
+	// write queue overflow, 0 means no high-water mark
+	writeHighWater int
+	overflowPolicy OverflowPolicy
+	// read-ahead buffer size, 0 means defaultReadBufferSize
+	readBufferSize int
+	// write buffer size, 0 means write to the net.Conn directly
+	writeBufferSize int
+	// bandwidth limit on bytes written, nil means unlimited
+	writeBucket *tokenBucket
+	// observer of packets dropped intentionally
+	dropObserver packet.DropObserver
+	// version and capabilities advertised to the peer
+	version      int
+	capabilities []string
+	// compressors to negotiate by preference, and the message data shorter
+	// than the threshold isn't compressed
+	compressors       []byte
+	compressThreshold int
 	// options for future usage
 	retain bool
 	clear  bool
@@ -59,8 +113,19 @@ type baseConn struct {
 	netconn net.Conn
 	side    geminio.Side
 	onlined bool
+	// advertised by the peer
+	peerVersion      int
+	peerCapabilities []string
+	peerClockSkew    time.Duration
+	// negotiated at connecting, nil means no compression
+	compressor packet.Compressor
+	// when we advertised, the skew is estimated against the midpoint of the
+	// round trip if we advertised first
+	advertisedAt time.Time
 	// sync hub
 	shub *synchub.SyncHub
+	// nil if the write buffer disabled
+	wbuf *writeBuffer
 
 	// read write failed channel
 	readInCh, writeOutCh     chan packet.Packet // io neighbor channel
@@ -95,6 +160,23 @@ func (bc *baseConn) Write(pkt packet.Packet) error {
 	if !bc.connOK {
 		return io.EOF
 	}
+	if bc.writeHighWater > 0 && len(bc.writeInCh) >= bc.writeHighWater {
+		switch bc.overflowPolicy {
+		case OverflowDropData:
+			if !packet.ConnLayer(pkt) && !packet.SessionLayer(pkt) {
+				bc.log.Warnf("conn write queue overflow, drop data, clientID: %d, packetID: %d, packetType: %s",
+					bc.clientID, pkt.ID(), pkt.Type().String())
+				packet.NotifyDrop(bc.dropObserver, pkt, packet.DropReasonWriteQueueOverflow, packet.DirectionOut)
+				return ErrWriteQueueOverflow
+			}
+		case OverflowDisconnect:
+			bc.log.Errorf("conn write queue overflow, disconnect, clientID: %d, packetID: %d, packetType: %s",
+				bc.clientID, pkt.ID(), pkt.Type().String())
+			// the read and write goroutines will quit and then fini the conn
+			bc.netconn.Close()
+			return ErrWriteQueueOverflow
+		}
+	}
 	bc.writeInCh <- pkt
 	return nil
 }
@@ -115,7 +197,21 @@ func (bc *baseConn) writePkt() {
 				bc.clientID, pkt.ID(), pkt.Type().String())
 			record := !packet.ConnLayer(pkt)
 			err = bc.dowritePkt(pkt, record)
+			if err == nil && len(writeOutCh) == 0 {
+				// nothing more pending, don't hold the packets in buffer
+				err = bc.Flush()
+			}
 			if err != nil {
+				// the ones in buffer are never out either
+				bc.failPending()
+				// we must keep draining the writeOutCh, or the handlePkt
+				// might be blocked and the conn never gets finished
+				bc.netconn.Close()
+				for pkt := range writeOutCh {
+					if bc.failedCh != nil && !packet.ConnLayer(pkt) {
+						bc.failedCh <- pkt
+					}
+				}
 				return
 			}
 		}
@@ -123,7 +219,18 @@ func (bc *baseConn) writePkt() {
 }
 
 func (bc *baseConn) dowritePkt(pkt packet.Packet, record bool) error {
-	err := packet.EncodeToWriter(pkt, bc.netconn)
+	writer := io.Writer(bc.netconn)
+	if bc.wbuf != nil {
+		writer = bc.wbuf
+	}
+	// conn and session control packets are exempt from the bandwidth limit
+	if bc.writeBucket != nil && !packet.ConnLayer(pkt) && !packet.SessionLayer(pkt) {
+		writer = &limitedWriter{w: writer, tb: bc.writeBucket}
+	}
+	if bc.compressor != nil {
+		packet.SetCompression(pkt, bc.compressor, bc.compressThreshold)
+	}
+	err := packet.EncodeToWriter(pkt, writer)
 	if err != nil {
 		bc.log.Errorf("conn write down err: %s, clientID: %d, packetID: %d, packetType: %s",
 			err, bc.clientID, pkt.ID(), pkt.Type().String())
@@ -131,15 +238,38 @@ func (bc *baseConn) dowritePkt(pkt packet.Packet, record bool) error {
 			// only upper layer packet need to be notified
 			bc.failedCh <- pkt
 		}
+		return err
+	}
+	if bc.wbuf != nil {
+		bc.wbuf.buffered(pkt)
+	}
+	return nil
+}
+
+// failPending notifies the packets left in the write buffer as failed
+func (bc *baseConn) failPending() {
+	if bc.wbuf == nil {
+		return
+	}
+	for _, pkt := range bc.wbuf.takePending() {
+		if bc.failedCh != nil && !packet.ConnLayer(pkt) {
+			bc.failedCh <- pkt
+		}
 	}
-	return err
 }
 
 func (bc *baseConn) readPkt() {
 	readInCh := bc.readInCh
+	// headers and bodies are all read through the one read-ahead buffer, so
+	// packets coalesced in a segment are pulled by one syscall
+	size := bc.readBufferSize
+	if size <= 0 {
+		size = defaultReadBufferSize
+	}
+	reader := bufio.NewReaderSize(bc.netconn, size)
 
 	for {
-		pkt, err := packet.DecodeFromReader(bc.netconn)
+		pkt, err := packet.DecodeFromReader(reader)
 		if err != nil {
 			if iodefine.ErrUseOfClosedNetwork(err) {
 				bc.log.Debugf("conn read down closed, clientID: %d", bc.clientID)
@@ -253,6 +383,79 @@ func (bc *baseConn) ClientID() uint64 {
 	return bc.clientID
 }
 
+func (bc *baseConn) PeerVersion() int {
+	return bc.peerVersion
+}
+
+func (bc *baseConn) PeerCapabilities() []string {
+	return bc.peerCapabilities
+}
+
+func (bc *baseConn) PeerClockSkew() time.Duration {
+	return bc.peerClockSkew
+}
+
+func (bc *baseConn) Compression() string {
+	if bc.compressor == nil {
+		return packet.CompressionNone
+	}
+	return packet.CompressorName(bc.compressor.ID())
+}
+
+// advertise fills our version, capabilities and time into the conn or conn ack
+func (bc *baseConn) advertise(data *packet.ConnData) {
+	data.Version = bc.version
+	data.Capabilities = bc.capabilities
+	if len(bc.compressors) > 0 {
+		data.Capabilities = append(append([]string{}, bc.capabilities...),
+			packet.CompressionCapabilities(bc.compressors)...)
+	}
+	if bc.advertisedAt.IsZero() {
+		bc.advertisedAt = time.Now()
+	}
+	data.Timestamp = time.Now().UnixNano()
+}
+
+func (bc *baseConn) peerAdvertised(data *packet.ConnData) {
+	bc.peerVersion = data.Version
+	bc.peerCapabilities = data.Capabilities
+	if len(bc.compressors) > 0 {
+		bc.compressor, _ = packet.NegotiateCompressor(bc.compressors, data.Capabilities)
+	}
+	if data.Timestamp == 0 {
+		return
+	}
+	// the server side can't tell the latency, which is taken into the skew
+	now := time.Now()
+	if !bc.advertisedAt.IsZero() {
+		now = bc.advertisedAt.Add(now.Sub(bc.advertisedAt) / 2)
+	}
+	bc.peerClockSkew = time.Unix(0, data.Timestamp).Sub(now)
+	if bc.peerClockSkew > clockSkewWarning || bc.peerClockSkew < -clockSkewWarning {
+		bc.log.Warnf("peer clock skewed, clientID: %d, skew: %s, remote: %s",
+			bc.clientID, bc.peerClockSkew, bc.netconn.RemoteAddr())
+	}
+}
+
 func (bc *baseConn) Close() {
 	bc.cn.Close()
 }
+
+func (bc *baseConn) Flush() error {
+	if bc.wbuf == nil {
+		return nil
+	}
+	err := bc.wbuf.Flush()
+	if err != nil {
+		bc.log.Errorf("conn flush err: %s, clientID: %d, remote: %s",
+			err, bc.clientID, bc.netconn.RemoteAddr())
+	}
+	return err
+}
+
+func (bc *baseConn) Abort() {
+	bc.log.Debugf("conn aborting, clientID: %d, remote: %s, meta: %s",
+		bc.clientID, bc.netconn.RemoteAddr(), string(bc.meta))
+	// the read and write goroutines will quit and then fini the conn
+	bc.netconn.Close()
+}
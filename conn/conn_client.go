@@ -72,6 +72,84 @@ func OptionClientConnClientID(clientID uint64) ClientConnOption {
 	}
 }
 
+// OptionClientConnWriteOverflow sets the high-water mark of the write queue
+// and the policy to apply when it's reached, ErrInvalidHighWater is returned
+// if the mark is beyond the write queue, which could never be reached.
+func OptionClientConnWriteOverflow(highWater int, policy OverflowPolicy) ClientConnOption {
+	return func(cc *ClientConn) error {
+		if highWater > cap(cc.writeInCh) {
+			return ErrInvalidHighWater
+		}
+		cc.writeHighWater = highWater
+		cc.overflowPolicy = policy
+		return nil
+	}
+}
+
+// OptionClientConnReadBuffer sets the read-ahead buffer size on the read path,
+// 4096 bytes if not set.
+func OptionClientConnReadBuffer(size int) ClientConnOption {
+	return func(cc *ClientConn) error {
+		cc.readBufferSize = size
+		return nil
+	}
+}
+
+// OptionClientConnWriteBuffer sets the buffer size on the write path, the
+// buffer is flushed once no more packets pending, or by Flush.
+func OptionClientConnWriteBuffer(size int) ClientConnOption {
+	return func(cc *ClientConn) error {
+		cc.writeBufferSize = size
+		return nil
+	}
+}
+
+// OptionClientConnBandwidthLimit caps the bytes written per second across all
+// dialogues on the conn, burst is the bytes allowed at once.
+func OptionClientConnBandwidthLimit(bytesPerSec, burst int) ClientConnOption {
+	return func(cc *ClientConn) error {
+		cc.writeBucket = newTokenBucket(bytesPerSec, burst)
+		return nil
+	}
+}
+
+// OptionClientConnDropObserver sets the observer notified of every packet
+// the conn drops intentionally.
+func OptionClientConnDropObserver(observer packet.DropObserver) ClientConnOption {
+	return func(cc *ClientConn) error {
+		cc.dropObserver = observer
+		return nil
+	}
+}
+
+// OptionClientConnVersion overrides the protocol version advertised to the
+// server, which is ProtocolVersion by default.
+func OptionClientConnVersion(version int) ClientConnOption {
+	return func(cc *ClientConn) error {
+		cc.version = version
+		return nil
+	}
+}
+
+// OptionClientConnCapabilities advertises the capabilities to the server.
+func OptionClientConnCapabilities(capabilities ...string) ClientConnOption {
+	return func(cc *ClientConn) error {
+		cc.capabilities = capabilities
+		return nil
+	}
+}
+
+// OptionClientConnCompression negotiates the compression of the message
+// data with the server among the compressors, the best in common is picked
+// and the message data shorter than threshold is kept as is.
+func OptionClientConnCompression(threshold int, compressors ...byte) ClientConnOption {
+	return func(cc *ClientConn) error {
+		cc.compressThreshold = threshold
+		cc.compressors = compressors
+		return nil
+	}
+}
+
 func NewClientConn(netconn net.Conn, opts ...ClientConnOption) (*ClientConn, error) {
 	return newClientConn(netconn, opts...)
 }
@@ -92,6 +170,7 @@ func newClientConn(netconn net.Conn, opts ...ClientConnOption) (*ClientConn, err
 				clientID:  packet.ClientIDNull,
 				heartbeat: packet.Heartbeat20,
 				meta:      []byte{},
+				version:   ProtocolVersion,
 			},
 			netconn:    netconn,
 			fsm:        yafsm.NewFSM(),
@@ -133,6 +212,9 @@ func newClientConn(netconn net.Conn, opts ...ClientConnOption) (*ClientConn, err
 		timer.WithHandler(cc.sendHeartbeat), timer.WithCyclically())
 	// start
 	go cc.readPkt()
+	if cc.writeBufferSize > 0 {
+		cc.wbuf = newWriteBuffer(cc.netconn, cc.writeBufferSize)
+	}
 	go cc.writePkt()
 	go cc.handlePkt()
 	err = cc.connect()
@@ -181,7 +263,10 @@ func (cc *ClientConn) initFSM() {
 }
 
 func (cc *ClientConn) connect() error {
-	pkt := cc.pf.NewConnPacket(cc.clientID, true, cc.heartbeat, cc.meta)
+	// ask server for a clientID unless we've set one
+	acquire := cc.clientID == packet.ClientIDNull
+	pkt := cc.pf.NewConnPacket(cc.clientID, acquire, cc.heartbeat, cc.meta)
+	cc.advertise(pkt.ConnData)
 	cc.writeInCh <- pkt
 	sync := cc.shub.New(pkt.PacketID, synchub.WithTimeout(10*time.Second))
 	event := <-sync.C()
@@ -279,6 +364,7 @@ func (cc *ClientConn) handleInConnAckPacket(pkt *packet.ConnAckPacket) iodefine.
 		return iodefine.IOErr
 	}
 	cc.clientID = pkt.ClientID
+	cc.peerAdvertised(pkt.ConnData)
 
 	if pkt.ConnData.Error != "" {
 		cc.shub.Error(pkt.PacketID, errors.New(pkt.ConnData.Error))
@@ -310,6 +396,7 @@ func (cc *ClientConn) handleInDataPacket(pkt packet.Packet) iodefine.IORet {
 	if !ok {
 		cc.log.Debugf("data at non CONNED, clientID: %d, packetID: %d, remote: %s, meta: %s",
 			cc.clientID, pkt.ID(), cc.netconn.RemoteAddr(), string(cc.meta))
+		packet.NotifyDrop(cc.dropObserver, pkt, packet.DropReasonNotConnected, packet.DirectionIn)
 		return iodefine.IODiscard
 	}
 	cc.readOutCh <- pkt
@@ -405,6 +492,8 @@ func (cc *ClientConn) fini() {
 			cc.failedCh <- pkt
 		}
 	}
+	// and the ones never flushed
+	cc.failPending()
 	// collect timer
 	if !cc.tmrOutside {
 		cc.tmr.Close()
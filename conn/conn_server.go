@@ -25,6 +25,10 @@ type ServerConn struct {
 	// default global client ID factory
 	clientIDs id.IDFactory
 
+	// decides if the client is dead by its heartbeats
+	newDetector NewFailureDetector
+	detector    FailureDetector
+
 	closeOnce *sync.Once
 }
 
@@ -74,12 +78,89 @@ func OptionServerConnClientID(clientID uint64) ServerConnOption {
 	}
 }
 
+// OptionServerConnWriteOverflow sets the high-water mark of the write queue
+// and the policy to apply when it's reached, ErrInvalidHighWater is returned
+// by NewServerConn if the mark is beyond the write queue, which could never
+// be reached, see OptionServerConnBufferSize.
+func OptionServerConnWriteOverflow(highWater int, policy OverflowPolicy) ServerConnOption {
+	return func(sc *ServerConn) {
+		sc.writeHighWater = highWater
+		sc.overflowPolicy = policy
+	}
+}
+
+// OptionServerConnReadBuffer sets the read-ahead buffer size on the read path,
+// 4096 bytes if not set.
+func OptionServerConnReadBuffer(size int) ServerConnOption {
+	return func(sc *ServerConn) {
+		sc.readBufferSize = size
+	}
+}
+
+// OptionServerConnWriteBuffer sets the buffer size on the write path, the
+// buffer is flushed once no more packets pending, or by Flush.
+func OptionServerConnWriteBuffer(size int) ServerConnOption {
+	return func(sc *ServerConn) {
+		sc.writeBufferSize = size
+	}
+}
+
+// OptionServerConnBandwidthLimit caps the bytes written per second across all
+// dialogues on the conn, burst is the bytes allowed at once.
+func OptionServerConnBandwidthLimit(bytesPerSec, burst int) ServerConnOption {
+	return func(sc *ServerConn) {
+		sc.writeBucket = newTokenBucket(bytesPerSec, burst)
+	}
+}
+
+// OptionServerConnDropObserver sets the observer notified of every packet
+// the conn drops intentionally.
+func OptionServerConnDropObserver(observer packet.DropObserver) ServerConnOption {
+	return func(sc *ServerConn) {
+		sc.dropObserver = observer
+	}
+}
+
+// OptionServerConnVersion overrides the protocol version advertised to the
+// client, which is ProtocolVersion by default.
+func OptionServerConnVersion(version int) ServerConnOption {
+	return func(sc *ServerConn) {
+		sc.version = version
+	}
+}
+
+// OptionServerConnFailureDetector replaces the default detector, which
+// closes the conn once 2 heartbeats in a row missed.
+func OptionServerConnFailureDetector(newDetector NewFailureDetector) ServerConnOption {
+	return func(sc *ServerConn) {
+		sc.newDetector = newDetector
+	}
+}
+
+// OptionServerConnCapabilities advertises the capabilities to the client.
+func OptionServerConnCapabilities(capabilities ...string) ServerConnOption {
+	return func(sc *ServerConn) {
+		sc.capabilities = capabilities
+	}
+}
+
+// OptionServerConnCompression negotiates the compression of the message
+// data with the client among the compressors, the best in common is picked
+// and the message data shorter than threshold is kept as is.
+func OptionServerConnCompression(threshold int, compressors ...byte) ServerConnOption {
+	return func(sc *ServerConn) {
+		sc.compressThreshold = threshold
+		sc.compressors = compressors
+	}
+}
+
 func NewServerConn(netconn net.Conn, opts ...ServerConnOption) (*ServerConn, error) {
 	err := error(nil)
 	sc := &ServerConn{
 		baseConn: &baseConn{
 			connOpts: connOpts{
 				waitTimeout: 10,
+				version:     ProtocolVersion,
 			},
 			fsm:          yafsm.NewFSM(),
 			netconn:      netconn,
@@ -99,6 +180,10 @@ func NewServerConn(netconn net.Conn, opts ...ServerConnOption) (*ServerConn, err
 	for _, opt := range opts {
 		opt(sc)
 	}
+	// a mark beyond the write queue could never be reached
+	if sc.writeHighWater > sc.writeInSize {
+		return nil, ErrInvalidHighWater
+	}
 	// io size
 	sc.readInCh = make(chan packet.Packet, sc.readInSize)
 	sc.writeOutCh = make(chan packet.Packet, sc.writeOutSize)
@@ -120,6 +205,9 @@ func NewServerConn(netconn net.Conn, opts ...ServerConnOption) (*ServerConn, err
 	// states
 	sc.initFSM()
 	// rolling up
+	if sc.writeBufferSize > 0 {
+		sc.wbuf = newWriteBuffer(sc.netconn, sc.writeBufferSize)
+	}
 	go sc.writePkt()
 	go sc.handlePkt()
 	err = sc.wait()
@@ -289,6 +377,7 @@ func (sc *ServerConn) handleInConnPacket(pkt *packet.ConnPacket) iodefine.IORet
 	}
 
 	sc.meta = pkt.ConnData.Meta
+	sc.peerAdvertised(pkt.ConnData)
 	if pkt.ClientIDAcquire() {
 		if sc.dlgt != nil {
 			sc.clientID, err = sc.dlgt.GetClientID(sc.meta)
@@ -301,6 +390,7 @@ func (sc *ServerConn) handleInConnPacket(pkt *packet.ConnPacket) iodefine.IORet
 			sc.log.Errorf("get ID err: %s, clientID: %d, packetID: %d, remote: %s, meta: %s",
 				err, sc.clientID, pkt.ID(), sc.netconn.RemoteAddr(), string(sc.meta))
 			retPkt := sc.pf.NewConnAckPacket(pkt.PacketID, sc.clientID, err)
+			sc.advertise(retPkt.ConnData)
 			sc.writeInCh <- retPkt
 			return iodefine.IOSuccess
 		}
@@ -316,6 +406,7 @@ func (sc *ServerConn) handleInConnPacket(pkt *packet.ConnPacket) iodefine.IORet
 				err, sc.clientID, pkt.ID(), sc.netconn.RemoteAddr(), string(sc.meta))
 
 			retPkt := sc.pf.NewConnAckPacket(pkt.PacketID, sc.clientID, err)
+			sc.advertise(retPkt.ConnData)
 			sc.writeInCh <- retPkt
 			return iodefine.IOSuccess
 		}
@@ -323,11 +414,20 @@ func (sc *ServerConn) handleInConnPacket(pkt *packet.ConnPacket) iodefine.IORet
 	// the first packet received.
 	sc.shub.Ack(sc.getSyncID(), nil)
 	retPkt := sc.pf.NewConnAckPacket(pkt.PacketID, sc.clientID, nil)
+	sc.advertise(retPkt.ConnData)
 	sc.writeInCh <- retPkt
 
 	// set the heartbeat
 	sc.heartbeat = pkt.Heartbeat
-	sc.hbTick = sc.tmr.Add(time.Duration(sc.heartbeat)*2*time.Second, timer.WithHandler(sc.waitHBTimeout))
+	interval := time.Duration(sc.heartbeat) * time.Second
+	if sc.newDetector != nil {
+		sc.detector = sc.newDetector(interval)
+	} else {
+		sc.detector = NewMissedBeatDetector(interval, defaultMissedBeats)
+	}
+	sc.detector.Heartbeat(time.Now())
+	sc.hbTick = sc.tmr.Add(interval/failureDetectChecks,
+		timer.WithHandler(sc.waitHBTimeout), timer.WithCyclically())
 	return iodefine.IOSuccess
 }
 
@@ -338,9 +438,7 @@ func (sc *ServerConn) handleInHeartbeatPacket(pkt *packet.HeartbeatPacket) iodef
 			sc.clientID, pkt.ID(), sc.netconn.RemoteAddr(), string(sc.meta), sc.fsm.State())
 		return iodefine.IODiscard
 	}
-	// reset hearbeat
-	sc.hbTick.Cancel()
-	sc.hbTick = sc.tmr.Add(time.Duration(sc.heartbeat)*2*time.Second, timer.WithHandler(sc.waitHBTimeout))
+	sc.detector.Heartbeat(time.Now())
 
 	retPkt := sc.pf.NewHeartbeatAckPacket(pkt.PacketID)
 	sc.writeInCh <- retPkt
@@ -355,6 +453,7 @@ func (sc *ServerConn) handleInDataPacket(pkt packet.Packet) iodefine.IORet {
 	if !ok {
 		sc.log.Debugf("data at non CONNED, clientID: %d, packetID: %d, remote: %s, meta: %s",
 			sc.clientID, pkt.ID(), sc.netconn.RemoteAddr(), string(sc.meta))
+		packet.NotifyDrop(sc.dropObserver, pkt, packet.DropReasonNotConnected, packet.DirectionIn)
 		if sc.failedCh != nil {
 			sc.failedCh <- pkt
 		}
@@ -452,6 +551,8 @@ func (sc *ServerConn) fini() {
 			sc.failedCh <- pkt
 		}
 	}
+	// and the ones never flushed
+	sc.failPending()
 	// collect timer
 	if !sc.tmrOutside {
 		sc.tmr.Close()
@@ -471,12 +572,18 @@ func (sc *ServerConn) fini() {
 }
 
 func (sc *ServerConn) waitHBTimeout(event *timer.Event) {
-	if event.Error == timer.ErrTimerForceClosed {
+	switch {
+	case event.Error == timer.ErrTimerForceClosed:
 		sc.log.Infof("wait HEARTBEAT err: %s, clientID: %d, remote: %s, meta: %s",
 			event.Error, sc.clientID, sc.netconn.RemoteAddr(), string(sc.meta))
-	} else {
+	case event.Error != nil:
 		sc.log.Errorf("wait HEARTBEAT err: %s, clientID: %d, remote: %s, meta: %s",
 			event.Error, sc.clientID, sc.netconn.RemoteAddr(), string(sc.meta))
+	case sc.detector.Suspect(time.Now()):
+		sc.log.Errorf("wait HEARTBEAT timeout, peer suspected dead, clientID: %d, remote: %s, meta: %s",
+			sc.clientID, sc.netconn.RemoteAddr(), string(sc.meta))
+	default:
+		return
 	}
 	// changed from sc.netconn.Close() to sc.Close()
 	sc.Close()
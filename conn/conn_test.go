@@ -1,12 +1,18 @@
 package conn
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"math"
 	"net"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/jumboframes/armorigo/log"
+	"github.com/singchia/geminio/delegate"
 	"github.com/singchia/geminio/packet"
 	"github.com/singchia/geminio/pkg/id"
 )
@@ -233,3 +239,477 @@ func getTCPConnPair() (net.Conn, net.Conn, error) {
 	}
 	return connServer, connClient, nil
 }
+
+func TestServerConnInvalidHighWater(t *testing.T) {
+	connServer, connClient := net.Pipe()
+	defer connServer.Close()
+	defer connClient.Close()
+
+	// the same as the client, the mark could never be reached
+	_, err := NewServerConn(connServer, OptionServerConnWriteOverflow(1024, OverflowDisconnect))
+	if err != ErrInvalidHighWater {
+		t.Errorf("unexpected err of the mark beyond the write queue: %v", err)
+	}
+	// unless the write queue is enlarged
+	done := make(chan error, 1)
+	go func() {
+		sc, err := NewServerConn(connServer, OptionServerConnBufferSize(128, 2048),
+			OptionServerConnWriteOverflow(1024, OverflowDisconnect))
+		if err == nil {
+			sc.Close()
+		}
+		done <- err
+	}()
+	cc, err := NewClientConn(connClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+	if err = <-done; err != nil {
+		t.Errorf("unexpected err of the mark within the write queue: %v", err)
+	}
+}
+
+func TestWriteOverflowDisconnect(t *testing.T) {
+	connBlocked, connClient := net.Pipe()
+	// the blocked side only acks the conn packet and then never reads again
+	go func() {
+		pkt, err := packet.DecodeFromReader(connBlocked)
+		if err != nil {
+			return
+		}
+		pf := packet.NewPacketFactory(id.NewIDCounter(id.Even))
+		retPkt := pf.NewConnAckPacket(pkt.ID(), 1, nil)
+		packet.EncodeToWriter(retPkt, connBlocked)
+	}()
+	defer connBlocked.Close()
+
+	// the mark could never be reached
+	_, err := NewClientConn(connClient, OptionClientConnWriteOverflow(1024, OverflowDisconnect))
+	if err != ErrInvalidHighWater {
+		t.Errorf("unexpected err of the mark beyond the write queue: %v", err)
+	}
+
+	cc, err := NewClientConn(connClient,
+		OptionClientConnWriteOverflow(4, OverflowDisconnect))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// keep writing until the queue reaches the mark
+	errCh := make(chan error, 1)
+	go func() {
+		pf := packet.NewPacketFactory(id.NewIDCounter(id.Odd))
+		for {
+			err := cc.Write(pf.NewMessagePacket([]byte{}, []byte("overflow")))
+			if err != nil {
+				errCh <- err
+				return
+			}
+		}
+	}()
+	select {
+	case err = <-errCh:
+		if !errors.Is(err, ErrWriteQueueOverflow) {
+			t.Errorf("unexpected write err: %s", err)
+			return
+		}
+	case <-time.After(3 * time.Second):
+		t.Error("write queue overflow not triggered at the high-water mark")
+		return
+	}
+	// the conn should be finished
+	select {
+	case _, ok := <-cc.ChannelRead():
+		if ok {
+			t.Error("unexpected packet read")
+		}
+	case <-time.After(3 * time.Second):
+		t.Error("conn not disconnected after write queue overflow")
+	}
+}
+
+type versionDelegate struct {
+	capabilities chan []string
+}
+
+func (dlgt *versionDelegate) ConnOnline(cn delegate.ConnDescriber) error {
+	if cn.PeerVersion() < ProtocolVersion {
+		return errors.New("version too old")
+	}
+	dlgt.capabilities <- cn.PeerCapabilities()
+	return nil
+}
+
+func (dlgt *versionDelegate) ConnOffline(delegate.ConnDescriber) error { return nil }
+
+func (dlgt *versionDelegate) Heartbeat(delegate.ConnDescriber) error { return nil }
+
+func (dlgt *versionDelegate) GetClientID(meta []byte) (uint64, error) { return 0, nil }
+
+func TestPeerVersionRejected(t *testing.T) {
+	tests := []struct {
+		name    string
+		version int
+		reject  bool
+	}{
+		{"too old", 0, true},
+		{"current", ProtocolVersion, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			connServer, connClient := net.Pipe()
+			defer connServer.Close()
+			defer connClient.Close()
+
+			dlgt := &versionDelegate{capabilities: make(chan []string, 1)}
+			go NewServerConn(connServer, OptionServerConnDelegate(dlgt),
+				OptionServerConnCapabilities("server-cap"))
+
+			cc, err := NewClientConn(connClient, OptionClientConnVersion(tt.version),
+				OptionClientConnCapabilities("client-cap"))
+			if tt.reject {
+				if err == nil {
+					cc.Close()
+					t.Error("peer of old version accepted")
+				}
+				return
+			}
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer cc.Close()
+			select {
+			case caps := <-dlgt.capabilities:
+				if len(caps) != 1 || caps[0] != "client-cap" {
+					t.Errorf("unexpected client capabilities: %v", caps)
+				}
+			case <-time.After(time.Second):
+				t.Error("delegate not called")
+			}
+			// the server advertises back
+			if cc.PeerVersion() != ProtocolVersion {
+				t.Errorf("unexpected server version: %d", cc.PeerVersion())
+			}
+			if caps := cc.PeerCapabilities(); len(caps) != 1 || caps[0] != "server-cap" {
+				t.Errorf("unexpected server capabilities: %v", caps)
+			}
+		})
+	}
+}
+
+type skewDelegate struct {
+	versionDelegate
+	skew chan time.Duration
+}
+
+func (dlgt *skewDelegate) ConnOnline(cn delegate.ConnDescriber) error {
+	dlgt.skew <- cn.PeerClockSkew()
+	return nil
+}
+
+func TestPeerClockSkew(t *testing.T) {
+	skewed := time.Hour
+	near := func(skew, expected time.Duration) bool {
+		return skew > expected-time.Second && skew < expected+time.Second
+	}
+
+	// the server's clock is an hour ahead
+	connPeer, connClient := net.Pipe()
+	defer connPeer.Close()
+	go func() {
+		pkt, err := packet.DecodeFromReader(connPeer)
+		if err != nil {
+			return
+		}
+		pf := packet.NewPacketFactory(id.NewIDCounter(id.Even))
+		retPkt := pf.NewConnAckPacket(pkt.ID(), 1, nil)
+		retPkt.ConnData.Timestamp = time.Now().Add(skewed).UnixNano()
+		packet.EncodeToWriter(retPkt, connPeer)
+		io.Copy(io.Discard, connPeer)
+	}()
+	cc, err := NewClientConn(connClient)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cc.Close()
+	if skew := cc.PeerClockSkew(); !near(skew, skewed) {
+		t.Errorf("unexpected server clock skew: %s", skew)
+	}
+
+	// the client's clock is an hour behind
+	connServer, peer2 := net.Pipe()
+	defer peer2.Close()
+	dlgt := &skewDelegate{skew: make(chan time.Duration, 1)}
+	go NewServerConn(connServer, OptionServerConnDelegate(dlgt))
+	pf := packet.NewPacketFactory(id.NewIDCounter(id.Odd))
+	pkt := pf.NewConnPacket(1, false, packet.Heartbeat20, nil)
+	pkt.ConnData.Timestamp = time.Now().Add(-skewed).UnixNano()
+	go io.Copy(io.Discard, peer2)
+	if err = packet.EncodeToWriter(pkt, peer2); err != nil {
+		t.Error(err)
+		return
+	}
+	select {
+	case skew := <-dlgt.skew:
+		if !near(skew, -skewed) {
+			t.Errorf("unexpected client clock skew: %s", skew)
+		}
+	case <-time.After(time.Second):
+		t.Error("delegate not called")
+	}
+}
+
+func TestWriteBufferAutoFlush(t *testing.T) {
+	connPeer, connClient := net.Pipe()
+	defer connPeer.Close()
+	read := make(chan packet.Packet, 1)
+	go func() {
+		pkt, err := packet.DecodeFromReader(connPeer)
+		if err != nil {
+			return
+		}
+		pf := packet.NewPacketFactory(id.NewIDCounter(id.Even))
+		retPkt := pf.NewConnAckPacket(pkt.ID(), 1, nil)
+		packet.EncodeToWriter(retPkt, connPeer)
+		for {
+			pkt, err := packet.DecodeFromReader(connPeer)
+			if err != nil {
+				return
+			}
+			if pkt.Type() == packet.TypeMessagePacket {
+				read <- pkt
+				return
+			}
+		}
+	}()
+
+	// the buffer is much larger than the packet
+	cc, err := NewClientConn(connClient, OptionClientConnWriteBuffer(64*1024))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cc.Close()
+
+	pf := packet.NewPacketFactory(id.NewIDCounter(id.Odd))
+	pkt := pf.NewMessagePacket([]byte{}, []byte("urgent"))
+	if err = cc.Write(pkt); err != nil {
+		t.Error(err)
+		return
+	}
+	select {
+	case got := <-read:
+		if got.ID() != pkt.ID() {
+			t.Errorf("unexpected packet read, packetID: %d", got.ID())
+		}
+	case <-time.After(500 * time.Millisecond):
+		t.Error("single packet stuck in the write buffer")
+	}
+	if err = cc.Flush(); err != nil {
+		t.Errorf("unexpected flush err: %s", err)
+	}
+}
+
+// brokenConn fails the writes once broken
+type brokenConn struct {
+	net.Conn
+	broken int32
+}
+
+func (cn *brokenConn) Write(b []byte) (int, error) {
+	if atomic.LoadInt32(&cn.broken) == 1 {
+		return 0, io.ErrClosedPipe
+	}
+	return cn.Conn.Write(b)
+}
+
+func TestWriteBufferFlushFailed(t *testing.T) {
+	connServer, connClient := net.Pipe()
+	broken := &brokenConn{Conn: connServer}
+	failedCh := make(chan packet.Packet, 16)
+	var sc *ServerConn
+	var errServer error
+	done := make(chan struct{})
+	go func() {
+		sc, errServer = NewServerConn(broken, OptionServerConnFailedPacket(failedCh),
+			OptionServerConnWriteBuffer(64*1024))
+		close(done)
+	}()
+	cc, err := NewClientConn(connClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+	<-done
+	if errServer != nil {
+		t.Fatal(errServer)
+	}
+	defer sc.Close()
+
+	// the packets are buffered, and the flush fails
+	atomic.StoreInt32(&broken.broken, 1)
+	pf := packet.NewPacketFactory(id.NewIDCounter(id.Even))
+	written := map[uint64]bool{}
+	for i := 0; i < 3; i++ {
+		pkt := pf.NewMessagePacket([]byte{}, []byte("buffered"))
+		if err = sc.Write(pkt); err != nil {
+			break
+		}
+		written[pkt.ID()] = true
+	}
+	for len(written) > 0 {
+		select {
+		case pkt := <-failedCh:
+			delete(written, pkt.ID())
+		case <-time.After(time.Second):
+			t.Fatalf("packets lost in the write buffer: %d", len(written))
+		}
+	}
+}
+
+// phiAccrualDetector suspects the peer once phi of the silence exceeds the
+// threshold, phi is -log10 of the probability a heartbeat comes even later,
+// by the normal distribution of the latest intervals.
+type phiAccrualDetector struct {
+	threshold float64
+	window    int
+
+	mtx       sync.Mutex
+	last      time.Time
+	intervals []float64
+}
+
+func (detector *phiAccrualDetector) Heartbeat(at time.Time) {
+	detector.mtx.Lock()
+	defer detector.mtx.Unlock()
+	if !detector.last.IsZero() {
+		detector.intervals = append(detector.intervals, at.Sub(detector.last).Seconds())
+		if len(detector.intervals) > detector.window {
+			detector.intervals = detector.intervals[1:]
+		}
+	}
+	detector.last = at
+}
+
+func (detector *phiAccrualDetector) phi(now time.Time) float64 {
+	detector.mtx.Lock()
+	defer detector.mtx.Unlock()
+	if len(detector.intervals) == 0 {
+		return 0
+	}
+	mean, variance := 0.0, 0.0
+	for _, interval := range detector.intervals {
+		mean += interval
+	}
+	mean /= float64(len(detector.intervals))
+	for _, interval := range detector.intervals {
+		variance += (interval - mean) * (interval - mean)
+	}
+	variance /= float64(len(detector.intervals))
+	// a too regular history shouldn't make any jitter fatal
+	stddev := math.Max(math.Sqrt(variance), mean/10)
+	silence := now.Sub(detector.last).Seconds()
+	later := math.Erfc((silence-mean)/(stddev*math.Sqrt2)) / 2
+	return -math.Log10(later)
+}
+
+func (detector *phiAccrualDetector) Suspect(now time.Time) bool {
+	return detector.phi(now) > detector.threshold
+}
+
+func TestFailureDetector(t *testing.T) {
+	start := time.Now()
+	beat := func(detector FailureDetector, intervals ...time.Duration) time.Time {
+		at := start
+		detector.Heartbeat(at)
+		for _, interval := range intervals {
+			at = at.Add(interval)
+			detector.Heartbeat(at)
+		}
+		return at
+	}
+	regular := []time.Duration{}
+	for i := 0; i < 20; i++ {
+		// a second with some jitter
+		regular = append(regular, time.Second+time.Duration(i%3-1)*50*time.Millisecond)
+	}
+
+	missed := NewMissedBeatDetector(time.Second, 2)
+	last := beat(missed, regular...)
+	if missed.Suspect(last.Add(1500 * time.Millisecond)) {
+		t.Error("missed beat detector suspected before 2 misses")
+	}
+	if !missed.Suspect(last.Add(2 * time.Second)) {
+		t.Error("missed beat detector not suspected after 2 misses")
+	}
+
+	phi := &phiAccrualDetector{threshold: 8, window: 100}
+	last = beat(phi, regular...)
+	if phi.Suspect(last.Add(1200 * time.Millisecond)) {
+		t.Errorf("phi accrual detector suspected at a usual interval, phi: %f", phi.phi(last.Add(1200*time.Millisecond)))
+	}
+	// the intervals lengthen abnormally, still less than 2 misses
+	if !phi.Suspect(last.Add(1900 * time.Millisecond)) {
+		t.Errorf("phi accrual detector not suspected at an abnormal interval, phi: %f", phi.phi(last.Add(1900*time.Millisecond)))
+	}
+}
+
+// suspectDetector suspects the peer at the first consult
+type suspectDetector struct {
+	interval chan time.Duration
+}
+
+func (detector *suspectDetector) Heartbeat(time.Time) {}
+
+func (detector *suspectDetector) Suspect(time.Time) bool { return true }
+
+func TestServerConnFailureDetector(t *testing.T) {
+	connServer, connPeer := net.Pipe()
+	defer connPeer.Close()
+	detector := &suspectDetector{interval: make(chan time.Duration, 1)}
+	go NewServerConn(connServer, OptionServerConnFailureDetector(func(interval time.Duration) FailureDetector {
+		detector.interval <- interval
+		return detector
+	}))
+	pf := packet.NewPacketFactory(id.NewIDCounter(id.Odd))
+	start := time.Now()
+	if err := packet.EncodeToWriter(pf.NewConnPacket(1, false, packet.Heartbeat5, nil), connPeer); err != nil {
+		t.Error(err)
+		return
+	}
+	disconned := make(chan struct{})
+	go func() {
+		for {
+			pkt, err := packet.DecodeFromReader(connPeer)
+			if err != nil {
+				return
+			}
+			if pkt.Type() == packet.TypeDisConnPacket {
+				close(disconned)
+				io.Copy(io.Discard, connPeer)
+				return
+			}
+		}
+	}()
+	select {
+	case interval := <-detector.interval:
+		if interval != 5*time.Second {
+			t.Errorf("unexpected heartbeat interval: %s", interval)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("detector not created")
+	}
+	// consulted within a quarter of the interval
+	select {
+	case <-disconned:
+		if elapsed := time.Since(start); elapsed > 3*time.Second {
+			t.Errorf("closed too late: %s", elapsed)
+		}
+	case <-time.After(3 * time.Second):
+		t.Error("suspected conn not closed")
+	}
+}
@@ -0,0 +1,54 @@
+package conn
+
+import (
+	"sync"
+	"time"
+)
+
+// FailureDetector tells if the peer is dead by the arrivals of its
+// heartbeats. It's fed every heartbeat, and consulted several times per
+// heartbeat interval, from different goroutines.
+type FailureDetector interface {
+	// Heartbeat is fed the arrival time of a heartbeat, the first one is
+	// the time the conn established
+	Heartbeat(at time.Time)
+	// Suspect returns true if the peer is considered dead at now
+	Suspect(now time.Time) bool
+}
+
+// NewFailureDetector creates the detector of a conn with the heartbeat
+// interval negotiated
+type NewFailureDetector func(interval time.Duration) FailureDetector
+
+// the detector consulting times per heartbeat interval
+const failureDetectChecks = 4
+
+// the misses of the default detector
+const defaultMissedBeats = 2
+
+// NewMissedBeatDetector suspects the peer after misses heartbeats in a row
+// missing, it's the default with 2 misses.
+func NewMissedBeatDetector(interval time.Duration, misses int) FailureDetector {
+	return &missedBeatDetector{
+		timeout: interval * time.Duration(misses),
+	}
+}
+
+type missedBeatDetector struct {
+	timeout time.Duration
+
+	mtx  sync.Mutex
+	last time.Time
+}
+
+func (detector *missedBeatDetector) Heartbeat(at time.Time) {
+	detector.mtx.Lock()
+	defer detector.mtx.Unlock()
+	detector.last = at
+}
+
+func (detector *missedBeatDetector) Suspect(now time.Time) bool {
+	detector.mtx.Lock()
+	defer detector.mtx.Unlock()
+	return now.Sub(detector.last) >= detector.timeout
+}
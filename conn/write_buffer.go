@@ -0,0 +1,65 @@
+package conn
+
+import (
+	"bufio"
+	"io"
+	"sync"
+
+	"github.com/singchia/geminio/packet"
+)
+
+// writeBuffer gathers the packets written down, they are flushed once the
+// write queue is empty, or by Flush from outside.
+type writeBuffer struct {
+	mtx sync.Mutex
+	w   *bufio.Writer
+	// the packets not out yet since the last flush, they're failed along
+	// with the flush
+	pending []packet.Packet
+}
+
+func newWriteBuffer(w io.Writer, size int) *writeBuffer {
+	return &writeBuffer{w: bufio.NewWriterSize(w, size)}
+}
+
+func (wb *writeBuffer) Write(p []byte) (int, error) {
+	wb.mtx.Lock()
+	defer wb.mtx.Unlock()
+	buffered := wb.w.Buffered()
+	n, err := wb.w.Write(p)
+	if err == nil && wb.w.Buffered() < buffered+len(p) {
+		// flushed while writing, the ones buffered before are out
+		wb.pending = nil
+	}
+	return n, err
+}
+
+// buffered records the packet just written, unless it's out already
+func (wb *writeBuffer) buffered(pkt packet.Packet) {
+	wb.mtx.Lock()
+	defer wb.mtx.Unlock()
+	if wb.w.Buffered() == 0 {
+		wb.pending = nil
+		return
+	}
+	wb.pending = append(wb.pending, pkt)
+}
+
+func (wb *writeBuffer) Flush() error {
+	wb.mtx.Lock()
+	defer wb.mtx.Unlock()
+	err := wb.w.Flush()
+	if err == nil {
+		wb.pending = nil
+	}
+	return err
+}
+
+// takePending returns the packets never out after a failed write or flush
+func (wb *writeBuffer) takePending() []packet.Packet {
+	wb.mtx.Lock()
+	defer wb.mtx.Unlock()
+	pending := wb.pending
+	wb.pending = nil
+	return pending
+}
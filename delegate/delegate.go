@@ -2,6 +2,7 @@ package delegate
 
 import (
 	"net"
+	"time"
 
 	"github.com/singchia/geminio"
 )
@@ -13,6 +14,14 @@ type ConnDescriber interface {
 	LocalAddr() net.Addr
 	RemoteAddr() net.Addr
 	Side() geminio.Side
+	// the protocol version and capabilities the peer advertised at
+	// connecting, delegates may reject the peers by them at ConnOnline
+	PeerVersion() int
+	PeerCapabilities() []string
+	// how far the peer's clock is ahead of ours, estimated at connecting
+	PeerClockSkew() time.Duration
+	// the name of the compressor negotiated at connecting
+	Compression() string
 }
 
 type ClientConnDelegate interface {
@@ -35,15 +44,57 @@ type DialogueDescriber interface {
 	DialogueID() uint64
 	Meta() []byte
 	Side() geminio.Side
+	// whether the dialogue is opened by peer
+	PeerInitiated() bool
+	// the reason given by the peer if it dismissed the dialogue
+	DismissReason() string
+}
+
+// DialogueCloseReason tells how a dialogue was closed
+type DialogueCloseReason int32
+
+const (
+	// not closed yet, or closed by the under layer, e.g. the conn's EOF
+	DialogueCloseReasonUnknown DialogueCloseReason = iota
+	// closed by the dismiss handshake
+	DialogueCloseReasonDismiss
+	// reset by either side without the handshake
+	DialogueCloseReasonReset
+	// reset since no one read the dialogue in time
+	DialogueCloseReasonUnconsumed
+	// reset since the peer sent an unknown packet in strict mode
+	DialogueCloseReasonUnknownPacket
+	// reset since the peer didn't answer the keepalive in time
+	DialogueCloseReasonKeepalive
+)
+
+func (reason DialogueCloseReason) String() string {
+	switch reason {
+	case DialogueCloseReasonDismiss:
+		return "dismiss"
+	case DialogueCloseReasonReset:
+		return "reset"
+	case DialogueCloseReasonUnconsumed:
+		return "unconsumed"
+	case DialogueCloseReasonUnknownPacket:
+		return "unknown packet"
+	case DialogueCloseReasonKeepalive:
+		return "keepalive timeout"
+	}
+	return "unknown"
 }
 
 type ClientDialogueDelegate interface {
 	DialogueOnline(DialogueDescriber) error
-	DialogueOffline(DialogueDescriber) error
+	DialogueOffline(DialogueDescriber, DialogueCloseReason) error
 }
 
 type ServerDialogueDelegate interface {
 	ClientDialogueDelegate
+	// ResumeDialogue decides whether the dialogue reopened with the oldID,
+	// such as the one before the client reconnected, keeps the ID. A false
+	// gives it a new ID, and an error refuses it.
+	ResumeDialogue(oldID uint64, meta []byte) (bool, error)
 }
 
 type ClientDescriber interface {
@@ -79,7 +130,8 @@ type Delegate interface {
 	GetClientID(meta []byte) (uint64, error)
 	// dialogue layer
 	DialogueOnline(DialogueDescriber) error
-	DialogueOffline(DialogueDescriber) error
+	DialogueOffline(DialogueDescriber, DialogueCloseReason) error
+	ResumeDialogue(oldID uint64, meta []byte) (bool, error)
 	// application layer
 	EndReOnline(ClientDescriber)
 	RemoteRegistration(method string, clientID uint64, streamID uint64)
@@ -97,7 +149,13 @@ func (dlgt *UnimplementedDelegate) GetClientID(meta []byte) (uint64, error) { re
 
 func (dlgt *UnimplementedDelegate) DialogueOnline(DialogueDescriber) error { return nil }
 
-func (dlgt *UnimplementedDelegate) DialogueOffline(DialogueDescriber) error { return nil }
+func (dlgt *UnimplementedDelegate) DialogueOffline(DialogueDescriber, DialogueCloseReason) error {
+	return nil
+}
+
+func (dlgt *UnimplementedDelegate) ResumeDialogue(oldID uint64, meta []byte) (bool, error) {
+	return false, nil
+}
 
 func (dlgt *UnimplementedDelegate) EndReOnline(ClientDescriber) { return }
 
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"io"
+	"strconv"
+
+	"github.com/jumboframes/armorigo/log"
+	"github.com/singchia/geminio/client"
+)
+
+func main() {
+	opt := client.NewEndOptions()
+	opt.SetWaitRemoteRPCs("sum")
+	end, err := client.NewEnd("tcp", "127.0.0.1:8080", opt)
+	if err != nil {
+		log.Errorf("client dial err: %s", err)
+		return
+	}
+	defer end.Close()
+
+	stream, err := end.CallStream(context.TODO(), "sum")
+	if err != nil {
+		log.Errorf("end call stream err: %s", err)
+		return
+	}
+	go func() {
+		for i := 1; i <= 10; i++ {
+			if err := stream.SendMsg([]byte(strconv.Itoa(i))); err != nil {
+				log.Errorf("stream send err: %s", err)
+				return
+			}
+		}
+		stream.CloseSend()
+	}()
+	for {
+		data, err := stream.RecvMsg()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Errorf("stream recv err: %s", err)
+			return
+		}
+		log.Info("sum:", string(data))
+	}
+}
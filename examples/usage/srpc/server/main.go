@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"io"
+	"strconv"
+
+	"github.com/jumboframes/armorigo/log"
+	"github.com/singchia/geminio"
+	"github.com/singchia/geminio/server"
+)
+
+func main() {
+	ln, err := server.Listen("tcp", "127.0.0.1:8080")
+	if err != nil {
+		log.Errorf("server listen err: %s", err)
+		return
+	}
+
+	for {
+		end, err := ln.AcceptEnd()
+		if err != nil {
+			log.Errorf("accept err: %s", err)
+			break
+		}
+		go func() {
+			err := end.RegisterStream(context.TODO(), "sum", sum)
+			if err != nil {
+				return
+			}
+		}()
+	}
+}
+
+// sum streams the running total back for every number received
+func sum(_ context.Context, stream geminio.StreamResponse) error {
+	total := 0
+	for {
+		data, err := stream.RecvMsg()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		n, err := strconv.Atoi(string(data))
+		if err != nil {
+			return err
+		}
+		total += n
+		log.Info("sum:", total)
+		if err = stream.SendMsg([]byte(strconv.Itoa(total))); err != nil {
+			return err
+		}
+	}
+}
@@ -2,6 +2,7 @@ package geminio
 
 import (
 	"context"
+	"io"
 	"net"
 	"time"
 
@@ -46,6 +47,9 @@ type Response interface {
 	SetCustom([]byte)
 	SetClientID(clientID uint64)
 	SetStreamID(streamID uint64)
+	// Write appends to the data, for the caller of CallTo it's streamed
+	// out in chunks as written rather than held as a whole
+	io.Writer
 }
 
 type MethodRPC struct {
@@ -59,6 +63,34 @@ type RPC func(context.Context, Request, Response)
 // hijack rpc functions
 type HijackRPC func(context.Context, string, Request, Response)
 
+// StreamRequest is the caller side of a streaming call, both sides send
+// messages until the callee returns or closes, then RecvMsg returns io.EOF,
+// or the callee's error.
+type StreamRequest interface {
+	Method() string
+	SendMsg(data []byte) error
+	RecvMsg() ([]byte, error)
+	// CloseSend tells the callee no more messages, the callee's RecvMsg
+	// returns io.EOF then
+	CloseSend() error
+}
+
+// StreamResponse is the callee side of a streaming call
+type StreamResponse interface {
+	Method() string
+	SendMsg(data []byte) error
+	// RecvMsg returns io.EOF after the caller closed sending
+	RecvMsg() ([]byte, error)
+	// Close ends the call before the rpc returns, the caller's RecvMsg
+	// returns io.EOF if err is nil, or err. SendMsg and Close return
+	// ErrSendClosed afterwards.
+	Close(err error) error
+}
+
+// streaming rpc functions, the call ends once it returns, with the returned
+// error unless Close was called
+type StreamRPC func(context.Context, StreamResponse) error
+
 // for async RPC
 type Call struct {
 	Method   string
@@ -73,9 +105,15 @@ type RPCer interface {
 
 	Call(ctx context.Context, method string, req Request, opts ...*options.CallOptions) (Response, error)
 	CallAsync(ctx context.Context, method string, req Request, ch chan *Call, opts ...*options.CallOptions) (*Call, error)
+	// CallTo streams the response body into w as chunks arrive
+	CallTo(ctx context.Context, method string, req Request, w io.Writer, opts ...*options.CallOptions) error
 	Register(ctx context.Context, method string, rpc RPC) error
 	// Hijack rpc from remote
 	Hijack(rpc HijackRPC, opts ...*options.HijackOptions) error
+	// CallStream opens a streaming call, RecvMsg must be called until it
+	// returns an error to release the call
+	CallStream(ctx context.Context, method string, opts ...*options.CallOptions) (StreamRequest, error)
+	RegisterStream(ctx context.Context, method string, rpc StreamRPC) error
 }
 
 type Message interface {
@@ -95,11 +133,14 @@ type Message interface {
 	Data() []byte
 	// custom data
 	Custom() []byte
+	// key for the consumer to drop duplicates, empty if not set
+	IdempotencyKey() string
 
 	// those Set operations must be accomplish before Publish
 	SetTimeout(timeout time.Duration)
 	SetCustom(data []byte)
 	SetTopic(topic string)
+	SetIdempotencyKey(key string)
 	SetClientID(clientID uint64)
 	SetStreamID(streamID uint64)
 }
@@ -116,7 +157,9 @@ type Messager interface {
 
 	Publish(ctx context.Context, msg Message, opts ...*options.PublishOptions) error
 	PublishAsync(ctx context.Context, msg Message, ch chan *Publish, opts ...*options.PublishOptions) (*Publish, error)
-	Receive(ctx context.Context) (Message, error)
+	// Receive with the visibility set peeks the message, see
+	// options.ReceiveOptions
+	Receive(ctx context.Context, opts ...*options.ReceiveOptions) (Message, error)
 }
 
 type Raw net.Conn
@@ -142,6 +185,8 @@ type Stream interface {
 	RawRPCMessager
 	// meta info for a stream
 	StreamID() uint64
+	// ClientID is assigned by the server unless the client set one,
+	// it's ready once the End is returned
 	ClientID() uint64
 	Meta() []byte
 	Side() Side
@@ -155,6 +200,15 @@ type Multiplexer interface {
 	ListStreams() []Stream
 }
 
+// MethodStat is the statistics of a served RPC method
+type MethodStat struct {
+	// total calls done and calls with error
+	Total  uint64
+	Errors uint64
+	// calls in processing
+	InFlight int64
+}
+
 type End interface {
 	// End is a default stream with streamID 1
 	// Close on default stream will close all from the End
@@ -162,6 +216,27 @@ type End interface {
 	// End is a stream multiplexer
 	Multiplexer
 
+	// MethodStats returns statistics of RPCs served by the End and its streams,
+	// key is the method
+	MethodStats() map[string]MethodStat
+
+	// Quiesce rejects new streams and requests on the End's default stream,
+	// while existing streams keep working, Unquiesce resumes them.
+	Quiesce()
+	Unquiesce()
+
+	// SetDefaultRequestTimeout sets the timeout for Calls without their own,
+	// zero means no timeout.
+	SetDefaultRequestTimeout(timeout time.Duration)
+
+	// CallDedup sends identical requests in flight, the same method and
+	// body, only once and fans the response out to all callers.
+	CallDedup(ctx context.Context, method string, req Request, opts ...*options.CallOptions) (Response, error)
+
+	// AckStream yields the highest ID of the published messages whose
+	// predecessors are all acked too, advancing as acks arrive.
+	AckStream() <-chan uint64
+
 	// End is a net.Listener
 	// Accept is a wrapper for AcceptStream
 	// Addr is a wrapper for LocalAddr
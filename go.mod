@@ -4,7 +4,9 @@ go 1.20
 
 require (
 	github.com/golang/mock v1.6.0
+	github.com/golang/snappy v1.0.0
 	github.com/jumboframes/armorigo v0.2.5
+	github.com/klauspost/compress v1.17.9
 	github.com/singchia/go-timer/v2 v2.2.1
 	github.com/singchia/go-xtables v1.0.1
 	github.com/singchia/yafsm v1.0.1
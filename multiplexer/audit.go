@@ -0,0 +1,69 @@
+package multiplexer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"time"
+)
+
+// SessionRecord is the audit record of a dialogue's open or close
+type SessionRecord struct {
+	Time          time.Time
+	ClientID      uint64
+	DialogueID    uint64
+	PeerInitiated bool
+	// hex encoded sha256 of the meta, the meta itself might be sensitive
+	MetaHash   string
+	LocalAddr  net.Addr
+	RemoteAddr net.Addr
+	// outcome of the open, nil means succeed
+	Err error
+	// only set at close
+	CloseReason CloseReason
+}
+
+// AuditSink receives the records of dialogues' lifecycle, the calls happen
+// in the dialogue's goroutines and shouldn't block.
+type AuditSink interface {
+	RecordSessionOpen(SessionRecord)
+	RecordSessionClose(SessionRecord)
+}
+
+// OptionMultiplexerAuditSink sets the sink to record every dialogue opened
+// and closed, except the default one.
+func OptionMultiplexerAuditSink(sink AuditSink) MultiplexerOption {
+	return func(opts *multiplexerOpts) {
+		opts.audit = sink
+	}
+}
+
+func (dg *dialogue) sessionRecord(err error) SessionRecord {
+	hash := sha256.Sum256(dg.meta)
+	return SessionRecord{
+		Time:          time.Now(),
+		ClientID:      dg.cn.ClientID(),
+		DialogueID:    dg.dialogueID,
+		PeerInitiated: dg.peerInitiated,
+		MetaHash:      hex.EncodeToString(hash[:]),
+		LocalAddr:     dg.cn.LocalAddr(),
+		RemoteAddr:    dg.cn.RemoteAddr(),
+		Err:           err,
+	}
+}
+
+func (dg *dialogue) auditOpen(err error) {
+	if dg.audit == nil {
+		return
+	}
+	dg.audit.RecordSessionOpen(dg.sessionRecord(err))
+}
+
+func (dg *dialogue) auditClose() {
+	if dg.audit == nil {
+		return
+	}
+	record := dg.sessionRecord(nil)
+	record.CloseReason = dg.CloseReason()
+	dg.audit.RecordSessionClose(record)
+}
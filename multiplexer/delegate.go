@@ -4,5 +4,12 @@ import "github.com/singchia/geminio/delegate"
 
 type Delegate interface {
 	DialogueOnline(delegate.DialogueDescriber) error
-	DialogueOffline(delegate.DialogueDescriber) error
+	DialogueOffline(delegate.DialogueDescriber, delegate.DialogueCloseReason) error
+}
+
+// DialogueResumer is the optional part of the Delegate, which decides the
+// dialogues resumed by peer at the side assigning dialogueIDs. Without it the
+// resumed dialogues get new IDs.
+type DialogueResumer interface {
+	ResumeDialogue(oldID uint64, meta []byte) (bool, error)
 }
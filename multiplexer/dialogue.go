@@ -1,8 +1,10 @@
 package multiplexer
 
 import (
+	"context"
 	"io"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/jumboframes/armorigo/log"
@@ -13,6 +15,7 @@ import (
 	"github.com/singchia/geminio/pkg/id"
 	"github.com/singchia/geminio/pkg/iodefine"
 	gsync "github.com/singchia/geminio/pkg/sync"
+	"github.com/singchia/go-timer/v2"
 	"github.com/singchia/yafsm"
 )
 
@@ -37,14 +40,20 @@ const (
 	ET_FINI        = "fini"
 )
 
+// the interval to check if the read buffers are drained
+const drainInterval = 10 * time.Millisecond
+
 type dialogue struct {
 	// options for timer, packet factory, log, delegate and meta
 	*opts
-	// delegate
+	// delegate of the manager or hub
 	dlgt Delegate
+	// dialogue specific delegate, prior to the End-wide one
+	customDlgt Delegate
 	// meta
-	meta []byte
-	peer string
+	meta   []byte
+	metaFn func() []byte
+	peer   string
 
 	// under layer
 	cn conn.Conn
@@ -57,6 +66,47 @@ type dialogue struct {
 	peerNegotiatingID   uint64
 	dialogueIDPeersCall bool
 	dialogueID          uint64
+	// the dialogueID acked by the peer, set by the manager while routing the
+	// ack and only accessed under the manager's mtx
+	ackedID uint64
+	// the previous dialogueID asked to resume, 0 means not resuming
+	resumeID uint64
+	// whether the dialogue is opened by peer
+	peerInitiated bool
+	// the session packet is sent by the batch if set
+	batch *sessionBatch
+	// read ahead of the writeOutCh by the writePkt
+	prio priorityBuffer
+	// interactive dialogue never coalesces writes
+	interactive bool
+	// namespace set to the header of data packets, 0 means absent
+	namespace uint64
+	// requested QoS level before the handshake, negotiated after
+	qos int8
+	// negotiated max payload size of data packets, 0 means no limit
+	packetSize int
+	// timeout of open and close syncs, and the hook when they time out
+	syncTimeout   time.Duration
+	onSyncTimeout func(packetID uint64, op string)
+	// keepalive once sessioned, disabled if not positive
+	keepaliveInterval time.Duration
+	keepaliveTimeout  time.Duration
+	kaMtx             sync.Mutex
+	kaTick            timer.Tick
+	// unix nano of the latest pong
+	lastPong int64
+	// nanoseconds of the handshake's and the smoothed round trip time
+	handshakeRTT int64
+	srtt         int64
+	// the pings to be timed, key: packetID
+	rttMtx sync.Mutex
+	pings  map[uint64]time.Time
+	// write the pending packets down at a normal dismiss rather than fail them
+	drainOnClose bool
+	// epoch of the session, to tell dismisses of a previous session
+	// with the same dialogueID apart, accessed atomically since the close
+	// paths read it out of handlePkt
+	epoch uint64
 	// synchub
 	shub *synchub.SyncHub
 
@@ -72,9 +122,30 @@ type dialogue struct {
 	readInSize, writeOutSize int
 	readOutSize, writeInSize int
 	failedCh                 chan packet.Packet
+	// 1 if the queued packets reached the high-water of the write buffers
+	congested int32
+	// signaled once recovered from the congestion
+	writable chan struct{}
+	// latest packets for debugging, nil if not enabled
+	history *packetHistory
 
 	closeOnce   *gsync.Once
 	closeIOOnce *gsync.Once
+	// asserted with the geminio_invariants build tag
+	inv         invariants
+	resetOnce   *gsync.Once
+	closeReason int32
+	// the reason given by the peer's dismiss
+	dismissReason atomic.Value
+	// the fsm's state mirrored for reading from outside, and the hook of
+	// state changes
+	state         atomic.Value
+	onStateChange func(old, new string)
+	// key: the state transited to, value: the handlers added by options
+	transitions map[string][]TransitionHandler
+
+	// timestamps of activities
+	stats dialogueStats
 }
 
 type DialogueOption func(*dialogue)
@@ -98,12 +169,34 @@ func OptionDialogueState(state string) DialogueOption {
 	}
 }
 
-func OptionDialogueDelegate(dlgt Delegate) DialogueOption {
+// OptionDialogueQoS requests the QoS level for the dialogue, the peer may
+// downgrade it while negotiating.
+func OptionDialogueQoS(qos int8) DialogueOption {
+	return func(dg *dialogue) {
+		dg.qos = qos
+	}
+}
+
+// QoS returns the negotiated QoS level after the handshake
+func (dg *dialogue) QoS() int8 {
+	return dg.qos
+}
+
+// the manager or hub tracks the dialogue's online and offline
+func optionDialogueOwner(dlgt Delegate) DialogueOption {
 	return func(dg *dialogue) {
 		dg.dlgt = dlgt
 	}
 }
 
+// OptionDialogueDelegate sets a delegate for the dialogue's online and offline
+// events, which takes precedence over the End-wide delegate.
+func OptionDialogueDelegate(dlgt Delegate) DialogueOption {
+	return func(dg *dialogue) {
+		dg.customDlgt = dlgt
+	}
+}
+
 // OptionDialogueMeta set the meta info for the dialogue
 func OptionDialogueMeta(meta []byte) DialogueOption {
 	return func(dg *dialogue) {
@@ -111,6 +204,102 @@ func OptionDialogueMeta(meta []byte) DialogueOption {
 	}
 }
 
+// OptionDialogueMetaFunc set the function to get meta just before every open,
+// which is prior to OptionDialogueMeta
+func OptionDialogueMetaFunc(fn func() []byte) DialogueOption {
+	return func(dg *dialogue) {
+		dg.metaFn = fn
+	}
+}
+
+// OptionDialogueInteractive disables the write coalescing of the dialogue,
+// small writes go down immediately, like TCP_NODELAY but per dialogue.
+func OptionDialogueInteractive() DialogueOption {
+	return func(dg *dialogue) {
+		dg.interactive = true
+	}
+}
+
+// OptionDialogueNamespace sets the namespace to the header of data packets
+// written by the dialogue, for routing layers to switch on it cheaply.
+func OptionDialogueNamespace(namespace uint64) DialogueOption {
+	return func(dg *dialogue) {
+		dg.namespace = namespace
+	}
+}
+
+// OptionDialogueSyncTimeout sets the timeout waiting for the session ack and
+// dismiss ack, default is 30 seconds.
+func OptionDialogueSyncTimeout(timeout time.Duration) DialogueOption {
+	return func(dg *dialogue) {
+		dg.syncTimeout = timeout
+	}
+}
+
+// OptionDialogueOnSyncTimeout sets the hook called whenever a sync of the
+// dialogue times out, the op is "open" or "close", for alerting and metrics.
+func OptionDialogueOnSyncTimeout(fn func(packetID uint64, op string)) DialogueOption {
+	return func(dg *dialogue) {
+		dg.onSyncTimeout = fn
+	}
+}
+
+// OptionDialogueOnStateChange sets the hook called after every state change
+// of the dialogue, it's called in the dialogue's goroutine without any lock
+// held and shouldn't block.
+func OptionDialogueOnStateChange(fn func(old, new string)) DialogueOption {
+	return func(dg *dialogue) {
+		dg.onStateChange = fn
+	}
+}
+
+// TransitionHandler is called at a transition of the dialogue's state machine
+type TransitionHandler func(event, from, to string)
+
+// OptionDialogueTransitionHandler adds the handler to every transition into
+// the state, e.g. SESSIONED, for metrics or validation. A transition moves the
+// state first, then calls the dialogue's own handlers such as closing at an
+// error, then the added ones in the order given, all in the goroutine emitting
+// the event, and the OnStateChange hook comes last. The handlers shouldn't
+// block or emit events of the dialogue, e.g. by closing it.
+func OptionDialogueTransitionHandler(state string, handler TransitionHandler) DialogueOption {
+	return func(dg *dialogue) {
+		if dg.transitions == nil {
+			dg.transitions = make(map[string][]TransitionHandler)
+		}
+		dg.transitions[state] = append(dg.transitions[state], handler)
+	}
+}
+
+// OptionDialogueBufferSize sets the capacities of the read in, write in, read
+// out and write out buffers, the non-positive ones keep the default 128.
+func OptionDialogueBufferSize(readIn, writeIn, readOut, writeOut int) DialogueOption {
+	return func(dg *dialogue) {
+		if readIn > 0 {
+			dg.readInSize = readIn
+		}
+		if writeIn > 0 {
+			dg.writeInSize = writeIn
+		}
+		if readOut > 0 {
+			dg.readOutSize = readOut
+		}
+		if writeOut > 0 {
+			dg.writeOutSize = writeOut
+		}
+	}
+}
+
+// OptionDialogueDrainOnClose writes the packets still pending in the write
+// buffer down to the conn once the dismiss handshake completed, instead of
+// failing them, bounded by the dismiss timeout. Resets and conn errors still
+// fail them.
+func OptionDialogueDrainOnClose(drain bool) DialogueOption {
+	return func(dg *dialogue) {
+		dg.drainOnClose = drain
+	}
+}
+
 func OptionDialoguePeer(peer string) DialogueOption {
 	return func(dg *dialogue) {
 		dg.peer = peer
@@ -124,6 +313,15 @@ func OptionDialogueNegotiatingID(negotiatingID uint64, dialogueIDPeersCall bool)
 	}
 }
 
+// the dialogue is opened by the peer's session of negotiateID, set before
+// rolling so that the owner may tell the duplicate sessions
+func optionDialoguePeerSession(negotiateID uint64) DialogueOption {
+	return func(dg *dialogue) {
+		dg.peerNegotiatingID = negotiateID
+		dg.peerInitiated = true
+	}
+}
+
 func NewDialogue(cn conn.Conn, baseOpts *opts, opts ...DialogueOption) (*dialogue, error) {
 	dg := &dialogue{
 		opts:         baseOpts,
@@ -133,11 +331,16 @@ func NewDialogue(cn conn.Conn, baseOpts *opts, opts ...DialogueOption) (*dialogu
 		fsm:          yafsm.NewFSM(yafsm.WithInSeq()),
 		closeOnce:    new(gsync.Once),
 		closeIOOnce:  new(gsync.Once),
+		resetOnce:    new(gsync.Once),
 		dialogueOK:   true,
 		readInSize:   128,
 		writeOutSize: 128,
 		readOutSize:  128,
 		writeInSize:  128,
+		syncTimeout:  30 * time.Second,
+		stats: dialogueStats{
+			openedAt: time.Now(),
+		},
 	}
 	// states
 	dg.initFSM()
@@ -145,11 +348,17 @@ func NewDialogue(cn conn.Conn, baseOpts *opts, opts ...DialogueOption) (*dialogu
 	for _, opt := range opts {
 		opt(dg)
 	}
+	dg.addTransitionHandlers()
+	dg.state.Store(dg.fsm.State())
+	if dg.history == nil && dg.historySize > 0 {
+		dg.history = newPacketHistory(dg.historySize)
+	}
 	// io size
 	dg.readInCh = make(chan packet.Packet, dg.readInSize)
 	dg.writeOutCh = make(chan packet.Packet, dg.writeOutSize)
 	dg.readOutCh = make(chan packet.Packet, dg.readOutSize)
 	dg.writeInCh = make(chan packet.Packet, dg.writeInSize)
+	dg.writable = make(chan struct{}, 1)
 
 	dg.shub = synchub.NewSyncHub(synchub.OptionTimer(dg.tmr))
 	// packet factory
@@ -163,7 +372,7 @@ func NewDialogue(cn conn.Conn, baseOpts *opts, opts ...DialogueOption) (*dialogu
 
 	// rolling up
 	go dg.handlePkt()
-	go dg.writePkt()
+	go dg.writePkt(dg.writeInCh, dg.writeOutCh)
 	return dg, nil
 }
 
@@ -192,30 +401,190 @@ func (dg *dialogue) Peer() string {
 	return dg.peer
 }
 
+// PeerInitiated returns true if the dialogue is opened by peer and accepted
+// by us, false if it's opened locally.
+func (dg *dialogue) PeerInitiated() bool {
+	return dg.peerInitiated
+}
+
 func (dg *dialogue) Write(pkt packet.Packet) error {
-	dg.mtx.RLock()
-	defer dg.mtx.RUnlock()
+	return dg.WritePriority(pkt, 0)
+}
 
+func (dg *dialogue) write(pkt packet.Packet) error {
+	dg.mtx.RLock()
 	if !dg.dialogueOK {
-		return io.EOF
+		err := dg.closedErr()
+		dg.mtx.RUnlock()
+		return err
+	}
+	if dg.packetSize > 0 && payloadLen(pkt) > dg.packetSize {
+		dg.mtx.RUnlock()
+		return ErrPacketTooLarge
 	}
 	pkt.(packet.SessionAbove).SetSessionID(dg.dialogueID)
+	if dg.namespace != 0 {
+		if nsPkt, ok := pkt.(packet.Namespaced); ok {
+			nsPkt.SetNamespace(dg.namespace)
+		}
+	}
+	dg.stats.stamp(pkt)
 	dg.writeInCh <- pkt
+	changed, congested := dg.congestionChanged(dg.writeInCh, dg.writeOutCh)
+	dg.mtx.RUnlock()
+	// out of the lock, the callback may write or close the dialogue
+	if changed {
+		dg.notifyCongestion(congested)
+	}
 	return nil
 }
 
+// Congested returns true since the queued packets reached 3/4 of the write
+// buffers, until they drained to 1/4.
+func (dg *dialogue) Congested() bool {
+	return atomic.LoadInt32(&dg.congested) == 1
+}
+
+func (dg *dialogue) updateCongestion(writeInCh, writeOutCh chan packet.Packet) {
+	if changed, congested := dg.congestionChanged(writeInCh, writeOutCh); changed {
+		dg.notifyCongestion(congested)
+	}
+}
+
+// congestionChanged takes the transition of the congestion, and returns
+// whether it changed and the state changed to
+func (dg *dialogue) congestionChanged(writeInCh, writeOutCh chan packet.Packet) (bool, bool) {
+	queued := len(writeInCh) + len(writeOutCh) + dg.prio.len()
+	capacity := dg.writeInSize + dg.writeOutSize
+	if atomic.LoadInt32(&dg.congested) == 0 {
+		return queued >= capacity*3/4 && atomic.CompareAndSwapInt32(&dg.congested, 0, 1), true
+	}
+	return queued <= capacity/4 && atomic.CompareAndSwapInt32(&dg.congested, 1, 0), false
+}
+
+// notifyCongestion must be called without the dialogue locked, since the
+// callback may write or close the dialogue
+func (dg *dialogue) notifyCongestion(congested bool) {
+	if !congested {
+		select {
+		case dg.writable <- struct{}{}:
+		default:
+		}
+	}
+	if dg.congestionFn != nil {
+		dg.congestionFn(dg, congested)
+	}
+}
+
+// WritableSignal fires once the dialogue recovered from the congestion, a
+// signal not taken is kept until the next recovery, so drain it before
+// waiting if a stale one matters.
+func (dg *dialogue) WritableSignal() <-chan struct{} {
+	return dg.writable
+}
+
+// BufferCaps returns the capacities of the buffers actually allocated
+func (dg *dialogue) BufferCaps() (readIn, writeIn, readOut, writeOut int) {
+	return cap(dg.readInCh), cap(dg.writeInCh), cap(dg.readOutCh), cap(dg.writeOutCh)
+}
+
+// Synced blocks until all packets queued before the call are written down
+// to the under layer conn, and returns the write error if any.
+func (dg *dialogue) Synced() error {
+	sp := newSyncPacket()
+	dg.mtx.RLock()
+	if !dg.dialogueOK {
+		dg.mtx.RUnlock()
+		return dg.closedErr()
+	}
+	dg.writeInCh <- sp
+	dg.mtx.RUnlock()
+	return <-sp.done
+}
+
 func (dg *dialogue) Read() (packet.Packet, error) {
+	return dg.ReadContext(context.Background())
+}
+
+func (dg *dialogue) ReadContext(ctx context.Context) (packet.Packet, error) {
+	select {
+	case pkt, ok := <-dg.readOutCh:
+		if !ok {
+			return nil, dg.closedErr()
+		}
+		return pkt, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (dg *dialogue) ReadWithContext(ctx context.Context) (packet.Packet, error) {
+	return dg.ReadContext(ctx)
+}
+
+func (dg *dialogue) TryRead() (packet.Packet, bool) {
+	select {
+	case pkt, ok := <-dg.readOutCh:
+		return pkt, ok
+	default:
+		return nil, false
+	}
+}
+
+// ReadBatch reads one packet at least, a max less than 1 is taken as 1
+func (dg *dialogue) ReadBatch(max int) ([]packet.Packet, error) {
 	pkt, ok := <-dg.readOutCh
 	if !ok {
-		return nil, io.EOF
+		return nil, dg.closedErr()
+	}
+	if max < 1 {
+		max = 1
 	}
-	return pkt, nil
+	pkts := make([]packet.Packet, 1, max)
+	pkts[0] = pkt
+	for len(pkts) < max {
+		select {
+		case pkt, ok := <-dg.readOutCh:
+			if !ok {
+				// the EOF is left to the next read
+				return pkts, nil
+			}
+			pkts = append(pkts, pkt)
+		default:
+			return pkts, nil
+		}
+	}
+	return pkts, nil
 }
 
 func (dg *dialogue) ReadC() <-chan packet.Packet {
 	return dg.readOutCh
 }
 
+// State returns the current state of the dialogue, e.g. sessioned
+func (dg *dialogue) State() string {
+	state, _ := dg.state.Load().(string)
+	return state
+}
+
+// emitEvent notifies the state change after the fsm released its lock, so
+// the hook is free to query the dialogue
+func (dg *dialogue) emitEvent(event string) error {
+	err := dg.fsm.EmitEvent(event)
+	if err != nil {
+		return err
+	}
+	old, new := dg.State(), dg.fsm.State()
+	if old == new {
+		return nil
+	}
+	dg.state.Store(new)
+	if dg.onStateChange != nil {
+		dg.onStateChange(old, new)
+	}
+	return nil
+}
+
 func (dg *dialogue) initFSM() {
 	init := dg.fsm.AddState(INIT)
 	sessionsent := dg.fsm.AddState(SESSION_SENT)
@@ -253,6 +622,9 @@ func (dg *dialogue) initFSM() {
 	dg.fsm.AddEvent(ET_DISMISSACK, dismissrecv, dismisshalf)
 	dg.fsm.AddEvent(ET_DISMISSACK, dismisshalf, dismissed)
 
+	// keepalive timeout
+	dg.fsm.AddEvent(ET_ERROR, sessioned, dismissed)
+
 	// fini
 	dg.fsm.AddEvent(ET_FINI, init, fini)
 	dg.fsm.AddEvent(ET_FINI, sessionsent, fini)
@@ -264,63 +636,208 @@ func (dg *dialogue) initFSM() {
 	dg.fsm.AddEvent(ET_FINI, dismissed, fini)
 }
 
+// the handlers from options follow the ones added in initFSM
+func (dg *dialogue) addTransitionHandlers() {
+	if len(dg.transitions) == 0 {
+		return
+	}
+	// ET_SESSIONACK shares the name with ET_SESSIONRECV
+	events := []string{ET_SESSIONSENT, ET_SESSIONRECV, ET_ERROR,
+		ET_DISMISSSENT, ET_DISMISSRECV, ET_DISMISSACK, ET_FINI}
+	for _, event := range events {
+		for _, et := range dg.fsm.GetEvents(event) {
+			for _, handler := range dg.transitions[et.To.State] {
+				handler := handler
+				et.AddHandler(func(et *yafsm.Event) {
+					handler(et.Event, et.From.State, et.To.State)
+				})
+			}
+		}
+	}
+}
+
 func (dg *dialogue) open() error {
 	dg.log.Debugf("dialogue is opening, clientID: %d, dialogueID: %d",
 		dg.cn.ClientID(), dg.dialogueID)
 
+	if dg.metaFn != nil {
+		dg.meta = dg.metaFn()
+	}
 	var pkt *packet.SessionPacket
 	pkt = dg.pf.NewSessionPacket(dg.negotiatingID, dg.dialogueIDPeersCall, dg.meta, dg.peer)
-	// sync must set before the packet send down, in case of the ack coming first
-	sync := dg.shub.Add(pkt.PacketID, synchub.WithTimeout(30*time.Second))
-
+	pkt.SessionFlags.Qos = dg.qos
+	pkt.SessionData.MaxPacketSize = dg.maxPacketSize
+	if dg.resumeID != packet.SessionIDNull {
+		pkt.SetResume(dg.resumeID)
+	}
 	dg.mtx.RLock()
 	if !dg.dialogueOK {
 		dg.mtx.RUnlock()
-		return io.EOF
+		dg.batch.cancel()
+		return newOpenError(io.EOF)
 	}
+	// sync must set before the packet send down, in case of the ack coming
+	// first, and the shub is collected once not ok
+	sync := dg.shub.Add(pkt.PacketID, synchub.WithTimeout(dg.syncTimeout))
+	sent := time.Now()
 	dg.writeInCh <- pkt
 	dg.mtx.RUnlock()
 
 	event := <-sync.C()
-	if event.Error != nil {
-		dg.log.Debugf("dialogue open err: %s, clientID: %d, dialogueID: %d",
-			event.Error, dg.cn.ClientID(), dg.dialogueID)
-		dg.mtx.Lock()
-		if dg.dialogueOK {
-			close(dg.readInCh)
-		}
-		dg.mtx.Unlock()
+	if event.Error == nil {
+		dg.handshaked(time.Since(sent))
+		dg.auditOpen(nil)
+		return nil
+	}
+	err := newOpenError(event.Error)
+	dg.auditOpen(err)
+	dg.log.Debugf("dialogue open err: %s, clientID: %d, dialogueID: %d",
+		err, dg.cn.ClientID(), dg.dialogueID)
+	if err.Kind == OpenErrorTimeout {
+		dg.syncTimedOut(pkt.PacketID, "open")
 	}
-	return event.Error
+	dg.mtx.Lock()
+	if dg.dialogueOK {
+		dg.closeIO()
+	}
+	dg.mtx.Unlock()
+	return err
 }
 
-// we may or not separate the goroutine because the underlay is still a channel
-func (dg *dialogue) writePkt() {
-	writeOutCh := dg.writeOutCh
+// we may or not separate the goroutine because the underlay is still a channel,
+// the channels are passed in since fini collects them
+func (dg *dialogue) writePkt(writeInCh, writeOutCh chan packet.Packet) {
 	err := error(nil)
+	// data packets of a bulk dialogue are coalesced and written down together
+	coalesce := dg.coalesceDelay > 0 && !dg.interactive
+	batch := []packet.Packet{}
+	var (
+		flushTimer *time.Timer
+		flushC     <-chan time.Time
+	)
 
 	for {
-		select {
-		case pkt, ok := <-writeOutCh:
-			if !ok {
-				dg.log.Debugf("dialogue write done, clientID: %d, dialogueID: %d",
-					dg.cn.ClientID(), dg.dialogueID)
-				return
+		if dg.prio.len() == 0 && !dg.prio.closed {
+			select {
+			case pkt, ok := <-writeOutCh:
+				if !ok {
+					dg.prio.closed = true
+					break
+				}
+				dg.prio.push(pkt)
+			case <-flushC:
+				flushTimer, flushC = nil, nil
+				err = dg.writeBatch(batch)
+				batch = batch[:0]
+				if err != nil {
+					dg.drainWritePkt(writeOutCh, err)
+					return
+				}
+				continue
 			}
-			dg.log.Tracef("dialogue write down, clientID: %d, dialogueID: %d, packetID: %d, packetType: %s",
-				dg.cn.ClientID(), dg.dialogueID, pkt.ID(), pkt.Type().String())
-			err = dg.dowritePkt(pkt, true)
-			if err != nil {
-				dg.log.Errorf("dialogue write down err: %s, clientID: %d, dialogueID: %d, packetID: %d, packetType: %s",
-					err, dg.cn.ClientID(), dg.dialogueID, pkt.ID(), pkt.Type().String())
+		}
+		// the pending ones are read ahead for the higher priority to go first
+		dg.prio.fill(writeOutCh)
+		pkt, eof := dg.prio.pop()
+		if eof != nil {
+			if flushTimer != nil {
+				flushTimer.Stop()
+			}
+			if err = dg.writeBatch(batch); err != nil {
+				dg.drainWritePkt(writeOutCh, err)
 				return
 			}
+			dg.log.Debugf("dialogue write done, clientID: %d, dialogueID: %d",
+				dg.cn.ClientID(), dg.dialogueID)
+			return
+		}
+		dg.log.Tracef("dialogue write down, clientID: %d, dialogueID: %d, packetID: %d, packetType: %s",
+			dg.cn.ClientID(), dg.dialogueID, pkt.ID(), pkt.Type().String())
+		dg.updateCongestion(writeInCh, writeOutCh)
+		_, isSync := pkt.(*syncPacket)
+		if coalesce && !isSync && !packet.SessionLayer(pkt) {
+			batch = append(batch, pkt)
+			if dg.coalesceSize <= 0 || len(batch) < dg.coalesceSize {
+				if flushTimer == nil {
+					flushTimer = time.NewTimer(dg.coalesceDelay)
+					flushC = flushTimer.C
+				}
+				continue
+			}
+			pkt = nil
+		}
+		// the batch must be written ahead to keep the order
+		if flushTimer != nil {
+			flushTimer.Stop()
+			flushTimer, flushC = nil, nil
+		}
+		err = dg.writeBatch(batch)
+		batch = batch[:0]
+		if err == nil && pkt != nil {
+			err = dg.writeBatch([]packet.Packet{pkt})
+		}
+		if err != nil {
+			dg.drainWritePkt(writeOutCh, err)
+			return
+		}
+	}
+}
+
+func (dg *dialogue) writeBatch(pkts []packet.Packet) error {
+	for _, pkt := range pkts {
+		if sp, ok := pkt.(*syncPacket); ok {
+			// all packets before the sync packet are written down
+			sp.done <- nil
+			continue
+		}
+		err := dg.dowritePkt(pkt, true)
+		if err != nil {
+			dg.log.Errorf("dialogue write down err: %s, clientID: %d, dialogueID: %d, packetID: %d, packetType: %s",
+				err, dg.cn.ClientID(), dg.dialogueID, pkt.ID(), pkt.Type().String())
+			return err
+		}
+		dg.stats.touchWrite()
+		dg.stats.observeWrite(pkt)
+		dg.recordPacket(pkt, packet.DirectionOut)
+	}
+	return nil
+}
+
+// keep draining the writeOutCh to release the handlePkt and the waiting Synced
+func (dg *dialogue) drainWritePkt(writeOutCh chan packet.Packet, err error) {
+	fail := func(pkt packet.Packet) {
+		if sp, ok := pkt.(*syncPacket); ok {
+			sp.done <- err
+			return
+		}
+		if dg.failedCh != nil && !packet.SessionLayer(pkt) {
+			dg.failedCh <- pkt
+		}
+	}
+	// the read ahead ones go first
+	for {
+		pkt, eof := dg.prio.pop()
+		if pkt == nil || eof != nil {
+			break
 		}
+		fail(pkt)
+	}
+	if dg.prio.closed {
+		return
+	}
+	for pkt := range writeOutCh {
+		fail(pkt)
 	}
 }
 
 func (dg *dialogue) dowritePkt(pkt packet.Packet, record bool) error {
-	err := dg.cn.Write(pkt)
+	var err error
+	dg.stats.countWrite(pkt)
+	if dg.sched != nil {
+		err = dg.sched.write(dg.qos, pkt)
+	} else {
+		err = dg.cn.Write(pkt)
+	}
 	if err != nil {
 		dg.log.Errorf("dialogue write down err: %s, clientID: %d, dialogueID: %d, packetID: %d, packetType: %s",
 			err, dg.cn.ClientID(), dg.dialogueID, pkt.ID(), pkt.Type().String())
@@ -344,9 +861,16 @@ func (dg *dialogue) handlePkt() {
 			}
 			dg.log.Tracef("dialogue read in packet, clientID: %d, dialogueID: %d, packetID: %d, packetType: %s",
 				dg.cn.ClientID(), dg.dialogueID, pkt.ID(), pkt.Type().String())
+			dg.stats.touchRead()
+			dg.stats.countRead(pkt)
+			dg.recordPacket(pkt, packet.DirectionIn)
+			dg.assertLive("handle in " + pkt.Type().String())
 			ret := dg.handleIn(pkt)
 			switch ret {
-			case iodefine.IONewActive, iodefine.IOSuccess:
+			case iodefine.IONewActive, iodefine.IONewPassive, iodefine.IOSuccess:
+				continue
+			case iodefine.IODiscard:
+				// dropped, such as the stale dismisses and resets
 				continue
 			case iodefine.IOClosed:
 				goto FINI
@@ -360,6 +884,7 @@ func (dg *dialogue) handlePkt() {
 			}
 			dg.log.Tracef("dialogue write in packet, clientID: %d, dialogueID: %d, packetID: %d, packetType: %s",
 				dg.cn.ClientID(), dg.dialogueID, pkt.ID(), pkt.Type().String())
+			dg.assertLive("handle out " + pkt.Type().String())
 			ret := dg.handleOut(pkt)
 			switch ret {
 			case iodefine.IONewPassive, iodefine.IOSuccess:
@@ -377,7 +902,10 @@ FINI:
 
 	// only onlined Dialogue need to be notified
 	if dg.dlgt != nil && dg.onlined {
-		dg.dlgt.DialogueOffline(dg)
+		dg.dlgt.DialogueOffline(dg, dg.CloseReason())
+	}
+	if dg.onlined {
+		dg.auditClose()
 	}
 	// only handlePkt leads to this fini, and reclaims all channels and other resources
 	dg.fini()
@@ -393,7 +921,16 @@ func (dg *dialogue) handleIn(pkt packet.Packet) iodefine.IORet {
 		return dg.handleInDismissPacket(realPkt)
 	case *packet.DismissAckPacket:
 		return dg.handleInDimssAckPacket(realPkt)
+	case *packet.ResetPacket:
+		return dg.handleInResetPacket(realPkt)
+	case *packet.SessionHeartbeatPacket:
+		return dg.handleInSessionHeartbeatPacket(realPkt)
+	case *packet.SessionHeartbeatAckPacket:
+		return dg.handleInSessionHeartbeatAckPacket(realPkt)
 	default:
+		if dg.strictPackets && !packet.AppLayer(pkt) {
+			return dg.handleInUnknownPacket(pkt)
+		}
 		return dg.handleInDataPacket(pkt)
 	}
 }
@@ -408,6 +945,13 @@ func (dg *dialogue) handleOut(pkt packet.Packet) iodefine.IORet {
 		return dg.handleOutDismissPacket(realPkt)
 	case *packet.DismissAckPacket:
 		return dg.handleOutDismissAckPacket(realPkt)
+	case *syncPacket:
+		// keep the order with data packets
+		dg.writeOutCh <- realPkt
+		return iodefine.IOSuccess
+	case *packet.SessionHeartbeatPacket:
+		dg.writeOutCh <- realPkt
+		return iodefine.IOSuccess
 	default:
 		return dg.handleOutDataPacket(pkt)
 	}
@@ -415,10 +959,16 @@ func (dg *dialogue) handleOut(pkt packet.Packet) iodefine.IORet {
 
 // input packet
 func (dg *dialogue) handleInSessionPacket(pkt *packet.SessionPacket) iodefine.IORet {
-	dg.peerNegotiatingID = pkt.NegotiateID()
+	// a duplicate or spoofed open mustn't tear down the dialogue negotiated
+	if dg.fsm.State() != INIT {
+		dg.log.Warnf("read dialogue packet at state: %s, clientID: %d, negotiateID: %d, dialogueID: %d, packetID: %d",
+			dg.fsm.State(), dg.cn.ClientID(), pkt.NegotiateID(), dg.dialogueID, pkt.ID())
+		packet.NotifyDrop(dg.dropObserver, pkt, packet.DropReasonDuplicateSession, packet.DirectionIn)
+		return iodefine.IOSuccess
+	}
 	dg.log.Debugf("read dialogue packet, clientID: %d, negotiateID: %d, dialogueID: %d, packetID: %d",
 		dg.cn.ClientID(), pkt.NegotiateID(), dg.negotiatingID, pkt.ID())
-	err := dg.fsm.EmitEvent(ET_SESSIONRECV)
+	err := dg.emitEvent(ET_SESSIONRECV)
 	if err != nil {
 		dg.log.Debugf("emit ET_SESSIONRECV err: %s, clientID: %d, dialogueID: %d, packetID: %d",
 			err, dg.cn.ClientID(), dg.negotiatingID, pkt.ID())
@@ -433,24 +983,54 @@ func (dg *dialogue) handleInSessionPacket(pkt *packet.SessionPacket) iodefine.IO
 	}
 	dg.dialogueID = dialogueID
 	dg.meta = pkt.SessionData.Meta
+	atomic.StoreUint64(&dg.epoch, id.RandomUint64())
+
+	// the requested QoS is downgraded to our max
+	dg.qos = pkt.SessionFlags.Qos
+	if dg.qos > dg.maxQoS {
+		dg.qos = dg.maxQoS
+	}
+	dg.negotiatePacketSize(pkt.SessionData.MaxPacketSize)
 
 	retPkt := dg.pf.NewSessionAckPacket(pkt.PacketID, pkt.NegotiateID(), dialogueID, nil)
-	dg.writeInCh <- retPkt
-	return iodefine.IOSuccess
+	retPkt.SessionData.Epoch = atomic.LoadUint64(&dg.epoch)
+	retPkt.SessionFlags.Qos = dg.qos
+	retPkt.SessionData.MaxPacketSize = dg.maxPacketSize
+	// handle the ack out here rather than putting it into our own writeInCh,
+	// which may block this goroutine. The ack is queued to writeOutCh after
+	// DialogueOnline decided it, and before any data from the upper layer.
+	return dg.handleOutSessionAckPacket(retPkt)
 }
 
 func (dg *dialogue) handleInSessionAckPacket(pkt *packet.SessionAckPacket) iodefine.IORet {
 	dg.log.Debugf("read dialogue ack packet, clientID: %d, dialogueID: %d, packetID: %d",
 		dg.cn.ClientID(), pkt.SessionID(), pkt.ID())
-	err := dg.fsm.EmitEvent(ET_SESSIONACK)
+	err := dg.emitEvent(ET_SESSIONACK)
 	if err != nil {
 		dg.log.Debugf("emit ET_SESSIONACK err: %s, clientID: %d, dialogueID: %d, packetID: %d",
 			err, dg.cn.ClientID(), dg.dialogueID, pkt.ID())
 		dg.shub.Error(pkt.ID(), err)
 		return iodefine.IOErr
 	}
+	if pkt.SessionData.Error != "" {
+		err = newRejectedError(pkt.SessionData)
+		dg.log.Debugf("read dialogue ack packet with err: %s, clientID: %d, dialogueID: %d, packetID: %d",
+			err, dg.cn.ClientID(), pkt.SessionID(), pkt.ID())
+		// the peer refused, no more negotiating
+		dg.shub.Error(pkt.ID(), err)
+		return iodefine.IOErr
+	}
 	dg.dialogueID = pkt.SessionID()
-	dg.meta = pkt.SessionData.Meta
+	atomic.StoreUint64(&dg.epoch, pkt.SessionData.Epoch)
+	// peers without QoS ack 0
+	if pkt.SessionFlags.Qos < dg.qos {
+		dg.qos = pkt.SessionFlags.Qos
+	}
+	dg.negotiatePacketSize(pkt.SessionData.MaxPacketSize)
+	// the ack doesn't carry meta unless peer replaces it
+	if pkt.SessionData.Meta != nil {
+		dg.meta = pkt.SessionData.Meta
+	}
 
 	// the packetID is assigned by SessionPacket, originally from function open,
 	// and open is waiting for the completion.
@@ -460,30 +1040,62 @@ func (dg *dialogue) handleInSessionAckPacket(pkt *packet.SessionAckPacket) iodef
 			dg.cn.ClientID(), dg.dialogueID, pkt.ID())
 	}
 	dg.onlined = true
+	dg.startKeepalive()
 	return iodefine.IONewActive
 }
 
 func (dg *dialogue) handleInDismissPacket(pkt *packet.DismissPacket) iodefine.IORet {
 	dg.log.Debugf("read dismiss packet, clientID: %d, dialogueID: %d, packetID: %d",
 		dg.cn.ClientID(), dg.dialogueID, pkt.ID())
-	err := dg.fsm.EmitEvent(ET_DISMISSRECV)
+	// a dismiss replayed from a previous session with the same dialogueID,
+	// no ack for it, or else the previous closer might be confused.
+	epoch := atomic.LoadUint64(&dg.epoch)
+	if pkt.SessionData.Epoch != 0 && epoch != 0 && pkt.SessionData.Epoch != epoch {
+		dg.log.Warnf("read stale dismiss packet, clientID: %d, dialogueID: %d, packetID: %d, epoch: %d, current epoch: %d",
+			dg.cn.ClientID(), dg.dialogueID, pkt.ID(), pkt.SessionData.Epoch, epoch)
+		packet.NotifyDrop(dg.dropObserver, pkt, packet.DropReasonStaleEpoch, packet.DirectionIn)
+		return iodefine.IODiscard
+	}
+	err := dg.emitEvent(ET_DISMISSRECV)
 	if err != nil {
 		dg.log.Debugf("emit ET_DISMISSRECV err: %s, clientID: %d, dialogueID: %d, packetID: %d",
 			err, dg.cn.ClientID(), dg.dialogueID, pkt.ID())
 		return iodefine.IOErr
 	}
+	dg.setCloseReason(CloseReasonDismiss)
+	if pkt.SessionData.Error != "" {
+		dg.dismissReason.Store(pkt.SessionData.Error)
+	}
 	retPkt := dg.pf.NewDismissAckPacket(pkt.ID(),
 		pkt.SessionID(), nil)
+	dg.assertWriteInOpen("dismiss ack")
 	dg.writeInCh <- retPkt
 	// send out side dismiss while receiving dismiss packet
 	dg.Close()
 	return iodefine.IOSuccess
 }
 
+func (dg *dialogue) handleInResetPacket(pkt *packet.ResetPacket) iodefine.IORet {
+	dg.log.Debugf("read reset packet, clientID: %d, dialogueID: %d, packetID: %d",
+		dg.cn.ClientID(), dg.dialogueID, pkt.ID())
+	// the same as dismiss, a reset from a previous session is ignored
+	epoch := atomic.LoadUint64(&dg.epoch)
+	if pkt.SessionData.Epoch != 0 && epoch != 0 && pkt.SessionData.Epoch != epoch {
+		dg.log.Warnf("read stale reset packet, clientID: %d, dialogueID: %d, packetID: %d, epoch: %d, current epoch: %d",
+			dg.cn.ClientID(), dg.dialogueID, pkt.ID(), pkt.SessionData.Epoch, epoch)
+		packet.NotifyDrop(dg.dropObserver, pkt, packet.DropReasonStaleEpoch, packet.DirectionIn)
+		return iodefine.IODiscard
+	}
+	atomic.StoreInt32(&dg.closeReason, int32(CloseReasonReset))
+	// no more dismiss, and fini right now
+	dg.closeOnce.Do(func() {})
+	return iodefine.IOClosed
+}
+
 func (dg *dialogue) handleInDimssAckPacket(pkt *packet.DismissAckPacket) iodefine.IORet {
 	dg.log.Debugf("read dismiss ack packet, clientID: %d, dialogueID: %d, packetID: %d",
 		dg.cn.ClientID(), dg.dialogueID, pkt.ID())
-	err := dg.fsm.EmitEvent(ET_DISMISSACK)
+	err := dg.emitEvent(ET_DISMISSACK)
 	if err != nil {
 		dg.log.Debugf("emit ET_DISMISSACK err: %s, clientID: %d, dialogueID: %d, packetID: %d",
 			err, dg.cn.ClientID(), dg.dialogueID, pkt.ID())
@@ -499,6 +1111,14 @@ func (dg *dialogue) handleInDimssAckPacket(pkt *packet.DismissAckPacket) iodefin
 	return iodefine.IOClosed
 }
 
+func (dg *dialogue) handleInUnknownPacket(pkt packet.Packet) iodefine.IORet {
+	dg.log.Errorf("read unknown packet in strict mode, reset the dialogue, clientID: %d, dialogueID: %d, packetID: %d, packetType: %s",
+		dg.cn.ClientID(), dg.dialogueID, pkt.ID(), pkt.Type().String())
+	packet.NotifyDrop(dg.dropObserver, pkt, packet.DropReasonUnknownType, packet.DirectionIn)
+	dg.reset(CloseReasonUnknownPacket)
+	return iodefine.IOClosed
+}
+
 func (dg *dialogue) handleInDataPacket(pkt packet.Packet) iodefine.IORet {
 	// we regard statuses which include sessioned, dismiss_half, dismiss_sent as normal statuses
 	// and status dismiss_recv should be optimized from client side.
@@ -506,23 +1126,62 @@ func (dg *dialogue) handleInDataPacket(pkt packet.Packet) iodefine.IORet {
 	if !ok {
 		dg.log.Debugf("data at non normal status, clientID: %d, dialogueID: %d, packetID: %d, status: %s",
 			dg.cn.ClientID(), dg.dialogueID, pkt.ID(), dg.fsm.State())
+		packet.NotifyDrop(dg.dropObserver, pkt, packet.DropReasonDialogueAbnormal, packet.DirectionIn)
 		if dg.failedCh != nil {
 			dg.failedCh <- pkt
 		}
 		return iodefine.IODiscard
 	}
+	if dg.unconsumedTimeout <= 0 || dg.unconsumedPolicy == UnconsumedBlock {
+		dg.readOutCh <- pkt
+		return iodefine.IOSuccess
+	}
+	select {
+	case dg.readOutCh <- pkt:
+		return iodefine.IOSuccess
+	default:
+	}
+	// the buffer is full, wait for the reader at most the timeout
+	timer := time.NewTimer(dg.unconsumedTimeout)
+	defer timer.Stop()
+	select {
+	case dg.readOutCh <- pkt:
+		return iodefine.IOSuccess
+	case <-timer.C:
+	}
+	dg.log.Warnf("dialogue read buffer unconsumed, clientID: %d, dialogueID: %d, packetID: %d, timeout: %s",
+		dg.cn.ClientID(), dg.dialogueID, pkt.ID(), dg.unconsumedTimeout)
+	if dg.unconsumedPolicy == UnconsumedClose {
+		packet.NotifyDrop(dg.dropObserver, pkt, packet.DropReasonUnconsumed, packet.DirectionIn)
+		dg.reset(CloseReasonUnconsumed)
+		return iodefine.IOClosed
+	}
+	// drain the buffered and leave room for the latest
+	for len(dg.readOutCh) > 0 {
+		select {
+		case buffered := <-dg.readOutCh:
+			atomic.AddUint64(&dg.stats.dropped, 1)
+			packet.NotifyDrop(dg.dropObserver, buffered, packet.DropReasonUnconsumed, packet.DirectionIn)
+		default:
+		}
+	}
 	dg.readOutCh <- pkt
 	return iodefine.IOSuccess
 }
 
 // output packet
 func (dg *dialogue) handleOutSessionPacket(pkt *packet.SessionPacket) iodefine.IORet {
-	err := dg.fsm.EmitEvent(ET_SESSIONSENT)
+	err := dg.emitEvent(ET_SESSIONSENT)
 	if err != nil {
 		dg.log.Errorf("emit ET_SESSIONSENT err: %s, clientID: %d, dialogueID: %d, packetID: %d",
 			err, dg.cn.ClientID(), pkt.NegotiateID(), pkt.ID())
+		dg.batch.cancel()
 		return iodefine.IOErr
 	}
+	if dg.batch != nil {
+		dg.batch.add(dg, pkt)
+		return iodefine.IOSuccess
+	}
 	dg.writeOutCh <- pkt
 	dg.log.Debugf("send dialogue down succeed, clientID: %d, dialogueID: %d, packetID: %d",
 		dg.cn.ClientID(), pkt.NegotiateID(), pkt.ID())
@@ -536,8 +1195,9 @@ func (dg *dialogue) handleOutSessionAckPacket(pkt *packet.SessionAckPacket) iode
 		// notify delegation the online event
 		err = dg.dlgt.DialogueOnline(dg)
 		if err != nil {
+			dg.auditOpen(err)
 			pkt.SetError(err)
-			err = dg.fsm.EmitEvent(ET_ERROR)
+			err = dg.emitEvent(ET_ERROR)
 			if err != nil {
 				dg.log.Errorf("emit ET_ERROR err: %s, clientID: %d, dialogueID: %d, packetID: %d",
 					err, dg.cn.ClientID(), pkt.NegotiateID(), pkt.ID())
@@ -549,7 +1209,7 @@ func (dg *dialogue) handleOutSessionAckPacket(pkt *packet.SessionAckPacket) iode
 			return iodefine.IOSuccess
 		}
 	}
-	err = dg.fsm.EmitEvent(ET_SESSIONACK)
+	err = dg.emitEvent(ET_SESSIONACK)
 	if err != nil {
 		dg.log.Debugf("emit ET_SESSIONACK err: %s, clientID: %d, dialogueID: %d, packetID: %d",
 			err, dg.cn.ClientID(), dg.dialogueID, pkt.ID())
@@ -560,11 +1220,16 @@ func (dg *dialogue) handleOutSessionAckPacket(pkt *packet.SessionAckPacket) iode
 		dg.cn.ClientID(), dg.dialogueID, pkt.ID())
 
 	dg.onlined = true
+	dg.auditOpen(nil)
+	dg.startKeepalive()
 	return iodefine.IONewPassive
 }
 
 func (dg *dialogue) handleOutDismissPacket(pkt *packet.DismissPacket) iodefine.IORet {
-	err := dg.fsm.EmitEvent(ET_DISMISSSENT)
+	// the packet may be made before the session acked
+	pkt.SetSessionID(dg.dialogueID)
+	pkt.SessionData.Epoch = atomic.LoadUint64(&dg.epoch)
+	err := dg.emitEvent(ET_DISMISSSENT)
 	if err != nil {
 		dg.log.Errorf("emit ET_SESSIONSENT err: %s, clientID: %d, dialogueID: %d, packetID: %d",
 			err, dg.cn.ClientID(), dg.dialogueID, pkt.ID())
@@ -577,7 +1242,7 @@ func (dg *dialogue) handleOutDismissPacket(pkt *packet.DismissPacket) iodefine.I
 }
 
 func (dg *dialogue) handleOutDismissAckPacket(pkt *packet.DismissAckPacket) iodefine.IORet {
-	err := dg.fsm.EmitEvent(ET_DISMISSACK)
+	err := dg.emitEvent(ET_DISMISSACK)
 	if err != nil {
 		dg.log.Errorf("emit ET_DISMISSACK err: %s, clientID: %d, dialogueID: %d, packetID: %d, state: %s",
 			err, dg.cn.ClientID(), dg.dialogueID, pkt.ID(), dg.fsm.State())
@@ -608,18 +1273,26 @@ func (dg *dialogue) handleOutDataPacket(pkt packet.Packet) iodefine.IORet {
 }
 
 func (dg *dialogue) Close() {
+	dg.CloseWithReason("")
+}
+
+// CloseWithReason closes the dialogue like Close, the reason is carried by
+// the dismiss packet and readable from DismissReason at the peer.
+func (dg *dialogue) CloseWithReason(reason string) {
 	dg.closeOnce.Do(func() {
 		pkt := dg.pf.NewDismissPacket(dg.dialogueID)
-		// we need a tick in case of never receiving the dismiss ack packet
-		dg.closewait = dg.shub.New(pkt.PacketID, synchub.WithTimeout(30*time.Second))
-
+		pkt.SessionData.Epoch = atomic.LoadUint64(&dg.epoch)
+		pkt.SessionData.Error = reason
 		dg.mtx.RLock()
 		defer dg.mtx.RUnlock()
 		if !dg.dialogueOK {
 			return
 		}
+		// we need a tick in case of never receiving the dismiss ack packet
+		dg.closewait = dg.shub.New(pkt.PacketID, synchub.WithTimeout(dg.dismissWait()))
 		dg.log.Debugf("dialogue async close, clientID: %d, dialogueID: %d",
 			dg.cn.ClientID(), dg.dialogueID)
+		dg.setCloseReason(CloseReasonDismiss)
 
 		dg.writeInCh <- pkt
 
@@ -630,6 +1303,7 @@ func (dg *dialogue) Close() {
 				dg.log.Debugf("dialogue close wait err: %s, clientID: %d, peerDialogueID: %d, dialogueID: %d",
 					event.Error, dg.cn.ClientID(), dg.peerNegotiatingID, dg.dialogueID)
 				if event.Error == synchub.ErrSyncTimeout {
+					dg.syncTimedOut(pkt.PacketID, "close")
 					// timeout and exit the dialogue
 					dg.closeIO()
 				}
@@ -638,28 +1312,103 @@ func (dg *dialogue) Close() {
 	})
 }
 
+// Reset sends a best-effort reset packet, and closes the dialogue without
+// waiting for any ack, even if a dismiss handshake is hanging.
+func (dg *dialogue) Reset() {
+	dg.reset(CloseReasonReset)
+}
+
+func (dg *dialogue) reset(reason CloseReason) {
+	dg.resetOnce.Do(func() {
+		// no more dismiss after reset
+		dg.closeOnce.Do(func() {})
+
+		dg.mtx.RLock()
+		defer dg.mtx.RUnlock()
+		if !dg.dialogueOK {
+			return
+		}
+		dg.log.Debugf("dialogue resetting, clientID: %d, dialogueID: %d",
+			dg.cn.ClientID(), dg.dialogueID)
+		atomic.StoreInt32(&dg.closeReason, int32(reason))
+
+		pkt := dg.pf.NewResetPacket(dg.dialogueID)
+		pkt.SessionData.Epoch = atomic.LoadUint64(&dg.epoch)
+		// bypass the queued packets which may never be written, and don't
+		// wait for the conn since the peer might be unresponsive
+		dg.stats.countWrite(pkt)
+		go func() {
+			err := dg.cn.Write(pkt)
+			if err != nil {
+				dg.log.Debugf("dialogue write reset err: %s, clientID: %d, dialogueID: %d, packetID: %d",
+					err, dg.cn.ClientID(), pkt.SessionID(), pkt.ID())
+			}
+		}()
+		dg.closeIO()
+	})
+}
+
+// CloseReason returns how the dialogue was closed
+func (dg *dialogue) CloseReason() CloseReason {
+	return CloseReason(atomic.LoadInt32(&dg.closeReason))
+}
+
+// DismissReason returns the reason the peer dismissed the dialogue with,
+// empty if not given or not dismissed by peer.
+func (dg *dialogue) DismissReason() string {
+	reason, _ := dg.dismissReason.Load().(string)
+	return reason
+}
+
+// the dismiss doesn't override a reset
+func (dg *dialogue) setCloseReason(reason CloseReason) {
+	atomic.CompareAndSwapInt32(&dg.closeReason, int32(CloseReasonNone), int32(reason))
+}
+
 func (dg *dialogue) CloseWait() {
+	dg.CloseWaitContext(context.Background())
+}
+
+// CloseWaitContext sends the dismiss packet and waits for the dismiss ack,
+// the sync timeout still applies. If ctx is done first, the dialogue exits
+// without waiting and ctx.Err() is returned.
+func (dg *dialogue) CloseWaitContext(ctx context.Context) error {
+	var err error
 	// send close packet and wait for the end
 	dg.closeOnce.Do(func() {
 		pkt := dg.pf.NewDismissPacket(dg.dialogueID)
-		dg.closewait = dg.shub.New(pkt.PacketID, synchub.WithTimeout(30*time.Second))
+		pkt.SessionData.Epoch = atomic.LoadUint64(&dg.epoch)
 		dg.mtx.RLock()
 		if !dg.dialogueOK {
 			dg.mtx.RUnlock()
 			return
 		}
+		dg.closewait = dg.shub.New(pkt.PacketID, synchub.WithTimeout(dg.dismissWait()))
 
 		dg.log.Debugf("dialogue is closing, clientID: %d, dialogueID: %d",
 			dg.cn.ClientID(), dg.dialogueID)
+		dg.setCloseReason(CloseReasonDismiss)
 
 		dg.writeInCh <- pkt
 		dg.mtx.RUnlock()
 		// the sync shouldn't be locked
-		event := <-dg.closewait.C()
+		var event *synchub.Event
+		select {
+		case event = <-dg.closewait.C():
+		case <-ctx.Done():
+			err = ctx.Err()
+			dg.log.Debugf("dialogue close wait canceled: %s, clientID: %d, dialogueID: %d",
+				err, dg.cn.ClientID(), dg.dialogueID)
+			// give up the dismiss ack and exit the dialogue
+			dg.closeIO()
+			return
+		}
 		if event.Error != nil {
+			err = event.Error
 			dg.log.Debugf("dialogue close wait err: %s, clientID: %d, peerDialogueID: %d, dialogueID: %d",
 				event.Error, dg.cn.ClientID(), dg.peerNegotiatingID, dg.dialogueID)
 			if event.Error == synchub.ErrSyncTimeout {
+				dg.syncTimedOut(pkt.PacketID, "close")
 				// timeout and exit the dialogue
 				dg.closeIO()
 			}
@@ -667,13 +1416,55 @@ func (dg *dialogue) CloseWait() {
 		}
 		dg.log.Debugf("dialogue closed, clientID: %d, dialogueID: %d",
 			dg.cn.ClientID(), dg.dialogueID)
-		return
 	})
+	return err
+}
+
+// CloseAfterDrain waits for the reader to consume all data read in before
+// the dismiss handshake, so nothing received is dropped by closing. If ctx is
+// done while draining, the dialogue stays open and ctx.Err() is returned.
+func (dg *dialogue) CloseAfterDrain(ctx context.Context) error {
+	ticker := time.NewTicker(drainInterval)
+	defer ticker.Stop()
+	for !dg.drained() {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return dg.CloseWaitContext(ctx)
+}
+
+func (dg *dialogue) drained() bool {
+	dg.mtx.RLock()
+	defer dg.mtx.RUnlock()
+	if !dg.dialogueOK {
+		return true
+	}
+	return len(dg.readInCh) == 0 && len(dg.readOutCh) == 0
+}
+
+func (dg *dialogue) syncTimedOut(packetID uint64, op string) {
+	dg.log.Warnf("dialogue %s timeout, clientID: %d, dialogueID: %d, packetID: %d",
+		op, dg.cn.ClientID(), dg.dialogueID, packetID)
+	if dg.onSyncTimeout != nil {
+		dg.onSyncTimeout(packetID, op)
+	}
+}
+
+// dismissWait returns how long the closes wait for the dismiss handshake
+func (dg *dialogue) dismissWait() time.Duration {
+	if dg.dismissTimeout > 0 {
+		return dg.dismissTimeout
+	}
+	return dg.syncTimeout
 }
 
 func (dg *dialogue) closeIO() {
 	dg.closeIOOnce.Do(func() {
 		close(dg.readInCh)
+		dg.closed(&dg.inv.readInClosed)
 	})
 }
 
@@ -685,19 +1476,44 @@ func (dg *dialogue) closeWrapper(_ *yafsm.Event) {
 
 // finish and reclaim resources
 func (dg *dialogue) fini() {
+	dg.assertFiniOnce()
 	dg.log.Debugf("dialogue finishing, clientID: %d, dialogueID: %d",
 		dg.cn.ClientID(), dg.dialogueID)
-	// collect shub
-	dg.shub.Close()
-	dg.shub = nil
+	dg.stopKeepalive()
 
 	dg.mtx.Lock()
 	// TODO should we move dialogueOK=false to Close and CloseWait?
 	dg.dialogueOK = false
 	close(dg.writeInCh)
+	dg.closed(&dg.inv.writeInClosed)
 	dg.mtx.Unlock()
+	// collect shub, no more syncs added after not ok
+	dg.shub.Close()
+	dg.shub = nil
 
+	// writePkt is still writing down until writeOutCh closed
+	drain := dg.drainOnClose && dg.CloseReason() == CloseReasonDismiss
+	var drainC <-chan time.Time
+	if drain {
+		drainTimer := time.NewTimer(dg.dismissWait())
+		defer drainTimer.Stop()
+		drainC = drainTimer.C
+	}
 	for pkt := range dg.writeInCh {
+		if drain && !packet.SessionLayer(pkt) {
+			select {
+			case dg.writeOutCh <- pkt:
+				continue
+			case <-drainC:
+				dg.log.Warnf("dialogue drain on close timeout, clientID: %d, dialogueID: %d",
+					dg.cn.ClientID(), dg.dialogueID)
+				drain = false
+			}
+		}
+		if sp, ok := pkt.(*syncPacket); ok {
+			sp.done <- io.EOF
+			continue
+		}
 		if dg.failedCh != nil && !packet.SessionLayer(pkt) {
 			dg.failedCh <- pkt
 		}
@@ -711,7 +1527,7 @@ func (dg *dialogue) fini() {
 	// TODO we left the readInCh buffer at some edge cases which may cause peer msg timeout
 
 	// collect fsm
-	dg.fsm.EmitEvent(ET_FINI)
+	dg.emitEvent(ET_FINI)
 	dg.fsm.Close()
 	dg.fsm = nil
 
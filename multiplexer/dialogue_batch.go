@@ -0,0 +1,142 @@
+package multiplexer
+
+import (
+	"sync"
+
+	"github.com/singchia/geminio/conn"
+	"github.com/singchia/geminio/packet"
+)
+
+// sessionBatch collects the session packets of dialogues opened together,
+// and writes them down in one SessionBatchPacket once every dialogue sent
+// or gave up its own.
+type sessionBatch struct {
+	cn conn.Conn
+	pf packet.PacketFactory
+
+	mtx  sync.Mutex
+	left int
+	dgs  []*dialogue
+	pkts []*packet.SessionPacket
+}
+
+func newSessionBatch(cn conn.Conn, pf packet.PacketFactory, size int) *sessionBatch {
+	return &sessionBatch{
+		cn:   cn,
+		pf:   pf,
+		left: size,
+	}
+}
+
+// the dialogue sends its session packet by the batch
+func optionDialogueBatch(sb *sessionBatch) DialogueOption {
+	return func(dg *dialogue) {
+		dg.batch = sb
+	}
+}
+
+func (sb *sessionBatch) add(dg *dialogue, pkt *packet.SessionPacket) {
+	sb.mtx.Lock()
+	sb.dgs = append(sb.dgs, dg)
+	sb.pkts = append(sb.pkts, pkt)
+	sb.done()
+}
+
+// cancel is called by the dialogue giving up before its session sent, nil
+// batch is a noop
+func (sb *sessionBatch) cancel() {
+	if sb == nil {
+		return
+	}
+	sb.mtx.Lock()
+	sb.done()
+}
+
+// done must be called with mtx held, and unlocks it
+func (sb *sessionBatch) done() {
+	sb.left--
+	if sb.left != 0 || len(sb.pkts) == 0 {
+		sb.mtx.Unlock()
+		return
+	}
+	dgs, pkts := sb.dgs, sb.pkts
+	sb.dgs, sb.pkts = nil, nil
+	sb.mtx.Unlock()
+
+	err := sb.cn.Write(sb.pf.NewSessionBatchPacket(pkts))
+	if err == nil {
+		return
+	}
+	// fail the opens at once rather than timeout
+	for i, dg := range dgs {
+		dg.log.Errorf("write session batch err: %s, clientID: %d, dialogueID: %d, packetID: %d",
+			err, dg.cn.ClientID(), dg.negotiatingID, pkts[i].ID())
+		dg.shub.Error(pkts[i].PacketID, err)
+	}
+}
+
+// OpenDialogues opens n dialogues with one SessionBatchPacket, the peer acks
+// them one by one in the same round trip. Either all of them are opened, or
+// the opened ones are closed and the first error returned.
+func (dm *dialogueMgr) OpenDialogues(n int, meta []byte, peer string, opts ...DialogueOption) ([]Dialogue, error) {
+	if n <= 0 {
+		return nil, ErrInvalidDialogueCount
+	}
+	dm.mtx.RLock()
+	if !dm.mgrOK {
+		dm.mtx.RUnlock()
+		return nil, ErrOperationOnClosedMultiplexer
+	}
+	dm.mtx.RUnlock()
+
+	sb := newSessionBatch(dm.cn, dm.pf, n)
+	opts = append(opts[:len(opts):len(opts)], optionDialogueBatch(sb))
+	dgs := make([]*dialogue, 0, n)
+	for i := 0; i < n; i++ {
+		dg, err := dm.newOpeningDialogue(meta, peer, opts...)
+		if err != nil {
+			for _, dg := range dgs {
+				dm.abandonDialogue(dg)
+			}
+			return nil, err
+		}
+		dgs = append(dgs, dg)
+	}
+
+	errs := make([]error, n)
+	wg := sync.WaitGroup{}
+	wg.Add(n)
+	for i, dg := range dgs {
+		go func(i int, dg *dialogue) {
+			defer wg.Done()
+			errs[i] = dg.open()
+		}(i, dg)
+	}
+	wg.Wait()
+	return dm.openedDialogues(dgs, errs)
+}
+
+// openedDialogues registers the dialogues if all opened, or else closes the
+// opened ones
+func (dm *dialogueMgr) openedDialogues(dgs []*dialogue, errs []error) ([]Dialogue, error) {
+	var first error
+	for i, dg := range dgs {
+		errs[i] = dm.openedDialogue(dg, errs[i])
+		if first == nil && errs[i] != nil {
+			first = errs[i]
+		}
+	}
+	if first == nil {
+		opened := make([]Dialogue, 0, len(dgs))
+		for _, dg := range dgs {
+			opened = append(opened, dg)
+		}
+		return opened, nil
+	}
+	for i, dg := range dgs {
+		if errs[i] == nil {
+			dg.Close()
+		}
+	}
+	return nil, first
+}
@@ -0,0 +1,40 @@
+package multiplexer
+
+import "io"
+
+// The errors of reading and writing a closed dialogue tell how it closed,
+// they are all io.EOF by errors.Is for the callers checking the end only.
+var (
+	// ErrDialogueClosed is returned if the dialogue closed without a dismiss
+	// or reset, like the conn gone
+	ErrDialogueClosed error = &dialogueClosedError{"dialogue closed"}
+	// ErrDialogueDismissed is returned if the dialogue closed by the dismiss
+	// handshake, initiated by either side
+	ErrDialogueDismissed error = &dialogueClosedError{"dialogue dismissed"}
+	// ErrDialogueError is returned if the dialogue closed by a reset or an
+	// error, CloseReason tells which
+	ErrDialogueError error = &dialogueClosedError{"dialogue error"}
+)
+
+type dialogueClosedError struct {
+	msg string
+}
+
+func (err *dialogueClosedError) Error() string {
+	return err.msg
+}
+
+func (err *dialogueClosedError) Is(target error) bool {
+	return target == io.EOF
+}
+
+// closedErr returns the error by the close reason
+func (dg *dialogue) closedErr() error {
+	switch dg.CloseReason() {
+	case CloseReasonNone:
+		return ErrDialogueClosed
+	case CloseReasonDismiss:
+		return ErrDialogueDismissed
+	}
+	return ErrDialogueError
+}
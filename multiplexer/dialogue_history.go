@@ -0,0 +1,91 @@
+package multiplexer
+
+import (
+	"sync"
+	"time"
+
+	"github.com/singchia/geminio/packet"
+)
+
+// RecordedPacket is a packet read or written by the dialogue, for debugging
+type RecordedPacket struct {
+	Time      time.Time
+	Direction packet.Direction
+	Type      packet.Type
+	PacketID  uint64
+	// the encoded packet, nil if failed to encode
+	Data []byte
+}
+
+// packetHistory is a ring of the latest packets
+type packetHistory struct {
+	mtx  sync.Mutex
+	ring []RecordedPacket
+	next int
+	full bool
+}
+
+func newPacketHistory(size int) *packetHistory {
+	return &packetHistory{
+		ring: make([]RecordedPacket, size),
+	}
+}
+
+func (ph *packetHistory) record(pkt packet.Packet, direction packet.Direction) {
+	data, _ := pkt.Encode()
+	ph.mtx.Lock()
+	defer ph.mtx.Unlock()
+	ph.ring[ph.next] = RecordedPacket{
+		Time:      time.Now(),
+		Direction: direction,
+		Type:      pkt.Type(),
+		PacketID:  pkt.ID(),
+		Data:      data,
+	}
+	ph.next = (ph.next + 1) % len(ph.ring)
+	if ph.next == 0 {
+		ph.full = true
+	}
+}
+
+// recent returns the packets from the oldest to the latest
+func (ph *packetHistory) recent() []RecordedPacket {
+	ph.mtx.Lock()
+	defer ph.mtx.Unlock()
+	if !ph.full {
+		return append([]RecordedPacket(nil), ph.ring[:ph.next]...)
+	}
+	return append(append([]RecordedPacket(nil), ph.ring[ph.next:]...), ph.ring[:ph.next]...)
+}
+
+// OptionDialoguePacketHistory keeps the latest size packets read and written
+// by the dialogue, it's off by default since every packet is encoded again.
+func OptionDialoguePacketHistory(size int) DialogueOption {
+	return func(dg *dialogue) {
+		if size > 0 {
+			dg.history = newPacketHistory(size)
+		}
+	}
+}
+
+// OptionMultiplexerPacketHistory keeps the latest size packets for every
+// dialogue, the same as OptionDialoguePacketHistory.
+func OptionMultiplexerPacketHistory(size int) MultiplexerOption {
+	return func(opts *multiplexerOpts) {
+		opts.historySize = size
+	}
+}
+
+// RecentPackets returns the packets kept by the history, nil if not enabled
+func (dg *dialogue) RecentPackets() []RecordedPacket {
+	if dg.history == nil {
+		return nil
+	}
+	return dg.history.recent()
+}
+
+func (dg *dialogue) recordPacket(pkt packet.Packet, direction packet.Direction) {
+	if dg.history != nil {
+		dg.history.record(pkt, direction)
+	}
+}
@@ -53,8 +53,8 @@ func (dh *dialogueHub) DialogueOnline(dg delegate.DialogueDescriber) error {
 	}
 	key = dialogueKey(dg.ClientID(), dg.DialogueID())
 	dh.dialogues[key] = dg.(*dialogue)
-	if dh.dlgt != nil {
-		dh.dlgt.DialogueOnline(dg)
+	if dlgt := dh.delegateOf(dg.(*dialogue)); dlgt != nil {
+		dlgt.DialogueOnline(dg)
 	}
 	if dh.dialogueAcceptCh != nil {
 		// this must not be blocked, or else the whole system will stop
@@ -92,8 +92,8 @@ func NewDialogueHub(opts ...MultiplexerOption) (*dialogueHub, error) {
 	return dh, nil
 }
 
-func (dh *dialogueHub) DialogueOffline(dg delegate.DialogueDescriber) error {
-	dh.log.Debugf("dialogue offline, clientID: %d, del dialogueID: %d", dg.ClientID(), dg.DialogueID())
+func (dh *dialogueHub) DialogueOffline(dg delegate.DialogueDescriber, reason delegate.DialogueCloseReason) error {
+	dh.log.Debugf("dialogue offline, clientID: %d, del dialogueID: %d, reason: %s", dg.ClientID(), dg.DialogueID(), reason)
 	dh.mtx.Lock()
 	defer dh.mtx.Unlock()
 
@@ -101,8 +101,8 @@ func (dh *dialogueHub) DialogueOffline(dg delegate.DialogueDescriber) error {
 	dg, ok := dh.dialogues[key]
 	if ok {
 		delete(dh.dialogues, key)
-		if dh.dlgt != nil {
-			dh.dlgt.DialogueOffline(dg)
+		if dlgt := dh.delegateOf(dg.(*dialogue)); dlgt != nil {
+			dlgt.DialogueOffline(dg, reason)
 		}
 		return nil
 	}
@@ -120,6 +120,13 @@ func (dh *dialogueHub) ConnOffline(cn delegate.ConnDescriber) error {
 	return nil
 }
 
+func (dh *dialogueHub) negotiatingID(clientID uint64) uint64 {
+	if dh.idAllocator != nil {
+		return dh.idAllocator.AllocateSessionID(clientID)
+	}
+	return dh.dialogueIDs.GetID()
+}
+
 func (dh *dialogueHub) OpenDialogue(clientID uint64, meta []byte) (Dialogue, error) {
 	dh.mtx.RLock()
 	if !dh.hubOK {
@@ -132,10 +139,10 @@ func (dh *dialogueHub) OpenDialogue(clientID uint64, meta []byte) (Dialogue, err
 	if !ok {
 		return nil, ErrConnNotFound
 	}
-	negotiatingID := dh.dialogueIDs.GetID()
+	negotiatingID := dh.negotiatingID(clientID)
 	dg, err := NewDialogue(cn, dh.multiplexerOpts.opts,
 		OptionDialogueNegotiatingID(negotiatingID, false),
-		OptionDialogueDelegate(dh))
+		optionDialogueOwner(dh))
 	if err != nil {
 		dh.log.Errorf("new dialogue err: %s, clientID: %d", err, clientID)
 		return nil, err
@@ -161,8 +168,9 @@ func (dh *dialogueHub) OpenDialogue(clientID uint64, meta []byte) (Dialogue, err
 	delete(dh.negotiatingDialogues, key)
 
 	if !dh.hubOK {
-		// !hubOK only happends after dialogueMgr fini, so fini the dialogue
-		dg.fini()
+		// !hubOK only happends after dialogueMgr fini, which closed the
+		// dialogue's io, and the handlePkt finis it
+		dg.closeIO()
 		return nil, ErrOperationOnClosedMultiplexer
 	}
 
@@ -229,10 +237,11 @@ func (dh *dialogueHub) handlePkt(pkt packet.Packet) {
 			return
 		}
 		// new negotiating dialogue
-		negotiatingID := dh.dialogueIDs.GetID()
+		negotiatingID := dh.negotiatingID(clientID)
 		dg, err := NewDialogue(cn, dh.multiplexerOpts.opts,
 			OptionDialogueNegotiatingID(negotiatingID, false),
-			OptionDialogueDelegate(dh))
+			optionDialoguePeerSession(realPkt.NegotiateID()),
+			optionDialogueOwner(dh))
 		if err != nil {
 			dh.log.Errorf("new dialogue err: %s, clientID: %d", err, clientID)
 			return
@@ -241,8 +250,15 @@ func (dh *dialogueHub) handlePkt(pkt packet.Packet) {
 		dh.mtx.Lock()
 		dh.negotiatingDialogues[key] = dg
 		dh.mtx.Unlock()
+		dg.assertReadInOpen("dialogue hub")
 		dg.readInCh <- pkt
 
+	case *packet.SessionBatchPacket:
+		// each of them is handled and acked as if came alone
+		for _, snPkt := range realPkt.Sessions {
+			dh.handlePkt(snPkt)
+		}
+
 	case *packet.SessionAckPacket:
 		clientID := realPkt.ClientID()
 		key := dialogueKey(clientID, realPkt.NegotiateID())
@@ -255,6 +271,7 @@ func (dh *dialogueHub) handlePkt(pkt packet.Packet) {
 				clientID, realPkt.NegotiateID())
 			return
 		}
+		dg.assertReadInOpen("dialogue hub")
 		dg.readInCh <- pkt
 
 	default:
@@ -273,11 +290,13 @@ func (dh *dialogueHub) handlePkt(pkt packet.Packet) {
 		if !ok {
 			dh.log.Errorf("clientID: %d, unable to find dialogueID: %d, packetID: %d, packetType: %s",
 				clientID, dialogueID, pkt.ID(), pkt.Type().String())
+			packet.NotifyDrop(dh.dropObserver, pkt, packet.DropReasonDialogueNotFound, packet.DirectionIn)
 			return
 		}
 
 		dh.log.Tracef("write to dialogue, clientID: %d, dialogueID: %d, packetID: %d, packetType: %s",
 			clientID, dialogueID, pkt.ID(), pkt.Type().String())
+		dg.assertReadInOpen("dialogue hub")
 		dg.readInCh <- pkt
 	}
 }
@@ -328,13 +347,13 @@ func (dh *dialogueHub) fini() {
 	// collect all dialogues
 	for id, dg := range dh.dialogues {
 		// cause the dialogue io err
-		close(dg.readInCh)
+		dg.closeIO()
 		delete(dh.dialogues, id)
 	}
 	for id, dg := range dh.negotiatingDialogues {
 		// cause the dialogue io err
-		close(dg.readInCh)
-		delete(dh.dialogues, id)
+		dg.closeIO()
+		delete(dh.negotiatingDialogues, id)
 	}
 
 	// collect timer
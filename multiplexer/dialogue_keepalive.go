@@ -0,0 +1,102 @@
+package multiplexer
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/singchia/geminio/packet"
+	"github.com/singchia/geminio/pkg/iodefine"
+	"github.com/singchia/go-timer/v2"
+)
+
+// OptionDialogueKeepalive pings the peer every interval once sessioned, and
+// resets the dialogue if no pong returns in timeout, to tell a half-open
+// conn from an idle dialogue. The peer answers the pings whether it's enabled
+// or not.
+func OptionDialogueKeepalive(interval, timeout time.Duration) DialogueOption {
+	return func(dg *dialogue) {
+		dg.keepaliveInterval = interval
+		dg.keepaliveTimeout = timeout
+	}
+}
+
+// startKeepalive is called in the handlePkt goroutine once sessioned
+func (dg *dialogue) startKeepalive() {
+	if dg.keepaliveInterval <= 0 || dg.keepaliveTimeout <= 0 {
+		return
+	}
+	dg.pong()
+	dg.kaMtx.Lock()
+	defer dg.kaMtx.Unlock()
+	dg.kaTick = dg.tmr.Add(dg.keepaliveInterval,
+		timer.WithHandler(dg.keepalive), timer.WithCyclically())
+}
+
+func (dg *dialogue) stopKeepalive() {
+	dg.kaMtx.Lock()
+	defer dg.kaMtx.Unlock()
+	if dg.kaTick != nil {
+		dg.kaTick.Cancel()
+		dg.kaTick = nil
+	}
+}
+
+func (dg *dialogue) pong() {
+	atomic.StoreInt64(&dg.lastPong, time.Now().UnixNano())
+}
+
+func (dg *dialogue) keepalive(_ *timer.Event) {
+	dg.mtx.RLock()
+	if !dg.dialogueOK {
+		dg.mtx.RUnlock()
+		return
+	}
+	if dg.State() != SESSIONED {
+		// the dismissing has its own timeout
+		dg.mtx.RUnlock()
+		dg.stopKeepalive()
+		return
+	}
+	silent := time.Since(time.Unix(0, atomic.LoadInt64(&dg.lastPong)))
+	if silent < dg.keepaliveTimeout {
+		pkt := dg.pf.NewSessionHeartbeatPacket(dg.dialogueID)
+		dg.pinged(pkt.ID())
+		// don't block the timer, the queue of a stalled conn stays full
+		select {
+		case dg.writeInCh <- pkt:
+		default:
+		}
+		dg.mtx.RUnlock()
+		return
+	}
+
+	dg.log.Warnf("dialogue keepalive timeout, clientID: %d, dialogueID: %d, silent: %s",
+		dg.cn.ClientID(), dg.dialogueID, silent)
+	// the peer is unable to finish the dismiss handshake, so the dialogue
+	// goes to dismissed at once and resets
+	err := dg.emitEvent(ET_ERROR)
+	if err != nil {
+		dg.log.Debugf("emit ET_ERROR err: %s, clientID: %d, dialogueID: %d",
+			err, dg.cn.ClientID(), dg.dialogueID)
+	}
+	dg.mtx.RUnlock()
+	dg.stopKeepalive()
+	dg.reset(CloseReasonKeepalive)
+}
+
+func (dg *dialogue) handleInSessionHeartbeatPacket(pkt *packet.SessionHeartbeatPacket) iodefine.IORet {
+	dg.log.Tracef("read session heartbeat packet, clientID: %d, dialogueID: %d, packetID: %d",
+		dg.cn.ClientID(), dg.dialogueID, pkt.ID())
+	retPkt := dg.pf.NewSessionHeartbeatAckPacket(pkt.ID(), dg.dialogueID)
+	// the same as the session ack, our own writeInCh may block us
+	dg.writeOutCh <- retPkt
+	return iodefine.IOSuccess
+}
+
+func (dg *dialogue) handleInSessionHeartbeatAckPacket(pkt *packet.SessionHeartbeatAckPacket) iodefine.IORet {
+	dg.log.Tracef("read session heartbeat ack packet, clientID: %d, dialogueID: %d, packetID: %d",
+		dg.cn.ClientID(), dg.dialogueID, pkt.ID())
+	dg.pong()
+	dg.ponged(pkt.ID())
+	return iodefine.IOSuccess
+}
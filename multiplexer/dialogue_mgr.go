@@ -4,6 +4,7 @@ import (
 	"errors"
 	"io"
 	"sync"
+	"time"
 
 	"github.com/jumboframes/armorigo/log"
 	"github.com/singchia/geminio"
@@ -11,6 +12,7 @@ import (
 	"github.com/singchia/geminio/delegate"
 	"github.com/singchia/geminio/packet"
 	"github.com/singchia/geminio/pkg/id"
+	gtimer "github.com/singchia/geminio/pkg/timer"
 	"github.com/singchia/go-timer/v2"
 )
 
@@ -24,12 +26,51 @@ type opts struct {
 	log log.Logger
 	// delegate
 	dlgt Delegate
+	// write coalescing of bulk dialogues, 0 delay means no coalescing
+	coalesceDelay time.Duration
+	coalesceSize  int
+	// max QoS level accepted from the peer
+	maxQoS int8
+	// max payload size of data packets advertised, 0 means no limit
+	maxPacketSize int
+	// tick granularity of the timer owned by the multiplexer, 0 means default
+	tmrGranularity time.Duration
+	// heartbeat interval watching the timer, 0 means default
+	tmrWatch time.Duration
+	// audit of dialogues' open and close, nil means off
+	audit AuditSink
+	// observer of packets dropped intentionally
+	dropObserver packet.DropObserver
+	// how long a full read buffer waits for the reader, 0 means forever
+	unconsumedTimeout time.Duration
+	unconsumedPolicy  UnconsumedPolicy
+	// notified at the congestion state of a dialogue changed
+	congestionFn func(dg Dialogue, congested bool)
+	// size of the packet history of every dialogue, 0 means off
+	historySize int
+	// reset the dialogue at unknown packets rather than read them as data
+	strictPackets bool
+	// how long the closes wait for the dismiss handshake, 0 means the
+	// dialogues' sync timeout
+	dismissTimeout time.Duration
+	// schedules the writes of the conn by QoS, nil means off
+	sched *qosScheduler
+}
+
+// the dialogue specific delegate takes precedence over the End-wide one
+func (opts *opts) delegateOf(dg *dialogue) Delegate {
+	if dg.customDlgt != nil {
+		return dg.customDlgt
+	}
+	return opts.dlgt
 }
 
 type multiplexerOpts struct {
 	*opts
 	// global client ID factory, set nil at client side
 	dialogueIDs id.IDFactory
+	// assigns dialogueIDs at server side, nil means the dialogueIDs
+	idAllocator SessionIDAllocator
 	// for outside usage
 	dialogueAcceptCh        chan *dialogue
 	dialogueAcceptChOutside bool
@@ -40,6 +81,11 @@ type multiplexerOpts struct {
 	dialogueClosedChOutside bool
 
 	dialogueClosedFn func(Dialogue)
+
+	// write the dialogues' packets by QoS
+	qosScheduling bool
+	// max dialogues in flight, 0 means no limit
+	maxDialogues int
 }
 
 type dialogueMgr struct {
@@ -51,14 +97,21 @@ type dialogueMgr struct {
 	// close channel
 	closeCh chan struct{}
 
+	// the tmr watched, by the multiplexer unless watched outside
+	watchedTmr    *gtimer.Timer
+	watchedInside bool
+
 	// dialogues
 	dialogueIDs     id.IDFactory // set nil in client
 	defaultDialogue *dialogue
 	// mtx protect follows
 	mtx                  sync.RWMutex
 	mgrOK                bool
+	quiescing            bool
 	dialogues            map[uint64]*dialogue // key: dialogueID, value: dialogue
 	negotiatingDialogues map[uint64]*dialogue
+	// the peer initiated ones in either of above, key: peer's negotiatingID
+	peerSessions map[uint64]*dialogue
 }
 
 type MultiplexerOption func(*multiplexerOpts)
@@ -117,15 +170,140 @@ func OptionTimer(tmr timer.Timer) MultiplexerOption {
 	}
 }
 
+// OptionMultiplexerWriteCoalesce makes data packets of the dialogues, except
+// the interactive ones, be held for at most delay and written down together,
+// and a batch reaching size packets is written down at once.
+func OptionMultiplexerWriteCoalesce(delay time.Duration, size int) MultiplexerOption {
+	return func(opts *multiplexerOpts) {
+		opts.coalesceDelay = delay
+		opts.coalesceSize = size
+	}
+}
+
+// OptionMultiplexerMaxDialogues limits the dialogues in flight on the conn,
+// the negotiating ones counted and the default one not. The dialogues the
+// peer opens beyond are rejected with ErrTooManyDialogues, while the local
+// opens are not limited.
+func OptionMultiplexerMaxDialogues(max int) MultiplexerOption {
+	return func(opts *multiplexerOpts) {
+		opts.maxDialogues = max
+	}
+}
+
+// OptionMultiplexerMaxQoS caps the QoS level requested by the peer's dialogues
+func OptionMultiplexerMaxQoS(qos int8) MultiplexerOption {
+	return func(opts *multiplexerOpts) {
+		opts.maxQoS = qos
+	}
+}
+
+// SessionIDAllocator assigns the dialogueIDs at server side, for dialogues
+// opened from both sides. The IDs must be unique within the conn and never be
+// packet.SessionID1, which is reserved for the default dialogue.
+type SessionIDAllocator interface {
+	AllocateSessionID(clientID uint64) uint64
+}
+
+// SessionIDReserver is the optional part of the SessionIDAllocator, which
+// keeps the dialogueIDs resumed from being allocated again, false means the
+// ID is in use and the dialogue gets a new one. It's called with the
+// multiplexer locked.
+type SessionIDReserver interface {
+	ReserveSessionID(clientID uint64, sessionID uint64) bool
+}
+
+// OptionMultiplexerSessionIDAllocator replaces the local ID counter at server
+// side, such as a central allocator to make IDs unique across a cluster.
+func OptionMultiplexerSessionIDAllocator(allocator SessionIDAllocator) MultiplexerOption {
+	return func(opts *multiplexerOpts) {
+		opts.idAllocator = allocator
+	}
+}
+
+// OptionMultiplexerUnconsumed takes the policy if a dialogue's read buffer
+// stays full for timeout, so that a forgotten dialogue won't stall the conn.
+func OptionMultiplexerUnconsumed(timeout time.Duration, policy UnconsumedPolicy) MultiplexerOption {
+	return func(opts *multiplexerOpts) {
+		opts.unconsumedTimeout = timeout
+		opts.unconsumedPolicy = policy
+	}
+}
+
+// OptionMultiplexerStrictPackets resets the dialogue with
+// CloseReasonUnknownPacket once the peer sent a packet of neither session
+// nor application layer. By default such packets are read as data for
+// the forward compatibility.
+func OptionMultiplexerStrictPackets() MultiplexerOption {
+	return func(opts *multiplexerOpts) {
+		opts.strictPackets = true
+	}
+}
+
+// OptionMultiplexerDismissTimeout bounds the dismiss handshake of Close and
+// CloseWait, once the peer didn't ack or dismiss in time, the dialogue is
+// finished without it. By default the dialogue's sync timeout applies.
+func OptionMultiplexerDismissTimeout(timeout time.Duration) MultiplexerOption {
+	return func(opts *multiplexerOpts) {
+		opts.dismissTimeout = timeout
+	}
+}
+
+// OptionMultiplexerCongestionFunc notifies fn once a dialogue turned
+// congested or recovered, it's called in the writing goroutines and shouldn't
+// block.
+func OptionMultiplexerCongestionFunc(fn func(dg Dialogue, congested bool)) MultiplexerOption {
+	return func(opts *multiplexerOpts) {
+		opts.congestionFn = fn
+	}
+}
+
+// OptionMultiplexerDropObserver sets the observer notified of every packet
+// the dialogues drop intentionally.
+func OptionMultiplexerDropObserver(observer packet.DropObserver) MultiplexerOption {
+	return func(opts *multiplexerOpts) {
+		opts.dropObserver = observer
+	}
+}
+
+// OptionMultiplexerTimerGranularity sets the tick granularity of the timer
+// created by the multiplexer, it takes no effect with OptionTimer. Timeouts
+// are rounded up to whole ticks and fire within one tick past due, so a
+// finer granularity suits low-latency timeouts, at the cost of more wakeups.
+func OptionMultiplexerTimerGranularity(granularity time.Duration) MultiplexerOption {
+	return func(opts *multiplexerOpts) {
+		opts.tmrGranularity = granularity
+	}
+}
+
+// OptionMultiplexerTimerWatch sets the heartbeat interval watching the timer,
+// the default is 1s. A timer missing the heartbeats for a few intervals is
+// taken as failed, and the timeouts are scheduled by a fallback timer until
+// it recovers, see TimerFallbacks.
+func OptionMultiplexerTimerWatch(interval time.Duration) MultiplexerOption {
+	return func(opts *multiplexerOpts) {
+		opts.tmrWatch = interval
+	}
+}
+
+func newTimer(granularity time.Duration) timer.Timer {
+	if granularity <= 0 {
+		return timer.NewTimer()
+	}
+	return timer.NewTimer(timer.WithTimeInterval(granularity))
+}
+
 func NewDialogueMgr(cn conn.Conn, mpopts ...MultiplexerOption) (Multiplexer, error) {
 	dm := &dialogueMgr{
 		multiplexerOpts: &multiplexerOpts{
-			opts: &opts{},
+			opts: &opts{
+				maxQoS: QoSMax,
+			},
 		},
 		cn:                   cn,
 		mgrOK:                true,
 		dialogues:            make(map[uint64]*dialogue),
 		negotiatingDialogues: make(map[uint64]*dialogue),
+		peerSessions:         make(map[uint64]*dialogue),
 		closeCh:              make(chan struct{}),
 	}
 	// dialogue id counter
@@ -142,17 +320,27 @@ func NewDialogueMgr(cn conn.Conn, mpopts ...MultiplexerOption) (Multiplexer, err
 	}
 	// sync hub
 	if dm.tmr == nil {
-		dm.tmr = timer.NewTimer()
+		dm.tmr = newTimer(dm.tmrGranularity)
 		dm.tmrOwner = dm
 	}
+	if tmr, ok := dm.tmr.(*gtimer.Timer); ok {
+		dm.watchedTmr = tmr
+	} else {
+		dm.watchedTmr = gtimer.New(dm.tmr, dm.tmrWatch)
+		dm.watchedInside = true
+		dm.tmr = dm.watchedTmr
+	}
 	// log
 	if dm.log == nil {
 		dm.log = log.DefaultLog
 	}
+	if dm.qosScheduling {
+		dm.sched = newQoSScheduler(cn)
+	}
 	// add default dialogue
 	dg, err := NewDialogue(cn, dm.multiplexerOpts.opts,
 		OptionDialogueState(SESSIONED),
-		OptionDialogueDelegate(dm),
+		optionDialogueOwner(dm),
 		OptionDialogueLogger(dm.log),
 		OptionDialoguePacketFactory(dm.pf),
 		OptionDialogueMeta(cn.Meta()))
@@ -168,9 +356,7 @@ func NewDialogueMgr(cn conn.Conn, mpopts ...MultiplexerOption) (Multiplexer, err
 	go dm.readPkt()
 	return dm, nil
 ERR:
-	if dm.tmrOwner == dm {
-		dm.tmr.Close()
-	}
+	dm.closeTimer()
 	return nil, err
 }
 
@@ -187,9 +373,15 @@ func (dm *dialogueMgr) DialogueOnline(dg delegate.DialogueDescriber) error {
 	if ok {
 		delete(dm.negotiatingDialogues, dg.NegotiatingID())
 	}
+	if dm.quiescing {
+		dm.forgetPeerSession(dg.(*dialogue))
+		// the dialogue will be dismissed after the error acked
+		dm.log.Debugf("dialogue online while quiescing, clientID: %d, dialogueID: %d", dg.ClientID(), dg.DialogueID())
+		return ErrQuiescing
+	}
 	dm.dialogues[dg.DialogueID()] = dg.(*dialogue)
-	if dm.dlgt != nil {
-		dm.dlgt.DialogueOnline(dg)
+	if dlgt := dm.delegateOf(dg.(*dialogue)); dlgt != nil {
+		dlgt.DialogueOnline(dg)
 	}
 	// notify outside that a dialogue is accepting
 	if dm.dialogueAcceptFn != nil {
@@ -202,24 +394,33 @@ func (dm *dialogueMgr) DialogueOnline(dg delegate.DialogueDescriber) error {
 	return nil
 }
 
-func (dm *dialogueMgr) DialogueOffline(dg delegate.DialogueDescriber) error {
+func (dm *dialogueMgr) DialogueOffline(dg delegate.DialogueDescriber, reason delegate.DialogueCloseReason) error {
 	clientID := dg.ClientID()
 	dialogueID := dg.DialogueID()
 
-	dm.log.Debugf("dialogue offline, clientID: %d, del dialogueID: %d", clientID, dialogueID)
+	dm.log.Debugf("dialogue offline, clientID: %d, del dialogueID: %d, reason: %s", clientID, dialogueID, reason)
 	dm.mtx.Lock()
 	defer dm.mtx.Unlock()
 
 	_, ok := dm.dialogues[dialogueID]
 	if ok {
 		delete(dm.dialogues, dialogueID)
-		if dm.dlgt != nil {
-			dm.dlgt.DialogueOffline(dg)
+		dm.forgetPeerSession(dg.(*dialogue))
+		// release the ID if reserved by a resume
+		if dm.dialogueIDs != nil && dialogueID != packet.SessionID1 {
+			dm.dialogueIDs.DelID(dialogueID)
+		}
+		if dlgt := dm.delegateOf(dg.(*dialogue)); dlgt != nil {
+			dlgt.DialogueOffline(dg, reason)
 		}
 	} else {
 		dm.log.Warnf("dialogue offline, cliengID: %d, dialogueID: %d not found", clientID, dialogueID)
 	}
-	// notify outside that a dialogue is closed
+	// notify outside that a dialogue is closed, the channel is closed
+	// after the manager finished
+	if !dm.mgrOK {
+		return ErrDialogueNotFound
+	}
 	if dm.dialogueClosedFn != nil {
 		dm.dialogueClosedFn(dg.(*dialogue))
 
@@ -232,6 +433,14 @@ func (dm *dialogueMgr) DialogueOffline(dg delegate.DialogueDescriber) error {
 	return ErrDialogueNotFound
 }
 
+// negotiatingID becomes the dialogueID at server side
+func (dm *dialogueMgr) negotiatingID() uint64 {
+	if dm.idAllocator != nil && dm.cn.Side() == geminio.RecipientSide {
+		return dm.idAllocator.AllocateSessionID(dm.cn.ClientID())
+	}
+	return dm.dialogueIDs.GetID()
+}
+
 func (dm *dialogueMgr) getID() uint64 {
 	if dm.cn.Side() == geminio.InitiatorSide {
 		return packet.SessionIDNull
@@ -240,7 +449,7 @@ func (dm *dialogueMgr) getID() uint64 {
 }
 
 // OpenDialogue blocks until succeed or failed
-func (dm *dialogueMgr) OpenDialogue(meta []byte, peer string) (Dialogue, error) {
+func (dm *dialogueMgr) OpenDialogue(meta []byte, peer string, opts ...DialogueOption) (Dialogue, error) {
 	dm.mtx.RLock()
 	if !dm.mgrOK {
 		dm.mtx.RUnlock()
@@ -248,15 +457,32 @@ func (dm *dialogueMgr) OpenDialogue(meta []byte, peer string) (Dialogue, error)
 	}
 	dm.mtx.RUnlock()
 
-	negotiatingID := dm.dialogueIDs.GetID()
+	dg, err := dm.newOpeningDialogue(meta, peer, opts...)
+	if err != nil {
+		return nil, err
+	}
+	// Open take times, shouldn't be locked
+	err = dm.openedDialogue(dg, dg.open())
+	if err != nil {
+		return nil, err
+	}
+	return dg, nil
+}
+
+// newOpeningDialogue creates the dialogue to open, and holds it in the
+// negotiating dialogues until openedDialogue
+func (dm *dialogueMgr) newOpeningDialogue(meta []byte, peer string, opts ...DialogueOption) (*dialogue, error) {
+	negotiatingID := dm.negotiatingID()
 	dialogueIDPeersCall := dm.cn.Side() == geminio.InitiatorSide
-	dg, err := NewDialogue(dm.cn, dm.multiplexerOpts.opts,
+	dgOpts := []DialogueOption{
 		OptionDialogueNegotiatingID(negotiatingID, dialogueIDPeersCall),
-		OptionDialogueDelegate(dm),
+		optionDialogueOwner(dm),
 		OptionDialogueLogger(dm.log),
 		OptionDialoguePacketFactory(dm.pf),
 		OptionDialogueMeta(meta),
-		OptionDialoguePeer(peer))
+		OptionDialoguePeer(peer),
+	}
+	dg, err := NewDialogue(dm.cn, dm.multiplexerOpts.opts, append(dgOpts, opts...)...)
 	if err != nil {
 		dm.log.Errorf("new dialogue err: %s, clientID: %d", err, dm.cn.ClientID())
 		return nil, err
@@ -264,28 +490,41 @@ func (dm *dialogueMgr) OpenDialogue(meta []byte, peer string) (Dialogue, error)
 	dm.mtx.Lock()
 	dm.negotiatingDialogues[negotiatingID] = dg
 	dm.mtx.Unlock()
-	// Open take times, shouldn't be locked
-	err = dg.open()
+	return dg, nil
+}
+
+// openedDialogue moves the dialogue out of the negotiating dialogues by the
+// open's err
+func (dm *dialogueMgr) openedDialogue(dg *dialogue, err error) error {
 	if err != nil {
 		dm.log.Errorf("dialogue open err: %s, clientID: %d, negotiatingID: %d", err, dm.cn.ClientID(), dg.negotiatingID)
 		dm.mtx.Lock()
-		delete(dm.negotiatingDialogues, negotiatingID)
+		delete(dm.negotiatingDialogues, dg.negotiatingID)
 		dm.mtx.Unlock()
-		return nil, err
+		return err
 	}
 	dm.mtx.Lock()
-	delete(dm.negotiatingDialogues, negotiatingID)
+	delete(dm.negotiatingDialogues, dg.negotiatingID)
 	if !dm.mgrOK {
 		// delete(dm.dialogues, dg.dialogueID)
-		// !mgrOK only happens after dialogueMgr fini, so fini the dialogue
+		// !mgrOK only happens after dialogueMgr fini, which closed the
+		// dialogue's io, and the handlePkt finis it
 		dm.mtx.Unlock()
-		dg.fini()
-		return nil, ErrOperationOnClosedMultiplexer
+		dg.closeIO()
+		return ErrOperationOnClosedMultiplexer
 	}
 	// the logic on negotiatingDialogues is tricky, be care of it.
 	dm.dialogues[dg.dialogueID] = dg
 	dm.mtx.Unlock()
-	return dg, nil
+	return nil
+}
+
+// abandonDialogue closes the dialogue never opened, the handlePkt finis it
+func (dm *dialogueMgr) abandonDialogue(dg *dialogue) {
+	dm.mtx.Lock()
+	delete(dm.negotiatingDialogues, dg.negotiatingID)
+	dm.mtx.Unlock()
+	dg.closeIO()
 }
 
 // AcceptDialogue blocks until success or end
@@ -334,6 +573,44 @@ func (dm *dialogueMgr) GetDialogue(clientID, dialogueID uint64) (Dialogue, error
 	return dialogue, nil
 }
 
+// CloseDialoguesWhere closes all dialogues matched asynchronously and gracefully,
+// the default dialogue is never matched since it lives with the conn.
+func (dm *dialogueMgr) CloseDialoguesWhere(match func(DialogueDescriber) bool) int {
+	matched := []*dialogue{}
+	dm.mtx.RLock()
+	if !dm.mgrOK {
+		dm.mtx.RUnlock()
+		return 0
+	}
+	for dialogueID, dg := range dm.dialogues {
+		if dialogueID == packet.SessionID1 {
+			continue
+		}
+		if match(dg) {
+			matched = append(matched, dg)
+		}
+	}
+	dm.mtx.RUnlock()
+
+	// close outside the lock, the offline of dialogues needs it
+	for _, dg := range matched {
+		dg.Close()
+	}
+	return len(matched)
+}
+
+func (dm *dialogueMgr) Quiesce() {
+	dm.mtx.Lock()
+	defer dm.mtx.Unlock()
+	dm.quiescing = true
+}
+
+func (dm *dialogueMgr) Unquiesce() {
+	dm.mtx.Lock()
+	defer dm.mtx.Unlock()
+	dm.quiescing = false
+}
+
 func (dm *dialogueMgr) readPkt() {
 	for {
 		select {
@@ -355,12 +632,42 @@ FINI:
 func (dm *dialogueMgr) handlePkt(pkt packet.Packet) {
 	switch realPkt := pkt.(type) {
 	case *packet.SessionPacket:
+		if dg, ok := dm.peerSession(realPkt.NegotiateID()); ok {
+			// the dialogue ignores it rather than a new one created
+			dm.log.Warnf("read duplicate dialogue packet, clientID: %d, negotiateID: %d, dialogueID: %d, packetID: %d",
+				dm.cn.ClientID(), realPkt.NegotiateID(), dg.dialogueID, realPkt.ID())
+			packet.NotifyDrop(dm.dropObserver, pkt, packet.DropReasonDuplicateSession, packet.DirectionIn)
+			return
+		}
+		if dm.dialoguesExceeded() {
+			dm.rejectSession(realPkt, ErrTooManyDialogues)
+			return
+		}
+		negotiatingID, err := dm.resumeID(realPkt)
+		if err != nil {
+			dm.rejectSession(realPkt, err)
+			return
+		}
+		resumed := negotiatingID != packet.SessionIDNull
 		// new negotiating dialogue
-		negotiatingID := dm.dialogueIDs.GetID()
+		if !resumed {
+			negotiatingID = dm.negotiatingID()
+		}
+		// the ID resumed is checked again and taken along with the insert
+		dm.mtx.Lock()
+		if resumed && !dm.takeResumedID(negotiatingID) {
+			dm.mtx.Unlock()
+			dm.log.Infof("resume dialogue in use, clientID: %d, dialogueID: %d",
+				dm.cn.ClientID(), negotiatingID)
+			negotiatingID = dm.negotiatingID()
+			dm.mtx.Lock()
+		}
+		defer dm.mtx.Unlock()
 		dialogueIDPeersCall := dm.cn.Side() == geminio.InitiatorSide
 		dg, err := NewDialogue(dm.cn, dm.multiplexerOpts.opts,
 			OptionDialogueNegotiatingID(negotiatingID, dialogueIDPeersCall),
-			OptionDialogueDelegate(dm),
+			optionDialoguePeerSession(realPkt.NegotiateID()),
+			optionDialogueOwner(dm),
 			OptionDialogueLogger(dm.log),
 			OptionDialoguePacketFactory(dm.pf),
 			OptionDialogueMeta(realPkt.SessionData.Meta),
@@ -369,24 +676,32 @@ func (dm *dialogueMgr) handlePkt(pkt packet.Packet) {
 			dm.log.Errorf("new dialogue err: %s, clientID: %d", err, dm.cn.ClientID())
 			return
 		}
-		dm.mtx.Lock()
 		dm.negotiatingDialogues[negotiatingID] = dg
+		dm.peerSessions[realPkt.NegotiateID()] = dg
+		dg.assertReadInOpen("dialogue manager")
 		dg.readInCh <- pkt
-		dm.mtx.Unlock()
+
+	case *packet.SessionBatchPacket:
+		// each of them is handled and acked as if came alone
+		for _, snPkt := range realPkt.Sessions {
+			dm.handlePkt(snPkt)
+		}
 
 	case *packet.SessionAckPacket:
-		dm.mtx.RLock()
+		dm.mtx.Lock()
 		dg, ok := dm.negotiatingDialogues[realPkt.NegotiateID()]
 		if !ok {
 			// TODO we must warn the dialogue initiator
 			dm.log.Errorf("clientID: %d, unable to find negotiatingID: %d",
 				dm.cn.ClientID(), realPkt.NegotiateID())
-			dm.mtx.RUnlock()
+			dm.mtx.Unlock()
 			return
 		}
-		// TODO do we need handle the packet in time? before data or dismiss coming.
+		// the peer's data or dismiss may come before the open returned
+		dg.ackedID = realPkt.SessionID()
+		dg.assertReadInOpen("dialogue manager")
 		dg.readInCh <- pkt
-		dm.mtx.RUnlock()
+		dm.mtx.Unlock()
 
 	default:
 		dgPkt, ok := pkt.(packet.SessionAbove)
@@ -400,21 +715,82 @@ func (dm *dialogueMgr) handlePkt(pkt packet.Packet) {
 		dg, ok := dm.dialogues[dialogueID]
 		if !ok {
 			// maybe the dialogue is in negotiating
-			dg, ok = dm.negotiatingDialogues[dialogueID]
+			dg, ok = dm.negotiatingDialogue(dialogueID)
 			if !ok {
 				dm.log.Errorf("clientID: %d, unable to find dialogueID: %d, packetID: %d, packetType: %s",
 					dm.cn.ClientID(), dialogueID, pkt.ID(), pkt.Type().String())
 				dm.mtx.RUnlock()
+				packet.NotifyDrop(dm.dropObserver, pkt, packet.DropReasonDialogueNotFound, packet.DirectionIn)
 				return
 			}
 		}
 		dm.log.Tracef("read to dialogue, clientID: %d, dialogueID: %d, packetID: %d, packetType %s",
 			dm.cn.ClientID(), dialogueID, pkt.ID(), pkt.Type().String())
+		dg.assertReadInOpen("dialogue manager")
 		dg.readInCh <- pkt
 		dm.mtx.RUnlock()
 	}
 }
 
+// negotiatingDialogue returns the dialogue in negotiating by the dialogueID,
+// which is the acked one if we opened it, must be called with mtx held
+func (dm *dialogueMgr) negotiatingDialogue(dialogueID uint64) (*dialogue, bool) {
+	if dg, ok := dm.negotiatingDialogues[dialogueID]; ok {
+		return dg, true
+	}
+	for _, dg := range dm.negotiatingDialogues {
+		if dg.ackedID != packet.SessionIDNull && dg.ackedID == dialogueID {
+			return dg, true
+		}
+	}
+	return nil, false
+}
+
+// peerSession returns the dialogue opened by the peer's session of
+// negotiateID, which is unique within the conn
+func (dm *dialogueMgr) peerSession(negotiateID uint64) (*dialogue, bool) {
+	dm.mtx.RLock()
+	defer dm.mtx.RUnlock()
+	dg, ok := dm.peerSessions[negotiateID]
+	return dg, ok
+}
+
+// forgetPeerSession must be called with mtx held, after the dialogue removed
+// from the dialogues or the negotiating dialogues
+func (dm *dialogueMgr) forgetPeerSession(dg *dialogue) {
+	if !dg.peerInitiated || dm.peerSessions[dg.peerNegotiatingID] != dg {
+		return
+	}
+	if dm.dialogues[dg.dialogueID] == dg || dm.negotiatingDialogues[dg.negotiatingID] == dg {
+		return
+	}
+	delete(dm.peerSessions, dg.peerNegotiatingID)
+}
+
+func (dm *dialogueMgr) dialoguesExceeded() bool {
+	if dm.maxDialogues <= 0 {
+		return false
+	}
+	dm.mtx.RLock()
+	defer dm.mtx.RUnlock()
+	inflight := len(dm.dialogues) + len(dm.negotiatingDialogues)
+	if _, ok := dm.dialogues[packet.SessionID1]; ok {
+		inflight--
+	}
+	return inflight >= dm.maxDialogues
+}
+
+// rejectSession acks the session with err, and no dialogue is created
+func (dm *dialogueMgr) rejectSession(pkt *packet.SessionPacket, err error) {
+	dm.log.Warnf("reject dialogue: %s, clientID: %d, negotiateID: %d, packetID: %d",
+		err, dm.cn.ClientID(), pkt.NegotiateID(), pkt.ID())
+	retPkt := dm.pf.NewSessionAckPacket(pkt.PacketID, pkt.NegotiateID(), packet.SessionIDNull, err)
+	if err := dm.cn.Write(retPkt); err != nil {
+		dm.log.Debugf("write session ack err: %s, clientID: %d, negotiateID: %d, packetID: %d",
+			err, dm.cn.ClientID(), pkt.NegotiateID(), pkt.ID())
+	}
+}
+
 func (dm *dialogueMgr) Close() {
 	dm.log.Debugf("dialogue manager is closing, clientID: %d", dm.cn.ClientID())
 	wg := sync.WaitGroup{}
@@ -466,6 +842,7 @@ func (dm *dialogueMgr) fini() {
 		dg.closeIO()
 		delete(dm.negotiatingDialogues, id)
 	}
+	dm.peerSessions = make(map[uint64]*dialogue)
 
 	// collect id
 	dm.dialogueIDs.Close()
@@ -479,10 +856,21 @@ func (dm *dialogueMgr) fini() {
 	}
 	// dm.dialogueAcceptCh, dm.dialogueClosedCh = nil, nil
 	// collect timer
+	dm.closeTimer()
+	dm.tmr = nil
+
+	dm.log.Debugf("dialogue manager finished, clientID: %d", dm.cn.ClientID())
+}
+
+// closeTimer closes the timer if owned, or else stops watching it
+func (dm *dialogueMgr) closeTimer() {
 	if dm.tmrOwner == dm {
 		dm.tmr.Close()
+	} else if dm.watchedInside {
+		dm.watchedTmr.Stop()
 	}
-	dm.tmr = nil
+}
 
-	dm.log.Debugf("dialogue manager finished, clientID: %d", dm.cn.ClientID())
+func (dm *dialogueMgr) TimerFallbacks() uint64 {
+	return dm.watchedTmr.Fallbacks()
 }
@@ -0,0 +1,1151 @@
+package multiplexer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/singchia/geminio"
+	"github.com/singchia/geminio/conn"
+	"github.com/singchia/geminio/delegate"
+	"github.com/singchia/geminio/packet"
+	"github.com/singchia/geminio/pkg/id"
+)
+
+func TestPeerInitiated(t *testing.T) {
+	mpServer, mpClient, err := getMultiplexerPair()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		mpClient.Close()
+		mpServer.Close()
+	}()
+
+	opened, err := mpClient.OpenDialogue([]byte("peer initiated"), "")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	accepted, err := mpServer.AcceptDialogue()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if opened.PeerInitiated() {
+		t.Error("locally opened dialogue reports peer initiated")
+	}
+	if !accepted.PeerInitiated() {
+		t.Error("accepted dialogue doesn't report peer initiated")
+	}
+	if accepted.DialogueID() != opened.DialogueID() {
+		t.Errorf("mismatch dialogueID, opened: %d, accepted: %d",
+			opened.DialogueID(), accepted.DialogueID())
+	}
+}
+
+func TestCloseDialoguesWhere(t *testing.T) {
+	mpServer, mpClient, err := getMultiplexerPair(OptionMultiplexerClosedDialogue())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		mpClient.Close()
+		mpServer.Close()
+	}()
+
+	// a multiplexer serves only one client, label the dialogues by meta instead
+	metas := []string{"tenant-a", "tenant-b", "tenant-a", "tenant-b"}
+	for _, meta := range metas {
+		_, err := mpClient.OpenDialogue([]byte(meta), "")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	closed := mpClient.CloseDialoguesWhere(func(dg DialogueDescriber) bool {
+		return string(dg.Meta()) == "tenant-a"
+	})
+	if closed != 2 {
+		t.Errorf("unexpected closed number: %d", closed)
+		return
+	}
+	for i := 0; i < closed; i++ {
+		dg, err := mpClient.ClosedDialogue()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if string(dg.Meta()) != "tenant-a" {
+			t.Errorf("unexpected closed dialogue, meta: %s", string(dg.Meta()))
+		}
+	}
+	left := 0
+	for _, dg := range mpClient.ListDialogues() {
+		if string(dg.Meta()) == "tenant-a" {
+			t.Errorf("dialogue not closed, dialogueID: %d", dg.DialogueID())
+		}
+		if string(dg.Meta()) == "tenant-b" {
+			left++
+		}
+	}
+	if left != 2 {
+		t.Errorf("unexpected left number: %d", left)
+	}
+}
+
+func TestOpenDialogueMetaFunc(t *testing.T) {
+	mpServer, mpClient, err := getMultiplexerPair()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		mpClient.Close()
+		mpServer.Close()
+	}()
+
+	token := 0
+	metaFn := func() []byte {
+		token++
+		return []byte("token-" + strconv.Itoa(token))
+	}
+	for i := 1; i <= 3; i++ {
+		_, err := mpClient.OpenDialogue([]byte("static"), "", OptionDialogueMetaFunc(metaFn))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		accepted, err := mpServer.AcceptDialogue()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if string(accepted.Meta()) != "token-"+strconv.Itoa(i) {
+			t.Errorf("unexpected meta: %s", string(accepted.Meta()))
+		}
+	}
+}
+
+func TestWriteCoalesceInteractive(t *testing.T) {
+	delay := 200 * time.Millisecond
+	mpServer, mpClient, err := getMultiplexerPair(OptionMultiplexerWriteCoalesce(delay, 0))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		mpClient.Close()
+		mpServer.Close()
+	}()
+
+	interactive, err := mpClient.OpenDialogue([]byte("interactive"), "", OptionDialogueInteractive())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	interactivePeer, err := mpServer.AcceptDialogue()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	bulk, err := mpClient.OpenDialogue([]byte("bulk"), "")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	bulkPeer, err := mpServer.AcceptDialogue()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	pf := packet.NewPacketFactory(id.NewIDCounter(id.Odd))
+
+	// small writes of the interactive dialogue go down immediately
+	if err = interactive.Write(pf.NewStreamPacket([]byte("ping"))); err != nil {
+		t.Error(err)
+		return
+	}
+	select {
+	case <-interactivePeer.ReadC():
+	case <-time.After(delay / 2):
+		t.Error("interactive write delayed")
+		return
+	}
+
+	// while writes of the bulk dialogue are batched
+	count := 3
+	for i := 0; i < count; i++ {
+		if err = bulk.Write(pf.NewStreamPacket([]byte("bulk"))); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	select {
+	case <-bulkPeer.ReadC():
+		t.Error("bulk write not coalesced")
+		return
+	case <-time.After(delay / 2):
+	}
+	for i := 0; i < count; i++ {
+		select {
+		case <-bulkPeer.ReadC():
+		case <-time.After(delay * 2):
+			t.Errorf("bulk write lost, read: %d", i)
+			return
+		}
+	}
+}
+
+func TestEmptyDataPacket(t *testing.T) {
+	mpServer, mpClient, err := getMultiplexerPair()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer mpServer.Close()
+
+	opened, err := mpClient.OpenDialogue([]byte("empty"), "")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	accepted, err := mpServer.AcceptDialogue()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	pf := packet.NewPacketFactory(id.NewIDCounter(id.Odd))
+	if err = opened.Write(pf.NewStreamPacket(nil)); err != nil {
+		t.Error(err)
+		return
+	}
+	if err = opened.Write(pf.NewStreamPacket([]byte{})); err != nil {
+		t.Error(err)
+		return
+	}
+	for i := 0; i < 2; i++ {
+		pkt, err := accepted.Read()
+		if err != nil {
+			t.Errorf("empty data packet read err: %s", err)
+			return
+		}
+		if pkt == nil {
+			t.Error("empty data packet read nil")
+			return
+		}
+		streamPkt, ok := pkt.(*packet.StreamPacket)
+		if !ok {
+			t.Errorf("unexpected packet type: %s", pkt.Type().String())
+			return
+		}
+		if len(streamPkt.Data) != 0 {
+			t.Errorf("unexpected data length: %d", len(streamPkt.Data))
+		}
+	}
+	// EOF after all the packets, which tells the dismiss
+	mpClient.Close()
+	pkt, err := accepted.Read()
+	if err != ErrDialogueDismissed || !errors.Is(err, io.EOF) {
+		t.Errorf("unexpected read after close, packet: %v, err: %v", pkt, err)
+	}
+}
+
+func TestDialogueStats(t *testing.T) {
+	mpServer, mpClient, err := getMultiplexerPair()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		mpClient.Close()
+		mpServer.Close()
+	}()
+
+	opened, err := mpClient.OpenDialogue([]byte("stats"), "")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	accepted, err := mpServer.AcceptDialogue()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	openedAt := opened.Stats().OpenedAt
+	if openedAt.IsZero() {
+		t.Error("zero opened at")
+		return
+	}
+	pf := packet.NewPacketFactory(id.NewIDCounter(id.Odd))
+	exchange := func() (DialogueStats, DialogueStats) {
+		if err := opened.Write(pf.NewStreamPacket([]byte("stats"))); err != nil {
+			t.Error(err)
+		}
+		if _, err := accepted.Read(); err != nil {
+			t.Error(err)
+		}
+		if err := opened.Synced(); err != nil {
+			t.Error(err)
+		}
+		return opened.Stats(), accepted.Stats()
+	}
+	writer1, reader1 := exchange()
+	if writer1.LastWriteAt.Before(openedAt) || reader1.LastReadAt.IsZero() {
+		t.Errorf("unexpected first stats, writer: %+v, reader: %+v", writer1, reader1)
+		return
+	}
+	time.Sleep(20 * time.Millisecond)
+	writer2, reader2 := exchange()
+	if !writer2.LastWriteAt.After(writer1.LastWriteAt) {
+		t.Errorf("last write at not advanced, before: %s, after: %s",
+			writer1.LastWriteAt, writer2.LastWriteAt)
+	}
+	if !reader2.LastReadAt.After(reader1.LastReadAt) {
+		t.Errorf("last read at not advanced, before: %s, after: %s",
+			reader1.LastReadAt, reader2.LastReadAt)
+	}
+	if writer2.LastReadAt.Before(writer1.LastReadAt) {
+		t.Error("last read at went backwards")
+	}
+	if !writer2.OpenedAt.Equal(openedAt) || !reader2.OpenedAt.Equal(reader1.OpenedAt) {
+		t.Error("opened at changed")
+	}
+}
+
+func TestDialogueResetByPeer(t *testing.T) {
+	mpServer, mpClient, err := getMultiplexerPair()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		mpClient.Close()
+		mpServer.Close()
+	}()
+
+	opened, err := mpClient.OpenDialogue([]byte("reset"), "")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	accepted, err := mpServer.AcceptDialogue()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	opened.Reset()
+	select {
+	case _, ok := <-accepted.ReadC():
+		if ok {
+			t.Error("unexpected packet read")
+			return
+		}
+	case <-time.After(time.Second):
+		t.Error("peer not closed by reset")
+		return
+	}
+	if accepted.CloseReason() != CloseReasonReset {
+		t.Errorf("unexpected peer close reason: %s", accepted.CloseReason())
+	}
+}
+
+func TestDialogueQoS(t *testing.T) {
+	// the cap only applies to dialogues opened by peer
+	mpServer, mpClient, err := getMultiplexerPair(OptionMultiplexerMaxQoS(1))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		mpClient.Close()
+		mpServer.Close()
+	}()
+
+	opened, err := mpClient.OpenDialogue([]byte("qos"), "", OptionDialogueQoS(2))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	accepted, err := mpServer.AcceptDialogue()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if opened.QoS() != 1 || accepted.QoS() != 1 {
+		t.Errorf("unexpected negotiated qos, opened: %d, accepted: %d", opened.QoS(), accepted.QoS())
+	}
+	if opened.Stats().QoS != 1 {
+		t.Errorf("unexpected qos in stats: %d", opened.Stats().QoS)
+	}
+}
+
+func TestQoSScheduling(t *testing.T) {
+	cn := newFakeConn(geminio.InitiatorSide)
+	mp, err := NewDialogueMgr(cn, OptionMultiplexerAcceptDialogue(),
+		OptionMultiplexerQoSScheduling())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cn.Close()
+
+	pf := packet.NewPacketFactory(id.NewIDCounter(id.Even))
+	dgs := []Dialogue{}
+	for i, qos := range []int8{0, 0, 5} {
+		pkt := pf.NewSessionPacket(uint64(100+2*i), false, []byte("qos"), "")
+		pkt.SessionFlags.Qos = qos
+		cn.readCh <- pkt
+		dg, err := mp.AcceptDialogue()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		dgs = append(dgs, dg)
+	}
+	// the conn gets slow, the first low packet holds it, then a low and a
+	// high one are pending
+	cn.setWriteDelay(100 * time.Millisecond)
+	from := cn.writtenLen()
+	for i, dg := range dgs {
+		if err = dg.Write(pf.NewStreamPacket([]byte(strconv.Itoa(i)))); err != nil {
+			t.Error(err)
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	for _, dg := range dgs {
+		if err = dg.Synced(); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	order := ""
+	for _, pkt := range cn.writtenFrom(from) {
+		if streamPkt, ok := pkt.(*packet.StreamPacket); ok {
+			order += string(streamPkt.Data)
+		}
+	}
+	if order != "021" {
+		t.Errorf("unexpected written order: %s", order)
+	}
+}
+
+// seqAllocator assigns IDs from a fixed sequence
+type seqAllocator struct {
+	ids chan uint64
+}
+
+func (sa *seqAllocator) AllocateSessionID(clientID uint64) uint64 {
+	return <-sa.ids
+}
+
+func TestSessionIDAllocator(t *testing.T) {
+	ids := []uint64{1000, 2000, 3000}
+	allocator := &seqAllocator{ids: make(chan uint64, len(ids))}
+	for _, id := range ids {
+		allocator.ids <- id
+	}
+	// the allocator only takes effect at server side
+	mpServer, mpClient, err := getMultiplexerPair(OptionMultiplexerSessionIDAllocator(allocator))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		mpClient.Close()
+		mpServer.Close()
+	}()
+
+	for _, id := range ids {
+		opened, err := mpClient.OpenDialogue([]byte("allocated"), "")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		accepted, err := mpServer.AcceptDialogue()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if accepted.DialogueID() != id || opened.DialogueID() != id {
+			t.Errorf("unexpected dialogueID, expected: %d, opened: %d, accepted: %d",
+				id, opened.DialogueID(), accepted.DialogueID())
+		}
+	}
+}
+
+// reserveAllocator assigns IDs from a fixed sequence and records the
+// resumed ones, the taken ones are refused
+type reserveAllocator struct {
+	seqAllocator
+	mtx      sync.Mutex
+	taken    map[uint64]bool
+	reserved []uint64
+}
+
+func (ra *reserveAllocator) ReserveSessionID(clientID uint64, sessionID uint64) bool {
+	ra.mtx.Lock()
+	defer ra.mtx.Unlock()
+	if ra.taken[sessionID] {
+		return false
+	}
+	ra.reserved = append(ra.reserved, sessionID)
+	return true
+}
+
+// resumeDelegate accepts all the dialogues resumed
+type resumeDelegate struct{}
+
+func (rd *resumeDelegate) DialogueOnline(dg delegate.DialogueDescriber) error {
+	return nil
+}
+
+func (rd *resumeDelegate) DialogueOffline(dg delegate.DialogueDescriber, _ delegate.DialogueCloseReason) error {
+	return nil
+}
+
+func (rd *resumeDelegate) ResumeDialogue(oldID uint64, meta []byte) (bool, error) {
+	return true, nil
+}
+
+func openResumed(t *testing.T, mpServer, mpClient Multiplexer, resumeID uint64) uint64 {
+	t.Helper()
+	opened, err := mpClient.OpenDialogue([]byte("resumed"), "", OptionDialogueResume(resumeID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := mpServer.AcceptDialogue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if accepted.DialogueID() != opened.DialogueID() {
+		t.Fatalf("mismatched dialogueID, opened: %d, accepted: %d",
+			opened.DialogueID(), accepted.DialogueID())
+	}
+	return opened.DialogueID()
+}
+
+func TestDialogueResumeReserved(t *testing.T) {
+	ids := []uint64{1000, 2000, 3000}
+	allocator := &reserveAllocator{
+		seqAllocator: seqAllocator{ids: make(chan uint64, len(ids))},
+		taken:        map[uint64]bool{4000: true},
+	}
+	for _, id := range ids {
+		allocator.ids <- id
+	}
+	mpServer, mpClient, err := getMultiplexerPair(OptionDelegate(&resumeDelegate{}),
+		OptionMultiplexerSessionIDAllocator(allocator),
+		OptionMultiplexerDismissTimeout(200*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		mpClient.Close()
+		mpServer.Close()
+	}()
+
+	dg, err := mpClient.OpenDialogue([]byte("previous"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = mpServer.AcceptDialogue(); err != nil {
+		t.Fatal(err)
+	}
+	dg.Close()
+	deadline := time.Now().Add(3 * time.Second)
+	for len(mpServer.ListDialogues()) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("previous dialogue not offline")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// resumed and reserved at the allocator
+	if id := openResumed(t, mpServer, mpClient, 1000); id != 1000 {
+		t.Fatalf("unexpected dialogueID resumed: %d", id)
+	}
+	// in use, a new one allocated
+	if id := openResumed(t, mpServer, mpClient, 1000); id != 2000 {
+		t.Fatalf("unexpected dialogueID resuming the one in use: %d", id)
+	}
+	// refused by the allocator, a new one allocated
+	if id := openResumed(t, mpServer, mpClient, 4000); id != 3000 {
+		t.Fatalf("unexpected dialogueID resuming the taken one: %d", id)
+	}
+	allocator.mtx.Lock()
+	defer allocator.mtx.Unlock()
+	if len(allocator.reserved) != 1 || allocator.reserved[0] != 1000 {
+		t.Errorf("unexpected dialogueIDs reserved: %v", allocator.reserved)
+	}
+}
+
+func TestDialogueResumeCounter(t *testing.T) {
+	mpServer, mpClient, err := getMultiplexerPair(OptionDelegate(&resumeDelegate{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		mpClient.Close()
+		mpServer.Close()
+	}()
+
+	// resume the ID the counter would assign next, it must be skipped
+	next := mpServer.(*dialogueMgr).dialogueIDs.PeekID()
+	if id := openResumed(t, mpServer, mpClient, next); id != next {
+		t.Fatalf("unexpected dialogueID resumed: %d", id)
+	}
+	dg, err := mpClient.OpenDialogue([]byte("fresh"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = mpServer.AcceptDialogue(); err != nil {
+		t.Fatal(err)
+	}
+	if dg.DialogueID() == next {
+		t.Errorf("resumed dialogueID allocated again: %d", next)
+	}
+}
+
+type recordAudit struct {
+	opens, closes chan SessionRecord
+}
+
+func (ra *recordAudit) RecordSessionOpen(record SessionRecord) {
+	ra.opens <- record
+}
+
+func (ra *recordAudit) RecordSessionClose(record SessionRecord) {
+	ra.closes <- record
+}
+
+func TestAuditSink(t *testing.T) {
+	audit := &recordAudit{
+		opens:  make(chan SessionRecord, 4),
+		closes: make(chan SessionRecord, 4),
+	}
+	mpServer, mpClient, err := getMultiplexerPair(OptionMultiplexerAuditSink(audit))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		mpClient.Close()
+		mpServer.Close()
+	}()
+
+	opened, err := mpClient.OpenDialogue([]byte("audit"), "")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err = mpServer.AcceptDialogue(); err != nil {
+		t.Error(err)
+		return
+	}
+	opened.Close()
+
+	hash := sha256.Sum256([]byte("audit"))
+	metaHash := hex.EncodeToString(hash[:])
+	// both sides share the sink, one record for each side
+	next := func(ch chan SessionRecord, op string) []SessionRecord {
+		records := []SessionRecord{}
+		for i := 0; i < 2; i++ {
+			select {
+			case record := <-ch:
+				records = append(records, record)
+			case <-time.After(time.Second):
+				t.Errorf("%s record not emitted", op)
+				return nil
+			}
+		}
+		if records[0].PeerInitiated == records[1].PeerInitiated {
+			t.Errorf("%s records from the same side", op)
+		}
+		for _, record := range records {
+			if record.DialogueID != opened.DialogueID() || record.ClientID != opened.ClientID() ||
+				record.MetaHash != metaHash || record.LocalAddr == nil ||
+				record.RemoteAddr == nil || record.Time.IsZero() || record.Err != nil {
+				t.Errorf("unexpected %s record: %+v", op, record)
+			}
+		}
+		return records
+	}
+	next(audit.opens, "open")
+	for _, record := range next(audit.closes, "close") {
+		if record.CloseReason != CloseReasonDismiss {
+			t.Errorf("unexpected close reason: %s", record.CloseReason)
+		}
+	}
+	select {
+	case record := <-audit.opens:
+		t.Errorf("unexpected open record: %+v", record)
+	default:
+	}
+}
+
+type recordDelegate struct {
+	offlines chan uint64
+}
+
+func (rd *recordDelegate) DialogueOnline(dg delegate.DialogueDescriber) error {
+	return nil
+}
+
+func (rd *recordDelegate) DialogueOffline(dg delegate.DialogueDescriber, _ delegate.DialogueCloseReason) error {
+	// both sides share the delegate, only the opener side is recorded
+	if dg.PeerInitiated() {
+		return nil
+	}
+	rd.offlines <- dg.DialogueID()
+	return nil
+}
+
+func TestDialogueDelegate(t *testing.T) {
+	endWide := &recordDelegate{offlines: make(chan uint64, 8)}
+	custom := &recordDelegate{offlines: make(chan uint64, 8)}
+	mpServer, mpClient, err := getMultiplexerPair(OptionDelegate(endWide))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		mpClient.Close()
+		mpServer.Close()
+	}()
+
+	control, err := mpClient.OpenDialogue([]byte("control"), "", OptionDialogueDelegate(custom))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	data, err := mpClient.OpenDialogue([]byte("data"), "")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	control.Close()
+	data.Close()
+
+	expect := func(rd *recordDelegate, name string, dialogueID uint64) {
+		select {
+		case got := <-rd.offlines:
+			if got != dialogueID {
+				t.Errorf("unexpected offline to %s delegate, dialogueID: %d, expected: %d", name, got, dialogueID)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("offline not routed to %s delegate, dialogueID: %d", name, dialogueID)
+		}
+	}
+	expect(custom, "custom", control.DialogueID())
+	expect(endWide, "end-wide", data.DialogueID())
+	select {
+	case got := <-custom.offlines:
+		t.Errorf("unexpected offline to custom delegate, dialogueID: %d", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// reasonDelegate records the dismiss reasons seen by the accepting side
+type reasonDelegate struct {
+	reasons chan string
+}
+
+func (rd *reasonDelegate) DialogueOnline(dg delegate.DialogueDescriber) error {
+	return nil
+}
+
+func (rd *reasonDelegate) DialogueOffline(dg delegate.DialogueDescriber, _ delegate.DialogueCloseReason) error {
+	if dg.PeerInitiated() {
+		rd.reasons <- dg.DismissReason()
+	}
+	return nil
+}
+
+func TestDialogueDismissReason(t *testing.T) {
+	dlgt := &reasonDelegate{reasons: make(chan string, 2)}
+	mpServer, mpClient, err := getMultiplexerPair(OptionDelegate(dlgt))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		mpClient.Close()
+		mpServer.Close()
+	}()
+
+	for _, reason := range []string{"server draining", ""} {
+		opened, err := mpClient.OpenDialogue([]byte("reason"), "")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		accepted, err := mpServer.AcceptDialogue()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		opened.CloseWithReason(reason)
+		select {
+		case got := <-dlgt.reasons:
+			if got != reason {
+				t.Errorf("unexpected dismiss reason: %q, expected: %q", got, reason)
+			}
+		case <-time.After(time.Second):
+			t.Error("dialogue not offline")
+			return
+		}
+		if got := accepted.DismissReason(); got != reason {
+			t.Errorf("unexpected dismiss reason of the dialogue: %q", got)
+		}
+		// the closer itself sees nothing from the peer
+		if got := opened.DismissReason(); got != "" {
+			t.Errorf("unexpected dismiss reason of the closer: %q", got)
+		}
+	}
+}
+
+// closeReasonDelegate records the close reasons seen by the accepting side
+type closeReasonDelegate struct {
+	reasons chan delegate.DialogueCloseReason
+}
+
+func (cd *closeReasonDelegate) DialogueOnline(dg delegate.DialogueDescriber) error {
+	return nil
+}
+
+func (cd *closeReasonDelegate) DialogueOffline(dg delegate.DialogueDescriber, reason delegate.DialogueCloseReason) error {
+	if dg.PeerInitiated() {
+		cd.reasons <- reason
+	}
+	return nil
+}
+
+func TestDialogueOfflineReason(t *testing.T) {
+	dlgt := &closeReasonDelegate{reasons: make(chan delegate.DialogueCloseReason, 2)}
+	mpServer, mpClient, err := getMultiplexerPair(OptionDelegate(dlgt))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		mpClient.Close()
+		mpServer.Close()
+	}()
+
+	closes := []struct {
+		close  func(Dialogue)
+		reason CloseReason
+	}{
+		{Dialogue.Close, CloseReasonDismiss},
+		{Dialogue.Reset, CloseReasonReset},
+	}
+	for _, c := range closes {
+		opened, err := mpClient.OpenDialogue([]byte("reason"), "")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if _, err = mpServer.AcceptDialogue(); err != nil {
+			t.Error(err)
+			return
+		}
+		c.close(opened)
+		select {
+		case got := <-dlgt.reasons:
+			if got != c.reason {
+				t.Errorf("unexpected offline reason: %s, expected: %s", got, c.reason)
+			}
+		case <-time.After(time.Second):
+			t.Error("dialogue not offline")
+			return
+		}
+	}
+}
+
+func TestDialogueOnStateChange(t *testing.T) {
+	mpServer, mpClient, err := getMultiplexerPair()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		mpClient.Close()
+		mpServer.Close()
+	}()
+
+	var opened atomic.Value
+	changes := make(chan string, 16)
+	dg, err := mpClient.OpenDialogue([]byte("state"), "", OptionDialogueOnStateChange(func(old, new string) {
+		// querying the dialogue inside the hook mustn't deadlock
+		if dg, ok := opened.Load().(Dialogue); ok && dg.State() != new {
+			t.Errorf("unexpected state in hook: %s, new: %s", dg.State(), new)
+		}
+		changes <- old + "->" + new
+	}))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	opened.Store(dg)
+	if dg.State() != SESSIONED {
+		t.Errorf("unexpected state: %s", dg.State())
+	}
+	if _, err = mpServer.AcceptDialogue(); err != nil {
+		t.Error(err)
+		return
+	}
+	dg.Close()
+
+	expected := []string{
+		INIT + "->" + SESSION_SENT,
+		SESSION_SENT + "->" + SESSIONED,
+		SESSIONED + "->" + DISMISS_SENT,
+		DISMISS_SENT + "->" + DISMISS_HALF,
+		DISMISS_HALF + "->" + DISMISSED,
+		DISMISSED + "->" + FINI,
+	}
+	for _, want := range expected {
+		select {
+		case got := <-changes:
+			if got != want {
+				t.Errorf("unexpected state change: %s, expected: %s", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("state change %s not notified", want)
+			return
+		}
+	}
+	if dg.State() != FINI {
+		t.Errorf("unexpected state after closed: %s", dg.State())
+	}
+}
+
+func TestDialogueBytes(t *testing.T) {
+	mpServer, mpClient, err := getMultiplexerPair()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		mpClient.Close()
+		mpServer.Close()
+	}()
+
+	opened, err := mpClient.OpenDialogue([]byte("bytes"), "")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	accepted, err := mpServer.AcceptDialogue()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	pf := packet.NewPacketFactory(id.NewIDCounter(id.Odd))
+	data := bytes.Repeat([]byte("b"), 100)
+	encoded, err := pf.NewStreamPacketWithSessionID(opened.DialogueID(), data).Encode()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	// the session handshake is counted already
+	writeFrom, readFrom := opened.WriteBytes(), accepted.ReadBytes()
+	n := 10
+	for i := 0; i < n; i++ {
+		if err = opened.Write(pf.NewStreamPacket(data)); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	for i := 0; i < n; i++ {
+		if _, err = accepted.Read(); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	expected := uint64(n * len(encoded))
+	if got := accepted.ReadBytes() - readFrom; got != expected {
+		t.Errorf("unexpected read bytes: %d, expected: %d", got, expected)
+	}
+	if got := accepted.Stats().ReadBytes - readFrom; got != expected {
+		t.Errorf("unexpected read bytes of stats: %d, expected: %d", got, expected)
+	}
+	// the writes are counted after the conn returned
+	deadline := time.Now().Add(time.Second)
+	for opened.WriteBytes()-writeFrom != expected && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if got := opened.WriteBytes() - writeFrom; got != expected {
+		t.Errorf("unexpected write bytes: %d, expected: %d", got, expected)
+	}
+}
+
+func TestMaxDialogues(t *testing.T) {
+	max := 3
+	mpServer, mpClient, err := getMultiplexerPair(OptionMultiplexerMaxDialogues(max))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		mpClient.Close()
+		mpServer.Close()
+	}()
+
+	for i := 0; i < max; i++ {
+		if _, err = mpClient.OpenDialogue([]byte("limited"), ""); err != nil {
+			t.Fatalf("open dialogue %d err: %s", i, err)
+		}
+		if _, err = mpServer.AcceptDialogue(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = mpClient.OpenDialogue([]byte("limited"), "")
+	openErr := &OpenError{}
+	if !errors.As(err, &openErr) || openErr.Kind != OpenErrorRejected || !errors.Is(err, ErrTooManyDialogues) {
+		t.Fatalf("unexpected err beyond the limit: %v", err)
+	}
+	// only the default dialogue and the ones under the limit
+	if n := len(mpServer.ListDialogues()); n != max+1 {
+		t.Errorf("unexpected dialogues at the rejecting side: %d", n)
+	}
+}
+
+func getMultiplexerPair(opts ...MultiplexerOption) (Multiplexer, Multiplexer, error) {
+	netconnServer, netconnClient := net.Pipe()
+
+	var cnServer conn.Conn
+	var errServer error
+	done := make(chan struct{})
+	go func() {
+		cnServer, errServer = conn.NewServerConn(netconnServer)
+		close(done)
+	}()
+	cnClient, err := conn.NewClientConn(netconnClient)
+	if err != nil {
+		return nil, nil, err
+	}
+	<-done
+	if errServer != nil {
+		return nil, nil, errServer
+	}
+
+	opts = append(opts, OptionMultiplexerAcceptDialogue())
+	mpServer, err := NewDialogueMgr(cnServer, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	mpClient, err := NewDialogueMgr(cnClient, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return mpServer, mpClient, nil
+}
+
+func TestOpenDialogues(t *testing.T) {
+	n := 10
+	cnClient := newFakeConn(geminio.InitiatorSide)
+	cnServer := newFakeConn(geminio.RecipientSide)
+	defer func() {
+		cnClient.Close()
+		cnServer.Close()
+	}()
+	mpClient, err := NewDialogueMgr(cnClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mpServer, err := NewDialogueMgr(cnServer, OptionMultiplexerAcceptDialogue())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type result struct {
+		dgs []Dialogue
+		err error
+	}
+	resultCh := make(chan result, 1)
+	go func() {
+		dgs, err := mpClient.OpenDialogues(n, []byte("batched"), "")
+		resultCh <- result{dgs, err}
+	}()
+
+	// all sessions go in one packet
+	pkt := cnClient.waitWritten(t, packet.TypeSessionBatchPacket, time.Second)
+	if pkt == nil {
+		return
+	}
+	if sessions := pkt.(*packet.SessionBatchPacket).Sessions; len(sessions) != n {
+		t.Fatalf("unexpected sessions in the batch: %d", len(sessions))
+	}
+	cnServer.readCh <- pkt
+
+	// and the acks come back in the same round trip
+	acks := []packet.Packet{}
+	deadline := time.Now().Add(time.Second)
+	for len(acks) < n && time.Now().Before(deadline) {
+		acks = acks[:0]
+		for _, written := range cnServer.writtenFrom(0) {
+			if written.Type() == packet.TypeSessionAckPacket {
+				acks = append(acks, written)
+			}
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if len(acks) != n {
+		t.Fatalf("unexpected acks: %d", len(acks))
+	}
+	for _, ack := range acks {
+		cnClient.readCh <- ack
+	}
+
+	var res result
+	select {
+	case res = <-resultCh:
+	case <-time.After(time.Second):
+		t.Fatal("open dialogues timeout")
+	}
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	if written := cnClient.writtenLen(); written != 1 {
+		t.Errorf("unexpected packets written by the opens: %d", written)
+	}
+	ids := map[uint64]struct{}{}
+	for _, dg := range res.dgs {
+		if dg.State() != SESSIONED {
+			t.Errorf("unexpected state: %s, dialogueID: %d", dg.State(), dg.DialogueID())
+		}
+		if string(dg.Meta()) != "batched" {
+			t.Errorf("unexpected meta: %s", dg.Meta())
+		}
+		ids[dg.DialogueID()] = struct{}{}
+	}
+	if len(ids) != n {
+		t.Errorf("unexpected distinct dialogueIDs: %d", len(ids))
+	}
+	for i := 0; i < n; i++ {
+		dg, err := mpServer.AcceptDialogue()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := ids[dg.DialogueID()]; !ok {
+			t.Errorf("unexpected dialogueID accepted: %d", dg.DialogueID())
+		}
+	}
+
+	if _, err = mpClient.OpenDialogues(0, nil, ""); err != ErrInvalidDialogueCount {
+		t.Errorf("unexpected err of no dialogue: %v", err)
+	}
+}
@@ -0,0 +1,46 @@
+package multiplexer
+
+import "github.com/singchia/geminio/packet"
+
+// OptionMultiplexerMaxPacketSize advertises the max payload size of the data
+// packets accepted by the dialogues, the smaller one of both sides' is taken
+// while negotiating. 0 means no limit.
+func OptionMultiplexerMaxPacketSize(size int) MultiplexerOption {
+	return func(opts *multiplexerOpts) {
+		opts.maxPacketSize = size
+	}
+}
+
+// MaxPacketSize returns the negotiated max payload size of the data packets
+// after the handshake, 0 means no limit. Writes exceeding it fail with
+// ErrPacketTooLarge, the upper layer should chunk the large payloads.
+func (dg *dialogue) MaxPacketSize() int {
+	return dg.packetSize
+}
+
+// the non-zero smaller one of ours and the peer's, peers without the limit
+// advertise 0
+func (dg *dialogue) negotiatePacketSize(peer int) {
+	dg.packetSize = dg.maxPacketSize
+	if peer > 0 && (dg.packetSize == 0 || peer < dg.packetSize) {
+		dg.packetSize = peer
+	}
+}
+
+// payloadLen returns the length of the data carried, -1 for the packets
+// not limited
+func payloadLen(pkt packet.Packet) int {
+	switch realPkt := pkt.(type) {
+	case *packet.StreamPacket:
+		return len(realPkt.Data)
+	case *packet.MessagePacket:
+		return len(realPkt.Data.Value)
+	case *packet.RequestPacket:
+		return len(realPkt.Data.Value)
+	case *packet.MessageAckPacket:
+		return len(realPkt.Data.Value)
+	case *packet.ResponsePacket:
+		return len(realPkt.Data.Value)
+	}
+	return -1
+}
@@ -0,0 +1,118 @@
+package multiplexer
+
+import (
+	"io"
+	"sync/atomic"
+
+	"github.com/singchia/geminio/packet"
+)
+
+const (
+	// the packets read ahead of the writeOutCh for the higher priority ones
+	// to go first
+	priorityBufferSize = 64
+	// a packet overtaken this many times by the higher priority ones goes
+	// next regardless of the priority
+	priorityAging = 16
+)
+
+// WritePriority writes the packet like Write, the higher priority ones
+// pending in the dialogue are written down first, and the same priority
+// ones in the order they came, 0 is the lowest and what Write uses.
+//
+// Only the data packets pending at most priorityBufferSize ahead are
+// reordered, the session layer packets keep their places so nothing
+// crosses a dismiss. To avoid starvation, a packet overtaken priorityAging
+// times is written next whatever its priority. The priority orders the
+// packets within the dialogue, the QoS scheduling orders the dialogues.
+func (dg *dialogue) WritePriority(pkt packet.Packet, priority uint8) error {
+	if prioritized, ok := pkt.(packet.Prioritized); ok {
+		prioritized.SetWritePriority(priority)
+	}
+	return dg.write(pkt)
+}
+
+type prioritizedPacket struct {
+	pkt       packet.Packet
+	priority  uint8
+	overtaken int
+	// the session layer and sync packets are never reordered
+	barrier bool
+}
+
+// priorityBuffer is only accessed by the writePkt goroutine but the length
+type priorityBuffer struct {
+	pkts []*prioritizedPacket
+	// the writeOutCh is closed after the buffered ones
+	closed bool
+	length int32
+}
+
+func (pb *priorityBuffer) len() int {
+	return int(atomic.LoadInt32(&pb.length))
+}
+
+func (pb *priorityBuffer) push(pkt packet.Packet) {
+	pp := &prioritizedPacket{pkt: pkt}
+	if _, isSync := pkt.(*syncPacket); isSync || packet.SessionLayer(pkt) {
+		pp.barrier = true
+	} else if prioritized, ok := pkt.(packet.Prioritized); ok {
+		pp.priority = prioritized.WritePriority()
+	}
+	pb.pkts = append(pb.pkts, pp)
+	atomic.AddInt32(&pb.length, 1)
+}
+
+// fill reads the pending packets of writeOutCh without blocking, until full
+// or a barrier buffered, since nothing goes ahead of it
+func (pb *priorityBuffer) fill(writeOutCh chan packet.Packet) {
+	for !pb.closed && len(pb.pkts) < priorityBufferSize {
+		if n := len(pb.pkts); n > 0 && pb.pkts[n-1].barrier {
+			return
+		}
+		select {
+		case pkt, ok := <-writeOutCh:
+			if !ok {
+				pb.closed = true
+				return
+			}
+			pb.push(pkt)
+		default:
+			return
+		}
+	}
+}
+
+// pop returns the next packet to write, io.EOF after the writeOutCh closed
+// and all buffered ones returned
+func (pb *priorityBuffer) pop() (packet.Packet, error) {
+	if len(pb.pkts) == 0 {
+		if pb.closed {
+			return nil, io.EOF
+		}
+		return nil, nil
+	}
+	// the candidates are the ones ahead of the first barrier
+	candidates := len(pb.pkts)
+	for i, pp := range pb.pkts {
+		if pp.barrier {
+			candidates = i
+			break
+		}
+	}
+	index := 0
+	if candidates > 0 && pb.pkts[0].overtaken < priorityAging {
+		for i := 1; i < candidates; i++ {
+			if pb.pkts[i].priority > pb.pkts[index].priority {
+				index = i
+			}
+		}
+	}
+	for i := 0; i < index; i++ {
+		pb.pkts[i].overtaken++
+	}
+	pkt := pb.pkts[index].pkt
+	pb.pkts = append(pb.pkts[:index], pb.pkts[index+1:]...)
+	atomic.AddInt32(&pb.length, -1)
+	return pkt, nil
+}
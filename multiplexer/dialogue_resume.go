@@ -0,0 +1,61 @@
+package multiplexer
+
+import (
+	"github.com/singchia/geminio"
+	"github.com/singchia/geminio/packet"
+)
+
+// OptionDialogueResume asks the peer to keep the dialogueID of a previous
+// dialogue, such as the one before reconnecting, so that the states bound
+// to the ID survive. The peer's DialogueResumer decides it, and the dialogue
+// gets a new ID if refused quietly, check DialogueID after opened.
+func OptionDialogueResume(dialogueID uint64) DialogueOption {
+	return func(dg *dialogue) {
+		dg.resumeID = dialogueID
+	}
+}
+
+// resumeID returns the ID resumed for the peer's session, SessionIDNull if
+// not resuming or not accepted, the error refuses the session
+func (dm *dialogueMgr) resumeID(pkt *packet.SessionPacket) (uint64, error) {
+	oldID, ok := pkt.Resume()
+	// only the side assigning dialogueIDs resumes them
+	if !ok || !pkt.SessionIDAcquire() || oldID == packet.SessionID1 {
+		return packet.SessionIDNull, nil
+	}
+	resumer, ok := dm.dlgt.(DialogueResumer)
+	if !ok {
+		return packet.SessionIDNull, nil
+	}
+	dm.mtx.RLock()
+	_, online := dm.dialogues[oldID]
+	_, negotiating := dm.negotiatingDialogues[oldID]
+	dm.mtx.RUnlock()
+	if online || negotiating {
+		dm.log.Infof("resume dialogue in use, clientID: %d, dialogueID: %d",
+			dm.cn.ClientID(), oldID)
+		return packet.SessionIDNull, nil
+	}
+	resumed, err := resumer.ResumeDialogue(oldID, pkt.SessionData.Meta)
+	if err != nil || !resumed {
+		return packet.SessionIDNull, err
+	}
+	return oldID, nil
+}
+
+// takeResumedID must be called with mtx locked, along with the insert of the
+// dialogue, it returns false if the ID is taken since resumeID checked
+func (dm *dialogueMgr) takeResumedID(resumedID uint64) bool {
+	_, online := dm.dialogues[resumedID]
+	_, negotiating := dm.negotiatingDialogues[resumedID]
+	if online || negotiating {
+		return false
+	}
+	// never allocated again
+	if dm.idAllocator != nil && dm.cn.Side() == geminio.RecipientSide {
+		reserver, ok := dm.idAllocator.(SessionIDReserver)
+		return !ok || reserver.ReserveSessionID(dm.cn.ClientID(), resumedID)
+	}
+	dm.dialogueIDs.ReserveID(resumedID)
+	return true
+}
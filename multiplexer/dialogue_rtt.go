@@ -0,0 +1,62 @@
+package multiplexer
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// HandshakeRTT returns the round trip time from the session sent to its ack
+// read, only measured at the opening side, 0 at the accepting side.
+func (dg *dialogue) HandshakeRTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&dg.handshakeRTT))
+}
+
+// RTT returns the smoothed round trip time of the keepalive pings, seeded by
+// the handshake's, 0 if neither measured.
+func (dg *dialogue) RTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&dg.srtt))
+}
+
+func (dg *dialogue) handshaked(rtt time.Duration) {
+	atomic.StoreInt64(&dg.handshakeRTT, int64(rtt))
+	atomic.CompareAndSwapInt64(&dg.srtt, 0, int64(rtt))
+}
+
+// pinged is called before the ping written, the pings unanswered in the
+// keepalive timeout are forgotten
+func (dg *dialogue) pinged(packetID uint64) {
+	now := time.Now()
+	dg.rttMtx.Lock()
+	defer dg.rttMtx.Unlock()
+	if dg.pings == nil {
+		dg.pings = make(map[uint64]time.Time)
+	}
+	for id, at := range dg.pings {
+		if now.Sub(at) > dg.keepaliveTimeout {
+			delete(dg.pings, id)
+		}
+	}
+	dg.pings[packetID] = now
+}
+
+// ponged samples the RTT by the ping answered, the smoothing is the same as
+// TCP's, 1/8 of the sample is taken
+func (dg *dialogue) ponged(packetID uint64) {
+	dg.rttMtx.Lock()
+	at, ok := dg.pings[packetID]
+	if !ok {
+		dg.rttMtx.Unlock()
+		return
+	}
+	delete(dg.pings, packetID)
+	dg.rttMtx.Unlock()
+	sample := int64(time.Since(at))
+
+	srtt := atomic.LoadInt64(&dg.srtt)
+	if srtt == 0 {
+		srtt = sample
+	} else {
+		srtt += (sample - srtt) / 8
+	}
+	atomic.StoreInt64(&dg.srtt, srtt)
+}
@@ -0,0 +1,181 @@
+package multiplexer
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/singchia/geminio/packet"
+)
+
+// DialogueStats is a snapshot of the dialogue's activities, the zero
+// LastReadAt or LastWriteAt means no packet read or written yet.
+type DialogueStats struct {
+	OpenedAt    time.Time
+	LastReadAt  time.Time
+	LastWriteAt time.Time
+	// negotiated QoS level
+	QoS int8
+	// packets dropped since no one read them
+	Dropped uint64
+	// how long the packets written by the upper layer waited in the write
+	// queues before written down to the conn
+	WriteLatency LatencyHistogram
+	// bytes on the wire of the packets read and written
+	ReadBytes  uint64
+	WriteBytes uint64
+}
+
+// LatencyBuckets are the upper bounds of the LatencyHistogram's buckets
+var LatencyBuckets = [...]time.Duration{
+	100 * time.Microsecond,
+	time.Millisecond,
+	10 * time.Millisecond,
+	100 * time.Millisecond,
+	time.Second,
+}
+
+// LatencyHistogram counts the latencies by LatencyBuckets, Counts[i] is the
+// number of latencies in (LatencyBuckets[i-1], LatencyBuckets[i]], the last
+// one counts those beyond all buckets.
+type LatencyHistogram struct {
+	Counts [len(LatencyBuckets) + 1]uint64
+	Count  uint64
+	Sum    time.Duration
+	Max    time.Duration
+}
+
+// Mean returns the average latency, 0 if nothing observed
+func (histogram LatencyHistogram) Mean() time.Duration {
+	if histogram.Count == 0 {
+		return 0
+	}
+	return histogram.Sum / time.Duration(histogram.Count)
+}
+
+type latencyHistogram struct {
+	counts [len(LatencyBuckets) + 1]uint64
+	count  uint64
+	sum    int64
+	max    int64
+}
+
+func (histogram *latencyHistogram) observe(latency int64) {
+	bucket := len(LatencyBuckets)
+	for i, le := range LatencyBuckets {
+		if latency <= int64(le) {
+			bucket = i
+			break
+		}
+	}
+	atomic.AddUint64(&histogram.counts[bucket], 1)
+	atomic.AddInt64(&histogram.sum, latency)
+	atomic.AddUint64(&histogram.count, 1)
+	for {
+		max := atomic.LoadInt64(&histogram.max)
+		if latency <= max || atomic.CompareAndSwapInt64(&histogram.max, max, latency) {
+			return
+		}
+	}
+}
+
+func (histogram *latencyHistogram) snapshot() LatencyHistogram {
+	snapshot := LatencyHistogram{
+		Count: atomic.LoadUint64(&histogram.count),
+		Sum:   time.Duration(atomic.LoadInt64(&histogram.sum)),
+		Max:   time.Duration(atomic.LoadInt64(&histogram.max)),
+	}
+	for i := range histogram.counts {
+		snapshot.Counts[i] = atomic.LoadUint64(&histogram.counts[i])
+	}
+	return snapshot
+}
+
+type dialogueStats struct {
+	// openedAt holds the monotonic clock reading
+	openedAt time.Time
+	// nanoseconds since openedAt, 0 means never happened
+	lastRead  int64
+	lastWrite int64
+	dropped   uint64
+	// enqueue to write latency of the upper layer packets
+	writeLatency latencyHistogram
+	// the encoded sizes of packets read in and written down
+	readBytes  uint64
+	writeBytes uint64
+}
+
+func (stats *dialogueStats) elapsed() int64 {
+	elapsed := int64(time.Since(stats.openedAt))
+	if elapsed <= 0 {
+		elapsed = 1
+	}
+	return elapsed
+}
+
+func (stats *dialogueStats) touchRead() {
+	atomic.StoreInt64(&stats.lastRead, stats.elapsed())
+}
+
+func (stats *dialogueStats) touchWrite() {
+	atomic.StoreInt64(&stats.lastWrite, stats.elapsed())
+}
+
+// stamp marks the packet enqueued now
+func (stats *dialogueStats) stamp(pkt packet.Packet) {
+	if stamped, ok := pkt.(packet.Enqueued); ok {
+		stamped.SetEnqueuedAt(stats.elapsed())
+	}
+}
+
+func (stats *dialogueStats) observeWrite(pkt packet.Packet) {
+	stamped, ok := pkt.(packet.Enqueued)
+	if !ok || stamped.EnqueuedAt() == 0 {
+		return
+	}
+	stats.writeLatency.observe(stats.elapsed() - stamped.EnqueuedAt())
+}
+
+func (stats *dialogueStats) countRead(pkt packet.Packet) {
+	if measured, ok := pkt.(packet.Measured); ok {
+		atomic.AddUint64(&stats.readBytes, uint64(measured.WireLen()))
+	}
+}
+
+// countWrite lets the conn count the bytes after the packet encoded
+func (stats *dialogueStats) countWrite(pkt packet.Packet) {
+	if measured, ok := pkt.(packet.Measured); ok {
+		measured.CountWritten(&stats.writeBytes)
+	}
+}
+
+func (stats *dialogueStats) at(elapsed int64) time.Time {
+	if elapsed == 0 {
+		return time.Time{}
+	}
+	return stats.openedAt.Add(time.Duration(elapsed))
+}
+
+// Stats returns a snapshot of the dialogue's timestamps, QoS and latencies
+func (dg *dialogue) Stats() DialogueStats {
+	return DialogueStats{
+		OpenedAt:     dg.stats.openedAt,
+		LastReadAt:   dg.stats.at(atomic.LoadInt64(&dg.stats.lastRead)),
+		LastWriteAt:  dg.stats.at(atomic.LoadInt64(&dg.stats.lastWrite)),
+		QoS:          dg.qos,
+		Dropped:      atomic.LoadUint64(&dg.stats.dropped),
+		WriteLatency: dg.stats.writeLatency.snapshot(),
+		ReadBytes:    dg.ReadBytes(),
+		WriteBytes:   dg.WriteBytes(),
+	}
+}
+
+// ReadBytes returns the bytes on the wire of the packets read in
+func (dg *dialogue) ReadBytes() uint64 {
+	return atomic.LoadUint64(&dg.stats.readBytes)
+}
+
+// WriteBytes returns the bytes on the wire of the packets written down, which
+// are counted after the conn encoded them
+func (dg *dialogue) WriteBytes() uint64 {
+	return atomic.LoadUint64(&dg.stats.writeBytes)
+}
@@ -0,0 +1,36 @@
+package multiplexer
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/singchia/geminio/packet"
+)
+
+// syncPacket is a marker queued behind the packets to be written, it's never
+// written to the conn, but notified when all packets ahead are written down.
+type syncPacket struct {
+	done chan error
+}
+
+func newSyncPacket() *syncPacket {
+	return &syncPacket{
+		done: make(chan error, 1),
+	}
+}
+
+func (sp *syncPacket) Decode(data []byte) (uint32, error) { return 0, nil }
+
+func (sp *syncPacket) DecodeFromReader(reader io.Reader) error { return nil }
+
+func (sp *syncPacket) Encode() ([]byte, error) { return nil, nil }
+
+func (sp *syncPacket) EncodeTo(buf *bytes.Buffer) error { return nil }
+
+func (sp *syncPacket) Length() int { return 0 }
+
+func (sp *syncPacket) Consistency() packet.Cnss { return packet.CnssAtMostOnce }
+
+func (sp *syncPacket) ID() uint64 { return 0 }
+
+func (sp *syncPacket) Type() packet.Type { return packet.Type(0) }
@@ -0,0 +1,1917 @@
+package multiplexer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jumboframes/armorigo/synchub"
+	"github.com/singchia/geminio"
+	"github.com/singchia/geminio/packet"
+	"github.com/singchia/geminio/pkg/id"
+	"github.com/singchia/go-timer/v2"
+)
+
+func TestSessionAckNotBlocking(t *testing.T) {
+	cn := newFakeConn(geminio.RecipientSide)
+	cn.setWriteDelay(500 * time.Millisecond)
+	mp, err := NewDialogueMgr(cn, OptionMultiplexerAcceptDialogue())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cn.Close()
+
+	pf := packet.NewPacketFactory(id.NewIDCounter(id.Odd))
+	snPkt := pf.NewSessionPacket(packet.SessionIDNull, true, []byte("slow ack"), "")
+	cn.readCh <- snPkt
+	// data of the default dialogue arrives while the session ack is writing
+	dataPkt := pf.NewStreamPacketWithSessionID(packet.SessionID1, []byte("not blocked"))
+	cn.readCh <- dataPkt
+
+	dg, err := mp.GetDialogue(cn.ClientID(), packet.SessionID1)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	select {
+	case pkt := <-dg.ReadC():
+		if pkt.ID() != dataPkt.ID() {
+			t.Errorf("unexpected packet read, packetID: %d", pkt.ID())
+		}
+	case <-time.After(cn.writeDelay / 2):
+		t.Error("inbound processing blocked by session ack")
+		return
+	}
+	// and the session ack is written down at last
+	accepted, err := mp.AcceptDialogue()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	pkt := cn.waitWritten(t, packet.TypeSessionAckPacket, time.Second)
+	if pkt == nil {
+		return
+	}
+	if pkt.(*packet.SessionAckPacket).SessionID() != accepted.DialogueID() {
+		t.Errorf("unexpected session ack, dialogueID: %d", accepted.DialogueID())
+	}
+}
+
+func TestStaleDismissRejected(t *testing.T) {
+	// the peer is the recipient and decides the dialogueID
+	cn := newFakeConn(geminio.InitiatorSide)
+	mp, err := NewDialogueMgr(cn, OptionMultiplexerAcceptDialogue(), OptionMultiplexerClosedDialogue())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cn.Close()
+
+	pf := packet.NewPacketFactory(id.NewIDCounter(id.Even))
+	dialogueID := uint64(100)
+	// the first session
+	cn.readCh <- pf.NewSessionPacket(dialogueID, false, []byte("first"), "")
+	pkt := cn.waitWritten(t, packet.TypeSessionAckPacket, time.Second)
+	if pkt == nil {
+		return
+	}
+	firstEpoch := pkt.(*packet.SessionAckPacket).SessionData.Epoch
+	if _, err = mp.AcceptDialogue(); err != nil {
+		t.Error(err)
+		return
+	}
+	// dismiss the first session
+	disPkt := pf.NewDismissPacket(dialogueID)
+	disPkt.SessionData.Epoch = firstEpoch
+	cn.readCh <- disPkt
+	pkt = cn.waitWritten(t, packet.TypeDismissPacket, time.Second)
+	if pkt == nil {
+		return
+	}
+	cn.readCh <- pf.NewDismissAckPacket(pkt.ID(), dialogueID, nil)
+	if _, err = mp.ClosedDialogue(); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// the second session reuses the dialogueID
+	from := cn.writtenLen()
+	cn.readCh <- pf.NewSessionPacket(dialogueID, false, []byte("second"), "")
+	pkt = cn.waitWrittenFrom(t, packet.TypeSessionAckPacket, from, time.Second)
+	if pkt == nil {
+		return
+	}
+	if pkt.(*packet.SessionAckPacket).SessionData.Epoch == firstEpoch {
+		t.Error("epoch not changed at a new session")
+	}
+	second, err := mp.AcceptDialogue()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	// replay the dismiss of the first session
+	cn.readCh <- disPkt
+	dataPkt := pf.NewStreamPacketWithSessionID(dialogueID, []byte("still alive"))
+	cn.readCh <- dataPkt
+	select {
+	case pkt, ok := <-second.ReadC():
+		if !ok {
+			t.Error("dialogue closed by stale dismiss")
+			return
+		}
+		if pkt.ID() != dataPkt.ID() {
+			t.Errorf("unexpected packet read, packetID: %d", pkt.ID())
+		}
+	case <-time.After(time.Second):
+		t.Error("read data timeout")
+		return
+	}
+	for _, pkt := range cn.writtenFrom(from) {
+		if pkt.Type() == packet.TypeDismissAckPacket || pkt.Type() == packet.TypeDismissPacket {
+			t.Errorf("unexpected %s written for stale dismiss", pkt.Type().String())
+		}
+	}
+	if _, err = mp.GetDialogue(cn.ClientID(), dialogueID); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDialogueSynced(t *testing.T) {
+	cn := newFakeConn(geminio.RecipientSide)
+	cn.setWriteDelay(10 * time.Millisecond)
+	mp, err := NewDialogueMgr(cn)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cn.Close()
+
+	dg, err := mp.GetDialogue(cn.ClientID(), packet.SessionID1)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	pf := packet.NewPacketFactory(id.NewIDCounter(id.Odd))
+	count := 10
+	for i := 0; i < count; i++ {
+		if err = dg.Write(pf.NewStreamPacket([]byte("synced"))); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	if err = dg.Synced(); err != nil {
+		t.Error(err)
+		return
+	}
+	written := 0
+	for _, pkt := range cn.writtenFrom(0) {
+		if pkt.Type() == packet.TypeStreamPacket {
+			written++
+		}
+	}
+	if written != count {
+		t.Errorf("unexpected written number before synced: %d", written)
+	}
+
+	// the write error is returned
+	cn.setWriteErr(io.ErrClosedPipe)
+	if err = dg.Write(pf.NewStreamPacket([]byte("failed"))); err != nil {
+		t.Error(err)
+		return
+	}
+	if err = dg.Synced(); err != io.ErrClosedPipe {
+		t.Errorf("unexpected synced err: %v", err)
+	}
+}
+
+func TestDialogueOnSyncTimeout(t *testing.T) {
+	cn := newFakeConn(geminio.InitiatorSide)
+	mp, err := NewDialogueMgr(cn)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cn.Close()
+
+	type timedOut struct {
+		packetID uint64
+		op       string
+	}
+	timedOuts := make(chan timedOut, 1)
+	onSyncTimeout := func(packetID uint64, op string) {
+		timedOuts <- timedOut{packetID, op}
+	}
+	// the session ack never comes
+	_, err = mp.OpenDialogue([]byte("timeout"), "",
+		OptionDialogueSyncTimeout(100*time.Millisecond),
+		OptionDialogueOnSyncTimeout(onSyncTimeout))
+	if !errors.Is(err, synchub.ErrSyncTimeout) {
+		t.Errorf("unexpected open err: %v", err)
+		return
+	}
+	pkt := cn.waitWritten(t, packet.TypeSessionPacket, time.Second)
+	if pkt == nil {
+		return
+	}
+	select {
+	case got := <-timedOuts:
+		if got.op != "open" || got.packetID != pkt.ID() {
+			t.Errorf("unexpected sync timeout, op: %s, packetID: %d", got.op, got.packetID)
+		}
+	case <-time.After(time.Second):
+		t.Error("sync timeout hook not called")
+	}
+}
+
+func TestTimerGranularity(t *testing.T) {
+	cn := newFakeConn(geminio.InitiatorSide)
+	mp, err := NewDialogueMgr(cn, OptionMultiplexerTimerGranularity(time.Millisecond))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cn.Close()
+
+	// the session ack never comes
+	timeout := 5 * time.Millisecond
+	start := time.Now()
+	_, err = mp.OpenDialogue([]byte("timeout"), "", OptionDialogueSyncTimeout(timeout))
+	elapsed := time.Since(start)
+	if !errors.Is(err, synchub.ErrSyncTimeout) {
+		t.Errorf("unexpected open err: %v", err)
+		return
+	}
+	// fires within one tick past due, plus some scheduling latency
+	if elapsed < timeout-time.Millisecond || elapsed > 5*timeout {
+		t.Errorf("open timeout not fired near %s, elapsed: %s", timeout, elapsed)
+	}
+}
+
+func TestTimerFallback(t *testing.T) {
+	tmr := timer.NewTimer()
+	defer tmr.Close()
+	cn := newFakeConn(geminio.InitiatorSide)
+	dismissTimeout := 100 * time.Millisecond
+	mp, err := NewDialogueMgr(cn, OptionTimer(tmr), OptionMultiplexerTimerWatch(10*time.Millisecond),
+		OptionMultiplexerAcceptDialogue(), OptionMultiplexerClosedDialogue(),
+		OptionMultiplexerDismissTimeout(dismissTimeout))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cn.Close()
+
+	// the paused timer fails every tick added, wait for the heartbeats missed
+	tmr.Pause()
+	defer tmr.Moveon()
+	time.Sleep(100 * time.Millisecond)
+
+	// the session ack never comes
+	timeout := 50 * time.Millisecond
+	start := time.Now()
+	_, err = mp.OpenDialogue([]byte("timeout"), "", OptionDialogueSyncTimeout(timeout))
+	if !errors.Is(err, synchub.ErrSyncTimeout) {
+		t.Errorf("unexpected open err: %v", err)
+		return
+	}
+	// the failed ticks would fire at once, give the rounding of ticks some room
+	if elapsed := time.Since(start); elapsed < timeout/2 || elapsed > 10*timeout {
+		t.Errorf("open timeout not fired near %s, elapsed: %s", timeout, elapsed)
+	}
+
+	// the peer never acks the dismiss
+	pf := packet.NewPacketFactory(id.NewIDCounter(id.Even))
+	cn.readCh <- pf.NewSessionPacket(100, false, []byte("close"), "")
+	dg, err := mp.AcceptDialogue()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	start = time.Now()
+	dg.Close()
+	if _, err = mp.ClosedDialogue(); err != nil {
+		t.Error(err)
+		return
+	}
+	if elapsed := time.Since(start); elapsed < dismissTimeout/2 || elapsed > 10*dismissTimeout {
+		t.Errorf("close timeout not fired near %s, elapsed: %s", dismissTimeout, elapsed)
+	}
+	if mp.TimerFallbacks() == 0 {
+		t.Error("no timeout fell back")
+	}
+}
+
+func TestDialogueReset(t *testing.T) {
+	cn := newFakeConn(geminio.InitiatorSide)
+	mp, err := NewDialogueMgr(cn, OptionMultiplexerAcceptDialogue(), OptionMultiplexerClosedDialogue())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cn.Close()
+
+	pf := packet.NewPacketFactory(id.NewIDCounter(id.Even))
+	dialogueID := uint64(100)
+	cn.readCh <- pf.NewSessionPacket(dialogueID, false, []byte("unresponsive"), "")
+	dg, err := mp.AcceptDialogue()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	// the peer never acks the dismiss
+	dg.Close()
+	if pkt := cn.waitWritten(t, packet.TypeDismissPacket, time.Second); pkt == nil {
+		return
+	}
+	start := time.Now()
+	dg.Reset()
+	closed, err := mp.ClosedDialogue()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if closed.DialogueID() != dialogueID {
+		t.Errorf("unexpected closed dialogue, dialogueID: %d", closed.DialogueID())
+	}
+	if _, ok := <-dg.ReadC(); ok {
+		t.Error("read channel not closed after reset")
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("reset took too long: %s", elapsed)
+	}
+	if dg.CloseReason() != CloseReasonReset {
+		t.Errorf("unexpected close reason: %s", dg.CloseReason())
+	}
+	if err = dg.Write(pf.NewStreamPacket([]byte("after reset"))); err != ErrDialogueError {
+		t.Errorf("unexpected write after reset: %v", err)
+	}
+	if _, err = mp.GetDialogue(cn.ClientID(), dialogueID); err == nil {
+		t.Error("dialogue left after reset")
+	}
+	pkt := cn.waitWritten(t, packet.TypeResetPacket, time.Second)
+	if pkt != nil && pkt.(*packet.ResetPacket).SessionID() != dialogueID {
+		t.Errorf("unexpected reset packet, dialogueID: %d", pkt.(*packet.ResetPacket).SessionID())
+	}
+}
+
+func TestDialogueReadContext(t *testing.T) {
+	cn := newFakeConn(geminio.InitiatorSide)
+	mp, err := NewDialogueMgr(cn, OptionMultiplexerAcceptDialogue())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cn.Close()
+
+	pf := packet.NewPacketFactory(id.NewIDCounter(id.Even))
+	dialogueID := uint64(100)
+	cn.readCh <- pf.NewSessionPacket(dialogueID, false, []byte("read"), "")
+	dg, err := mp.AcceptDialogue()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if _, ok := dg.TryRead(); ok {
+		t.Error("try read succeed on empty dialogue")
+	}
+	// canceled already
+	canceled, cancelNow := context.WithCancel(context.Background())
+	cancelNow()
+	start := time.Now()
+	if _, err = dg.ReadContext(canceled); err != context.Canceled {
+		t.Errorf("unexpected read err: %v", err)
+		return
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("read with canceled context blocked: %s", elapsed)
+	}
+	// timeout without closing the dialogue
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err = dg.ReadContext(ctx); err != context.DeadlineExceeded {
+		t.Errorf("unexpected read err: %v", err)
+		return
+	}
+	// the packet arrives after the timed-out read must not be lost
+	cn.readCh <- pf.NewStreamPacketWithSessionID(dialogueID, []byte("later"))
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	pkt, err := dg.ReadWithContext(ctx)
+	if err != nil {
+		t.Errorf("unexpected read err: %v", err)
+		return
+	}
+	if data := string(pkt.(*packet.StreamPacket).Data); data != "later" {
+		t.Errorf("unexpected data: %s", data)
+	}
+	cn.readCh <- pf.NewStreamPacketWithSessionID(dialogueID, []byte("polled"))
+	deadline := time.Now().Add(time.Second)
+	for {
+		pkt, ok := dg.TryRead()
+		if ok {
+			if data := string(pkt.(*packet.StreamPacket).Data); data != "polled" {
+				t.Errorf("unexpected data: %s", data)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Error("try read never succeed")
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestDialogueReadBatch(t *testing.T) {
+	cn := newFakeConn(geminio.InitiatorSide)
+	mp, err := NewDialogueMgr(cn, OptionMultiplexerAcceptDialogue())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cn.Close()
+
+	pf := packet.NewPacketFactory(id.NewIDCounter(id.Even))
+	dialogueID := uint64(100)
+	cn.readCh <- pf.NewSessionPacket(dialogueID, false, []byte("batch"), "")
+	dg, err := mp.AcceptDialogue()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	buffered := func(n int) {
+		for i := 0; i < n; i++ {
+			cn.readCh <- pf.NewStreamPacketWithSessionID(dialogueID, []byte(strconv.Itoa(i)))
+		}
+		deadline := time.Now().Add(time.Second)
+		for len(dg.ReadC()) < n && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	buffered(5)
+	pkts, err := dg.ReadBatch(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pkts) != 5 {
+		t.Fatalf("unexpected packets in the batch: %d", len(pkts))
+	}
+	for i, pkt := range pkts {
+		if data := string(pkt.(*packet.StreamPacket).Data); data != strconv.Itoa(i) {
+			t.Errorf("unexpected data at %d: %s", i, data)
+		}
+	}
+
+	// no more than max
+	buffered(3)
+	if pkts, err = dg.ReadBatch(2); err != nil || len(pkts) != 2 {
+		t.Fatalf("unexpected batch: %d, err: %v", len(pkts), err)
+	}
+	if pkts, err = dg.ReadBatch(2); err != nil || len(pkts) != 1 {
+		t.Fatalf("unexpected rest of the batch: %d, err: %v", len(pkts), err)
+	}
+
+	// EOF once closed and drained
+	cn.readCh <- pf.NewResetPacket(dialogueID)
+	if pkts, err = dg.ReadBatch(2); err != ErrDialogueError {
+		t.Errorf("unexpected read after closed: %d, err: %v", len(pkts), err)
+	}
+}
+
+func TestDialogueWritePriority(t *testing.T) {
+	cn := newFakeConn(geminio.InitiatorSide)
+	// the pending ones queue up while the conn is writing
+	cn.setWriteDelay(5 * time.Millisecond)
+	mp, err := NewDialogueMgr(cn, OptionMultiplexerAcceptDialogue())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cn.Close()
+
+	pf := packet.NewPacketFactory(id.NewIDCounter(id.Even))
+	dialogueID := uint64(100)
+	cn.readCh <- pf.NewSessionPacket(dialogueID, false, []byte("priority"), "")
+	dg, err := mp.AcceptDialogue()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	cn.waitWritten(t, packet.TypeSessionAckPacket, time.Second)
+
+	// writes the packets, and returns their data in the written order
+	written := func(priorities []uint8) []string {
+		from := cn.writtenLen()
+		for i, priority := range priorities {
+			pkt := pf.NewStreamPacket([]byte(strconv.Itoa(i)))
+			if err := dg.WritePriority(pkt, priority); err != nil {
+				t.Fatal(err)
+			}
+			if i == 0 {
+				// till the first one being written
+				time.Sleep(time.Millisecond)
+			}
+		}
+		deadline := time.Now().Add(time.Second)
+		for cn.writtenLen()-from < len(priorities) && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		datas := []string{}
+		for _, pkt := range cn.writtenFrom(from) {
+			datas = append(datas, string(pkt.(*packet.StreamPacket).Data))
+		}
+		return datas
+	}
+
+	// the first one holds the conn, and the high ones jump ahead of the rest
+	got := written([]uint8{0, 0, 0, 9, 0, 9, 0})
+	want := []string{"0", "3", "5", "1", "2", "4", "6"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("unexpected written order: %v, want: %v", got, want)
+	}
+
+	// the low one isn't starved by the high ones keeping coming
+	priorities := []uint8{0, 0}
+	for i := 0; i < 2*priorityAging; i++ {
+		priorities = append(priorities, 9)
+	}
+	got = written(priorities)
+	for i, data := range got {
+		if data == "1" {
+			if i > priorityAging+1 {
+				t.Errorf("the low one overtaken too many times, written at: %d", i)
+			}
+			break
+		}
+	}
+	if len(got) != len(priorities) {
+		t.Errorf("unexpected written: %d", len(got))
+	}
+}
+
+func TestDialogueClosedErrors(t *testing.T) {
+	// the peer of the last one is left to the dismiss timeout
+	mpServer, mpClient, err := getMultiplexerPair(OptionMultiplexerDismissTimeout(200 * time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mpServer.Close()
+	defer mpClient.Close()
+
+	pair := func() (Dialogue, Dialogue) {
+		accepted := make(chan Dialogue, 1)
+		go func() {
+			dg, err := mpServer.AcceptDialogue()
+			if err != nil {
+				t.Error(err)
+			}
+			accepted <- dg
+		}()
+		dg, err := mpClient.OpenDialogue(nil, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return dg, <-accepted
+	}
+	pf := packet.NewPacketFactory(id.NewIDCounter(id.Odd))
+	errs := []error{ErrDialogueClosed, ErrDialogueDismissed, ErrDialogueError}
+	check := func(err, want error) {
+		if err != want || !errors.Is(err, io.EOF) {
+			t.Errorf("unexpected err: %v, want: %v", err, want)
+		}
+		for _, other := range errs {
+			if other != want && errors.Is(err, other) {
+				t.Errorf("err: %v is %v as well", err, other)
+			}
+		}
+	}
+
+	// both sides see the dismiss
+	dg, peer := pair()
+	dg.CloseWaitContext(context.TODO())
+	_, err = peer.Read()
+	check(err, ErrDialogueDismissed)
+	check(dg.Write(pf.NewStreamPacket([]byte("after dismiss"))), ErrDialogueDismissed)
+
+	// the reset is an error
+	dg, peer = pair()
+	dg.Reset()
+	_, err = peer.Read()
+	check(err, ErrDialogueError)
+	check(dg.Write(pf.NewStreamPacket([]byte("after reset"))), ErrDialogueError)
+
+	// closed without any handshake, like the conn gone
+	dg, _ = pair()
+	dg.(*dialogue).closeIO()
+	_, err = dg.Read()
+	check(err, ErrDialogueClosed)
+}
+
+func TestDialogueCloseWaitContext(t *testing.T) {
+	cn := newFakeConn(geminio.InitiatorSide)
+	mp, err := NewDialogueMgr(cn, OptionMultiplexerAcceptDialogue())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cn.Close()
+
+	pf := packet.NewPacketFactory(id.NewIDCounter(id.Even))
+	cn.readCh <- pf.NewSessionPacket(100, false, []byte("close"), "")
+	dg, err := mp.AcceptDialogue()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	// the peer never acks the dismiss
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err = dg.CloseWaitContext(ctx); err != context.DeadlineExceeded {
+		t.Errorf("unexpected close err: %v", err)
+		return
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("close wait not bounded by ctx: %s", elapsed)
+	}
+	if cn.waitWritten(t, packet.TypeDismissPacket, time.Second) == nil {
+		return
+	}
+	// and the dialogue exits without the ack
+	select {
+	case _, ok := <-dg.ReadC():
+		if ok {
+			t.Error("unexpected packet read")
+		}
+	case <-time.After(time.Second):
+		t.Error("dialogue not exited after close wait canceled")
+	}
+}
+
+func TestDialogueCloseDismissTimeout(t *testing.T) {
+	cn := newFakeConn(geminio.InitiatorSide)
+	timeout := 100 * time.Millisecond
+	mp, err := NewDialogueMgr(cn, OptionMultiplexerAcceptDialogue(),
+		OptionMultiplexerClosedDialogue(), OptionMultiplexerDismissTimeout(timeout))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cn.Close()
+
+	pf := packet.NewPacketFactory(id.NewIDCounter(id.Even))
+	cn.readCh <- pf.NewSessionPacket(100, false, []byte("close"), "")
+	dg, err := mp.AcceptDialogue()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	// the peer never acks the dismiss
+	start := time.Now()
+	dg.Close()
+	if cn.waitWritten(t, packet.TypeDismissPacket, time.Second) == nil {
+		return
+	}
+	closed, err := mp.ClosedDialogue()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if closed.DialogueID() != dg.DialogueID() {
+		t.Errorf("unexpected dialogue closed, dialogueID: %d", closed.DialogueID())
+	}
+	if elapsed := time.Since(start); elapsed < timeout || elapsed > 10*timeout {
+		t.Errorf("dialogue not finished at the dismiss timeout: %s", elapsed)
+	}
+	if _, ok := <-dg.ReadC(); ok {
+		t.Error("unexpected packet read")
+	}
+	// the dialogue goes offline right before finishing
+	deadline := time.Now().Add(time.Second)
+	for dg.State() != FINI {
+		if time.Now().After(deadline) {
+			t.Errorf("unexpected state after the dismiss timeout: %s", dg.State())
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestDialogueDrainOnClose(t *testing.T) {
+	cn := newFakeConn(geminio.InitiatorSide)
+	mp, err := NewDialogueMgr(cn)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cn.Close()
+
+	pf := packet.NewPacketFactory(id.NewIDCounter(id.Even))
+	dialogueID := uint64(100)
+	go func() {
+		pkt := cn.waitWritten(t, packet.TypeSessionPacket, time.Second)
+		if pkt != nil {
+			cn.readCh <- pf.NewSessionAckPacket(pkt.ID(), pkt.(*packet.SessionPacket).NegotiateID(), dialogueID, nil)
+		}
+	}()
+	opened, err := mp.OpenDialogue([]byte("drain"), "", OptionDialogueDrainOnClose(true))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	dg := opened.(*dialogue)
+
+	// the peer dismisses, and we dismiss too
+	cn.readCh <- pf.NewDismissPacket(dialogueID)
+	pkt := cn.waitWritten(t, packet.TypeDismissPacket, time.Second)
+	if pkt == nil {
+		return
+	}
+	// block the dialogue by the unread data, the writes are kept pending
+	for i := 0; i <= dg.readOutSize; i++ {
+		cn.readCh <- pf.NewStreamPacketWithSessionID(dialogueID, []byte("unread"))
+	}
+	cn.readCh <- pf.NewDismissAckPacket(pkt.ID(), dialogueID, nil)
+	deadline := time.Now().Add(time.Second)
+	for len(dg.readOutCh) < dg.readOutSize {
+		if time.Now().After(deadline) {
+			t.Error("data not read into the buffer")
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	pending := map[string]struct{}{}
+	for i := 0; i < 5; i++ {
+		data := "pending " + strconv.Itoa(i)
+		pending[data] = struct{}{}
+		if err = dg.Write(pf.NewStreamPacket([]byte(data))); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	// the handshake completes once the data consumed
+	for range dg.ReadC() {
+	}
+	deadline = time.Now().Add(time.Second)
+	for len(pending) > 0 && time.Now().Before(deadline) {
+		for _, pkt := range cn.writtenFrom(0) {
+			if streamPkt, ok := pkt.(*packet.StreamPacket); ok {
+				delete(pending, string(streamPkt.Data))
+			}
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if len(pending) > 0 {
+		t.Errorf("pending packets not written at close: %v", pending)
+	}
+	if reason := dg.CloseReason(); reason != CloseReasonDismiss {
+		t.Errorf("unexpected close reason: %s", reason)
+	}
+}
+
+func TestDialogueCloseAfterDrain(t *testing.T) {
+	cn := newFakeConn(geminio.InitiatorSide)
+	mp, err := NewDialogueMgr(cn, OptionMultiplexerAcceptDialogue())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cn.Close()
+
+	pf := packet.NewPacketFactory(id.NewIDCounter(id.Even))
+	dialogueID := uint64(100)
+	cn.readCh <- pf.NewSessionPacket(dialogueID, false, []byte("drain"), "")
+	dg, err := mp.AcceptDialogue()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	// data buffered but unread
+	for i := 0; i < 3; i++ {
+		cn.readCh <- pf.NewStreamPacketWithSessionID(dialogueID, []byte(strconv.Itoa(i)))
+	}
+	for len(dg.(*dialogue).readOutCh) != 3 {
+		time.Sleep(time.Millisecond)
+	}
+	closed := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+		closed <- dg.CloseAfterDrain(ctx)
+	}()
+	// no dismiss until all consumed
+	time.Sleep(50 * time.Millisecond)
+	for _, pkt := range cn.writtenFrom(0) {
+		if pkt.Type() == packet.TypeDismissPacket {
+			t.Error("dismissed before the data consumed")
+			return
+		}
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case pkt := <-dg.ReadC():
+			if data := string(pkt.(*packet.StreamPacket).Data); data != strconv.Itoa(i) {
+				t.Errorf("unexpected data: %s", data)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("data %d dropped by closing", i)
+			return
+		}
+	}
+	pkt := cn.waitWritten(t, packet.TypeDismissPacket, time.Second)
+	if pkt == nil {
+		return
+	}
+	// the peer acks and dismisses too
+	cn.readCh <- pf.NewDismissAckPacket(pkt.ID(), dialogueID, nil)
+	cn.readCh <- pf.NewDismissPacket(dialogueID)
+	select {
+	case err = <-closed:
+		if err != nil {
+			t.Errorf("unexpected close err: %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("close after drain not returned")
+	}
+}
+
+type codedError struct {
+	code int64
+}
+
+func (err codedError) Error() string { return "coded" }
+
+func (err codedError) Code() int64 { return err.code }
+
+func TestOpenErrorKind(t *testing.T) {
+	open := func(cn *fakeConn, peer func(*packet.SessionPacket)) error {
+		mp, err := NewDialogueMgr(cn)
+		if err != nil {
+			return err
+		}
+		go func() {
+			pkt := cn.waitWritten(t, packet.TypeSessionPacket, time.Second)
+			if pkt != nil {
+				peer(pkt.(*packet.SessionPacket))
+			}
+		}()
+		_, err = mp.OpenDialogue([]byte("open error"), "", OptionDialogueSyncTimeout(100*time.Millisecond))
+		return err
+	}
+	pf := packet.NewPacketFactory(id.NewIDCounter(id.Even))
+
+	// rejected by peer with a reason
+	cn := newFakeConn(geminio.InitiatorSide)
+	defer cn.Close()
+	err := open(cn, func(sn *packet.SessionPacket) {
+		cn.readCh <- pf.NewSessionAckPacket(sn.ID(), sn.NegotiateID(), 100, errors.New("unknown service"))
+	})
+	openErr := &OpenError{}
+	if !errors.As(err, &openErr) || openErr.Kind != OpenErrorRejected || openErr.Reason != "unknown service" {
+		t.Errorf("unexpected rejected err: %v", err)
+	}
+	// the code of the rejection is kept exactly
+	cn = newFakeConn(geminio.InitiatorSide)
+	defer cn.Close()
+	err = open(cn, func(sn *packet.SessionPacket) {
+		cn.readCh <- pf.NewSessionAckPacket(sn.ID(), sn.NegotiateID(), 100, codedError{1<<53 + 1})
+	})
+	if !errors.As(err, &openErr) || openErr.Kind != OpenErrorRejected || openErr.Code != 1<<53+1 {
+		t.Errorf("unexpected rejected err with code: %v", err)
+	}
+	// quiescing is still comparable
+	cn = newFakeConn(geminio.InitiatorSide)
+	defer cn.Close()
+	err = open(cn, func(sn *packet.SessionPacket) {
+		cn.readCh <- pf.NewSessionAckPacket(sn.ID(), sn.NegotiateID(), 100, ErrQuiescing)
+	})
+	if !errors.As(err, &openErr) || openErr.Kind != OpenErrorRejected || !errors.Is(err, ErrQuiescing) {
+		t.Errorf("unexpected quiescing err: %v", err)
+	}
+	// the conn broke before the ack
+	cn = newFakeConn(geminio.InitiatorSide)
+	err = open(cn, func(sn *packet.SessionPacket) {
+		cn.Close()
+	})
+	if !errors.As(err, &openErr) || openErr.Kind != OpenErrorTransport {
+		t.Errorf("unexpected transport err: %v", err)
+	}
+	// the ack never comes
+	cn = newFakeConn(geminio.InitiatorSide)
+	defer cn.Close()
+	err = open(cn, func(sn *packet.SessionPacket) {})
+	if !errors.As(err, &openErr) || openErr.Kind != OpenErrorTimeout || !errors.Is(err, synchub.ErrSyncTimeout) {
+		t.Errorf("unexpected timeout err: %v", err)
+	}
+}
+
+func TestHandleInSessionPacket(t *testing.T) {
+	for _, acquire := range []bool{true, false} {
+		t.Run("acquire "+strconv.FormatBool(acquire), func(t *testing.T) {
+			cn := newFakeConn(geminio.RecipientSide)
+			mp, err := NewDialogueMgr(cn, OptionMultiplexerAcceptDialogue(), OptionMultiplexerMaxQoS(3))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer cn.Close()
+
+			pf := packet.NewPacketFactory(id.NewIDCounter(id.Odd))
+			snPkt := pf.NewSessionPacket(100, acquire, []byte("inbound"), "")
+			snPkt.SessionFlags.Qos = 7
+			cn.readCh <- snPkt
+			dg, err := mp.AcceptDialogue()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if !dg.PeerInitiated() {
+				t.Error("dialogue not peer initiated")
+			}
+			if string(dg.Meta()) != "inbound" {
+				t.Errorf("unexpected meta: %q", dg.Meta())
+			}
+			// the requested QoS is downgraded to our max
+			if dg.QoS() != 3 {
+				t.Errorf("unexpected qos: %d", dg.QoS())
+			}
+			// the peer's negotiateID is taken unless it asks for one
+			if acquire == (dg.DialogueID() == 100) {
+				t.Errorf("unexpected dialogueID: %d", dg.DialogueID())
+			}
+
+			pkt := cn.waitWritten(t, packet.TypeSessionAckPacket, time.Second)
+			if pkt == nil {
+				return
+			}
+			ackPkt := pkt.(*packet.SessionAckPacket)
+			if ackPkt.ID() != snPkt.ID() || ackPkt.NegotiateID() != 100 ||
+				ackPkt.SessionID() != dg.DialogueID() {
+				t.Errorf("unexpected session ack, packetID: %d, negotiateID: %d, dialogueID: %d",
+					ackPkt.ID(), ackPkt.NegotiateID(), ackPkt.SessionID())
+			}
+			if ackPkt.SessionFlags.Qos != 3 {
+				t.Errorf("unexpected acked qos: %d", ackPkt.SessionFlags.Qos)
+			}
+			if ackPkt.SessionData.Epoch == 0 {
+				t.Error("epoch not acked")
+			}
+		})
+	}
+}
+
+func TestNullSessionData(t *testing.T) {
+	cn := newFakeConn(geminio.RecipientSide)
+	mp, err := NewDialogueMgr(cn, OptionMultiplexerAcceptDialogue())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cn.Close()
+
+	// a session packet with null payload from peer
+	pf := packet.NewPacketFactory(id.NewIDCounter(id.Odd))
+	snPkt := pf.NewSessionPacket(packet.SessionIDNull, true, nil, "")
+	snPkt.SessionData = nil
+	data, err := snPkt.Encode()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	pkt, err := packet.DecodeFromReader(bytes.NewReader(data))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	cn.readCh <- pkt
+	dg, err := mp.AcceptDialogue()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if dg.Meta() != nil {
+		t.Errorf("unexpected meta: %q", dg.Meta())
+	}
+}
+
+func TestDialogueUnconsumed(t *testing.T) {
+	timeout := 50 * time.Millisecond
+	flood := func(policy UnconsumedPolicy) (*fakeConn, Dialogue, []packet.Packet) {
+		cn := newFakeConn(geminio.InitiatorSide)
+		mp, err := NewDialogueMgr(cn, OptionMultiplexerAcceptDialogue(),
+			OptionMultiplexerUnconsumed(timeout, policy))
+		if err != nil {
+			t.Fatal(err)
+		}
+		pf := packet.NewPacketFactory(id.NewIDCounter(id.Even))
+		dialogueID := uint64(100)
+		cn.readCh <- pf.NewSessionPacket(dialogueID, false, []byte("unconsumed"), "")
+		dg, err := mp.AcceptDialogue()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// one more than the read buffer, and no one reads
+		pkts := []packet.Packet{}
+		for i := 0; i < 129; i++ {
+			pkts = append(pkts, pf.NewStreamPacketWithSessionID(dialogueID, []byte(strconv.Itoa(i))))
+		}
+		go func() {
+			for _, pkt := range pkts {
+				cn.readCh <- pkt
+			}
+		}()
+		return cn, dg, pkts
+	}
+
+	// the buffered are dropped and the latest kept
+	cn, dg, pkts := flood(UnconsumedDrop)
+	defer cn.Close()
+	time.Sleep(timeout / 2)
+	if dropped := dg.Stats().Dropped; dropped != 0 {
+		t.Fatalf("dropped before the timeout: %d", dropped)
+	}
+	deadline := time.Now().Add(time.Second)
+	for dg.Stats().Dropped != 128 {
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected dropped: %d", dg.Stats().Dropped)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	pkt, err := dg.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pkt.ID() != pkts[128].ID() {
+		t.Errorf("unexpected packet kept, packetID: %d", pkt.ID())
+	}
+
+	// the dialogue is reset
+	cn, dg, _ = flood(UnconsumedClose)
+	defer cn.Close()
+	if pkt := cn.waitWritten(t, packet.TypeResetPacket, time.Second); pkt == nil {
+		return
+	}
+	if dg.CloseReason() != CloseReasonUnconsumed {
+		t.Errorf("unexpected close reason: %s", dg.CloseReason())
+	}
+}
+
+// unknownPacket is a session above packet of a type no one knows
+type unknownPacket struct {
+	*packet.StreamPacket
+}
+
+func (pkt *unknownPacket) Type() packet.Type { return 0xF1 }
+
+func TestDialogueStrictPackets(t *testing.T) {
+	inject := func(opts ...MultiplexerOption) (*fakeConn, Dialogue, packet.Packet) {
+		cn := newFakeConn(geminio.InitiatorSide)
+		mp, err := NewDialogueMgr(cn, append(opts, OptionMultiplexerAcceptDialogue())...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pf := packet.NewPacketFactory(id.NewIDCounter(id.Even))
+		dialogueID := uint64(100)
+		cn.readCh <- pf.NewSessionPacket(dialogueID, false, []byte("strict"), "")
+		dg, err := mp.AcceptDialogue()
+		if err != nil {
+			t.Fatal(err)
+		}
+		pkt := &unknownPacket{pf.NewStreamPacketWithSessionID(dialogueID, []byte("unknown"))}
+		cn.readCh <- pkt
+		return cn, dg, pkt
+	}
+
+	// passed through as data by default
+	cn, dg, pkt := inject()
+	defer cn.Close()
+	got, err := dg.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != pkt {
+		t.Errorf("unexpected packet read, packetID: %d", got.ID())
+	}
+
+	// the dialogue is reset in strict mode
+	cn, dg, _ = inject(OptionMultiplexerStrictPackets())
+	defer cn.Close()
+	if pkt := cn.waitWritten(t, packet.TypeResetPacket, time.Second); pkt == nil {
+		return
+	}
+	if dg.CloseReason() != CloseReasonUnknownPacket {
+		t.Errorf("unexpected close reason: %s", dg.CloseReason())
+	}
+	if _, err = dg.Read(); err != ErrDialogueError {
+		t.Errorf("unexpected read err: %v", err)
+	}
+}
+
+func TestDialogueCongested(t *testing.T) {
+	cn := newFakeConn(geminio.InitiatorSide)
+	// the conn writes slower than the dialogue queues
+	cn.setWriteDelay(time.Millisecond)
+	states := make(chan bool, 4)
+	mp, err := NewDialogueMgr(cn, OptionMultiplexerAcceptDialogue(),
+		OptionMultiplexerCongestionFunc(func(dg Dialogue, congested bool) {
+			states <- congested
+		}))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cn.Close()
+
+	pf := packet.NewPacketFactory(id.NewIDCounter(id.Even))
+	dialogueID := uint64(100)
+	cn.readCh <- pf.NewSessionPacket(dialogueID, false, []byte("congested"), "")
+	dg, err := mp.AcceptDialogue()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if dg.Congested() {
+		t.Error("congested before writing")
+	}
+	for i := 0; i < 200; i++ {
+		if err = dg.Write(pf.NewStreamPacket([]byte(strconv.Itoa(i)))); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	if !dg.Congested() {
+		t.Error("not congested with the write buffers near full")
+	}
+	if err = dg.Synced(); err != nil {
+		t.Error(err)
+		return
+	}
+	if dg.Congested() {
+		t.Error("congested after drained")
+	}
+	for _, expected := range []bool{true, false} {
+		select {
+		case congested := <-states:
+			if congested != expected {
+				t.Errorf("unexpected congestion notified: %t", congested)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("congestion %t not notified", expected)
+		}
+	}
+}
+
+func TestDialogueCongestionUnlocked(t *testing.T) {
+	cn := newFakeConn(geminio.InitiatorSide)
+	cn.setWriteDelay(time.Millisecond)
+	// the callback takes the dialogue's lock, which the writer mustn't hold
+	locked := make(chan struct{}, 1)
+	mp, err := NewDialogueMgr(cn, OptionMultiplexerAcceptDialogue(),
+		OptionMultiplexerCongestionFunc(func(dg Dialogue, congested bool) {
+			if !congested {
+				return
+			}
+			dg.(*dialogue).mtx.Lock()
+			dg.(*dialogue).mtx.Unlock()
+			locked <- struct{}{}
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cn.Close()
+
+	pf := packet.NewPacketFactory(id.NewIDCounter(id.Even))
+	cn.readCh <- pf.NewSessionPacket(100, false, []byte("unlocked"), "")
+	dg, err := mp.AcceptDialogue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	written := make(chan error, 1)
+	go func() {
+		for !dg.Congested() {
+			if err := dg.Write(pf.NewStreamPacket([]byte("congesting"))); err != nil {
+				written <- err
+				return
+			}
+		}
+		written <- nil
+	}()
+	select {
+	case <-locked:
+	case <-time.After(2 * time.Second):
+		t.Fatal("congestion callback called with the dialogue locked")
+	}
+	if err = <-written; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDialogueWritableSignal(t *testing.T) {
+	cn := newFakeConn(geminio.InitiatorSide)
+	cn.setWriteDelay(time.Millisecond)
+	mp, err := NewDialogueMgr(cn, OptionMultiplexerAcceptDialogue())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cn.Close()
+
+	pf := packet.NewPacketFactory(id.NewIDCounter(id.Even))
+	dialogueID := uint64(100)
+	cn.readCh <- pf.NewSessionPacket(dialogueID, false, []byte("writable"), "")
+	dg, err := mp.AcceptDialogue()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	select {
+	case <-dg.WritableSignal():
+		t.Error("signaled before congested")
+		return
+	default:
+	}
+
+	// the producer stops at the congestion and resumes at the signal
+	resumed := make(chan struct{})
+	errCh := make(chan error, 1)
+	go func() {
+		for i := 0; !dg.Congested(); i++ {
+			if err := dg.Write(pf.NewStreamPacket([]byte(strconv.Itoa(i)))); err != nil {
+				errCh <- err
+				return
+			}
+		}
+		<-dg.WritableSignal()
+		close(resumed)
+		errCh <- dg.Write(pf.NewStreamPacket([]byte("resumed")))
+	}()
+	select {
+	case <-resumed:
+		if dg.Congested() {
+			t.Error("resumed while congested")
+		}
+	case err = <-errCh:
+		t.Errorf("producer stopped: %v", err)
+		return
+	case <-time.After(2 * time.Second):
+		t.Error("writable not signaled after drained")
+		return
+	}
+	if err = <-errCh; err != nil {
+		t.Error(err)
+		return
+	}
+	if err = dg.Synced(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDialogueWriteLatency(t *testing.T) {
+	cn := newFakeConn(geminio.InitiatorSide)
+	mp, err := NewDialogueMgr(cn, OptionMultiplexerAcceptDialogue())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cn.Close()
+
+	pf := packet.NewPacketFactory(id.NewIDCounter(id.Even))
+	cn.readCh <- pf.NewSessionPacket(100, false, []byte("latency"), "")
+	dg, err := mp.AcceptDialogue()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	write := func(n int) LatencyHistogram {
+		for i := 0; i < n; i++ {
+			if err := dg.Write(pf.NewStreamPacket([]byte(strconv.Itoa(i)))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := dg.Synced(); err != nil {
+			t.Fatal(err)
+		}
+		return dg.Stats().WriteLatency
+	}
+	fast := write(10)
+	if fast.Count != 10 {
+		t.Errorf("unexpected latencies observed: %d", fast.Count)
+	}
+	// the queued packets wait for the slow conn
+	cn.setWriteDelay(5 * time.Millisecond)
+	slow := write(10)
+	if slow.Count != 20 {
+		t.Errorf("unexpected latencies observed: %d", slow.Count)
+	}
+	if slow.Mean() <= fast.Mean() || slow.Max < 5*cn.writeDelay {
+		t.Errorf("latency not increased, fast: %s, slow: %s, max: %s", fast.Mean(), slow.Mean(), slow.Max)
+	}
+	counted := uint64(0)
+	for _, count := range slow.Counts {
+		counted += count
+	}
+	if counted != slow.Count {
+		t.Errorf("unexpected bucket counts: %v", slow.Counts)
+	}
+}
+
+func TestDialogueRecentPackets(t *testing.T) {
+	cn := newFakeConn(geminio.InitiatorSide)
+	mp, err := NewDialogueMgr(cn, OptionMultiplexerAcceptDialogue(), OptionMultiplexerPacketHistory(10))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer cn.Close()
+
+	pf := packet.NewPacketFactory(id.NewIDCounter(id.Even))
+	dialogueID := uint64(100)
+	cn.readCh <- pf.NewSessionPacket(dialogueID, false, []byte("history"), "")
+	dg, err := mp.AcceptDialogue()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	// 10 packets in and 10 out by turns
+	exchanged := []packet.Packet{}
+	for i := 0; i < 10; i++ {
+		in := pf.NewStreamPacketWithSessionID(dialogueID, []byte("in"))
+		cn.readCh <- in
+		if _, err = dg.Read(); err != nil {
+			t.Error(err)
+			return
+		}
+		out := pf.NewStreamPacket([]byte("out"))
+		if err = dg.Write(out); err != nil {
+			t.Error(err)
+			return
+		}
+		if err = dg.Synced(); err != nil {
+			t.Error(err)
+			return
+		}
+		exchanged = append(exchanged, in, out)
+	}
+	recent := dg.RecentPackets()
+	if len(recent) != 10 {
+		t.Errorf("unexpected recent packets: %d", len(recent))
+		return
+	}
+	for i, record := range recent {
+		pkt := exchanged[10+i]
+		direction := packet.DirectionIn
+		if i%2 == 1 {
+			direction = packet.DirectionOut
+		}
+		if record.PacketID != pkt.ID() || record.Direction != direction || record.Type != packet.TypeStreamPacket {
+			t.Errorf("unexpected record at %d, packetID: %d, direction: %s", i, record.PacketID, record.Direction)
+		}
+		if len(record.Data) == 0 || record.Time.IsZero() {
+			t.Errorf("record at %d without data or time", i)
+		}
+	}
+}
+
+type fakeAddr struct{}
+
+func (addr fakeAddr) Network() string { return "fake" }
+
+func (addr fakeAddr) String() string { return "fake" }
+
+// fakeConn is a conn.Conn, packets put into readCh will be read by the
+// multiplexer, and packets written are recorded in order.
+type fakeConn struct {
+	side   geminio.Side
+	readCh chan packet.Packet
+
+	mtx        sync.Mutex
+	cond       *sync.Cond
+	writeDelay time.Duration
+	written    []packet.Packet
+	writeErr   error
+	closeOnce  sync.Once
+}
+
+func newFakeConn(side geminio.Side) *fakeConn {
+	cn := &fakeConn{
+		side:   side,
+		readCh: make(chan packet.Packet, 128),
+	}
+	cn.cond = sync.NewCond(&cn.mtx)
+	return cn
+}
+
+func (cn *fakeConn) Read() (packet.Packet, error) {
+	pkt, ok := <-cn.readCh
+	if !ok {
+		return nil, io.EOF
+	}
+	return pkt, nil
+}
+
+func (cn *fakeConn) ChannelRead() <-chan packet.Packet {
+	return cn.readCh
+}
+
+func (cn *fakeConn) Write(pkt packet.Packet) error {
+	cn.mtx.Lock()
+	delay := cn.writeDelay
+	cn.mtx.Unlock()
+	if delay != 0 {
+		time.Sleep(delay)
+	}
+	cn.mtx.Lock()
+	defer cn.mtx.Unlock()
+	if cn.writeErr != nil {
+		return cn.writeErr
+	}
+	cn.written = append(cn.written, pkt)
+	cn.cond.Broadcast()
+	return nil
+}
+
+// the delay may be changed while writing
+func (cn *fakeConn) setWriteDelay(delay time.Duration) {
+	cn.mtx.Lock()
+	defer cn.mtx.Unlock()
+	cn.writeDelay = delay
+}
+
+func (cn *fakeConn) setWriteErr(err error) {
+	cn.mtx.Lock()
+	defer cn.mtx.Unlock()
+	cn.writeErr = err
+}
+
+func (cn *fakeConn) writtenLen() int {
+	cn.mtx.Lock()
+	defer cn.mtx.Unlock()
+	return len(cn.written)
+}
+
+func (cn *fakeConn) writtenFrom(from int) []packet.Packet {
+	cn.mtx.Lock()
+	defer cn.mtx.Unlock()
+	return append([]packet.Packet{}, cn.written[from:]...)
+}
+
+// waitWritten waits for the first written packet of the type
+func (cn *fakeConn) waitWritten(t *testing.T, typ packet.Type, timeout time.Duration) packet.Packet {
+	return cn.waitWrittenFrom(t, typ, 0, timeout)
+}
+
+// waitWrittenFrom waits for the first packet of the type written after
+// the from'th one
+func (cn *fakeConn) waitWrittenFrom(t *testing.T, typ packet.Type, from int, timeout time.Duration) packet.Packet {
+	timer := time.AfterFunc(timeout, func() {
+		cn.mtx.Lock()
+		defer cn.mtx.Unlock()
+		cn.cond.Broadcast()
+	})
+	defer timer.Stop()
+	deadline := time.Now().Add(timeout)
+
+	cn.mtx.Lock()
+	defer cn.mtx.Unlock()
+	for {
+		for _, pkt := range cn.written[from:] {
+			if pkt.Type() == typ {
+				return pkt
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Errorf("wait for %s timeout", typ.String())
+			return nil
+		}
+		cn.cond.Wait()
+	}
+}
+
+func (cn *fakeConn) Close() {
+	cn.closeOnce.Do(func() {
+		close(cn.readCh)
+	})
+}
+
+func (cn *fakeConn) Abort() { cn.Close() }
+
+func (cn *fakeConn) Flush() error { return nil }
+
+func (cn *fakeConn) ClientID() uint64 { return 1 }
+
+func (cn *fakeConn) Meta() []byte { return nil }
+
+func (cn *fakeConn) LocalAddr() net.Addr { return fakeAddr{} }
+
+func (cn *fakeConn) RemoteAddr() net.Addr { return fakeAddr{} }
+
+func (cn *fakeConn) Side() geminio.Side { return cn.side }
+
+func (cn *fakeConn) PeerVersion() int { return 0 }
+
+func (cn *fakeConn) PeerCapabilities() []string { return nil }
+
+func (cn *fakeConn) PeerClockSkew() time.Duration { return 0 }
+func (cn *fakeConn) Compression() string          { return packet.CompressionNone }
+
+func TestDialogueTransitionHandler(t *testing.T) {
+	mpServer, mpClient, err := getMultiplexerPair()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		mpClient.Close()
+		mpServer.Close()
+	}()
+
+	hits := make(chan string, 4)
+	guard := func(name string) TransitionHandler {
+		return func(event, from, to string) {
+			hits <- name + ":" + event + ":" + from + ":" + to
+		}
+	}
+	dg, err := mpClient.OpenDialogue(nil, "",
+		OptionDialogueTransitionHandler(SESSIONED, guard("first")),
+		OptionDialogueTransitionHandler(SESSIONED, guard("second")))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer dg.Close()
+
+	// called in the order added
+	for _, name := range []string{"first", "second"} {
+		select {
+		case hit := <-hits:
+			expected := name + ":" + ET_SESSIONACK + ":" + SESSION_SENT + ":" + SESSIONED
+			if hit != expected {
+				t.Errorf("unexpected hit: %s, expected: %s", hit, expected)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("guard %s not hit", name)
+		}
+	}
+	select {
+	case hit := <-hits:
+		t.Errorf("unexpected extra hit: %s", hit)
+	default:
+	}
+}
+
+func TestDialogueBufferCaps(t *testing.T) {
+	mpServer, mpClient, err := getMultiplexerPair()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		mpClient.Close()
+		mpServer.Close()
+	}()
+
+	dg, err := mpClient.OpenDialogue(nil, "", OptionDialogueBufferSize(16, 32, 0, -1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dg.Close()
+	readIn, writeIn, readOut, writeOut := dg.BufferCaps()
+	if readIn != 16 || writeIn != 32 || readOut != 128 || writeOut != 128 {
+		t.Errorf("unexpected caps: %d, %d, %d, %d", readIn, writeIn, readOut, writeOut)
+	}
+
+	dg, err = mpClient.OpenDialogue(nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dg.Close()
+	readIn, writeIn, readOut, writeOut = dg.BufferCaps()
+	if readIn != 128 || writeIn != 128 || readOut != 128 || writeOut != 128 {
+		t.Errorf("unexpected default caps: %d, %d, %d, %d", readIn, writeIn, readOut, writeOut)
+	}
+}
+
+func TestDialogueKeepalive(t *testing.T) {
+	interval, timeout := 20*time.Millisecond, 100*time.Millisecond
+
+	// the peer answers the pings
+	mpServer, mpClient, err := getMultiplexerPair()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		mpClient.Close()
+		mpServer.Close()
+	}()
+	dg, err := mpClient.OpenDialogue(nil, "", OptionDialogueKeepalive(interval, timeout))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer dg.Close()
+	time.Sleep(3 * timeout)
+	if dg.State() != SESSIONED {
+		t.Errorf("unexpected state with pongs: %s", dg.State())
+	}
+
+	// the stalled conn never answers
+	cn := newFakeConn(geminio.InitiatorSide)
+	defer cn.Close()
+	mp, err := NewDialogueMgr(cn)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	dismissed := make(chan string, 1)
+	opened := make(chan Dialogue, 1)
+	go func() {
+		dg, err := mp.OpenDialogue(nil, "", OptionDialogueKeepalive(interval, timeout),
+			OptionDialogueTransitionHandler(DISMISSED, func(event, from, to string) {
+				dismissed <- event + ":" + from
+			}))
+		if err != nil {
+			t.Error(err)
+		}
+		opened <- dg
+	}()
+	pkt := cn.waitWritten(t, packet.TypeSessionPacket, time.Second)
+	if pkt == nil {
+		return
+	}
+	snPkt := pkt.(*packet.SessionPacket)
+	pf := packet.NewPacketFactory(id.NewIDCounter(id.Even))
+	// the keepalive starts after the ack read
+	start := time.Now()
+	cn.readCh <- pf.NewSessionAckPacket(snPkt.ID(), snPkt.NegotiateID(), 100, nil)
+	stalled := <-opened
+	if stalled == nil {
+		return
+	}
+	if pkt = cn.waitWritten(t, packet.TypeSessionHeartbeatPacket, time.Second); pkt == nil {
+		return
+	}
+	select {
+	case hit := <-dismissed:
+		if hit != ET_ERROR+":"+SESSIONED {
+			t.Errorf("unexpected transition to dismissed: %s", hit)
+		}
+		if elapsed := time.Since(start); elapsed < timeout {
+			t.Errorf("dismissed before the timeout: %s", elapsed)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("not dismissed after the timeout, state: %s", stalled.State())
+	}
+	if pkt = cn.waitWritten(t, packet.TypeResetPacket, time.Second); pkt == nil {
+		return
+	}
+	if stalled.CloseReason() != CloseReasonKeepalive {
+		t.Errorf("unexpected close reason: %s", stalled.CloseReason())
+	}
+}
+
+func TestDialogueMaxPacketSize(t *testing.T) {
+	cn := newFakeConn(geminio.InitiatorSide)
+	defer cn.Close()
+	mp, err := NewDialogueMgr(cn, OptionMultiplexerMaxPacketSize(1024))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	opened := make(chan Dialogue, 1)
+	go func() {
+		dg, err := mp.OpenDialogue(nil, "")
+		if err != nil {
+			t.Error(err)
+		}
+		opened <- dg
+	}()
+	pkt := cn.waitWritten(t, packet.TypeSessionPacket, time.Second)
+	if pkt == nil {
+		return
+	}
+	snPkt := pkt.(*packet.SessionPacket)
+	if snPkt.SessionData.MaxPacketSize != 1024 {
+		t.Errorf("unexpected max packet size advertised: %d", snPkt.SessionData.MaxPacketSize)
+	}
+	// the peer advertises a smaller one
+	pf := packet.NewPacketFactory(id.NewIDCounter(id.Even))
+	ackPkt := pf.NewSessionAckPacket(snPkt.ID(), snPkt.NegotiateID(), 100, nil)
+	ackPkt.SessionData.MaxPacketSize = 16
+	cn.readCh <- ackPkt
+	dg := <-opened
+	if dg == nil {
+		return
+	}
+	defer dg.Close()
+	if dg.MaxPacketSize() != 16 {
+		t.Errorf("unexpected negotiated max packet size: %d", dg.MaxPacketSize())
+	}
+
+	err = dg.Write(pf.NewMessagePacket(nil, make([]byte, 17)))
+	if err != ErrPacketTooLarge {
+		t.Errorf("unexpected err of the oversized write: %v", err)
+	}
+	err = dg.Write(pf.NewStreamPacket(make([]byte, 17)))
+	if err != ErrPacketTooLarge {
+		t.Errorf("unexpected err of the oversized stream write: %v", err)
+	}
+	err = dg.Write(pf.NewMessagePacket(nil, make([]byte, 16)))
+	if err != nil {
+		t.Errorf("unexpected err of the write: %v", err)
+	}
+	cn.waitWritten(t, packet.TypeMessagePacket, time.Second)
+}
+
+func TestDialogueAckMeta(t *testing.T) {
+	pf := packet.NewPacketFactory(id.NewIDCounter(id.Even))
+	// the acceptor doesn't echo the meta, unless it replaces it
+	cases := []struct {
+		ackMeta []byte
+		meta    string
+	}{
+		{nil, "opener"},
+		{[]byte("acceptor"), "acceptor"},
+	}
+	for _, c := range cases {
+		cn := newFakeConn(geminio.InitiatorSide)
+		defer cn.Close()
+		mp, err := NewDialogueMgr(cn)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		opened := make(chan Dialogue, 1)
+		go func() {
+			dg, err := mp.OpenDialogue([]byte("opener"), "")
+			if err != nil {
+				t.Error(err)
+			}
+			opened <- dg
+		}()
+		pkt := cn.waitWritten(t, packet.TypeSessionPacket, time.Second)
+		if pkt == nil {
+			return
+		}
+		snPkt := pkt.(*packet.SessionPacket)
+		ackPkt := pf.NewSessionAckPacket(snPkt.ID(), snPkt.NegotiateID(), 100, nil)
+		ackPkt.SessionData.Meta = c.ackMeta
+		cn.readCh <- ackPkt
+		dg := <-opened
+		if dg == nil {
+			return
+		}
+		if string(dg.Meta()) != c.meta {
+			t.Errorf("unexpected meta after the ack: %q, expected: %q", dg.Meta(), c.meta)
+		}
+	}
+}
+
+func TestDialogueRTT(t *testing.T) {
+	delay := 100 * time.Millisecond
+	tolerance := 50 * time.Millisecond
+	interval := 20 * time.Millisecond
+	cn := newFakeConn(geminio.InitiatorSide)
+	defer cn.Close()
+	mp, err := NewDialogueMgr(cn)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	opened := make(chan Dialogue, 1)
+	go func() {
+		dg, err := mp.OpenDialogue(nil, "", OptionDialogueKeepalive(interval, time.Second))
+		if err != nil {
+			t.Error(err)
+		}
+		opened <- dg
+	}()
+	pkt := cn.waitWritten(t, packet.TypeSessionPacket, time.Second)
+	if pkt == nil {
+		return
+	}
+	snPkt := pkt.(*packet.SessionPacket)
+	// the peer acks after the delay
+	time.Sleep(delay)
+	pf := packet.NewPacketFactory(id.NewIDCounter(id.Even))
+	cn.readCh <- pf.NewSessionAckPacket(snPkt.ID(), snPkt.NegotiateID(), 100, nil)
+	dg := <-opened
+	if dg == nil {
+		return
+	}
+	defer dg.Close()
+	rtt := dg.HandshakeRTT()
+	if rtt < delay || rtt > delay+tolerance {
+		t.Errorf("unexpected handshake rtt: %s, delay: %s", rtt, delay)
+	}
+	if dg.RTT() != rtt {
+		t.Errorf("rtt not seeded by the handshake: %s", dg.RTT())
+	}
+
+	// a faster pong pulls the smoothed rtt down
+	written := cn.writtenLen()
+	pkt = cn.waitWrittenFrom(t, packet.TypeSessionHeartbeatPacket, written, time.Second)
+	if pkt == nil {
+		return
+	}
+	pong := delay / 2
+	time.Sleep(pong)
+	cn.readCh <- pf.NewSessionHeartbeatAckPacket(pkt.ID(), dg.DialogueID())
+	deadline := time.Now().Add(time.Second)
+	for dg.RTT() == rtt && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if srtt := dg.RTT(); srtt >= rtt || srtt < pong {
+		t.Errorf("unexpected smoothed rtt: %s, handshake: %s, pong: %s", srtt, rtt, pong)
+	}
+	if dg.HandshakeRTT() != rtt {
+		t.Errorf("handshake rtt changed by the pong: %s", dg.HandshakeRTT())
+	}
+}
+
+type dropChan chan string
+
+func (ch dropChan) OnDrop(pkt packet.Packet, reason string, direction packet.Direction, dialogueID uint64) {
+	ch <- reason
+}
+
+func TestDialogueDuplicateSession(t *testing.T) {
+	cn := newFakeConn(geminio.RecipientSide)
+	defer cn.Close()
+	drops := make(dropChan, 4)
+	mp, err := NewDialogueMgr(cn, OptionMultiplexerAcceptDialogue(),
+		OptionMultiplexerDropObserver(drops))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	pf := packet.NewPacketFactory(id.NewIDCounter(id.Odd))
+	snPkt := pf.NewSessionPacket(101, true, nil, "")
+	cn.readCh <- snPkt
+	if pkt := cn.waitWritten(t, packet.TypeSessionAckPacket, time.Second); pkt == nil {
+		return
+	}
+	dg, err := mp.AcceptDialogue()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// the duplicate is dropped, without another dialogue or ack
+	written := cn.writtenLen()
+	cn.readCh <- snPkt
+	select {
+	case reason := <-drops:
+		if reason != packet.DropReasonDuplicateSession {
+			t.Errorf("unexpected drop reason: %s", reason)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("duplicate session not dropped")
+	}
+	for _, pkt := range cn.writtenFrom(written) {
+		if pkt.Type() == packet.TypeSessionAckPacket {
+			t.Error("duplicate session acked")
+		}
+	}
+	if dg.State() != SESSIONED {
+		t.Errorf("unexpected state after the duplicate: %s", dg.State())
+	}
+	if ids := mp.ListDialogues(); len(ids) != 2 {
+		t.Errorf("unexpected dialogues after the duplicate: %d", len(ids))
+	}
+
+	// the dialogue still reads
+	cn.readCh <- pf.NewMessagePacketWithSessionID(dg.DialogueID(), nil, []byte("alive"), nil)
+	pkt, err := dg.Read()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if string(pkt.(*packet.MessagePacket).Data.Value) != "alive" {
+		t.Errorf("unexpected data read: %v", pkt)
+	}
+
+	// the session is forgotten once the dialogue gone
+	dg.Reset()
+	deadline := time.Now().Add(time.Second)
+	for len(mp.ListDialogues()) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("dialogue not gone after reset")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cn.readCh <- snPkt
+	if _, err = mp.AcceptDialogue(); err != nil {
+		t.Error(err)
+	}
+}
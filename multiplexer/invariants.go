@@ -0,0 +1,70 @@
+package multiplexer
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// invariants are the dialogue's states asserted only with the
+// geminio_invariants build tag, the violations panic loudly with the
+// dialogue, rather than a bare send on closed channel or a leak later.
+type invariants struct {
+	finied        int32
+	readInClosed  int32
+	writeInClosed int32
+}
+
+func (dg *dialogue) violate(what string) {
+	panic(fmt.Sprintf("dialogue invariant violated: %s, clientID: %d, dialogueID: %d, state: %s",
+		what, dg.cn.ClientID(), dg.dialogueID, dg.State()))
+}
+
+// assertFiniOnce must be called at the beginning of fini
+func (dg *dialogue) assertFiniOnce() {
+	if !invariantsEnabled {
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&dg.inv.finied, 0, 1) {
+		dg.violate("fini runs twice")
+	}
+}
+
+// assertLive is called by the handlePkt goroutine, which is the only one
+// leads to fini, before handling a packet
+func (dg *dialogue) assertLive(op string) {
+	if !invariantsEnabled {
+		return
+	}
+	if atomic.LoadInt32(&dg.inv.finied) == 1 {
+		dg.violate(op + " after fini")
+	}
+}
+
+// closed is set after the channel closed, so that a send after it panics
+// here rather than in the runtime
+func (dg *dialogue) closed(flag *int32) {
+	if invariantsEnabled {
+		atomic.StoreInt32(flag, 1)
+	}
+}
+
+// assertReadInOpen is called by the owner before sending to the readInCh
+func (dg *dialogue) assertReadInOpen(by string) {
+	if !invariantsEnabled {
+		return
+	}
+	if atomic.LoadInt32(&dg.inv.readInClosed) == 1 {
+		dg.violate("send on closed readInCh by " + by)
+	}
+}
+
+// assertWriteInOpen is called before sending to the writeInCh without the
+// dialogueOK checked
+func (dg *dialogue) assertWriteInOpen(by string) {
+	if !invariantsEnabled {
+		return
+	}
+	if atomic.LoadInt32(&dg.inv.writeInClosed) == 1 {
+		dg.violate("send on closed writeInCh by " + by)
+	}
+}
@@ -0,0 +1,5 @@
+//go:build !geminio_invariants
+
+package multiplexer
+
+const invariantsEnabled = false
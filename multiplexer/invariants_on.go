@@ -0,0 +1,7 @@
+//go:build geminio_invariants
+
+package multiplexer
+
+// the dialogues assert their invariants at runtime, go test with
+// -tags geminio_invariants to turn it on
+const invariantsEnabled = true
@@ -0,0 +1,47 @@
+//go:build geminio_invariants
+
+package multiplexer
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/singchia/geminio"
+	"github.com/singchia/geminio/packet"
+	"github.com/singchia/geminio/pkg/id"
+)
+
+func TestDialogueInvariants(t *testing.T) {
+	cn := newFakeConn(geminio.InitiatorSide)
+	defer cn.Close()
+	mp, err := NewDialogueMgr(cn, OptionMultiplexerAcceptDialogue())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pf := packet.NewPacketFactory(id.NewIDCounter(id.Even))
+	cn.readCh <- pf.NewSessionPacket(100, false, nil, "")
+	accepted, err := mp.AcceptDialogue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dg := accepted.(*dialogue)
+	// the handlePkt finis it
+	dg.closeIO()
+	if _, err = dg.Read(); err != ErrDialogueClosed {
+		t.Fatalf("unexpected read err: %v", err)
+	}
+
+	violated := func(what string, fn func()) {
+		defer func() {
+			msg, _ := recover().(string)
+			if !strings.Contains(msg, what) {
+				t.Errorf("unexpected violation: %q, expected: %q", msg, what)
+			}
+		}()
+		fn()
+	}
+	violated("fini runs twice", dg.fini)
+	violated("send on closed readInCh", func() { dg.assertReadInOpen("test") })
+	violated("send on closed writeInCh", func() { dg.assertWriteInOpen("test") })
+	violated("handle in stream packet after fini", func() { dg.assertLive("handle in stream packet") })
+}
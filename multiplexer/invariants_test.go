@@ -0,0 +1,105 @@
+package multiplexer
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// the edge cases are asserted more with -tags geminio_invariants
+
+func TestDialogueSimultaneousClose(t *testing.T) {
+	mpServer, mpClient, err := getMultiplexerPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		mpClient.Close()
+		mpServer.Close()
+	}()
+
+	n := 20
+	pairs := make([][2]Dialogue, 0, n)
+	for i := 0; i < n; i++ {
+		dgClient, err := mpClient.OpenDialogue(nil, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		dgServer, err := mpServer.AcceptDialogue()
+		if err != nil {
+			t.Fatal(err)
+		}
+		pairs = append(pairs, [2]Dialogue{dgClient, dgServer})
+	}
+	// both sides dismiss at the same time, and some twice
+	wg := sync.WaitGroup{}
+	for _, pair := range pairs {
+		for _, dg := range []Dialogue{pair[0], pair[1], pair[0]} {
+			wg.Add(1)
+			go func(dg Dialogue) {
+				defer wg.Done()
+				dg.Close()
+			}(dg)
+		}
+	}
+	wg.Wait()
+	for _, pair := range pairs {
+		for _, dg := range pair {
+			if _, err := dg.Read(); err == nil {
+				t.Errorf("read on closed dialogue succeed, dialogueID: %d", dg.DialogueID())
+			}
+		}
+	}
+	// only the default dialogues left
+	deadline := time.Now().Add(time.Second)
+	for (len(mpClient.ListDialogues()) != 1 || len(mpServer.ListDialogues()) != 1) &&
+		time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if c, s := len(mpClient.ListDialogues()), len(mpServer.ListDialogues()); c != 1 || s != 1 {
+		t.Errorf("unexpected dialogues left, client: %d, server: %d", c, s)
+	}
+}
+
+func TestDialogueRapidOpenClose(t *testing.T) {
+	// the opens abandoned in handshake leave the peer's dismiss unacked
+	mpServer, mpClient, err := getMultiplexerPair(OptionMultiplexerDismissTimeout(200 * time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			dg, err := mpServer.AcceptDialogue()
+			if err != nil {
+				return
+			}
+			// the peer's close races with the accepting side's
+			go dg.Close()
+		}
+	}()
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				dg, err := mpClient.OpenDialogue(nil, "")
+				if err != nil {
+					// the manager closed in flight
+					return
+				}
+				dg.Close()
+			}
+		}()
+	}
+	// close the managers while the opens are in flight
+	time.Sleep(10 * time.Millisecond)
+	mpClient.Close()
+	wg.Wait()
+	mpServer.Close()
+
+	if _, err = mpClient.OpenDialogue(nil, ""); err == nil {
+		t.Error("open on closed multiplexer succeed")
+	}
+}
@@ -1,9 +1,12 @@
 package multiplexer
 
 import (
+	"context"
 	"errors"
+	"time"
 
 	"github.com/singchia/geminio"
+	"github.com/singchia/geminio/delegate"
 	"github.com/singchia/geminio/packet"
 )
 
@@ -13,33 +16,99 @@ var (
 	ErrDialogueNotFound             = errors.New("dialogue not found")
 	ErrAcceptChNotEnabled           = errors.New("accept channel not enabled")
 	ErrClosedChNotEnabled           = errors.New("closed channel not enabled")
+	ErrQuiescing                    = errors.New("quiescing")
+	ErrTooManyDialogues             = errors.New("too many dialogues")
+	ErrPacketTooLarge               = errors.New("packet too large")
+	ErrInvalidDialogueCount         = errors.New("invalid dialogue count")
 )
 
 // dialogue manager
 type Multiplexer interface {
-	OpenDialogue(meta []byte, peer string) (Dialogue, error)
+	OpenDialogue(meta []byte, peer string, opts ...DialogueOption) (Dialogue, error)
+	// open n dialogues in one handshake round trip, all or none
+	OpenDialogues(n int, meta []byte, peer string, opts ...DialogueOption) ([]Dialogue, error)
 	AcceptDialogue() (Dialogue, error)
 	ClosedDialogue() (Dialogue, error)
 	// list
 	ListDialogues() []Dialogue
 	GetDialogue(clientID uint64, dialogueID uint64) (Dialogue, error)
+	// close all dialogues matched, return the number of dialogues closed
+	CloseDialoguesWhere(match func(DialogueDescriber) bool) int
+	// reject dialogues opened by peer with ErrQuiescing, existing dialogues are untouched
+	Quiesce()
+	Unquiesce()
+	// the timeouts scheduled by the fallback timer while the timer failing
+	TimerFallbacks() uint64
 	Close()
 }
 
 // dialogue
 type Reader interface {
+	// Read returns the error of how the dialogue closed only after it closed,
+	// see ErrDialogueClosed, an empty data packet is a valid packet with
+	// zero-length body
 	Read() (packet.Packet, error)
+	// ReadContext returns ctx.Err() if nothing read before ctx done, the
+	// dialogue stays open and the later packet is kept for the next read
+	ReadContext(ctx context.Context) (packet.Packet, error)
+	// ReadWithContext is the same as ReadContext
+	ReadWithContext(ctx context.Context) (packet.Packet, error)
+	// TryRead returns false immediately if there is no packet pending
+	TryRead() (packet.Packet, bool)
+	// ReadBatch blocks for the first packet, then takes the ones pending up
+	// to max without blocking, the closed error only after the dialogue
+	// closed and all read
+	ReadBatch(max int) ([]packet.Packet, error)
 	ReadC() <-chan packet.Packet
 }
 
 type Writer interface {
 	Write(pkt packet.Packet) error
+	// WritePriority writes the higher priority packets ahead of the pending
+	// lower ones of the dialogue, Write is WritePriority with 0
+	WritePriority(pkt packet.Packet, priority uint8) error
 }
 
 type Closer interface {
 	Close()
 }
 
+// QoSMax is the max QoS level carried by the 4 bits session flag
+const QoSMax int8 = 0x0F
+
+// CloseReason tells how a dialogue was closed, it's what the delegate's
+// DialogueOffline gets
+type CloseReason = delegate.DialogueCloseReason
+
+const (
+	// not closed yet, or closed by the under layer
+	CloseReasonNone = delegate.DialogueCloseReasonUnknown
+	// closed by the dismiss handshake
+	CloseReasonDismiss = delegate.DialogueCloseReasonDismiss
+	// reset by either side without the handshake
+	CloseReasonReset = delegate.DialogueCloseReasonReset
+	// reset since no one read the dialogue in time
+	CloseReasonUnconsumed = delegate.DialogueCloseReasonUnconsumed
+	// reset since the peer sent an unknown packet in strict mode
+	CloseReasonUnknownPacket = delegate.DialogueCloseReasonUnknownPacket
+	// reset since the peer didn't answer the keepalive in time
+	CloseReasonKeepalive = delegate.DialogueCloseReasonKeepalive
+)
+
+// UnconsumedPolicy decides what to do if the read buffer of a dialogue is
+// full and no one reads it for a while
+type UnconsumedPolicy int
+
+const (
+	// wait for the reader however long it takes, the inbound of the conn
+	// is blocked meanwhile
+	UnconsumedBlock UnconsumedPolicy = iota
+	// drop the buffered packets and count them in the stats
+	UnconsumedDrop
+	// reset the dialogue with CloseReasonUnconsumed
+	UnconsumedClose
+)
+
 type Side int
 
 const (
@@ -53,6 +122,7 @@ type DialogueDescriber interface {
 	DialogueID() uint64
 	Meta() []byte
 	Side() geminio.Side
+	PeerInitiated() bool
 }
 
 type Dialogue interface {
@@ -67,4 +137,50 @@ type Dialogue interface {
 	Meta() []byte
 	Side() geminio.Side
 	Peer() string
+	PeerInitiated() bool
+	// Synced blocks until all queued packets are written to the conn
+	Synced() error
+	// Congested returns true if the write buffers are near full, which
+	// means the writes will block soon
+	Congested() bool
+	// WritableSignal fires once the congested write buffers freed up
+	WritableSignal() <-chan struct{}
+	// BufferCaps returns the capacities of the buffers in effect
+	BufferCaps() (readIn, writeIn, readOut, writeOut int)
+	// RecentPackets returns the latest packets read and written if the
+	// packet history enabled
+	RecentPackets() []RecordedPacket
+	// Stats returns the opened, last read and last write timestamps
+	Stats() DialogueStats
+	// ReadBytes and WriteBytes return the bytes on the wire of the packets
+	// read in and written down
+	ReadBytes() uint64
+	WriteBytes() uint64
+	// QoS returns the negotiated QoS level, which may be downgraded to
+	// the peer's max
+	QoS() int8
+	// HandshakeRTT returns the round trip time of the session handshake,
+	// only measured at the opening side
+	HandshakeRTT() time.Duration
+	// RTT returns the smoothed round trip time of the keepalive pings,
+	// the handshake's before any pong
+	RTT() time.Duration
+	// MaxPacketSize returns the negotiated max payload size of the data
+	// packets, 0 means no limit
+	MaxPacketSize() int
+	// Reset closes the dialogue at once without waiting for the peer
+	Reset()
+	// CloseWithReason closes the dialogue with the reason told to the peer
+	CloseWithReason(reason string)
+	// DismissReason returns the reason given by the peer's dismiss
+	DismissReason() string
+	// State returns the current state, e.g. sessioned
+	State() string
+	// CloseWaitContext closes the dialogue and waits for the peer's ack
+	// until ctx done, then returns ctx.Err()
+	CloseWaitContext(ctx context.Context) error
+	// CloseAfterDrain waits for all data read in to be consumed, then closes
+	// the dialogue like CloseWaitContext
+	CloseAfterDrain(ctx context.Context) error
+	CloseReason() CloseReason
 }
@@ -0,0 +1,81 @@
+package multiplexer
+
+import (
+	"errors"
+
+	"github.com/jumboframes/armorigo/synchub"
+	"github.com/singchia/geminio/packet"
+)
+
+// OpenErrorKind classifies why a dialogue failed to open
+type OpenErrorKind int
+
+const (
+	// the peer refused the dialogue, retrying the same peer mostly fails again,
+	// except ErrQuiescing and ErrTooManyDialogues
+	OpenErrorRejected OpenErrorKind = iota + 1
+	// the conn or the dialogue broke before the ack came
+	OpenErrorTransport
+	// the ack didn't come in time
+	OpenErrorTimeout
+)
+
+func (kind OpenErrorKind) String() string {
+	switch kind {
+	case OpenErrorRejected:
+		return "rejected"
+	case OpenErrorTransport:
+		return "transport"
+	case OpenErrorTimeout:
+		return "timeout"
+	}
+	return "unknown"
+}
+
+// OpenError is returned by OpenDialogue when the negotiation failed, the
+// underlying error is still reachable by errors.Is.
+type OpenError struct {
+	Kind OpenErrorKind
+	// the reason and code given by peer, only set if rejected
+	Reason string
+	Code   int64
+	Err    error
+}
+
+func (err *OpenError) Error() string {
+	return "open " + err.Kind.String() + ": " + err.Err.Error()
+}
+
+func (err *OpenError) Unwrap() error {
+	return err.Err
+}
+
+func newOpenError(err error) *OpenError {
+	if openErr, ok := err.(*OpenError); ok {
+		return openErr
+	}
+	kind := OpenErrorTransport
+	if err == synchub.ErrSyncTimeout {
+		kind = OpenErrorTimeout
+	}
+	return &OpenError{Kind: kind, Err: err}
+}
+
+// the reason is kept as is, known errors are restored for comparison
+func newRejectedError(snData *packet.SessionData) *OpenError {
+	var err error
+	switch snData.Error {
+	case ErrQuiescing.Error():
+		err = ErrQuiescing
+	case ErrTooManyDialogues.Error():
+		err = ErrTooManyDialogues
+	default:
+		err = errors.New(snData.Error)
+	}
+	return &OpenError{
+		Kind:   OpenErrorRejected,
+		Reason: snData.Error,
+		Code:   int64(snData.Code),
+		Err:    err,
+	}
+}
@@ -0,0 +1,91 @@
+package multiplexer
+
+import (
+	"container/heap"
+	"sync"
+
+	"github.com/singchia/geminio/conn"
+	"github.com/singchia/geminio/packet"
+)
+
+// OptionMultiplexerQoSScheduling writes the dialogues' packets down to the
+// conn one at a time. When the conn is busy and packets of several dialogues
+// are pending, the ones of the dialogue with higher negotiated QoS are written
+// first, and the same QoS ones in the order they came. The order within a
+// dialogue is always kept, and packets already queued in the conn are not
+// reordered.
+func OptionMultiplexerQoSScheduling() MultiplexerOption {
+	return func(opts *multiplexerOpts) {
+		opts.qosScheduling = true
+	}
+}
+
+// qosScheduler hands the turn of writing the conn to the pending writer of
+// the highest QoS
+type qosScheduler struct {
+	cn conn.Conn
+
+	mtx     sync.Mutex
+	writing bool
+	seq     uint64
+	pending qosTurns
+}
+
+type qosTurn struct {
+	qos  int8
+	seq  uint64
+	turn chan struct{}
+}
+
+type qosTurns []*qosTurn
+
+func (turns qosTurns) Len() int { return len(turns) }
+
+func (turns qosTurns) Less(i, j int) bool {
+	if turns[i].qos != turns[j].qos {
+		return turns[i].qos > turns[j].qos
+	}
+	return turns[i].seq < turns[j].seq
+}
+
+func (turns qosTurns) Swap(i, j int) { turns[i], turns[j] = turns[j], turns[i] }
+
+func (turns *qosTurns) Push(x interface{}) { *turns = append(*turns, x.(*qosTurn)) }
+
+func (turns *qosTurns) Pop() interface{} {
+	old := *turns
+	turn := old[len(old)-1]
+	*turns = old[:len(old)-1]
+	return turn
+}
+
+func newQoSScheduler(cn conn.Conn) *qosScheduler {
+	return &qosScheduler{cn: cn}
+}
+
+// write blocks until the packet is written to the conn
+func (sched *qosScheduler) write(qos int8, pkt packet.Packet) error {
+	sched.mtx.Lock()
+	if sched.writing {
+		turn := &qosTurn{qos: qos, seq: sched.seq, turn: make(chan struct{})}
+		sched.seq++
+		heap.Push(&sched.pending, turn)
+		sched.mtx.Unlock()
+		<-turn.turn
+	} else {
+		sched.writing = true
+		sched.mtx.Unlock()
+	}
+
+	err := sched.cn.Write(pkt)
+
+	sched.mtx.Lock()
+	if sched.pending.Len() > 0 {
+		// the writing state passes to the next
+		close(heap.Pop(&sched.pending).(*qosTurn).turn)
+	} else {
+		sched.writing = false
+	}
+	sched.mtx.Unlock()
+	return err
+}
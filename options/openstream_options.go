@@ -3,6 +3,12 @@ package options
 type OpenStreamOptions struct {
 	Meta []byte
 	Peer *string
+	// Interactive streams never coalesce writes
+	Interactive *bool
+	// Namespace in the packet header for tenant routing
+	Namespace *uint64
+	// Resume the streamID of a previous stream
+	Resume *uint64
 }
 
 func (opt *OpenStreamOptions) SetMeta(meta []byte) {
@@ -13,6 +19,25 @@ func (opt *OpenStreamOptions) SetPeer(peer string) {
 	opt.Peer = &peer
 }
 
+// SetInteractive disables the write coalescing of the stream, which is
+// preferred by RPC streams rather than bulk-transfer ones.
+func (opt *OpenStreamOptions) SetInteractive(interactive bool) {
+	opt.Interactive = &interactive
+}
+
+// SetNamespace sets the namespace to the header of data packets of the
+// stream, a routing layer may switch on it without decoding the body.
+func (opt *OpenStreamOptions) SetNamespace(namespace uint64) {
+	opt.Namespace = &namespace
+}
+
+// SetResume asks the peer to give the stream the streamID of a previous one,
+// such as the one before reconnecting. The peer may refuse it and give a new
+// one, check StreamID after opened.
+func (opt *OpenStreamOptions) SetResume(streamID uint64) {
+	opt.Resume = &streamID
+}
+
 func OpenStream() *OpenStreamOptions {
 	return &OpenStreamOptions{}
 }
@@ -29,6 +54,15 @@ func MergeOpenStreamOptions(opts ...*OpenStreamOptions) *OpenStreamOptions {
 		if opt.Peer != nil {
 			o.Peer = opt.Peer
 		}
+		if opt.Interactive != nil {
+			o.Interactive = opt.Interactive
+		}
+		if opt.Namespace != nil {
+			o.Namespace = opt.Namespace
+		}
+		if opt.Resume != nil {
+			o.Resume = opt.Resume
+		}
 	}
 	return o
 }
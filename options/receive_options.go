@@ -0,0 +1,32 @@
+package options
+
+import "time"
+
+type ReceiveOptions struct {
+	// peek the message for the visibility, see SetVisibility
+	Visibility *time.Duration
+}
+
+// SetVisibility peeks the at-least-once message, if neither Done nor Error
+// is called in the visibility, the message is redelivered to Receive and the
+// peeked one can't be acked any more.
+func (opt *ReceiveOptions) SetVisibility(visibility time.Duration) {
+	opt.Visibility = &visibility
+}
+
+func Receive() *ReceiveOptions {
+	return &ReceiveOptions{}
+}
+
+func MergeReceiveOptions(opts ...*ReceiveOptions) *ReceiveOptions {
+	ro := &ReceiveOptions{}
+	for _, opt := range opts {
+		if opt == nil {
+			continue
+		}
+		if opt.Visibility != nil {
+			ro.Visibility = opt.Visibility
+		}
+	}
+	return ro
+}
@@ -0,0 +1,106 @@
+package packet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sync"
+)
+
+// buffers larger than it are left to the GC rather than pooled, in case a
+// few large packets pin the memory
+const maxPooledBufferSize = 64 * 1024
+
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+func getBuffer() *bytes.Buffer {
+	return bufferPool.Get().(*bytes.Buffer)
+}
+
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBufferSize {
+		return
+	}
+	buf.Reset()
+	bufferPool.Put(buf)
+}
+
+// encodePooled encodes the packet to a pooled buffer and copies it out, for
+// the Encode of packets
+func encodePooled(pkt Packet) ([]byte, error) {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if err := pkt.EncodeTo(buf); err != nil {
+		return nil, err
+	}
+	data := make([]byte, buf.Len())
+	copy(data, buf.Bytes())
+	return data, nil
+}
+
+// EncodeTo appends the header only, the same as Encode
+func (pktHdr *PacketHeader) EncodeTo(buf *bytes.Buffer) error {
+	pktHdr.encodeHeaderTo(buf)
+	return nil
+}
+
+// encodeHeaderTo appends the header the same as Encode to buf, and returns
+// where it starts for sealTo
+func (pktHdr *PacketHeader) encodeHeaderTo(buf *bytes.Buffer) int {
+	start := buf.Len()
+	var hdr [headerLenV2 + checksumLen]byte
+	length := headerLen
+	if pktHdr.Namespace != 0 {
+		length = headerLenV2
+		version := pktHdr.Version
+		if version < V02 {
+			version = V02
+		}
+		hdr[0] = byte(version)
+		binary.BigEndian.PutUint64(hdr[14:22], pktHdr.Namespace)
+	} else {
+		hdr[0] = byte(pktHdr.Version)
+	}
+	hdr[1] = byte(pktHdr.Typ)
+	binary.BigEndian.PutUint64(hdr[2:10], pktHdr.PacketID)
+	binary.BigEndian.PutUint32(hdr[10:14], pktHdr.PacketLen)
+	if pktHdr.Compressed {
+		hdr[0] |= versionCompressed
+	}
+	if pktHdr.coded {
+		hdr[0] |= versionCoded
+	}
+	if pktHdr.Checksummed {
+		// filled by sealTo after the payload encoded
+		hdr[0] |= versionChecksum
+		length += checksumLen
+	}
+	buf.Write(hdr[:length])
+	return start
+}
+
+// sealTo sets the length of the payload appended after the header at start,
+// and the checksum of it if checksum is true and the header checksummed
+func (pktHdr *PacketHeader) sealTo(buf *bytes.Buffer, start int, checksum bool) {
+	data := buf.Bytes()[start:]
+	hdrLen := headerLen
+	if pktHdr.Namespace != 0 {
+		hdrLen = headerLenV2
+	}
+	if pktHdr.Checksummed {
+		hdrLen += checksumLen
+	}
+	binary.BigEndian.PutUint32(data[10:14], uint32(len(data)-hdrLen))
+	if checksum {
+		pktHdr.sealChecksum(data[:hdrLen], data[hdrLen:])
+	}
+}
+
+func writeUint64(buf *bytes.Buffer, v uint64) {
+	var data [8]byte
+	binary.BigEndian.PutUint64(data[:], v)
+	buf.Write(data[:])
+}
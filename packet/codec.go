@@ -0,0 +1,68 @@
+package packet
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+// Codec marshals the session data of the session layer packets in place of
+// JSON, the ID is carried ahead of the marshaled data for the peer to pick
+// the same one, which must be registered by RegisterCodec.
+type Codec interface {
+	ID() byte
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	codecsMtx sync.RWMutex
+	codecs    = map[byte]Codec{}
+)
+
+// RegisterCodec makes the codec available for decoding, the one with the
+// same ID is replaced.
+func RegisterCodec(codec Codec) {
+	codecsMtx.Lock()
+	defer codecsMtx.Unlock()
+	codecs[codec.ID()] = codec
+}
+
+func getCodec(id byte) (Codec, bool) {
+	codecsMtx.RLock()
+	defer codecsMtx.RUnlock()
+	codec, ok := codecs[id]
+	return codec, ok
+}
+
+// encodeSessionData marshals the session data by the codec, then compresses
+// it if the compression is set.
+func (pktHdr *PacketHeader) encodeSessionData(snData *SessionData) ([]byte, error) {
+	data, err := pktHdr.marshal(snData)
+	if err != nil {
+		return nil, err
+	}
+	return pktHdr.compress(data)
+}
+
+func (pktHdr *PacketHeader) marshal(snData *SessionData) ([]byte, error) {
+	pktHdr.coded = pktHdr.codec != nil
+	if !pktHdr.coded {
+		return json.Marshal(snData)
+	}
+	data, err := pktHdr.codec.Marshal(snData)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{pktHdr.codec.ID()}, data...), nil
+}
+
+func (pktHdr *PacketHeader) unmarshal(data []byte, snData *SessionData) error {
+	if !pktHdr.coded {
+		return json.Unmarshal(data, snData)
+	}
+	codec, ok := getCodec(data[0])
+	if !ok {
+		return ErrUnknownCodec
+	}
+	return codec.Unmarshal(data[1:], snData)
+}
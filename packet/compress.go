@@ -0,0 +1,285 @@
+package packet
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compressor compresses the session data of the session layer packets, the
+// ID is carried ahead of the compressed data for the peer to pick the same
+// one, which must be registered by RegisterCompressor.
+type Compressor interface {
+	ID() byte
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+}
+
+// IDs of the built-in compressors
+const (
+	CompressorGzip   byte = 0x01
+	CompressorSnappy byte = 0x02
+	CompressorZstd   byte = 0x03
+)
+
+// CompressionNone is the name of the negotiated compression if the peers
+// have no compressor in common.
+const CompressionNone = "none"
+
+// the capabilities advertising the compressors are prefixed by it
+const compressionCapabilityPrefix = "compression/"
+
+// the best goes first, the ones not listed follow by their IDs
+var compressorPreference = []byte{CompressorZstd, CompressorSnappy, CompressorGzip}
+
+var (
+	compressorsMtx sync.RWMutex
+	compressors    = map[byte]Compressor{
+		CompressorGzip:   GzipCompressor(),
+		CompressorSnappy: SnappyCompressor(),
+		CompressorZstd:   ZstdCompressor(),
+	}
+)
+
+// RegisterCompressor makes the compressor available for decoding, the one
+// with the same ID is replaced.
+func RegisterCompressor(compressor Compressor) {
+	compressorsMtx.Lock()
+	defer compressorsMtx.Unlock()
+	compressors[compressor.ID()] = compressor
+}
+
+func getCompressor(id byte) (Compressor, bool) {
+	compressorsMtx.RLock()
+	defer compressorsMtx.RUnlock()
+	compressor, ok := compressors[id]
+	return compressor, ok
+}
+
+// CompressorName returns the name of the compressor ID, which is carried by
+// the capabilities.
+func CompressorName(id byte) string {
+	switch id {
+	case CompressorGzip:
+		return "gzip"
+	case CompressorSnappy:
+		return "snappy"
+	case CompressorZstd:
+		return "zstd"
+	}
+	return strconv.Itoa(int(id))
+}
+
+// CompressionCapabilities returns the capabilities advertising the ones of
+// the compressors registered, the others are left out.
+func CompressionCapabilities(ids []byte) []string {
+	capabilities := []string{}
+	for _, id := range ids {
+		if _, ok := getCompressor(id); ok {
+			capabilities = append(capabilities, compressionCapabilityPrefix+CompressorName(id))
+		}
+	}
+	return capabilities
+}
+
+// NegotiateCompressor returns the best of our registered compressors the
+// peer advertised in its capabilities, false if none in common. The
+// preference is fixed, so that the peers pick the same one.
+func NegotiateCompressor(ids []byte, peerCapabilities []string) (Compressor, bool) {
+	advertised := map[string]struct{}{}
+	for _, capability := range peerCapabilities {
+		if strings.HasPrefix(capability, compressionCapabilityPrefix) {
+			advertised[strings.TrimPrefix(capability, compressionCapabilityPrefix)] = struct{}{}
+		}
+	}
+	common := []byte{}
+	for _, id := range ids {
+		if _, ok := advertised[CompressorName(id)]; ok {
+			common = append(common, id)
+		}
+	}
+	sort.Slice(common, func(i, j int) bool {
+		ri, rj := compressorRank(common[i]), compressorRank(common[j])
+		if ri != rj {
+			return ri < rj
+		}
+		return common[i] < common[j]
+	})
+	for _, id := range common {
+		if compressor, ok := getCompressor(id); ok {
+			return compressor, true
+		}
+	}
+	return nil, false
+}
+
+func compressorRank(id byte) int {
+	for rank, preferred := range compressorPreference {
+		if id == preferred {
+			return rank
+		}
+	}
+	return len(compressorPreference)
+}
+
+// SetCompression compresses the message data of the message, request and
+// response packets at encoding if it reaches threshold, the other packets
+// are left as is.
+func SetCompression(pkt Packet, compressor Compressor, threshold int) {
+	var pktHdr *PacketHeader
+	switch realPkt := pkt.(type) {
+	case *MessagePacket:
+		pktHdr = realPkt.PacketHeader
+	case *MessageAckPacket:
+		pktHdr = realPkt.PacketHeader
+	case *RequestPacket:
+		pktHdr = realPkt.PacketHeader
+	case *ResponsePacket:
+		pktHdr = realPkt.PacketHeader
+	default:
+		return
+	}
+	pktHdr.compression = &compression{
+		compressor: compressor,
+		threshold:  threshold,
+	}
+}
+
+type compression struct {
+	compressor Compressor
+	threshold  int
+}
+
+// compress compresses the data if the compression is set and the data
+// reaches the threshold, Compressed is set accordingly.
+func (pktHdr *PacketHeader) compress(data []byte) ([]byte, error) {
+	pktHdr.Compressed = false
+	if pktHdr.compression == nil || len(data) < pktHdr.compression.threshold {
+		return data, nil
+	}
+	compressed, err := pktHdr.compression.compressor.Compress(data)
+	if err != nil {
+		return nil, err
+	}
+	pktHdr.Compressed = true
+	return append([]byte{pktHdr.compression.compressor.ID()}, compressed...), nil
+}
+
+func (pktHdr *PacketHeader) decompress(data []byte) ([]byte, error) {
+	if !pktHdr.Compressed {
+		return data, nil
+	}
+	if len(data) == 0 {
+		return nil, ErrIllegalPacket
+	}
+	compressor, ok := getCompressor(data[0])
+	if !ok {
+		return nil, ErrUnknownCompressor
+	}
+	return compressor.Decompress(data[1:])
+}
+
+type gzipCompressor struct{}
+
+// GzipCompressor returns the built-in compressor of compress/gzip
+func GzipCompressor() Compressor {
+	return gzipCompressor{}
+}
+
+func (gzipCompressor) ID() byte {
+	return CompressorGzip
+}
+
+func (gzipCompressor) Compress(data []byte) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	writer := gzip.NewWriter(buf)
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCompressor) Decompress(data []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
+
+type snappyCompressor struct{}
+
+// SnappyCompressor returns the built-in compressor of the snappy block
+// format, faster than gzip at a lower ratio
+func SnappyCompressor() Compressor {
+	return snappyCompressor{}
+}
+
+func (snappyCompressor) ID() byte {
+	return CompressorSnappy
+}
+
+func (snappyCompressor) Compress(data []byte) ([]byte, error) {
+	return snappy.Encode(nil, data), nil
+}
+
+func (snappyCompressor) Decompress(data []byte) ([]byte, error) {
+	return snappy.Decode(nil, data)
+}
+
+// zstdCompressor shares the encoder and decoder, both are safe for the
+// concurrent EncodeAll and DecodeAll
+type zstdCompressor struct {
+	once    sync.Once
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+	err     error
+}
+
+var builtinZstd = &zstdCompressor{}
+
+// ZstdCompressor returns the built-in compressor of zstd, of the best ratio
+// and the most preferred, its encoder and decoder are made at the first use
+func ZstdCompressor() Compressor {
+	return builtinZstd
+}
+
+func (compressor *zstdCompressor) init() error {
+	compressor.once.Do(func() {
+		compressor.encoder, compressor.err = zstd.NewWriter(nil)
+		if compressor.err != nil {
+			return
+		}
+		compressor.decoder, compressor.err = zstd.NewReader(nil)
+	})
+	return compressor.err
+}
+
+func (compressor *zstdCompressor) ID() byte {
+	return CompressorZstd
+}
+
+func (compressor *zstdCompressor) Compress(data []byte) ([]byte, error) {
+	if err := compressor.init(); err != nil {
+		return nil, err
+	}
+	return compressor.encoder.EncodeAll(data, nil), nil
+}
+
+func (compressor *zstdCompressor) Decompress(data []byte) ([]byte, error) {
+	if err := compressor.init(); err != nil {
+		return nil, err
+	}
+	return compressor.decoder.DecodeAll(data, nil)
+}
@@ -11,120 +11,152 @@ var (
 	ErrExpectingData     = errors.New("expecting data")
 	ErrInvalidArguments  = errors.New("invalid arguments")
 	ErrIllegalPacket     = errors.New("illegal packet")
+	ErrChecksumMismatch  = errors.New("checksum mismatch")
+	ErrUnknownCompressor = errors.New("unknown compressor")
+	ErrUnknownCodec      = errors.New("unknown codec")
 )
 
 func Decode(data []byte) (Packet, uint32, error) {
 	pktHdr := &PacketHeader{}
-	n, err := pktHdr.Decode(data)
+	hdrLen, err := pktHdr.Decode(data)
 	if err != nil {
 		return nil, 0, err
 	}
+	n := uint32(0)
 
-	if uint32(len(data)-14) < pktHdr.PacketLen {
-		return pktHdr, 14, ErrExpectingData
+	if uint32(len(data))-hdrLen < pktHdr.PacketLen {
+		return pktHdr, hdrLen, ErrExpectingData
 	}
 
 	switch pktHdr.Typ {
 	case TypeConnPacket:
 		pkt := &ConnPacket{}
 		pkt.PacketHeader = pktHdr
-		n, err = pkt.Decode(data[14:])
+		n, err = pkt.Decode(data[hdrLen:])
 		return pkt, n, err
 
 	case TypeConnAckPacket:
 		pkt := &ConnAckPacket{}
 		pkt.PacketHeader = pktHdr
-		n, err = pkt.Decode(data[14:])
+		n, err = pkt.Decode(data[hdrLen:])
 		return pkt, n, err
 
 	case TypeDisConnPacket:
 		pkt := &DisConnPacket{}
 		pkt.PacketHeader = pktHdr
-		n, err = pkt.Decode(data[14:])
+		n, err = pkt.Decode(data[hdrLen:])
 		return pkt, n, err
 
 	case TypeDisConnAckPacket:
 		pkt := &DisConnAckPacket{}
 		pkt.PacketHeader = pktHdr
-		n, err = pkt.Decode(data[14:])
+		n, err = pkt.Decode(data[hdrLen:])
 		return pkt, n, err
 
 	case TypeHeartbeatPacket:
 		pkt := &HeartbeatPacket{}
 		pkt.PacketHeader = pktHdr
-		n, err = pkt.Decode(data[14:])
+		n, err = pkt.Decode(data[hdrLen:])
 		return pkt, n, err
 
 	case TypeHeartbeatAckPacket:
 		pkt := &HeartbeatAckPacket{}
 		pkt.PacketHeader = pktHdr
-		n, err = pkt.Decode(data[14:])
+		n, err = pkt.Decode(data[hdrLen:])
 		return pkt, n, err
 
 	case TypeSessionPacket:
 		pkt := &SessionPacket{}
 		pkt.PacketHeader = pktHdr
-		n, err = pkt.Decode(data[14:])
+		n, err = pkt.Decode(data[hdrLen:])
 		return pkt, n, err
 
 	case TypeSessionAckPacket:
 		pkt := &SessionAckPacket{}
 		pkt.PacketHeader = pktHdr
-		n, err = pkt.Decode(data[14:])
+		n, err = pkt.Decode(data[hdrLen:])
+		return pkt, n, err
+
+	case TypeSessionBatchPacket:
+		pkt := &SessionBatchPacket{}
+		pkt.PacketHeader = pktHdr
+		n, err = pkt.Decode(data[hdrLen:])
 		return pkt, n, err
 
 	case TypeDismissPacket:
 		pkt := &DismissPacket{}
 		pkt.PacketHeader = pktHdr
-		n, err = pkt.Decode(data[14:])
+		n, err = pkt.Decode(data[hdrLen:])
 		return pkt, n, err
 
 	case TypeDismissAckPacket:
 		pkt := &DismissAckPacket{}
 		pkt.PacketHeader = pktHdr
-		n, err = pkt.Decode(data[14:])
+		n, err = pkt.Decode(data[hdrLen:])
+		return pkt, n, err
+
+	case TypeResetPacket:
+		pkt := &ResetPacket{}
+		pkt.PacketHeader = pktHdr
+		n, err = pkt.Decode(data[hdrLen:])
+		return pkt, n, err
+
+	case TypeSessionHeartbeatPacket:
+		pkt := &SessionHeartbeatPacket{}
+		pkt.PacketHeader = pktHdr
+		n, err = pkt.Decode(data[hdrLen:])
+		return pkt, n, err
+
+	case TypeSessionHeartbeatAckPacket:
+		pkt := &SessionHeartbeatAckPacket{}
+		pkt.PacketHeader = pktHdr
+		n, err = pkt.Decode(data[hdrLen:])
 		return pkt, n, err
 
 	case TypeMessagePacket:
 		pkt := &MessagePacket{}
 		pkt.PacketHeader = pktHdr
-		n, err = pkt.Decode(data[14:])
+		n, err = pkt.Decode(data[hdrLen:])
 		return pkt, n, err
 
 	case TypeMessageAckPacket:
 		pkt := &MessageAckPacket{}
 		pkt.PacketHeader = pktHdr
-		n, err = pkt.Decode(data[14:])
+		n, err = pkt.Decode(data[hdrLen:])
 		return pkt, n, err
 
 	case TypeStreamPacket:
 		pkt := &StreamPacket{}
 		pkt.PacketHeader = pktHdr
-		n, err = pkt.Decode(data[14:])
+		n, err = pkt.Decode(data[hdrLen:])
 		return pkt, n, err
 
 	case TypeRegisterPacket:
 		pkt := &RegisterPacket{}
 		pkt.PacketHeader = pktHdr
-		n, err = pkt.Decode(data[14:])
+		n, err = pkt.Decode(data[hdrLen:])
 		return pkt, n, err
 
 	case TypeRegisterAckPacket:
 		pkt := &RegisterAckPacket{}
 		pkt.PacketHeader = pktHdr
-		n, err = pkt.Decode(data[14:])
+		n, err = pkt.Decode(data[hdrLen:])
 		return pkt, n, err
 
 	case TypeRequestPacket:
-		pkt := &RequestPacket{}
+		pkt := &RequestPacket{
+			&MessagePacket{},
+		}
 		pkt.PacketHeader = pktHdr
-		n, err = pkt.Decode(data[14:])
+		n, err = pkt.Decode(data[hdrLen:])
 		return pkt, n, err
 
 	case TypeResponsePacket:
-		pkt := &ResponsePacket{}
+		pkt := &ResponsePacket{
+			&MessageAckPacket{},
+		}
 		pkt.PacketHeader = pktHdr
-		n, err = pkt.Decode(data[14:])
+		n, err = pkt.Decode(data[hdrLen:])
 		return pkt, n, err
 
 	default:
@@ -192,6 +224,12 @@ func DecodeFromReader(reader io.Reader) (Packet, error) {
 		err = pkt.DecodeFromReader(reader)
 		return pkt, err
 
+	case TypeSessionBatchPacket:
+		pkt := &SessionBatchPacket{}
+		pkt.PacketHeader = pktHdr
+		err = pkt.DecodeFromReader(reader)
+		return pkt, err
+
 	case TypeDismissPacket:
 		pkt := &DismissPacket{}
 		pkt.PacketHeader = pktHdr
@@ -204,6 +242,24 @@ func DecodeFromReader(reader io.Reader) (Packet, error) {
 		err = pkt.DecodeFromReader(reader)
 		return pkt, err
 
+	case TypeResetPacket:
+		pkt := &ResetPacket{}
+		pkt.PacketHeader = pktHdr
+		err = pkt.DecodeFromReader(reader)
+		return pkt, err
+
+	case TypeSessionHeartbeatPacket:
+		pkt := &SessionHeartbeatPacket{}
+		pkt.PacketHeader = pktHdr
+		err = pkt.DecodeFromReader(reader)
+		return pkt, err
+
+	case TypeSessionHeartbeatAckPacket:
+		pkt := &SessionHeartbeatAckPacket{}
+		pkt.PacketHeader = pktHdr
+		err = pkt.DecodeFromReader(reader)
+		return pkt, err
+
 	case TypeMessagePacket:
 		pkt := &MessagePacket{}
 		pkt.PacketHeader = pktHdr
@@ -259,11 +315,16 @@ func Encode(pkt Packet) ([]byte, error) {
 	return pkt.Encode()
 }
 
+// EncodeToWriter encodes the packet on a pooled buffer, which is reused
+// by the following writes
 func EncodeToWriter(pkt Packet, writer io.Writer) error {
-	data, err := pkt.Encode()
+	buf := getBuffer()
+	defer putBuffer(buf)
+	err := pkt.EncodeTo(buf)
 	if err != nil {
 		return err
 	}
+	data := buf.Bytes()
 	length := len(data)
 	pos := 0
 	for {
@@ -276,5 +337,8 @@ func EncodeToWriter(pkt Packet, writer io.Writer) error {
 			break
 		}
 	}
+	if measured, ok := pkt.(interface{ written(int) }); ok {
+		measured.written(length)
+	}
 	return nil
 }
@@ -0,0 +1,53 @@
+package packet
+
+// Direction tells whether a packet is read from or written to the peer
+type Direction int
+
+const (
+	DirectionIn Direction = iota
+	DirectionOut
+)
+
+func (direction Direction) String() string {
+	switch direction {
+	case DirectionIn:
+		return "in"
+	case DirectionOut:
+		return "out"
+	}
+	return "unknown"
+}
+
+// reasons of dropping packets
+const (
+	DropReasonWriteQueueOverflow = "write queue overflow"
+	DropReasonBufferFull         = "buffer full"
+	DropReasonNotConnected       = "conn not connected"
+	DropReasonDialogueAbnormal   = "dialogue not in normal state"
+	DropReasonDialogueNotFound   = "dialogue not found"
+	DropReasonStaleEpoch         = "stale epoch"
+	DropReasonDuplicate          = "duplicate message"
+	DropReasonNoWaiting          = "no waiting caller"
+	DropReasonUnconsumed         = "read buffer unconsumed"
+	DropReasonUnknownType        = "unknown packet type"
+	DropReasonDuplicateSession   = "duplicate session"
+)
+
+// DropObserver is notified of every packet dropped intentionally, the calls
+// happen in the io goroutines and shouldn't block.
+type DropObserver interface {
+	// dialogueID is 0 for packets under the session layer
+	OnDrop(pkt Packet, reason string, direction Direction, dialogueID uint64)
+}
+
+// NotifyDrop notifies the observer if it's set
+func NotifyDrop(observer DropObserver, pkt Packet, reason string, direction Direction) {
+	if observer == nil {
+		return
+	}
+	dialogueID := uint64(0)
+	if above, ok := pkt.(SessionAbove); ok {
+		dialogueID = above.SessionID()
+	}
+	observer.OnDrop(pkt, reason, direction, dialogueID)
+}
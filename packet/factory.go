@@ -4,6 +4,9 @@ import "github.com/singchia/geminio/pkg/id"
 
 type PacketFactory interface {
 	NewPacketID() uint64
+	// PeekNextID and CurrentID are for debugging, they don't consume IDs
+	PeekNextID() uint64
+	CurrentID() uint64
 	// conn layer
 	NewConnPacket(wanted uint64, peersCall bool, heartbeat Heartbeat, meta []byte) *ConnPacket
 	NewConnAckPacket(packetID uint64, confirmedClientID uint64, err error) *ConnAckPacket
@@ -14,8 +17,12 @@ type PacketFactory interface {
 	// session layer
 	NewSessionPacket(negotiateID uint64, sessionIDPeersCall bool, meta []byte, peer string) *SessionPacket
 	NewSessionAckPacket(packetID uint64, negotiateID uint64, confirmedID uint64, err error) *SessionAckPacket
+	NewSessionBatchPacket(sessions []*SessionPacket) *SessionBatchPacket
 	NewDismissPacket(sessionID uint64) *DismissPacket
 	NewDismissAckPacket(packetID uint64, sessionID uint64, err error) *DismissAckPacket
+	NewResetPacket(sessionID uint64) *ResetPacket
+	NewSessionHeartbeatPacket(sessionID uint64) *SessionHeartbeatPacket
+	NewSessionHeartbeatAckPacket(packetID uint64, sessionID uint64) *SessionHeartbeatAckPacket
 	// application layer
 	NewMessagePacket(key, value []byte) *MessagePacket
 	NewMessagePacketWithIDAndSessionID(id, sessionID uint64, key, value []byte) *MessagePacket
@@ -36,26 +43,88 @@ type PacketFactory interface {
 
 type packetFactory struct {
 	packetIDs id.IDFactory
+	namespace uint64
+	checksum  bool
+	// nil means no compression
+	compression *compression
+	// nil means JSON
+	codec Codec
 }
 
-func NewPacketFactory(packetIDs *id.IDCounter) PacketFactory {
-	return &packetFactory{packetIDs}
+type PacketFactoryOption func(*packetFactory)
+
+// OptionPacketFactoryNamespace sets the namespace of all packets generated
+// by the factory, which makes the packets encoded as V02.
+func OptionPacketFactoryNamespace(namespace uint64) PacketFactoryOption {
+	return func(pf *packetFactory) {
+		pf.namespace = namespace
+	}
+}
+
+// OptionPacketFactoryChecksum carries the CRC32 of the payload in the header
+// of the session, session ack, dismiss and dismiss ack packets generated by
+// the factory, a mismatch fails the decoding with ErrChecksumMismatch. Peers
+// must be able to decode the checksummed header.
+func OptionPacketFactoryChecksum() PacketFactoryOption {
+	return func(pf *packetFactory) {
+		pf.checksum = true
+	}
+}
+
+// OptionPacketFactoryCompression compresses the session data of the session,
+// session ack, dismiss and dismiss ack packets generated by the factory, the
+// ones shorter than threshold are kept as is. The compressor's ID is carried
+// along, peers must have the compressor registered to decode.
+func OptionPacketFactoryCompression(compressor Compressor, threshold int) PacketFactoryOption {
+	return func(pf *packetFactory) {
+		pf.compression = &compression{
+			compressor: compressor,
+			threshold:  threshold,
+		}
+	}
+}
+
+// OptionPacketFactoryCodec marshals the session data of the session, session
+// ack, dismiss and dismiss ack packets generated by the factory with the codec
+// instead of JSON. The codec's ID is carried along, peers must have the codec
+// registered to decode.
+func OptionPacketFactoryCodec(codec Codec) PacketFactoryOption {
+	return func(pf *packetFactory) {
+		pf.codec = codec
+	}
+}
+
+func NewPacketFactory(packetIDs *id.IDCounter, opts ...PacketFactoryOption) PacketFactory {
+	pf := &packetFactory{packetIDs: packetIDs}
+	for _, opt := range opts {
+		opt(pf)
+	}
+	return pf
 }
 
 func (pf *packetFactory) NewPacketID() uint64 {
 	return pf.packetIDs.GetID()
 }
 
+func (pf *packetFactory) PeekNextID() uint64 {
+	return pf.packetIDs.PeekID()
+}
+
+func (pf *packetFactory) CurrentID() uint64 {
+	return pf.packetIDs.CurrentID()
+}
+
 // connection layer packets
 func (pf *packetFactory) NewConnPacket(wantedClientID uint64, clientIDPeersCall bool,
 	heartbeat Heartbeat, meta []byte) *ConnPacket {
 	packetID := pf.packetIDs.GetID()
 	connPkt := &ConnPacket{
 		PacketHeader: &PacketHeader{
-			Version:  V01,
-			Typ:      TypeConnPacket,
-			PacketID: packetID,
-			Cnss:     CnssAtMostOnce,
+			Version:   V01,
+			Namespace: pf.namespace,
+			Typ:       TypeConnPacket,
+			PacketID:  packetID,
+			Cnss:      CnssAtMostOnce,
 		},
 		ConnFlags: ConnFlags{
 			Heartbeat: heartbeat,
@@ -74,10 +143,11 @@ func (pf *packetFactory) NewConnAckPacket(packetID uint64,
 	confirmedClientID uint64, err error) *ConnAckPacket {
 	connAckPkt := &ConnAckPacket{
 		PacketHeader: &PacketHeader{
-			Version:  V01,
-			Typ:      TypeConnAckPacket,
-			PacketID: packetID,
-			Cnss:     CnssAtMostOnce,
+			Version:   V01,
+			Namespace: pf.namespace,
+			Typ:       TypeConnAckPacket,
+			PacketID:  packetID,
+			Cnss:      CnssAtMostOnce,
 		},
 		RetCode:  RetCodeOK,
 		ClientID: confirmedClientID,
@@ -94,10 +164,11 @@ func (pf *packetFactory) NewDisConnPacket() *DisConnPacket {
 	packetID := pf.packetIDs.GetID()
 	disConnPkt := &DisConnPacket{
 		PacketHeader: &PacketHeader{
-			Version:  V01,
-			Typ:      TypeDisConnPacket,
-			PacketID: packetID,
-			Cnss:     CnssAtMostOnce,
+			Version:   V01,
+			Namespace: pf.namespace,
+			Typ:       TypeDisConnPacket,
+			PacketID:  packetID,
+			Cnss:      CnssAtMostOnce,
 		},
 	}
 	return disConnPkt
@@ -107,10 +178,11 @@ func (pf *packetFactory) NewDisConnAckPacket(packetID uint64,
 	err error) *DisConnAckPacket {
 	disConnAckPkt := &DisConnAckPacket{
 		PacketHeader: &PacketHeader{
-			Version:  V01,
-			Typ:      TypeDisConnAckPacket,
-			PacketID: packetID,
-			Cnss:     CnssAtMostOnce,
+			Version:   V01,
+			Namespace: pf.namespace,
+			Typ:       TypeDisConnAckPacket,
+			PacketID:  packetID,
+			Cnss:      CnssAtMostOnce,
 		},
 		RetCode:  RetCodeOK,
 		ConnData: &ConnData{},
@@ -126,10 +198,11 @@ func (pf *packetFactory) NewHeartbeatPacket() *HeartbeatPacket {
 	packetID := pf.packetIDs.GetID()
 	hbPkt := &HeartbeatPacket{
 		PacketHeader: &PacketHeader{
-			Version:  V01,
-			Typ:      TypeHeartbeatPacket,
-			PacketID: packetID,
-			Cnss:     CnssAtLeastOnce,
+			Version:   V01,
+			Namespace: pf.namespace,
+			Typ:       TypeHeartbeatPacket,
+			PacketID:  packetID,
+			Cnss:      CnssAtLeastOnce,
 		},
 	}
 	return hbPkt
@@ -138,10 +211,11 @@ func (pf *packetFactory) NewHeartbeatPacket() *HeartbeatPacket {
 func (pf *packetFactory) NewHeartbeatAckPacket(packetID uint64) *HeartbeatAckPacket {
 	hbAckPkt := &HeartbeatAckPacket{
 		PacketHeader: &PacketHeader{
-			Version:  V01,
-			Typ:      TypeHeartbeatAckPacket,
-			PacketID: packetID,
-			Cnss:     CnssAtMostOnce,
+			Version:   V01,
+			Namespace: pf.namespace,
+			Typ:       TypeHeartbeatAckPacket,
+			PacketID:  packetID,
+			Cnss:      CnssAtMostOnce,
 		},
 	}
 	return hbAckPkt
@@ -152,10 +226,14 @@ func (pf *packetFactory) NewSessionPacket(negotiateID uint64, sessionIDPeersCall
 	packetID := pf.packetIDs.GetID()
 	snPkt := &SessionPacket{
 		PacketHeader: &PacketHeader{
-			Version:  V01,
-			Typ:      TypeSessionPacket,
-			PacketID: packetID,
-			Cnss:     CnssAtLeastOnce,
+			Version:     V01,
+			Namespace:   pf.namespace,
+			Typ:         TypeSessionPacket,
+			PacketID:    packetID,
+			Cnss:        CnssAtLeastOnce,
+			Checksummed: pf.checksum,
+			compression: pf.compression,
+			codec:       pf.codec,
 		},
 		SessionFlags: SessionFlags{
 			sessionIDAcquire: sessionIDPeersCall,
@@ -173,29 +251,53 @@ func (pf *packetFactory) NewSessionAckPacket(packetID uint64, negotiateID uint64
 	confirmedSessionID uint64, err error) *SessionAckPacket {
 	snAckPkt := &SessionAckPacket{
 		PacketHeader: &PacketHeader{
-			Version:  V01,
-			Typ:      TypeSessionAckPacket,
-			PacketID: packetID,
-			Cnss:     CnssAtLeastOnce,
+			Version:     V01,
+			Namespace:   pf.namespace,
+			Typ:         TypeSessionAckPacket,
+			PacketID:    packetID,
+			Cnss:        CnssAtLeastOnce,
+			Checksummed: pf.checksum,
+			compression: pf.compression,
+			codec:       pf.codec,
 		},
 		negotiateID: negotiateID,
 		sessionID:   confirmedSessionID,
 		SessionData: &SessionData{},
 	}
 	if err != nil {
-		snAckPkt.SessionData.Error = err.Error()
+		snAckPkt.SessionData.setError(err)
 	}
 	return snAckPkt
 }
 
+// the sessions are acked one by one, nothing waits for the batch itself
+func (pf *packetFactory) NewSessionBatchPacket(sessions []*SessionPacket) *SessionBatchPacket {
+	packetID := pf.packetIDs.GetID()
+	snBatchPkt := &SessionBatchPacket{
+		PacketHeader: &PacketHeader{
+			Version:   V01,
+			Namespace: pf.namespace,
+			Typ:       TypeSessionBatchPacket,
+			PacketID:  packetID,
+			Cnss:      CnssAtMostOnce,
+		},
+		Sessions: sessions,
+	}
+	return snBatchPkt
+}
+
 func (pf *packetFactory) NewDismissPacket(sessionID uint64) *DismissPacket {
 	packetID := pf.packetIDs.GetID()
 	disPkt := &DismissPacket{
 		PacketHeader: &PacketHeader{
-			Version:  V01,
-			Typ:      TypeDismissPacket,
-			PacketID: packetID,
-			Cnss:     CnssAtLeastOnce,
+			Version:     V01,
+			Namespace:   pf.namespace,
+			Typ:         TypeDismissPacket,
+			PacketID:    packetID,
+			Cnss:        CnssAtLeastOnce,
+			Checksummed: pf.checksum,
+			compression: pf.compression,
+			codec:       pf.codec,
 		},
 		sessionID:   sessionID,
 		SessionData: &SessionData{},
@@ -207,29 +309,79 @@ func (pf *packetFactory) NewDismissAckPacket(packetID uint64,
 	sessionID uint64, err error) *DismissAckPacket {
 	disAckPkt := &DismissAckPacket{
 		PacketHeader: &PacketHeader{
-			Version:  V01,
-			Typ:      TypeDismissAckPacket,
-			PacketID: packetID,
-			Cnss:     CnssAtLeastOnce,
+			Version:     V01,
+			Namespace:   pf.namespace,
+			Typ:         TypeDismissAckPacket,
+			PacketID:    packetID,
+			Cnss:        CnssAtLeastOnce,
+			Checksummed: pf.checksum,
+			compression: pf.compression,
+			codec:       pf.codec,
 		},
 		sessionID:   sessionID,
 		SessionData: &SessionData{},
 	}
 	if err != nil {
-		disAckPkt.SessionData.Error = err.Error()
+		disAckPkt.SessionData.setError(err)
 	}
 	return disAckPkt
 }
 
+func (pf *packetFactory) NewResetPacket(sessionID uint64) *ResetPacket {
+	packetID := pf.packetIDs.GetID()
+	rstPkt := &ResetPacket{
+		PacketHeader: &PacketHeader{
+			Version:   V01,
+			Namespace: pf.namespace,
+			Typ:       TypeResetPacket,
+			PacketID:  packetID,
+			Cnss:      CnssAtMostOnce,
+		},
+		sessionID:   sessionID,
+		SessionData: &SessionData{},
+	}
+	return rstPkt
+}
+
+func (pf *packetFactory) NewSessionHeartbeatPacket(sessionID uint64) *SessionHeartbeatPacket {
+	packetID := pf.packetIDs.GetID()
+	hbPkt := &SessionHeartbeatPacket{
+		PacketHeader: &PacketHeader{
+			Version:   V01,
+			Namespace: pf.namespace,
+			Typ:       TypeSessionHeartbeatPacket,
+			PacketID:  packetID,
+			Cnss:      CnssAtMostOnce,
+		},
+		sessionID: sessionID,
+	}
+	return hbPkt
+}
+
+func (pf *packetFactory) NewSessionHeartbeatAckPacket(packetID uint64, sessionID uint64) *SessionHeartbeatAckPacket {
+	hbAckPkt := &SessionHeartbeatAckPacket{
+		PacketHeader: &PacketHeader{
+			Version:   V01,
+			Namespace: pf.namespace,
+			Typ:       TypeSessionHeartbeatAckPacket,
+			PacketID:  packetID,
+			Cnss:      CnssAtMostOnce,
+		},
+		sessionID: sessionID,
+	}
+	return hbAckPkt
+}
+
 // application layer packets
 func (pf *packetFactory) NewMessagePacket(key, value []byte) *MessagePacket {
 	packetID := pf.packetIDs.GetID()
 	msgPkt := &MessagePacket{
 		PacketHeader: &PacketHeader{
-			Version:  V01,
-			Typ:      TypeMessagePacket,
-			PacketID: packetID,
-			Cnss:     CnssAtLeastOnce,
+			Version:   V01,
+			Namespace: pf.namespace,
+			Typ:       TypeMessagePacket,
+			PacketID:  packetID,
+			Cnss:      CnssAtLeastOnce,
 		},
 		Data: &MessageData{
 			Key:   key,
@@ -252,10 +404,11 @@ func (pf *packetFactory) NewMessagePacketWithSessionID(sessionID uint64,
 	packetID := pf.packetIDs.GetID()
 	msgPkt := &MessagePacket{
 		PacketHeader: &PacketHeader{
-			Version:  V01,
-			Typ:      TypeMessagePacket,
-			PacketID: packetID,
-			Cnss:     CnssAtLeastOnce,
+			Version:   V01,
+			Namespace: pf.namespace,
+			Typ:       TypeMessagePacket,
+			PacketID:  packetID,
+			Cnss:      CnssAtLeastOnce,
 		},
 		sessionID: sessionID,
 		Data: &MessageData{
@@ -270,10 +423,11 @@ func (pf *packetFactory) NewMessagePacketWithSessionID(sessionID uint64,
 func (pf *packetFactory) NewMessageAckPacket(packetID uint64, err error) *MessageAckPacket {
 	msgAckPkt := &MessageAckPacket{
 		PacketHeader: &PacketHeader{
-			Version:  V01,
-			Typ:      TypeMessageAckPacket,
-			PacketID: packetID,
-			Cnss:     CnssAtLeastOnce,
+			Version:   V01,
+			Namespace: pf.namespace,
+			Typ:       TypeMessageAckPacket,
+			PacketID:  packetID,
+			Cnss:      CnssAtLeastOnce,
 		},
 		Data: &MessageData{},
 	}
@@ -293,10 +447,11 @@ func (pf *packetFactory) NewRequestPacket(pattern, data []byte) *RequestPacket {
 	packetID := pf.packetIDs.GetID()
 	msgPkt := &MessagePacket{
 		PacketHeader: &PacketHeader{
-			Version:  V01,
-			Typ:      TypeRequestPacket,
-			PacketID: packetID,
-			Cnss:     CnssAtLeastOnce,
+			Version:   V01,
+			Namespace: pf.namespace,
+			Typ:       TypeRequestPacket,
+			PacketID:  packetID,
+			Cnss:      CnssAtLeastOnce,
 		},
 		Data: &MessageData{
 			Key:   pattern,
@@ -309,10 +464,11 @@ func (pf *packetFactory) NewRequestPacket(pattern, data []byte) *RequestPacket {
 func (pf *packetFactory) NewRequestCancelPacketWithIDAndSessionID(id, sessionID uint64, cancelType RequestCancelType) *RequestCancelPacket {
 	reqCelPkt := &RequestCancelPacket{
 		PacketHeader: &PacketHeader{
-			Version:  V01,
-			Typ:      TypeRequestCancelPacket,
-			PacketID: id,
-			Cnss:     CnssAtLeastOnce,
+			Version:   V01,
+			Namespace: pf.namespace,
+			Typ:       TypeRequestCancelPacket,
+			PacketID:  id,
+			Cnss:      CnssAtLeastOnce,
 		},
 		sessionID:  sessionID,
 		cancelType: cancelType,
@@ -331,10 +487,11 @@ func (pf *packetFactory) NewResponsePacket(requestPacketID uint64,
 	pattern, data []byte, err error) *ResponsePacket {
 	msgAckPkt := &MessageAckPacket{
 		PacketHeader: &PacketHeader{
-			Version:  V01,
-			Typ:      TypeResponsePacket,
-			PacketID: requestPacketID,
-			Cnss:     CnssAtLeastOnce,
+			Version:   V01,
+			Namespace: pf.namespace,
+			Typ:       TypeResponsePacket,
+			PacketID:  requestPacketID,
+			Cnss:      CnssAtLeastOnce,
 		},
 		Data: &MessageData{
 			Key:   pattern,
@@ -351,10 +508,11 @@ func (pf *packetFactory) NewStreamPacket(data []byte) *StreamPacket {
 	packetID := pf.packetIDs.GetID()
 	streamPkt := &StreamPacket{
 		PacketHeader: &PacketHeader{
-			Version:  V01,
-			Typ:      TypeStreamPacket,
-			PacketID: packetID,
-			Cnss:     CnssAtLeastOnce,
+			Version:   V01,
+			Namespace: pf.namespace,
+			Typ:       TypeStreamPacket,
+			PacketID:  packetID,
+			Cnss:      CnssAtLeastOnce,
 		},
 		Data: data,
 	}
@@ -371,10 +529,11 @@ func (pf *packetFactory) NewRegisterPacket(method []byte) *RegisterPacket {
 	packetID := pf.packetIDs.GetID()
 	registerPkt := &RegisterPacket{
 		PacketHeader: &PacketHeader{
-			Version:  V01,
-			Typ:      TypeRegisterPacket,
-			PacketID: packetID,
-			Cnss:     CnssAtLeastOnce,
+			Version:   V01,
+			Namespace: pf.namespace,
+			Typ:       TypeRegisterPacket,
+			PacketID:  packetID,
+			Cnss:      CnssAtLeastOnce,
 		},
 		method: method,
 	}
@@ -390,10 +549,11 @@ func (pf *packetFactory) NewRegisterPacketWithSessionID(sessionID uint64, method
 func (pf *packetFactory) NewRegisterAckPacket(packetID uint64, err error) *RegisterAckPacket {
 	registerAckPkt := &RegisterAckPacket{
 		PacketHeader: &PacketHeader{
-			Version:  V01,
-			Typ:      TypeRegisterAckPacket,
-			PacketID: packetID,
-			Cnss:     CnssAtLeastOnce,
+			Version:   V01,
+			Namespace: pf.namespace,
+			Typ:       TypeRegisterAckPacket,
+			PacketID:  packetID,
+			Cnss:      CnssAtLeastOnce,
 		},
 		RegisterData: &RegisterData{},
 	}
@@ -1,9 +1,12 @@
 package packet
 
 import (
+	"bytes"
 	"encoding/binary"
+	"hash/crc32"
 	"io"
 	"strconv"
+	"sync/atomic"
 )
 
 const (
@@ -37,6 +40,9 @@ type Packet interface {
 	Decode(data []byte) (uint32, error)
 	DecodeFromReader(reader io.Reader) error
 	Encode() ([]byte, error)
+	// EncodeTo appends the encoded packet to buf, which saves the
+	// allocations of Encode if buf is reused
+	EncodeTo(buf *bytes.Buffer) error
 	Length() int
 
 	Consistency() Cnss
@@ -48,6 +54,22 @@ type Version byte
 
 const (
 	V01 = 0x01
+	// V02 carries the namespace in the header
+	V02 = 0x02
+)
+
+const (
+	headerLen   = 14
+	headerLenV2 = 22
+	// the CRC32 follows the header if the flag of the version byte is set
+	versionChecksum = 0x80
+	checksumLen     = 4
+	// the session data is compressed if the flag of the version byte is set
+	versionCompressed = 0x40
+	// the session data is marshaled by the codec other than JSON if the flag
+	// of the version byte is set
+	versionCoded = 0x20
+	versionFlags = versionChecksum | versionCompressed | versionCoded
 )
 
 type Type byte
@@ -70,10 +92,18 @@ func (typ Type) String() string {
 		return "session packet"
 	case TypeSessionAckPacket:
 		return "session ack packet"
+	case TypeSessionBatchPacket:
+		return "session batch packet"
 	case TypeDismissPacket:
 		return "dismiss packet"
 	case TypeDismissAckPacket:
 		return "dismiss ack packet"
+	case TypeResetPacket:
+		return "reset packet"
+	case TypeSessionHeartbeatPacket:
+		return "session heartbeat packet"
+	case TypeSessionHeartbeatAckPacket:
+		return "session heartbeat ack packet"
 	case TypeMessagePacket:
 		return "message packet"
 	case TypeMessageAckPacket:
@@ -95,24 +125,28 @@ func (typ Type) String() string {
 }
 
 const (
-	TypeConnPacket          Type = 0x01
-	TypeConnAckPacket       Type = 0x02
-	TypeDisConnPacket       Type = 0x11
-	TypeDisConnAckPacket    Type = 0x12
-	TypeHeartbeatPacket     Type = 0x21
-	TypeHeartbeatAckPacket  Type = 0x22
-	TypeSessionPacket       Type = 0x31
-	TypeSessionAckPacket    Type = 0x32
-	TypeDismissPacket       Type = 0x41
-	TypeDismissAckPacket    Type = 0x42
-	TypeMessagePacket       Type = 0x51
-	TypeMessageAckPacket    Type = 0x52
-	TypeStreamPacket        Type = 0x61
-	TypeRequestPacket       Type = 0x71
-	TypeResponsePacket      Type = 0x72
-	TypeRequestCancelPacket Type = 0x73
-	TypeRegisterPacket      Type = 0x81
-	TypeRegisterAckPacket   Type = 0x82
+	TypeConnPacket                Type = 0x01
+	TypeConnAckPacket             Type = 0x02
+	TypeDisConnPacket             Type = 0x11
+	TypeDisConnAckPacket          Type = 0x12
+	TypeHeartbeatPacket           Type = 0x21
+	TypeHeartbeatAckPacket        Type = 0x22
+	TypeSessionPacket             Type = 0x31
+	TypeSessionAckPacket          Type = 0x32
+	TypeSessionBatchPacket        Type = 0x33
+	TypeDismissPacket             Type = 0x41
+	TypeDismissAckPacket          Type = 0x42
+	TypeResetPacket               Type = 0x43
+	TypeSessionHeartbeatPacket    Type = 0x44
+	TypeSessionHeartbeatAckPacket Type = 0x45
+	TypeMessagePacket             Type = 0x51
+	TypeMessageAckPacket          Type = 0x52
+	TypeStreamPacket              Type = 0x61
+	TypeRequestPacket             Type = 0x71
+	TypeResponsePacket            Type = 0x72
+	TypeRequestCancelPacket       Type = 0x73
+	TypeRegisterPacket            Type = 0x81
+	TypeRegisterAckPacket         Type = 0x82
 )
 
 type Cnss byte
@@ -132,6 +166,40 @@ const (
 
 type basePacket struct {
 	clientID uint64
+	// monotonic nanoseconds stamped by the writer, 0 means not stamped
+	enqueuedAt int64
+	// stamped by the dialogue's WritePriority, 0 is the lowest
+	writePriority uint8
+}
+
+// Enqueued is implemented by the session above packets, to measure how long
+// they waited before written down, the stamp is never encoded.
+type Enqueued interface {
+	SetEnqueuedAt(nanos int64)
+	EnqueuedAt() int64
+}
+
+func (basePacket *basePacket) SetEnqueuedAt(nanos int64) {
+	basePacket.enqueuedAt = nanos
+}
+
+func (basePacket *basePacket) EnqueuedAt() int64 {
+	return basePacket.enqueuedAt
+}
+
+// Prioritized is implemented by the session above packets, the higher write
+// priority goes down first among the ones pending, the stamp is never encoded.
+type Prioritized interface {
+	SetWritePriority(priority uint8)
+	WritePriority() uint8
+}
+
+func (basePacket *basePacket) SetWritePriority(priority uint8) {
+	basePacket.writePriority = priority
+}
+
+func (basePacket *basePacket) WritePriority() uint8 {
+	return basePacket.writePriority
 }
 
 func (basePacket basePacket) ClientID() uint64 {
@@ -144,6 +212,71 @@ type PacketHeader struct {
 	PacketID  uint64
 	PacketLen uint32
 	Cnss      Cnss
+	// Namespace is for tenant routing, 0 means absent and the header is
+	// encoded as V01 for single-tenant setups
+	Namespace uint64
+	// Checksummed carries the CRC32 (IEEE) of the payload in the header,
+	// which is verified by the session layer packets
+	Checksummed bool
+	checksum    uint32
+	// Compressed tells the session data of the session layer packets, or the
+	// message data of the message, request and response packets is
+	// compressed, set by the encoding with a compression given
+	Compressed  bool
+	compression *compression
+	// the codec set by the factory, coded tells it's used
+	codec Codec
+	coded bool
+	// bytes on the wire, set once decoded or written down, never encoded
+	wireLen uint32
+	// added the wireLen once written down
+	writtenCounter *uint64
+}
+
+// Measured is implemented by all packets with the PacketHeader
+type Measured interface {
+	// WireLen returns the bytes of the packet on the wire, 0 before it's
+	// decoded or written down
+	WireLen() int
+	// CountWritten adds the bytes on the wire to counter once the packet
+	// is written down by EncodeToWriter
+	CountWritten(counter *uint64)
+}
+
+func (pktHdr *PacketHeader) WireLen() int {
+	return int(atomic.LoadUint32(&pktHdr.wireLen))
+}
+
+func (pktHdr *PacketHeader) CountWritten(counter *uint64) {
+	pktHdr.writtenCounter = counter
+}
+
+func (pktHdr *PacketHeader) written(length int) {
+	atomic.StoreUint32(&pktHdr.wireLen, uint32(length))
+	if pktHdr.writtenCounter != nil {
+		atomic.AddUint64(pktHdr.writtenCounter, uint64(length))
+	}
+}
+
+// headerSize returns the encoded header length by the version and flags
+func (pktHdr *PacketHeader) headerSize() uint32 {
+	size := uint32(headerLen)
+	if pktHdr.Version >= V02 {
+		size = headerLenV2
+	}
+	if pktHdr.Checksummed {
+		size += checksumLen
+	}
+	return size
+}
+
+// Namespaced is implemented by all packets with the PacketHeader
+type Namespaced interface {
+	SetNamespace(namespace uint64)
+}
+
+func (pktHdr *PacketHeader) SetNamespace(namespace uint64) {
+	pktHdr.Namespace = namespace
 }
 
 // Length returns payload length
@@ -160,38 +293,127 @@ func (pktHdr *PacketHeader) ID() uint64 {
 }
 
 func (pktHdr *PacketHeader) Encode() ([]byte, error) {
-	hdr := make([]byte, 14)
-	hdr[0] = byte(pktHdr.Version)
+	var hdr []byte
+	if pktHdr.Namespace != 0 {
+		hdr = make([]byte, headerLenV2)
+		version := pktHdr.Version
+		if version < V02 {
+			version = V02
+		}
+		hdr[0] = byte(version)
+		binary.BigEndian.PutUint64(hdr[14:22], pktHdr.Namespace)
+	} else {
+		hdr = make([]byte, headerLen)
+		hdr[0] = byte(pktHdr.Version)
+	}
 	hdr[1] = byte(pktHdr.Typ)
 	binary.BigEndian.PutUint64(hdr[2:10], pktHdr.PacketID)
 	binary.BigEndian.PutUint32(hdr[10:14], pktHdr.PacketLen)
+	if pktHdr.Compressed {
+		hdr[0] |= versionCompressed
+	}
+	if pktHdr.coded {
+		hdr[0] |= versionCoded
+	}
+	if pktHdr.Checksummed {
+		// filled by sealChecksum after the payload encoded
+		hdr[0] |= versionChecksum
+		hdr = append(hdr, make([]byte, checksumLen)...)
+	}
 	return hdr, nil
 }
 
+// sealChecksum sets the CRC32 of the payload into the encoded header
+func (pktHdr *PacketHeader) sealChecksum(hdr, payload []byte) {
+	if !pktHdr.Checksummed {
+		return
+	}
+	pktHdr.checksum = crc32.ChecksumIEEE(payload)
+	binary.BigEndian.PutUint32(hdr[len(hdr)-checksumLen:], pktHdr.checksum)
+}
+
+func (pktHdr *PacketHeader) verifyChecksum(payload []byte) error {
+	if !pktHdr.Checksummed {
+		return nil
+	}
+	if crc32.ChecksumIEEE(payload) != pktHdr.checksum {
+		return ErrChecksumMismatch
+	}
+	return nil
+}
+
 func (pktHdr *PacketHeader) Type() Type {
 	return pktHdr.Typ
 }
 
 func (pktHdr *PacketHeader) Decode(data []byte) (uint32, error) {
-	if len(data) < 14 {
+	if len(data) < headerLen {
 		return 0, ErrIncompletePacket
 	}
-	pktHdr.Version = Version(data[0])
+	pktHdr.Version = Version(data[0] &^ versionFlags)
+	pktHdr.Checksummed = data[0]&versionChecksum != 0
+	pktHdr.Compressed = data[0]&versionCompressed != 0
+	pktHdr.coded = data[0]&versionCoded != 0
 	pktHdr.Typ = Type(data[1])
 	pktHdr.PacketID = binary.BigEndian.Uint64(data[2:10])
 	pktHdr.PacketLen = binary.BigEndian.Uint32(data[10:14])
-	return 14, nil
+	length := uint32(headerLen)
+	if pktHdr.Version >= V02 {
+		if len(data) < headerLenV2 {
+			return 0, ErrIncompletePacket
+		}
+		pktHdr.Namespace = binary.BigEndian.Uint64(data[14:22])
+		length = headerLenV2
+	}
+	if pktHdr.Checksummed {
+		if uint32(len(data)) < length+checksumLen {
+			return 0, ErrIncompletePacket
+		}
+		pktHdr.checksum = binary.BigEndian.Uint32(data[length : length+checksumLen])
+		length += checksumLen
+	}
+	pktHdr.wireLen = length + pktHdr.PacketLen
+	return length, nil
 }
 
 func (pktHdr *PacketHeader) DecodeFromReader(reader io.Reader) error {
-	data := make([]byte, 14)
-	_, err := io.ReadFull(reader, data)
+	data := make([]byte, headerLenV2)
+	_, err := io.ReadFull(reader, data[:headerLen])
 	if err != nil {
 		return err
 	}
-	pktHdr.Version = Version(data[0])
+	pktHdr.Version = Version(data[0] &^ versionFlags)
+	pktHdr.Checksummed = data[0]&versionChecksum != 0
+	pktHdr.Compressed = data[0]&versionCompressed != 0
+	pktHdr.coded = data[0]&versionCoded != 0
 	pktHdr.Typ = Type(data[1])
 	pktHdr.PacketID = binary.BigEndian.Uint64(data[2:10])
 	pktHdr.PacketLen = binary.BigEndian.Uint32(data[10:14])
+	if pktHdr.Version >= V02 {
+		_, err = io.ReadFull(reader, data[headerLen:])
+		if err != nil {
+			return err
+		}
+		pktHdr.Namespace = binary.BigEndian.Uint64(data[14:22])
+	}
+	if pktHdr.Checksummed {
+		_, err = io.ReadFull(reader, data[:checksumLen])
+		if err != nil {
+			return err
+		}
+		pktHdr.checksum = binary.BigEndian.Uint32(data[:checksumLen])
+	}
+	pktHdr.wireLen = pktHdr.headerSize() + pktHdr.PacketLen
 	return nil
 }
+
+// PeekNamespace returns the namespace of an encoded packet by the header
+// only, the body is never decoded, which is for cheap routing.
+func PeekNamespace(data []byte) (uint64, error) {
+	pktHdr := &PacketHeader{}
+	_, err := pktHdr.Decode(data)
+	if err != nil {
+		return 0, err
+	}
+	return pktHdr.Namespace, nil
+}
@@ -1,6 +1,7 @@
 package packet
 
 import (
+	"bytes"
 	"encoding/binary"
 	"encoding/json"
 	"io"
@@ -55,39 +56,41 @@ func (connPkt *ConnPacket) ClientIDAcquire() bool {
 }
 
 func (connPkt *ConnPacket) Encode() ([]byte, error) {
-	hdr, err := connPkt.PacketHeader.Encode()
-	if err != nil {
-		return nil, err
-	}
+	return encodePooled(connPkt)
+}
+
+func (connPkt *ConnPacket) EncodeTo(buf *bytes.Buffer) error {
 	data, err := json.Marshal(connPkt.ConnData)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	length := 10 + len(data)
-	pkt := make([]byte, length)
+	start := connPkt.PacketHeader.encodeHeaderTo(buf)
+	var next [10]byte
 	// conn flags
 	if connPkt.Retain {
-		pkt[0] |= 0x01
+		next[0] |= 0x01
 	}
 	if connPkt.Clear {
-		pkt[0] |= 0x02
+		next[0] |= 0x02
 	}
 	if connPkt.packetIDAcquire {
-		pkt[0] |= 0x04
+		next[0] |= 0x04
 	}
 	if connPkt.clientIDAcquire {
-		pkt[0] |= 0x08
+		next[0] |= 0x08
 	}
-	if connPkt.Heartbeat != Heartbeat5 {
-		pkt[0] |= byte(math.Pow(float64(connPkt.Heartbeat)/5, 0.25)) << 4
+	if connPkt.Heartbeat > Heartbeat5 {
+		// the heartbeat is 5*4^n, n takes 2 bits
+		next[0] |= byte(math.Round(math.Log(float64(connPkt.Heartbeat)/5)/math.Log(4))) & 0x03 << 4
 	}
 	// client id
-	binary.BigEndian.PutUint64(pkt[2:10], connPkt.ClientID)
+	binary.BigEndian.PutUint64(next[2:10], connPkt.ClientID)
+	buf.Write(next[:])
 	// data
-	copy(pkt[10:length], data)
+	buf.Write(data)
 	// header length
-	binary.BigEndian.PutUint32(hdr[10:14], uint32(length))
-	return append(hdr, pkt...), nil
+	connPkt.PacketHeader.sealTo(buf, start, false)
+	return nil
 }
 
 func (connPkt *ConnPacket) Decode(data []byte) (uint32, error) {
@@ -161,29 +164,37 @@ type ConnAckPacket struct {
 type ConnData struct {
 	Meta  []byte `json:"meta,omitempty"`
 	Error string `json:"error,omitempty"`
+	// the protocol version and capabilities advertised by the sender, the
+	// version is 0 from peers before advertising
+	Version      int      `json:"version,omitempty"`
+	Capabilities []string `json:"capabilities,omitempty"`
+	// unix nanoseconds of the sender's clock at sending, for the peer to
+	// estimate the clock skew
+	Timestamp int64 `json:"timestamp,omitempty"`
 }
 
 func (connAckPkt *ConnAckPacket) Encode() ([]byte, error) {
-	hdr, err := connAckPkt.PacketHeader.Encode()
-	if err != nil {
-		return nil, err
-	}
+	return encodePooled(connAckPkt)
+}
+
+func (connAckPkt *ConnAckPacket) EncodeTo(buf *bytes.Buffer) error {
 	data, err := json.Marshal(connAckPkt.ConnData)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	length := len(data) + 9
-	pkt := make([]byte, length)
+	start := connAckPkt.PacketHeader.encodeHeaderTo(buf)
+	var next [9]byte
 	// ret code
-	pkt[0] = byte(connAckPkt.RetCode)
+	next[0] = byte(connAckPkt.RetCode)
 	// client id
-	binary.BigEndian.PutUint64(pkt[1:9], connAckPkt.ClientID)
+	binary.BigEndian.PutUint64(next[1:9], connAckPkt.ClientID)
+	buf.Write(next[:])
 	// data
-	copy(pkt[9:length], data)
+	buf.Write(data)
 
 	// set pkt length
-	binary.BigEndian.PutUint32(hdr[10:14], uint32(length))
-	return append(hdr, pkt...), nil
+	connAckPkt.PacketHeader.sealTo(buf, start, false)
+	return nil
 }
 
 func (connAckPkt *ConnAckPacket) Decode(data []byte) (uint32, error) {
@@ -231,7 +242,12 @@ type DisConnPacket struct {
 }
 
 func (disConnPkt *DisConnPacket) Encode() ([]byte, error) {
-	return disConnPkt.PacketHeader.Encode()
+	return encodePooled(disConnPkt)
+}
+
+func (disConnPkt *DisConnPacket) EncodeTo(buf *bytes.Buffer) error {
+	disConnPkt.PacketHeader.encodeHeaderTo(buf)
+	return nil
 }
 
 func (disConnPkt *DisConnPacket) Decode(data []byte) (uint32, error) {
@@ -249,25 +265,23 @@ type DisConnAckPacket struct {
 }
 
 func (disConnAckPkt *DisConnAckPacket) Encode() ([]byte, error) {
-	hdr, err := disConnAckPkt.PacketHeader.Encode()
-	if err != nil {
-		return nil, err
-	}
+	return encodePooled(disConnAckPkt)
+}
+
+func (disConnAckPkt *DisConnAckPacket) EncodeTo(buf *bytes.Buffer) error {
 	data, err := json.Marshal(disConnAckPkt.ConnData)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	length := len(data) + 1
-	pkt := make([]byte, length)
+	start := disConnAckPkt.PacketHeader.encodeHeaderTo(buf)
 	// ret code
-	pkt[0] = byte(disConnAckPkt.RetCode)
-	// client id
-	copy(pkt[1:length], data)
+	buf.WriteByte(byte(disConnAckPkt.RetCode))
+	// data
+	buf.Write(data)
 
 	// set pkt length
-	binary.BigEndian.PutUint32(hdr[10:14], uint32(length))
-	hdr = append(hdr, pkt...)
-	return hdr, nil
+	disConnAckPkt.PacketHeader.sealTo(buf, start, false)
+	return nil
 }
 
 func (disConnAckPkt *DisConnAckPacket) Decode(data []byte) (uint32, error) {
@@ -311,7 +325,12 @@ type HeartbeatPacket struct {
 }
 
 func (hbPkt *HeartbeatPacket) Encode() ([]byte, error) {
-	return hbPkt.PacketHeader.Encode()
+	return encodePooled(hbPkt)
+}
+
+func (hbPkt *HeartbeatPacket) EncodeTo(buf *bytes.Buffer) error {
+	hbPkt.PacketHeader.encodeHeaderTo(buf)
+	return nil
 }
 
 func (hbPkt *HeartbeatPacket) Decode(data []byte) (uint32, error) {
@@ -327,7 +346,12 @@ type HeartbeatAckPacket struct {
 }
 
 func (hbAckPkt *HeartbeatAckPacket) Encode() ([]byte, error) {
-	return hbAckPkt.PacketHeader.Encode()
+	return encodePooled(hbAckPkt)
+}
+
+func (hbAckPkt *HeartbeatAckPacket) EncodeTo(buf *bytes.Buffer) error {
+	hbAckPkt.PacketHeader.encodeHeaderTo(buf)
+	return nil
 }
 
 func (hbAckPkt *HeartbeatAckPacket) Decode(data []byte) (uint32, error) {
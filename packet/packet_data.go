@@ -1,6 +1,7 @@
 package packet
 
 import (
+	"bytes"
 	"encoding/binary"
 	"encoding/json"
 	"errors"
@@ -12,6 +13,17 @@ type AppAbove interface {
 	SessionAbove
 }
 
+// AppLayer tells whether the packet is one of the known application packets
+func AppLayer(pkt Packet) bool {
+	switch pkt.Type() {
+	case TypeMessagePacket, TypeMessageAckPacket, TypeStreamPacket,
+		TypeRequestPacket, TypeResponsePacket, TypeRequestCancelPacket,
+		TypeRegisterPacket, TypeRegisterAckPacket:
+		return true
+	}
+	return false
+}
+
 // Request packet for RPC call
 type RequestPacket struct {
 	*MessagePacket
@@ -45,19 +57,20 @@ func (pkt *RequestCancelPacket) SetSessionID(sessionID uint64) {
 }
 
 func (pkt *RequestCancelPacket) Encode() ([]byte, error) {
-	hdr, err := pkt.PacketHeader.Encode()
-	if err != nil {
-		return nil, err
-	}
-	length := 10
-	next := make([]byte, length)
+	return encodePooled(pkt)
+}
+
+func (pkt *RequestCancelPacket) EncodeTo(buf *bytes.Buffer) error {
+	start := pkt.PacketHeader.encodeHeaderTo(buf)
+	var next [10]byte
 	// session id
 	binary.BigEndian.PutUint64(next[:8], pkt.sessionID)
 	// cancel type
 	binary.BigEndian.PutUint16(next[8:10], uint16(pkt.cancelType))
+	buf.Write(next[:])
 	// set next length
-	binary.BigEndian.PutUint32(hdr[10:14], uint32(length))
-	return append(hdr, next...), nil
+	pkt.PacketHeader.sealTo(buf, start, false)
+	return nil
 }
 
 func (pkt *RequestCancelPacket) Decode(data []byte) (uint32, error) {
@@ -108,6 +121,31 @@ type MessageData struct {
 	Context  struct {
 		Deadline time.Time `json:"deadline,omitempty"`
 	} `json:"context,omitempty"`
+	// set by producer for consumer's deduplication, only used by messages
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+	// set by caller to accept the response in chunks, only used by requests
+	Chunked bool `json:"chunked,omitempty"`
+	// set by callee while more chunks follow, only used by responses, and by
+	// caller for the messages of a streaming call after the opening request
+	More bool `json:"more,omitempty"`
+	// set by caller for the requests of a streaming call
+	Streaming bool `json:"streaming,omitempty"`
+	// set by caller at closing the sending of a streaming call
+	End bool `json:"end,omitempty"`
+	// more messages acked along with the packet, only used by message acks
+	Acks []uint64 `json:"acks,omitempty"`
+}
+
+func decodeMessageData(pktHdr *PacketHeader, data []byte) (*MessageData, error) {
+	data, err := pktHdr.decompress(data)
+	if err != nil {
+		return nil, err
+	}
+	msgData := &MessageData{}
+	if err = json.Unmarshal(data, msgData); err != nil {
+		return nil, err
+	}
+	return msgData, nil
 }
 
 func (pkt *MessagePacket) SessionID() uint64 {
@@ -119,23 +157,27 @@ func (pkt *MessagePacket) SetSessionID(sessionID uint64) {
 }
 
 func (pkt *MessagePacket) Encode() ([]byte, error) {
-	hdr, err := pkt.PacketHeader.Encode()
+	return encodePooled(pkt)
+}
+
+func (pkt *MessagePacket) EncodeTo(buf *bytes.Buffer) error {
+	data, err := json.Marshal(pkt.Data)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	data, err := json.Marshal(pkt.Data)
+	// data goes first for the header to know if it's compressed
+	data, err = pkt.PacketHeader.compress(data)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	length := len(data) + 8
-	next := make([]byte, length)
+	start := pkt.PacketHeader.encodeHeaderTo(buf)
 	// session id
-	binary.BigEndian.PutUint64(next[:8], pkt.sessionID)
+	writeUint64(buf, pkt.sessionID)
 	// data
-	copy(next[8:length], data)
+	buf.Write(data)
 	// set next length
-	binary.BigEndian.PutUint32(hdr[10:14], uint32(length))
-	return append(hdr, next...), nil
+	pkt.PacketHeader.sealTo(buf, start, false)
+	return nil
 }
 
 func (pkt *MessagePacket) Decode(data []byte) (uint32, error) {
@@ -145,8 +187,7 @@ func (pkt *MessagePacket) Decode(data []byte) (uint32, error) {
 	// session id
 	pkt.sessionID = binary.BigEndian.Uint64(data[:8])
 	// data
-	msgData := &MessageData{}
-	err := json.Unmarshal(data[8:pkt.PacketLen], msgData)
+	msgData, err := decodeMessageData(pkt.PacketHeader, data[8:pkt.PacketLen])
 	if err != nil {
 		return 0, err
 	}
@@ -166,8 +207,7 @@ func (pkt *MessagePacket) DecodeFromReader(reader io.Reader) error {
 	// session id
 	pkt.sessionID = binary.BigEndian.Uint64(data[:8])
 	// data
-	msgData := &MessageData{}
-	err = json.Unmarshal(data[8:pkt.PacketLen], msgData)
+	msgData, err := decodeMessageData(pkt.PacketHeader, data[8:pkt.PacketLen])
 	if err != nil {
 		return err
 	}
@@ -193,24 +233,27 @@ func (pkt *MessageAckPacket) SetSessionID(sessionID uint64) {
 }
 
 func (pkt *MessageAckPacket) Encode() ([]byte, error) {
-	hdr, err := pkt.PacketHeader.Encode()
+	return encodePooled(pkt)
+}
+
+func (pkt *MessageAckPacket) EncodeTo(buf *bytes.Buffer) error {
+	data, err := json.Marshal(pkt.Data)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	data, err := json.Marshal(pkt.Data)
+	// data goes first for the header to know if it's compressed
+	data, err = pkt.PacketHeader.compress(data)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	length := len(data) + 8
-	next := make([]byte, length)
+	start := pkt.PacketHeader.encodeHeaderTo(buf)
 	// session id
-	binary.BigEndian.PutUint64(next[:8], pkt.sessionID)
+	writeUint64(buf, pkt.sessionID)
 	// data
-	copy(next[8:length], data)
-
+	buf.Write(data)
 	// set next length
-	binary.BigEndian.PutUint32(hdr[10:14], uint32(length))
-	return append(hdr, next...), nil
+	pkt.PacketHeader.sealTo(buf, start, false)
+	return nil
 }
 
 func (pkt *MessageAckPacket) Decode(data []byte) (uint32, error) {
@@ -220,8 +263,7 @@ func (pkt *MessageAckPacket) Decode(data []byte) (uint32, error) {
 	// session id
 	pkt.sessionID = binary.BigEndian.Uint64(data[:8])
 	// data
-	msgData := &MessageData{}
-	err := json.Unmarshal(data[8:pkt.PacketLen], msgData)
+	msgData, err := decodeMessageData(pkt.PacketHeader, data[8:pkt.PacketLen])
 	if err != nil {
 		return 0, err
 	}
@@ -241,8 +283,7 @@ func (pkt *MessageAckPacket) DecodeFromReader(reader io.Reader) error {
 	// session id
 	pkt.sessionID = binary.BigEndian.Uint64(data[:8])
 	// data
-	msgData := &MessageData{}
-	err = json.Unmarshal(data[8:pkt.PacketLen], msgData)
+	msgData, err := decodeMessageData(pkt.PacketHeader, data[8:pkt.PacketLen])
 	if err != nil {
 		return err
 	}
@@ -272,19 +313,18 @@ func (pkt *StreamPacket) SetSessionID(sessionID uint64) {
 }
 
 func (pkt *StreamPacket) Encode() ([]byte, error) {
-	hdr, err := pkt.PacketHeader.Encode()
-	if err != nil {
-		return nil, err
-	}
-	length := len(pkt.Data) + 8
-	next := make([]byte, length)
+	return encodePooled(pkt)
+}
+
+func (pkt *StreamPacket) EncodeTo(buf *bytes.Buffer) error {
+	start := pkt.PacketHeader.encodeHeaderTo(buf)
 	// session id
-	binary.BigEndian.PutUint64(next[:8], pkt.sessionID)
+	writeUint64(buf, pkt.sessionID)
 	// data
-	copy(next[8:length], pkt.Data)
+	buf.Write(pkt.Data)
 	// set next length
-	binary.BigEndian.PutUint32(hdr[10:14], uint32(length))
-	return append(hdr, next...), nil
+	pkt.PacketHeader.sealTo(buf, start, false)
+	return nil
 }
 
 func (pkt *StreamPacket) Decode(data []byte) (uint32, error) {
@@ -342,19 +382,18 @@ func (pkt *RegisterPacket) SetSessionID(sessionID uint64) {
 }
 
 func (pkt *RegisterPacket) Encode() ([]byte, error) {
-	hdr, err := pkt.PacketHeader.Encode()
-	if err != nil {
-		return nil, err
-	}
-	length := len(pkt.method) + 8
-	next := make([]byte, length)
-	// sessin id
-	binary.BigEndian.PutUint64(next[:8], pkt.sessionID)
+	return encodePooled(pkt)
+}
+
+func (pkt *RegisterPacket) EncodeTo(buf *bytes.Buffer) error {
+	start := pkt.PacketHeader.encodeHeaderTo(buf)
+	// session id
+	writeUint64(buf, pkt.sessionID)
 	// method
-	copy(next[8:length], pkt.method)
+	buf.Write(pkt.method)
 	// set next length
-	binary.BigEndian.PutUint32(hdr[10:14], uint32(length))
-	return append(hdr, next...), nil
+	pkt.PacketHeader.sealTo(buf, start, false)
+	return nil
 }
 
 func (pkt *RegisterPacket) Decode(data []byte) (uint32, error) {
@@ -407,23 +446,22 @@ func (pkt *RegisterAckPacket) SetSessionID(sessionID uint64) {
 }
 
 func (pkt *RegisterAckPacket) Encode() ([]byte, error) {
-	hdr, err := pkt.PacketHeader.Encode()
-	if err != nil {
-		return nil, err
-	}
+	return encodePooled(pkt)
+}
+
+func (pkt *RegisterAckPacket) EncodeTo(buf *bytes.Buffer) error {
 	data, err := json.Marshal(pkt.RegisterData)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	length := len(data) + 8
-	next := make([]byte, length)
-	// sessin id
-	binary.BigEndian.PutUint64(next[:8], pkt.sessionID)
+	start := pkt.PacketHeader.encodeHeaderTo(buf)
+	// session id
+	writeUint64(buf, pkt.sessionID)
 	// data
-	copy(next[8:length], data)
+	buf.Write(data)
 	// set next length
-	binary.BigEndian.PutUint32(hdr[10:14], uint32(length))
-	return append(hdr, next...), nil
+	pkt.PacketHeader.sealTo(buf, start, false)
+	return nil
 }
 
 func (pkt *RegisterAckPacket) Decode(data []byte) (uint32, error) {
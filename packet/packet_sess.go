@@ -1,9 +1,11 @@
 package packet
 
 import (
+	"bytes"
 	"encoding/binary"
-	"encoding/json"
+	"errors"
 	"io"
+	"strconv"
 
 	"github.com/jumboframes/armorigo/log"
 )
@@ -15,9 +17,29 @@ type SessionAbove interface {
 
 type SessionFlags struct {
 	Priority         uint8 // 8 bits
-	Qos              int8  // 4 bits, unused now
+	Qos              int8  // 4 bits
 	sessionIDAcquire bool  // If peer's call to assign sessionID 1 bit
-	// reserved 3 bits
+	resume           bool  // If resuming a previous sessionID 1 bit
+	// reserved 2 bits
+}
+
+// encode puts the flags into the first 2 bytes of data
+func (flags SessionFlags) encode(data []byte) {
+	data[0] = flags.Priority
+	data[1] = byte(flags.Qos) & 0x0F
+	if flags.sessionIDAcquire {
+		data[1] |= 0x10
+	}
+	if flags.resume {
+		data[1] |= 0x20
+	}
+}
+
+func (flags *SessionFlags) decode(data []byte) {
+	flags.Priority = data[0]
+	flags.Qos = int8(data[1] & 0x0F)
+	flags.sessionIDAcquire = (data[1] & 0x10) != 0
+	flags.resume = (data[1] & 0x20) != 0
 }
 
 type SessionPacket struct {
@@ -33,14 +55,79 @@ type SessionPacket struct {
 type SessionData struct {
 	Meta  []byte `json:"meta,omitempty"`
 	Error string `json:"error,omitempty"`
-	Peer  string `json:"peer,omitempty"`
+	// set if the error has a Code() int64
+	Code ErrorCode `json:"code,omitempty"`
+	Peer string    `json:"peer,omitempty"`
+	// epoch is chosen by the acceptor at every session, a dismiss only
+	// takes effect at the same epoch, 0 means unknown
+	Epoch uint64 `json:"epoch,omitempty"`
+	// max payload size of data packets accepted by the sender, 0 means
+	// no limit
+	MaxPacketSize int `json:"max_packet_size,omitempty"`
+	// the previous sessionID asked to resume, only with the resume flag
+	ResumeID uint64 `json:"resume_id,omitempty"`
+}
+
+// ErrorCode is encoded as a JSON string, so that peers decoding JSON numbers
+// into float64 won't mangle the large codes, a bare integer is accepted too.
+type ErrorCode int64
+
+func (code ErrorCode) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + strconv.FormatInt(int64(code), 10) + `"`), nil
+}
+
+func (code *ErrorCode) UnmarshalJSON(data []byte) error {
+	str := string(data)
+	if str == "null" {
+		return nil
+	}
+	if len(str) >= 2 && str[0] == '"' && str[len(str)-1] == '"' {
+		str = str[1 : len(str)-1]
+	}
+	value, err := strconv.ParseInt(str, 10, 64)
+	if err != nil {
+		return err
+	}
+	*code = ErrorCode(value)
+	return nil
+}
+
+// setError keeps the error's code if any
+func (snData *SessionData) setError(err error) {
+	snData.Error = err.Error()
+	var coder interface{ Code() int64 }
+	if errors.As(err, &coder) {
+		snData.Code = ErrorCode(coder.Code())
+	}
+}
+
+// decodeSessionData never returns a nil SessionData without error, even the
+// payload from peer is empty or null
+func decodeSessionData(pktHdr *PacketHeader, data []byte) (*SessionData, error) {
+	snData := &SessionData{}
+	data, err := pktHdr.decompress(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return snData, nil
+	}
+	err = pktHdr.unmarshal(data, snData)
+	if err != nil {
+		return nil, err
+	}
+	return snData, nil
 }
 
 func SessionLayer(pkt Packet) bool {
 	if pkt.Type() == TypeSessionPacket ||
 		pkt.Type() == TypeSessionAckPacket ||
+		pkt.Type() == TypeSessionBatchPacket ||
 		pkt.Type() == TypeDismissPacket ||
-		pkt.Type() == TypeDismissAckPacket {
+		pkt.Type() == TypeDismissAckPacket ||
+		pkt.Type() == TypeResetPacket ||
+		pkt.Type() == TypeSessionHeartbeatPacket ||
+		pkt.Type() == TypeSessionHeartbeatAckPacket {
 		return true
 	}
 	return false
@@ -62,28 +149,42 @@ func (pkt *SessionPacket) SessionIDAcquire() bool {
 	return pkt.sessionIDAcquire
 }
 
-func (pkt *SessionPacket) Encode() ([]byte, error) {
-	hdr, err := pkt.PacketHeader.Encode()
-	if err != nil {
-		return nil, err
+// SetResume asks the peer to assign the sessionID of a previous session,
+// such as the one before reconnecting
+func (pkt *SessionPacket) SetResume(sessionID uint64) {
+	pkt.resume = true
+	pkt.SessionData.ResumeID = sessionID
+}
+
+// Resume returns the previous sessionID asked to resume, false if not
+// resuming
+func (pkt *SessionPacket) Resume() (uint64, bool) {
+	if !pkt.resume || pkt.SessionData.ResumeID == SessionIDNull {
+		return SessionIDNull, false
 	}
-	data, err := json.Marshal(pkt.SessionData)
+	return pkt.SessionData.ResumeID, true
+}
+
+func (pkt *SessionPacket) Encode() ([]byte, error) {
+	return encodePooled(pkt)
+}
+
+func (pkt *SessionPacket) EncodeTo(buf *bytes.Buffer) error {
+	// data goes first for the header to know if it's compressed
+	data, err := pkt.PacketHeader.encodeSessionData(pkt.SessionData)
 	if err != nil {
-		return nil, err
-	}
-	length := len(data) + 10
-	next := make([]byte, length)
-	next[0] = pkt.SessionFlags.Priority
-	next[1] |= byte(pkt.SessionFlags.Qos) << 4 >> 4
-	if pkt.SessionFlags.sessionIDAcquire {
-		next[1] |= 0x10
+		return err
 	}
+	start := pkt.PacketHeader.encodeHeaderTo(buf)
+	var next [10]byte
+	pkt.SessionFlags.encode(next[:])
 	binary.BigEndian.PutUint64(next[2:10], pkt.negotiateID)
-	copy(next[10:length], data)
+	buf.Write(next[:])
+	buf.Write(data)
 
 	// set pkt length
-	binary.BigEndian.PutUint32(hdr[10:14], uint32(length))
-	return append(hdr, next...), nil
+	pkt.PacketHeader.sealTo(buf, start, true)
+	return nil
 }
 
 func (pkt *SessionPacket) Decode(data []byte) (uint32, error) {
@@ -91,13 +192,13 @@ func (pkt *SessionPacket) Decode(data []byte) (uint32, error) {
 	if len(data) < length {
 		return 0, ErrIncompletePacket
 	}
-	pkt.SessionFlags.Priority = data[0]
-	pkt.SessionFlags.Qos = int8(data[1] & 0x0F)
-	pkt.SessionFlags.sessionIDAcquire = (data[1] & 0x10) != 0
+	if err := pkt.PacketHeader.verifyChecksum(data[:length]); err != nil {
+		return 0, err
+	}
+	pkt.SessionFlags.decode(data)
 	pkt.negotiateID = binary.BigEndian.Uint64(data[2:10])
 	// data
-	snData := &SessionData{}
-	err := json.Unmarshal(data[10:length], snData)
+	snData, err := decodeSessionData(pkt.PacketHeader, data[10:length])
 	if err != nil {
 		log.Errorf("session packet decode err: %s", err)
 		return 0, err
@@ -113,13 +214,13 @@ func (pkt *SessionPacket) DecodeFromReader(reader io.Reader) error {
 	if err != nil {
 		return err
 	}
-	pkt.SessionFlags.Priority = data[0]
-	pkt.SessionFlags.Qos = int8(data[1] & 0x0F)
-	pkt.SessionFlags.sessionIDAcquire = (data[1] & 0x10) != 0
+	if err = pkt.PacketHeader.verifyChecksum(data); err != nil {
+		return err
+	}
+	pkt.SessionFlags.decode(data)
 	pkt.negotiateID = binary.BigEndian.Uint64(data[2:10])
 	// data
-	snData := &SessionData{}
-	err = json.Unmarshal(data[10:length], snData)
+	snData, err := decodeSessionData(pkt.PacketHeader, data[10:length])
 	if err != nil {
 		log.Errorf("session packet decode from reader err: %s", err)
 		return err
@@ -130,7 +231,7 @@ func (pkt *SessionPacket) DecodeFromReader(reader io.Reader) error {
 
 type SessionAckPacket struct {
 	*PacketHeader
-	SessionFlags        // 16 bits, unused now
+	SessionFlags        // 16 bits, same layout as the SessionPacket's
 	negotiateID  uint64 // 8 bytes
 	sessionID    uint64 // 8 bytes
 	SessionData  *SessionData
@@ -152,28 +253,35 @@ func (pkt *SessionAckPacket) SetSessionID(sessionID uint64) {
 }
 
 func (pkt *SessionAckPacket) SetError(err error) {
-	pkt.SessionData.Error = err.Error()
+	if pkt.SessionData == nil {
+		pkt.SessionData = &SessionData{}
+	}
+	pkt.SessionData.setError(err)
 }
 
 func (pkt *SessionAckPacket) Encode() ([]byte, error) {
-	hdr, err := pkt.PacketHeader.Encode()
-	if err != nil {
-		return nil, err
-	}
-	data, err := json.Marshal(pkt.SessionData)
+	return encodePooled(pkt)
+}
+
+func (pkt *SessionAckPacket) EncodeTo(buf *bytes.Buffer) error {
+	// data goes first for the header to know if it's compressed
+	data, err := pkt.PacketHeader.encodeSessionData(pkt.SessionData)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	length := len(data) + 18
-	next := make([]byte, length)
+	start := pkt.PacketHeader.encodeHeaderTo(buf)
+	var next [18]byte
+	// negotiated qos
+	pkt.SessionFlags.encode(next[:])
 	// session id
 	binary.BigEndian.PutUint64(next[2:10], pkt.negotiateID)
 	binary.BigEndian.PutUint64(next[10:18], pkt.sessionID)
-	copy(next[18:length], data)
+	buf.Write(next[:])
+	buf.Write(data)
 
 	// set pkt length
-	binary.BigEndian.PutUint32(hdr[10:14], uint32(length))
-	return append(hdr, next...), nil
+	pkt.PacketHeader.sealTo(buf, start, true)
+	return nil
 }
 
 func (pkt *SessionAckPacket) Decode(data []byte) (uint32, error) {
@@ -181,11 +289,14 @@ func (pkt *SessionAckPacket) Decode(data []byte) (uint32, error) {
 	if len(data) < length {
 		return 0, ErrIncompletePacket
 	}
+	if err := pkt.PacketHeader.verifyChecksum(data[:length]); err != nil {
+		return 0, err
+	}
+	pkt.SessionFlags.decode(data)
 	pkt.negotiateID = binary.BigEndian.Uint64(data[2:10])
 	pkt.sessionID = binary.BigEndian.Uint64(data[10:18])
 	// data
-	snData := &SessionData{}
-	err := json.Unmarshal(data[18:length], snData)
+	snData, err := decodeSessionData(pkt.PacketHeader, data[18:length])
 	if err != nil {
 		log.Errorf("session ack packet decode err: %s", err)
 		return 0, err
@@ -201,11 +312,14 @@ func (pkt *SessionAckPacket) DecodeFromReader(reader io.Reader) error {
 	if err != nil {
 		return err
 	}
+	if err = pkt.PacketHeader.verifyChecksum(data); err != nil {
+		return err
+	}
+	pkt.SessionFlags.decode(data)
 	pkt.negotiateID = binary.BigEndian.Uint64(data[2:10])
 	pkt.sessionID = binary.BigEndian.Uint64(data[10:18])
 	// data
-	snData := &SessionData{}
-	err = json.Unmarshal(data[18:length], snData)
+	snData, err := decodeSessionData(pkt.PacketHeader, data[18:length])
 	if err != nil {
 		log.Errorf("session ack packet decode from reader err: %s", err)
 		return err
@@ -214,6 +328,87 @@ func (pkt *SessionAckPacket) DecodeFromReader(reader io.Reader) error {
 	return nil
 }
 
+// SessionBatchPacket carries several SessionPackets in one write, each
+// encoded as is with its own header, and every one of them is acked by a
+// SessionAckPacket of its own.
+type SessionBatchPacket struct {
+	*PacketHeader
+	Sessions []*SessionPacket
+
+	// the following fields are not encoded into packet
+	basePacket
+}
+
+func (pkt *SessionBatchPacket) Encode() ([]byte, error) {
+	return encodePooled(pkt)
+}
+
+func (pkt *SessionBatchPacket) EncodeTo(buf *bytes.Buffer) error {
+	start := pkt.PacketHeader.encodeHeaderTo(buf)
+	for _, snPkt := range pkt.Sessions {
+		// the sessions are checksummed by themselves
+		if err := snPkt.EncodeTo(buf); err != nil {
+			return err
+		}
+	}
+	// set pkt length
+	pkt.PacketHeader.sealTo(buf, start, false)
+	return nil
+}
+
+func (pkt *SessionBatchPacket) Decode(data []byte) (uint32, error) {
+	length := int(pkt.PacketLen)
+	if len(data) < length {
+		return 0, ErrIncompletePacket
+	}
+	sessions, err := decodeSessions(data[:length])
+	if err != nil {
+		log.Errorf("session batch packet decode err: %s", err)
+		return 0, err
+	}
+	pkt.Sessions = sessions
+	return uint32(length), nil
+}
+
+func (pkt *SessionBatchPacket) DecodeFromReader(reader io.Reader) error {
+	length := int(pkt.PacketLen)
+	data := make([]byte, length)
+	_, err := io.ReadFull(reader, data)
+	if err != nil {
+		return err
+	}
+	sessions, err := decodeSessions(data)
+	if err != nil {
+		log.Errorf("session batch packet decode from reader err: %s", err)
+		return err
+	}
+	pkt.Sessions = sessions
+	return nil
+}
+
+// decodeSessions decodes the SessionPackets back to back until data ends
+func decodeSessions(data []byte) ([]*SessionPacket, error) {
+	sessions := []*SessionPacket{}
+	for len(data) > 0 {
+		pktHdr := &PacketHeader{}
+		hdrLen, err := pktHdr.Decode(data)
+		if err != nil {
+			return nil, err
+		}
+		if pktHdr.Typ != TypeSessionPacket {
+			return nil, ErrIllegalPacket
+		}
+		snPkt := &SessionPacket{PacketHeader: pktHdr}
+		n, err := snPkt.Decode(data[hdrLen:])
+		if err != nil {
+			return nil, err
+		}
+		data = data[hdrLen+n:]
+		sessions = append(sessions, snPkt)
+	}
+	return sessions, nil
+}
+
 type DismissPacket struct {
 	*PacketHeader
 	sessionID   uint64
@@ -232,23 +427,23 @@ func (pkt *DismissPacket) SetSessionID(sessionID uint64) {
 }
 
 func (pkt *DismissPacket) Encode() ([]byte, error) {
-	hdr, err := pkt.PacketHeader.Encode()
-	if err != nil {
-		return nil, err
-	}
-	data, err := json.Marshal(pkt.SessionData)
+	return encodePooled(pkt)
+}
+
+func (pkt *DismissPacket) EncodeTo(buf *bytes.Buffer) error {
+	// data goes first for the header to know if it's compressed
+	data, err := pkt.PacketHeader.encodeSessionData(pkt.SessionData)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	length := len(data) + 8
-	next := make([]byte, length)
+	start := pkt.PacketHeader.encodeHeaderTo(buf)
 	// session id
-	binary.BigEndian.PutUint64(next[:8], pkt.sessionID)
+	writeUint64(buf, pkt.sessionID)
 	// data
-	copy(next[8:length], data)
+	buf.Write(data)
 	// set pkt length
-	binary.BigEndian.PutUint32(hdr[10:14], uint32(length))
-	return append(hdr, next...), nil
+	pkt.PacketHeader.sealTo(buf, start, true)
+	return nil
 }
 
 func (pkt *DismissPacket) Decode(data []byte) (uint32, error) {
@@ -256,11 +451,13 @@ func (pkt *DismissPacket) Decode(data []byte) (uint32, error) {
 	if len(data) < length {
 		return 0, ErrIncompletePacket
 	}
+	if err := pkt.PacketHeader.verifyChecksum(data[:length]); err != nil {
+		return 0, err
+	}
 	// session id
 	pkt.sessionID = binary.BigEndian.Uint64(data[:8])
 	// data
-	disData := &SessionData{}
-	err := json.Unmarshal(data[8:length], disData)
+	disData, err := decodeSessionData(pkt.PacketHeader, data[8:length])
 	if err != nil {
 		log.Errorf("dismiss packet decode err: %s", err)
 		return 0, err
@@ -277,11 +474,13 @@ func (pkt *DismissPacket) DecodeFromReader(reader io.Reader) error {
 		log.Errorf("dismiss packet decode from reader err: %s", err)
 		return err
 	}
+	if err = pkt.PacketHeader.verifyChecksum(data); err != nil {
+		return err
+	}
 	// session id
 	pkt.sessionID = binary.BigEndian.Uint64(data[:8])
 	// data
-	disData := &SessionData{}
-	err = json.Unmarshal(data[8:length], disData)
+	disData, err := decodeSessionData(pkt.PacketHeader, data[8:length])
 	if err != nil {
 		return err
 	}
@@ -307,23 +506,23 @@ func (pkt *DismissAckPacket) SetSessionID(sessionID uint64) {
 }
 
 func (pkt *DismissAckPacket) Encode() ([]byte, error) {
-	hdr, err := pkt.PacketHeader.Encode()
-	if err != nil {
-		return nil, err
-	}
-	data, err := json.Marshal(pkt.SessionData)
+	return encodePooled(pkt)
+}
+
+func (pkt *DismissAckPacket) EncodeTo(buf *bytes.Buffer) error {
+	// data goes first for the header to know if it's compressed
+	data, err := pkt.PacketHeader.encodeSessionData(pkt.SessionData)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	length := len(data) + 8
-	next := make([]byte, length)
+	start := pkt.PacketHeader.encodeHeaderTo(buf)
 	// session id
-	binary.BigEndian.PutUint64(next[:8], pkt.sessionID)
-	copy(next[8:length], data)
-
+	writeUint64(buf, pkt.sessionID)
+	// data
+	buf.Write(data)
 	// set pkt length
-	binary.BigEndian.PutUint32(hdr[10:14], uint32(length))
-	return append(hdr, next...), nil
+	pkt.PacketHeader.sealTo(buf, start, true)
+	return nil
 }
 
 func (pkt *DismissAckPacket) Decode(data []byte) (uint32, error) {
@@ -331,11 +530,13 @@ func (pkt *DismissAckPacket) Decode(data []byte) (uint32, error) {
 	if len(data) < length {
 		return 0, ErrIncompletePacket
 	}
+	if err := pkt.PacketHeader.verifyChecksum(data[:length]); err != nil {
+		return 0, err
+	}
 	// session id
 	pkt.sessionID = binary.BigEndian.Uint64(data[:8])
 	// data
-	disData := &SessionData{}
-	err := json.Unmarshal(data[8:length], disData)
+	disData, err := decodeSessionData(pkt.PacketHeader, data[8:length])
 	if err != nil {
 		return 0, err
 	}
@@ -350,14 +551,209 @@ func (pkt *DismissAckPacket) DecodeFromReader(reader io.Reader) error {
 	if err != nil {
 		return err
 	}
+	if err = pkt.PacketHeader.verifyChecksum(data); err != nil {
+		return err
+	}
 	// session id
 	pkt.sessionID = binary.BigEndian.Uint64(data[0:8])
 	// data
-	disData := &SessionData{}
-	err = json.Unmarshal(data[8:length], disData)
+	disData, err := decodeSessionData(pkt.PacketHeader, data[8:length])
 	if err != nil {
 		return err
 	}
 	pkt.SessionData = disData
 	return nil
 }
+
+// ResetPacket closes the session at once without the dismiss handshake,
+// and no ack is expected.
+type ResetPacket struct {
+	*PacketHeader
+	sessionID   uint64
+	SessionData *SessionData
+
+	// the following fields are not encoded into packet
+	basePacket
+}
+
+func (pkt *ResetPacket) SessionID() uint64 {
+	return pkt.sessionID
+}
+
+func (pkt *ResetPacket) SetSessionID(sessionID uint64) {
+	pkt.sessionID = sessionID
+}
+
+func (pkt *ResetPacket) Encode() ([]byte, error) {
+	return encodePooled(pkt)
+}
+
+func (pkt *ResetPacket) EncodeTo(buf *bytes.Buffer) error {
+	// data goes first for the header to know if it's compressed
+	data, err := pkt.PacketHeader.encodeSessionData(pkt.SessionData)
+	if err != nil {
+		return err
+	}
+	start := pkt.PacketHeader.encodeHeaderTo(buf)
+	// session id
+	writeUint64(buf, pkt.sessionID)
+	// data
+	buf.Write(data)
+	// set pkt length
+	pkt.PacketHeader.sealTo(buf, start, false)
+	return nil
+}
+
+func (pkt *ResetPacket) Decode(data []byte) (uint32, error) {
+	length := int(pkt.PacketLen)
+	if len(data) < length {
+		return 0, ErrIncompletePacket
+	}
+	// session id
+	pkt.sessionID = binary.BigEndian.Uint64(data[:8])
+	// data
+	rstData, err := decodeSessionData(pkt.PacketHeader, data[8:length])
+	if err != nil {
+		log.Errorf("reset packet decode err: %s", err)
+		return 0, err
+	}
+	pkt.SessionData = rstData
+	return uint32(length), nil
+}
+
+func (pkt *ResetPacket) DecodeFromReader(reader io.Reader) error {
+	length := int(pkt.PacketLen)
+	data := make([]byte, length)
+	_, err := io.ReadFull(reader, data)
+	if err != nil {
+		log.Errorf("reset packet decode from reader err: %s", err)
+		return err
+	}
+	// session id
+	pkt.sessionID = binary.BigEndian.Uint64(data[:8])
+	// data
+	rstData, err := decodeSessionData(pkt.PacketHeader, data[8:length])
+	if err != nil {
+		return err
+	}
+	pkt.SessionData = rstData
+	return nil
+}
+
+// SessionHeartbeatPacket checks if the session is alive, it carries nothing
+// but the sessionID.
+type SessionHeartbeatPacket struct {
+	*PacketHeader
+	sessionID uint64
+
+	// the following fields are not encoded into packet
+	basePacket
+}
+
+func (pkt *SessionHeartbeatPacket) SessionID() uint64 {
+	return pkt.sessionID
+}
+
+func (pkt *SessionHeartbeatPacket) SetSessionID(sessionID uint64) {
+	pkt.sessionID = sessionID
+}
+
+func (pkt *SessionHeartbeatPacket) Encode() ([]byte, error) {
+	return encodePooled(pkt)
+}
+
+func (pkt *SessionHeartbeatPacket) EncodeTo(buf *bytes.Buffer) error {
+	encodeSessionIDTo(buf, pkt.PacketHeader, pkt.sessionID)
+	return nil
+}
+
+func (pkt *SessionHeartbeatPacket) Decode(data []byte) (uint32, error) {
+	sessionID, length, err := decodeSessionID(pkt.PacketHeader, data)
+	if err != nil {
+		return 0, err
+	}
+	pkt.sessionID = sessionID
+	return length, nil
+}
+
+func (pkt *SessionHeartbeatPacket) DecodeFromReader(reader io.Reader) error {
+	sessionID, err := decodeSessionIDFromReader(pkt.PacketHeader, reader)
+	if err != nil {
+		return err
+	}
+	pkt.sessionID = sessionID
+	return nil
+}
+
+// SessionHeartbeatAckPacket answers the heartbeat with the same packetID
+type SessionHeartbeatAckPacket struct {
+	*PacketHeader
+	sessionID uint64
+
+	// the following fields are not encoded into packet
+	basePacket
+}
+
+func (pkt *SessionHeartbeatAckPacket) SessionID() uint64 {
+	return pkt.sessionID
+}
+
+func (pkt *SessionHeartbeatAckPacket) SetSessionID(sessionID uint64) {
+	pkt.sessionID = sessionID
+}
+
+func (pkt *SessionHeartbeatAckPacket) Encode() ([]byte, error) {
+	return encodePooled(pkt)
+}
+
+func (pkt *SessionHeartbeatAckPacket) EncodeTo(buf *bytes.Buffer) error {
+	encodeSessionIDTo(buf, pkt.PacketHeader, pkt.sessionID)
+	return nil
+}
+
+func (pkt *SessionHeartbeatAckPacket) Decode(data []byte) (uint32, error) {
+	sessionID, length, err := decodeSessionID(pkt.PacketHeader, data)
+	if err != nil {
+		return 0, err
+	}
+	pkt.sessionID = sessionID
+	return length, nil
+}
+
+func (pkt *SessionHeartbeatAckPacket) DecodeFromReader(reader io.Reader) error {
+	sessionID, err := decodeSessionIDFromReader(pkt.PacketHeader, reader)
+	if err != nil {
+		return err
+	}
+	pkt.sessionID = sessionID
+	return nil
+}
+
+// the packets with only the sessionID as body
+func encodeSessionIDTo(buf *bytes.Buffer, hdr *PacketHeader, sessionID uint64) {
+	start := hdr.encodeHeaderTo(buf)
+	writeUint64(buf, sessionID)
+	// set pkt length
+	hdr.sealTo(buf, start, false)
+}
+
+func decodeSessionID(hdr *PacketHeader, data []byte) (uint64, uint32, error) {
+	length := int(hdr.PacketLen)
+	if len(data) < length || length < 8 {
+		return 0, 0, ErrIncompletePacket
+	}
+	return binary.BigEndian.Uint64(data[:8]), uint32(length), nil
+}
+
+func decodeSessionIDFromReader(hdr *PacketHeader, reader io.Reader) (uint64, error) {
+	length := int(hdr.PacketLen)
+	if length < 8 {
+		return 0, ErrIncompletePacket
+	}
+	data := make([]byte, length)
+	_, err := io.ReadFull(reader, data)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(data[:8]), nil
+}
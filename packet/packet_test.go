@@ -1,8 +1,19 @@
 package packet
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
 	"errors"
+	"io"
+	"math"
+	"math/rand"
+	"reflect"
 	"testing"
+	"time"
+
+	"github.com/singchia/geminio/pkg/id"
 )
 
 func TestPacketHeader(t *testing.T) {
@@ -30,3 +41,888 @@ func TestPacketHeader(t *testing.T) {
 		return
 	}
 }
+
+// the buffer is smaller than a packet, so packets always span buffer refills
+func TestDecodeFromBufferedReader(t *testing.T) {
+	pf := NewPacketFactory(id.NewIDCounter(id.Even))
+	buf := &bytes.Buffer{}
+	pkts := []*MessagePacket{}
+	for i := 0; i < 64; i++ {
+		pkt := pf.NewMessagePacket([]byte("key"), bytes.Repeat([]byte{byte(i)}, i*7))
+		err := EncodeToWriter(pkt, buf)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		pkts = append(pkts, pkt)
+	}
+
+	reader := bufio.NewReaderSize(buf, 16)
+	for _, pkt := range pkts {
+		got, err := DecodeFromReader(reader)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		msgPkt, ok := got.(*MessagePacket)
+		if !ok {
+			t.Errorf("unexpected packet type: %s", got.Type().String())
+			return
+		}
+		if msgPkt.ID() != pkt.ID() || !bytes.Equal(msgPkt.Data.Value, pkt.Data.Value) {
+			t.Error(errors.New("unmatch encode and decode"))
+			return
+		}
+	}
+	_, err := DecodeFromReader(reader)
+	if err != io.EOF {
+		t.Errorf("unexpected err at the end: %v", err)
+	}
+}
+
+// packets of all kinds coalesced in one segment are decoded in order,
+// without reading again
+func TestDecodeCoalescedPackets(t *testing.T) {
+	pf := NewPacketFactory(id.NewIDCounter(id.Even))
+	pkts := []Packet{
+		pf.NewHeartbeatPacket(),
+		pf.NewSessionPacket(1, false, []byte("meta"), "peer"),
+		pf.NewMessagePacket([]byte("key"), []byte("value")),
+		pf.NewRequestPacket([]byte("method"), []byte("request")),
+		pf.NewResponsePacket(1, []byte("method"), []byte("response"), nil),
+		pf.NewDismissPacket(1),
+		pf.NewSessionHeartbeatPacket(1),
+		pf.NewSessionHeartbeatAckPacket(1, 1),
+	}
+	segment := []byte{}
+	for _, pkt := range pkts {
+		data, err := pkt.Encode()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		segment = append(segment, data...)
+	}
+
+	cr := &countReader{reader: bytes.NewReader(segment)}
+	reader := bufio.NewReader(cr)
+	for _, pkt := range pkts {
+		got, err := DecodeFromReader(reader)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if got.Type() != pkt.Type() || got.ID() != pkt.ID() {
+			t.Errorf("unexpected packet: %s %d, expected: %s %d",
+				got.Type().String(), got.ID(), pkt.Type().String(), pkt.ID())
+			return
+		}
+	}
+	if cr.reads != 1 {
+		t.Errorf("unexpected reads: %d", cr.reads)
+	}
+	_, err := DecodeFromReader(reader)
+	if err != io.EOF {
+		t.Errorf("unexpected err at the end: %v", err)
+	}
+}
+
+type countReader struct {
+	reader io.Reader
+	reads  int
+}
+
+func (cr *countReader) Read(p []byte) (int, error) {
+	cr.reads++
+	return cr.reader.Read(p)
+}
+
+func TestPacketFactoryPeekNextID(t *testing.T) {
+	for _, mode := range []id.Mode{id.Even, id.Odd, id.Inc, id.Unique} {
+		pf := NewPacketFactory(id.NewIDCounter(mode))
+		for i := 0; i < 100; i++ {
+			peek := pf.PeekNextID()
+			if pf.PeekNextID() != peek {
+				t.Errorf("peek consumed the ID, mode: %s", mode)
+				return
+			}
+			got := pf.NewPacketID()
+			// the time part may go on between peek and allocation
+			if got != peek && got>>32 == peek>>32 {
+				t.Errorf("mismatch peeked ID: %d, allocated ID: %d, mode: %s", peek, got, mode)
+				return
+			}
+			if uint32(pf.CurrentID()) != uint32(got) {
+				t.Errorf("mismatch current ID: %d, allocated ID: %d, mode: %s", pf.CurrentID(), got, mode)
+				return
+			}
+		}
+	}
+
+	// peeking along with concurrent allocation
+	pf := NewPacketFactory(id.NewIDCounter(id.Odd))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			pf.NewPacketID()
+		}
+	}()
+	for i := 0; i < 1000; i++ {
+		pf.PeekNextID()
+		pf.CurrentID()
+	}
+	<-done
+}
+
+func BenchmarkDecodeFromReader(b *testing.B) {
+	pf := NewPacketFactory(id.NewIDCounter(id.Even))
+	pkt := pf.NewMessagePacket([]byte("key"), make([]byte, 128))
+	data, err := pkt.Encode()
+	if err != nil {
+		b.Error(err)
+		return
+	}
+
+	bench := func(b *testing.B, size int) {
+		cr := &countReader{
+			reader: bytes.NewReader(bytes.Repeat(data, b.N)),
+		}
+		reader := io.Reader(cr)
+		if size > 0 {
+			reader = bufio.NewReaderSize(cr, size)
+		}
+		b.ResetTimer()
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_, err := DecodeFromReader(reader)
+			if err != nil {
+				b.Error(err)
+				return
+			}
+		}
+		b.ReportMetric(float64(cr.reads)/float64(b.N), "reads/op")
+	}
+	b.Run("unbuffered", func(b *testing.B) { bench(b, 0) })
+	b.Run("buffered", func(b *testing.B) { bench(b, 4096) })
+}
+
+func TestPacketHeaderNamespace(t *testing.T) {
+	// single-tenant setups keep the V01 header
+	pf := NewPacketFactory(id.NewIDCounter(id.Even))
+	data, err := pf.NewStreamPacket([]byte("body")).Encode()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if Version(data[0]) != V01 || len(data) != headerLen+8+4 {
+		t.Errorf("unexpected header without namespace, version: %d, length: %d", data[0], len(data))
+		return
+	}
+
+	namespace := uint64(0x7e4a47)
+	pf = NewPacketFactory(id.NewIDCounter(id.Even), OptionPacketFactoryNamespace(namespace))
+	pkt := pf.NewStreamPacketWithSessionID(3, []byte("body"))
+	data, err = pkt.Encode()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	// the routing function reads the namespace from the header only
+	route := func(hdr []byte) uint64 {
+		namespace, err := PeekNamespace(hdr)
+		if err != nil {
+			t.Error(err)
+		}
+		return namespace
+	}
+	if got := route(data[:headerLenV2]); got != namespace {
+		t.Errorf("unexpected routed namespace: %d", got)
+	}
+
+	// and the whole packet round-trips
+	got, err := DecodeFromReader(bytes.NewReader(data))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	streamPkt, ok := got.(*StreamPacket)
+	if !ok {
+		t.Errorf("unexpected packet type: %s", got.Type().String())
+		return
+	}
+	if streamPkt.Namespace != namespace || streamPkt.Version != V02 ||
+		streamPkt.SessionID() != 3 || string(streamPkt.Data) != "body" {
+		t.Error(errors.New("unmatch encode and decode"))
+	}
+	got, _, err = Decode(data)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if got.(*StreamPacket).Namespace != namespace || string(got.(*StreamPacket).Data) != "body" {
+		t.Error(errors.New("unmatch encode and decode"))
+	}
+}
+
+func TestDecodeNullSessionData(t *testing.T) {
+	pf := NewPacketFactory(id.NewIDCounter(id.Even))
+	pkts := []Packet{
+		pf.NewSessionPacket(1, true, nil, ""),
+		pf.NewSessionAckPacket(1, 1, 3, nil),
+		pf.NewDismissPacket(3),
+		pf.NewDismissAckPacket(1, 3, nil),
+		pf.NewResetPacket(3),
+	}
+	sessionData := func(pkt Packet) **SessionData {
+		switch realPkt := pkt.(type) {
+		case *SessionPacket:
+			return &realPkt.SessionData
+		case *SessionAckPacket:
+			return &realPkt.SessionData
+		case *DismissPacket:
+			return &realPkt.SessionData
+		case *DismissAckPacket:
+			return &realPkt.SessionData
+		case *ResetPacket:
+			return &realPkt.SessionData
+		}
+		return nil
+	}
+	for _, pkt := range pkts {
+		// a nil SessionData is encoded as null
+		*sessionData(pkt) = nil
+		null, err := pkt.Encode()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if !bytes.HasSuffix(null, []byte("null")) {
+			t.Errorf("unexpected payload of %s: %q", pkt.Type(), null)
+			return
+		}
+		// and the empty payload
+		empty := append([]byte(nil), null[:len(null)-4]...)
+		binary.BigEndian.PutUint32(empty[10:14], binary.BigEndian.Uint32(empty[10:14])-4)
+
+		for _, data := range [][]byte{null, empty} {
+			decoded, err := DecodeFromReader(bytes.NewReader(data))
+			if err != nil {
+				t.Errorf("decode %s err: %s", pkt.Type(), err)
+				return
+			}
+			snData := *sessionData(decoded)
+			if snData == nil {
+				t.Errorf("nil session data of %s", pkt.Type())
+				return
+			}
+			if snData.Meta != nil || snData.Error != "" || snData.Epoch != 0 {
+				t.Errorf("unexpected session data of %s: %+v", pkt.Type(), snData)
+			}
+		}
+	}
+}
+
+type codedError struct {
+	code int64
+}
+
+func (err codedError) Error() string { return "coded" }
+
+func (err codedError) Code() int64 { return err.code }
+
+func TestSessionErrorCode(t *testing.T) {
+	pf := NewPacketFactory(id.NewIDCounter(id.Even))
+	codes := []int64{0, 1, -1, 1<<53 + 1, -(1<<53 + 1), math.MaxInt64, math.MinInt64}
+	for _, code := range codes {
+		pkt := pf.NewSessionAckPacket(1, 1, 3, codedError{code})
+		data, err := pkt.Encode()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		decoded, err := DecodeFromReader(bytes.NewReader(data))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		snData := decoded.(*SessionAckPacket).SessionData
+		if int64(snData.Code) != code || snData.Error != "coded" {
+			t.Errorf("unexpected code after round-trip: %d, expected: %d", snData.Code, code)
+		}
+	}
+	// peers may send the code quoted or bare, both decoded exactly
+	for payload, code := range map[string]int64{
+		`{"code":"9007199254740993"}`:     1<<53 + 1,
+		`{"code":9007199254740993}`:       1<<53 + 1,
+		`{"code":"-9223372036854775808"}`: math.MinInt64,
+		`{"code":9223372036854775807}`:    math.MaxInt64,
+		`{"code":null}`:                   0,
+		`{}`:                              0,
+	} {
+		snData, err := decodeSessionData(&PacketHeader{}, []byte(payload))
+		if err != nil {
+			t.Errorf("decode %s err: %s", payload, err)
+			continue
+		}
+		if int64(snData.Code) != code {
+			t.Errorf("unexpected code of %s: %d", payload, snData.Code)
+		}
+	}
+	// and encoded as a string
+	data, err := json.Marshal(&SessionData{Code: math.MaxInt64})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if string(data) != `{"code":"9223372036854775807"}` {
+		t.Errorf("unexpected encoded code: %s", data)
+	}
+	if _, err = decodeSessionData(&PacketHeader{}, []byte(`{"code":1.5}`)); err == nil {
+		t.Error("non-integer code decoded")
+	}
+}
+
+// all flags of the packets having them survive encode and decode
+func TestFlagsSymmetric(t *testing.T) {
+	pf := NewPacketFactory(id.NewIDCounter(id.Even))
+	rd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	heartbeats := []Heartbeat{Heartbeat5, Heartbeat20, Heartbeat80, Heartbeat320}
+	sessionFlags := func() SessionFlags {
+		return SessionFlags{
+			Priority:         uint8(rd.Intn(256)),
+			Qos:              int8(rd.Intn(16)),
+			sessionIDAcquire: rd.Intn(2) == 1,
+		}
+	}
+	for i := 0; i < 256; i++ {
+		connPkt := pf.NewConnPacket(rd.Uint64(), rd.Intn(2) == 1,
+			heartbeats[rd.Intn(len(heartbeats))], []byte("meta"))
+		connPkt.ConnFlags.packetIDAcquire = rd.Intn(2) == 1
+		connPkt.ConnFlags.Retain = rd.Intn(2) == 1
+		connPkt.ConnFlags.Clear = rd.Intn(2) == 1
+
+		snPkt := pf.NewSessionPacket(rd.Uint64(), false, []byte("meta"), "peer")
+		snPkt.SessionFlags = sessionFlags()
+
+		snAckPkt := pf.NewSessionAckPacket(rd.Uint64(), rd.Uint64(), rd.Uint64(), nil)
+		snAckPkt.SessionFlags = sessionFlags()
+
+		for _, pkt := range []Packet{connPkt, snPkt, snAckPkt} {
+			data, err := Encode(pkt)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			decoded, _, err := Decode(data)
+			if err != nil {
+				t.Errorf("decode %s err: %s", pkt.Type(), err)
+				return
+			}
+			fromReader, err := DecodeFromReader(bytes.NewReader(data))
+			if err != nil {
+				t.Errorf("decode %s from reader err: %s", pkt.Type(), err)
+				return
+			}
+			// the lengths are only known after encoding, and the consistency
+			// isn't on the wire
+			header := reflect.ValueOf(pkt).Elem().FieldByName("PacketHeader").Interface().(*PacketHeader)
+			header.PacketLen = uint32(len(data) - 14)
+			header.wireLen = uint32(len(data))
+			header.Cnss = 0
+			if !reflect.DeepEqual(pkt, decoded) || !reflect.DeepEqual(pkt, fromReader) {
+				t.Errorf("unmatch encode and decode of %s: %+v, %+v, %+v",
+					pkt.Type(), pkt, decoded, fromReader)
+				return
+			}
+		}
+	}
+}
+
+func TestSessionChecksum(t *testing.T) {
+	for _, opts := range [][]PacketFactoryOption{
+		{OptionPacketFactoryChecksum()},
+		{OptionPacketFactoryChecksum(), OptionPacketFactoryNamespace(7)},
+	} {
+		pf := NewPacketFactory(id.NewIDCounter(id.Even), opts...)
+		pkts := []Packet{
+			pf.NewSessionPacket(1, true, []byte("meta"), "peer"),
+			pf.NewSessionAckPacket(1, 1, 3, errors.New("rejected")),
+			pf.NewDismissPacket(3),
+			pf.NewDismissAckPacket(1, 3, nil),
+		}
+		for _, pkt := range pkts {
+			data, err := Encode(pkt)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if data[0]&versionChecksum == 0 {
+				t.Errorf("checksum flag not set of %s", pkt.Type())
+				return
+			}
+			if _, _, err = Decode(data); err != nil {
+				t.Errorf("decode %s err: %s", pkt.Type(), err)
+				return
+			}
+			if _, err = DecodeFromReader(bytes.NewReader(data)); err != nil {
+				t.Errorf("decode %s from reader err: %s", pkt.Type(), err)
+				return
+			}
+			// corrupt the last byte of the payload
+			data[len(data)-1] ^= 0xFF
+			if _, _, err = Decode(data); err != ErrChecksumMismatch {
+				t.Errorf("unexpected decode err of corrupted %s: %v", pkt.Type(), err)
+			}
+			if _, err = DecodeFromReader(bytes.NewReader(data)); err != ErrChecksumMismatch {
+				t.Errorf("unexpected decode from reader err of corrupted %s: %v", pkt.Type(), err)
+			}
+		}
+	}
+
+	// the header stays as is without checksum
+	pf := NewPacketFactory(id.NewIDCounter(id.Even))
+	data, err := Encode(pf.NewSessionPacket(1, true, nil, ""))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if data[0] != V01 || int(binary.BigEndian.Uint32(data[10:14])) != len(data)-headerLen {
+		t.Errorf("unexpected header without checksum: %v", data[:headerLen])
+	}
+}
+
+func TestSessionCompression(t *testing.T) {
+	meta := bytes.Repeat([]byte("meta"), 256)
+	pf := NewPacketFactory(id.NewIDCounter(id.Even),
+		OptionPacketFactoryCompression(GzipCompressor(), 128), OptionPacketFactoryChecksum())
+	pkts := []Packet{
+		pf.NewSessionPacket(1, true, meta, "peer"),
+		pf.NewSessionAckPacket(1, 1, 3, errors.New(string(meta))),
+	}
+	for _, pkt := range pkts {
+		data, err := Encode(pkt)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if data[0]&versionCompressed == 0 {
+			t.Errorf("compressed flag not set of %s", pkt.Type())
+			return
+		}
+		if len(data) >= len(meta) {
+			t.Errorf("%s not compressed, length: %d", pkt.Type(), len(data))
+		}
+		decoded, _, err := Decode(data)
+		if err != nil {
+			t.Errorf("decode %s err: %s", pkt.Type(), err)
+			return
+		}
+		fromReader, err := DecodeFromReader(bytes.NewReader(data))
+		if err != nil {
+			t.Errorf("decode %s from reader err: %s", pkt.Type(), err)
+			return
+		}
+		switch pkt.(type) {
+		case *SessionPacket:
+			for _, got := range []Packet{decoded, fromReader} {
+				if !bytes.Equal(got.(*SessionPacket).SessionData.Meta, meta) {
+					t.Error("unexpected decompressed meta")
+				}
+			}
+		case *SessionAckPacket:
+			for _, got := range []Packet{decoded, fromReader} {
+				if got.(*SessionAckPacket).SessionData.Error != string(meta) {
+					t.Error("unexpected decompressed error")
+				}
+			}
+		}
+	}
+
+	// the small ones are kept as is, which the peers without compression decode
+	data, err := Encode(pf.NewDismissPacket(3))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if data[0]&versionCompressed != 0 {
+		t.Error("compressed flag set below the threshold")
+	}
+	if _, _, err = Decode(data); err != nil {
+		t.Errorf("decode uncompressed err: %s", err)
+	}
+
+	// the compressor ID follows the session flags and negotiate id
+	pf = NewPacketFactory(id.NewIDCounter(id.Even),
+		OptionPacketFactoryCompression(GzipCompressor(), 0))
+	data, err = Encode(pf.NewSessionPacket(1, true, meta, "peer"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	data[headerLen+10] = 0xFF
+	if _, _, err = Decode(data); err != ErrUnknownCompressor {
+		t.Errorf("unexpected decode err of unknown compressor: %v", err)
+	}
+}
+
+func TestMessageCompression(t *testing.T) {
+	value := bytes.Repeat([]byte("value"), 256)
+	pf := NewPacketFactory(id.NewIDCounter(id.Even))
+	pkts := []Packet{
+		pf.NewMessagePacket(nil, value),
+		pf.NewRequestPacket([]byte("method"), value),
+		pf.NewResponsePacket(1, []byte("method"), value, nil),
+	}
+	builtins := []Compressor{GzipCompressor(), SnappyCompressor(), ZstdCompressor()}
+	for i, pkt := range append(append(pkts, pkts...), pkts...) {
+		// by each of the built-in ones
+		compressor := builtins[i/len(pkts)]
+		SetCompression(pkt, compressor, 128)
+		data, err := Encode(pkt)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if data[0]&versionCompressed == 0 || len(data) >= len(value) {
+			t.Errorf("%s not compressed by %s, length: %d", pkt.Type(), CompressorName(compressor.ID()), len(data))
+			continue
+		}
+		decoded, _, err := Decode(data)
+		if err != nil {
+			t.Errorf("decode %s err: %s", pkt.Type(), err)
+			continue
+		}
+		fromReader, err := DecodeFromReader(bytes.NewReader(data))
+		if err != nil {
+			t.Errorf("decode %s from reader err: %s", pkt.Type(), err)
+			continue
+		}
+		for _, got := range []Packet{decoded, fromReader} {
+			var msgData *MessageData
+			switch realPkt := got.(type) {
+			case *MessagePacket:
+				msgData = realPkt.Data
+			case *RequestPacket:
+				msgData = realPkt.Data
+			case *ResponsePacket:
+				msgData = realPkt.Data
+			}
+			if msgData == nil || !bytes.Equal(msgData.Value, value) {
+				t.Errorf("unexpected decompressed value of %s", got.Type())
+			}
+		}
+	}
+
+	// the small ones are kept as is
+	pkt := pf.NewMessagePacket(nil, []byte("small"))
+	SetCompression(pkt, GzipCompressor(), 128)
+	data, err := Encode(pkt)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if data[0]&versionCompressed != 0 {
+		t.Error("compressed flag set below the threshold")
+	}
+}
+
+func TestNegotiateCompressor(t *testing.T) {
+	cases := []struct {
+		ours   []byte
+		theirs []byte
+		want   string
+	}{
+		{[]byte{CompressorGzip, CompressorZstd}, []byte{CompressorZstd, CompressorGzip}, "zstd"},
+		{[]byte{CompressorGzip, CompressorZstd}, []byte{CompressorGzip}, "gzip"},
+		{[]byte{CompressorGzip, CompressorSnappy}, []byte{CompressorGzip, CompressorSnappy}, "snappy"},
+		{[]byte{CompressorGzip, CompressorSnappy, CompressorZstd}, []byte{CompressorSnappy, CompressorZstd}, "zstd"},
+		{[]byte{CompressorSnappy}, []byte{CompressorGzip}, CompressionNone},
+		{[]byte{CompressorGzip}, nil, CompressionNone},
+	}
+	for _, c := range cases {
+		capabilities := append([]string{"other"}, CompressionCapabilities(c.theirs)...)
+		got := CompressionNone
+		if compressor, ok := NegotiateCompressor(c.ours, capabilities); ok {
+			got = CompressorName(compressor.ID())
+		}
+		if got != c.want {
+			t.Errorf("unexpected negotiated of ours: %v, theirs: %v, got: %s, want: %s",
+				c.ours, c.theirs, got, c.want)
+		}
+	}
+}
+
+// binaryCodec lays the session data out as the length prefixed fields, for
+// the codec tests only
+type binaryCodec struct{}
+
+func (binaryCodec) ID() byte { return 0x10 }
+
+func (binaryCodec) Marshal(v interface{}) ([]byte, error) {
+	snData := v.(*SessionData)
+	data := make([]byte, 0, len(snData.Meta)+len(snData.Error)+len(snData.Peer)+28)
+	for _, field := range [][]byte{snData.Meta, []byte(snData.Error), []byte(snData.Peer)} {
+		data = binary.BigEndian.AppendUint32(data, uint32(len(field)))
+		data = append(data, field...)
+	}
+	data = binary.BigEndian.AppendUint64(data, uint64(snData.Code))
+	return binary.BigEndian.AppendUint64(data, snData.Epoch), nil
+}
+
+func (binaryCodec) Unmarshal(data []byte, v interface{}) error {
+	snData := v.(*SessionData)
+	fields := make([][]byte, 3)
+	for i := range fields {
+		if len(data) < 4 || len(data)-4 < int(binary.BigEndian.Uint32(data)) {
+			return ErrIncompletePacket
+		}
+		length := binary.BigEndian.Uint32(data)
+		if length > 0 {
+			fields[i] = data[4 : 4+length]
+		}
+		data = data[4+length:]
+	}
+	if len(data) < 16 {
+		return ErrIncompletePacket
+	}
+	snData.Meta, snData.Error, snData.Peer = fields[0], string(fields[1]), string(fields[2])
+	snData.Code = ErrorCode(binary.BigEndian.Uint64(data[:8]))
+	snData.Epoch = binary.BigEndian.Uint64(data[8:16])
+	return nil
+}
+
+func TestSessionCodec(t *testing.T) {
+	RegisterCodec(binaryCodec{})
+	pf := NewPacketFactory(id.NewIDCounter(id.Even), OptionPacketFactoryCodec(binaryCodec{}))
+	rejected := errors.New("rejected")
+	pkts := []Packet{
+		pf.NewSessionPacket(1, true, []byte("meta"), "peer"),
+		pf.NewSessionAckPacket(1, 1, 3, rejected),
+		pf.NewDismissPacket(3),
+		pf.NewDismissAckPacket(1, 3, rejected),
+	}
+	pkts[0].(*SessionPacket).SessionData.Epoch = 5
+	for _, pkt := range pkts {
+		data, err := Encode(pkt)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if data[0]&versionCoded == 0 {
+			t.Errorf("coded flag not set of %s", pkt.Type())
+			return
+		}
+		decoded, _, err := Decode(data)
+		if err != nil {
+			t.Errorf("decode %s err: %s", pkt.Type(), err)
+			return
+		}
+		fromReader, err := DecodeFromReader(bytes.NewReader(data))
+		if err != nil {
+			t.Errorf("decode %s from reader err: %s", pkt.Type(), err)
+			return
+		}
+		expected := reflect.ValueOf(pkt).Elem().FieldByName("SessionData").Interface()
+		for _, got := range []Packet{decoded, fromReader} {
+			snData := reflect.ValueOf(got).Elem().FieldByName("SessionData").Interface()
+			if !reflect.DeepEqual(snData, expected) {
+				t.Errorf("unexpected session data of %s: %+v", pkt.Type(), snData)
+			}
+		}
+	}
+
+	// the codec ID follows the session id
+	data, err := Encode(pf.NewDismissPacket(3))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	data[headerLen+8] = 0xFF
+	if _, _, err = Decode(data); err != ErrUnknownCodec {
+		t.Errorf("unexpected decode err of unknown codec: %v", err)
+	}
+}
+
+func BenchmarkSessionCodec(b *testing.B) {
+	RegisterCodec(binaryCodec{})
+	meta := bytes.Repeat([]byte("m"), 4096)
+	bench := func(b *testing.B, opts ...PacketFactoryOption) {
+		pf := NewPacketFactory(id.NewIDCounter(id.Even), opts...)
+		pkt := pf.NewSessionPacket(1, true, meta, "peer")
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			data, err := Encode(pkt)
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			if _, _, err = Decode(data); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	}
+	b.Run("json", func(b *testing.B) { bench(b) })
+	b.Run("binary", func(b *testing.B) { bench(b, OptionPacketFactoryCodec(binaryCodec{})) })
+}
+
+func TestSessionIDAcquireRoundTrip(t *testing.T) {
+	pf := NewPacketFactory(id.NewIDCounter(id.Even))
+	for _, acquire := range []bool{true, false} {
+		pkt := pf.NewSessionPacket(1, acquire, nil, "")
+		// the QoS shares the byte with the acquire bit, only 4 bits are kept
+		pkt.SessionFlags.Qos = 0x7F
+		// the resume bit follows the acquire bit
+		if acquire {
+			pkt.SetResume(42)
+		}
+		data, err := Encode(pkt)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		decoded, _, err := Decode(data)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		fromReader, err := DecodeFromReader(bytes.NewReader(data))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		for _, got := range []*SessionPacket{decoded.(*SessionPacket), fromReader.(*SessionPacket)} {
+			if got.SessionIDAcquire() != acquire {
+				t.Errorf("unexpected acquire: %t, expected: %t", got.SessionIDAcquire(), acquire)
+			}
+			if got.SessionFlags.Qos != 0x0F {
+				t.Errorf("unexpected qos: %d", got.SessionFlags.Qos)
+			}
+			if resumeID, resume := got.Resume(); resume != acquire || (resume && resumeID != 42) {
+				t.Errorf("unexpected resume: %t, resumeID: %d", resume, resumeID)
+			}
+		}
+	}
+}
+
+func TestSessionBatchRoundTrip(t *testing.T) {
+	pf := NewPacketFactory(id.NewIDCounter(id.Even), OptionPacketFactoryChecksum())
+	sessions := []*SessionPacket{}
+	for i := 0; i < 3; i++ {
+		pkt := pf.NewSessionPacket(uint64(i+1), true, []byte("batched"), "peer")
+		sessions = append(sessions, pkt)
+	}
+	data, err := Encode(pf.NewSessionBatchPacket(sessions))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, _, err := Decode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromReader, err := DecodeFromReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, got := range []*SessionBatchPacket{decoded.(*SessionBatchPacket), fromReader.(*SessionBatchPacket)} {
+		if !SessionLayer(got) {
+			t.Error("session batch packet not at the session layer")
+		}
+		if len(got.Sessions) != len(sessions) {
+			t.Fatalf("unexpected sessions: %d", len(got.Sessions))
+		}
+		for i, snPkt := range got.Sessions {
+			if snPkt.ID() != sessions[i].ID() || snPkt.NegotiateID() != uint64(i+1) ||
+				!snPkt.SessionIDAcquire() || string(snPkt.SessionData.Meta) != "batched" ||
+				snPkt.SessionData.Peer != "peer" {
+				t.Errorf("unexpected session %d: %+v", i, snPkt)
+			}
+		}
+	}
+
+	// anything but sessions inside is illegal
+	batch := pf.NewSessionBatchPacket(nil)
+	buf := &bytes.Buffer{}
+	start := batch.PacketHeader.encodeHeaderTo(buf)
+	if err = pf.NewStreamPacket([]byte("stream")).EncodeTo(buf); err != nil {
+		t.Fatal(err)
+	}
+	batch.PacketHeader.sealTo(buf, start, false)
+	if _, _, err = Decode(buf.Bytes()); err != ErrIllegalPacket {
+		t.Errorf("unexpected err of a stream inside: %v", err)
+	}
+}
+
+func TestEncodeTo(t *testing.T) {
+	for _, opts := range [][]PacketFactoryOption{
+		nil,
+		{OptionPacketFactoryNamespace(7), OptionPacketFactoryChecksum()},
+	} {
+		pf := NewPacketFactory(id.NewIDCounter(id.Even), opts...)
+		pkts := []Packet{
+			pf.NewSessionPacket(1, true, []byte("meta"), "peer"),
+			pf.NewDismissPacket(2),
+			pf.NewSessionHeartbeatPacket(2),
+			pf.NewMessagePacketWithSessionID(2, []byte("key"), []byte("value"), nil),
+			pf.NewStreamPacketWithSessionID(2, []byte("stream")),
+			pf.NewRequestPacketWithIDAndSessionID(3, 2, []byte("method"), []byte("req")),
+		}
+		// appended after the packets encoded before, as the pooled buffer
+		buf := &bytes.Buffer{}
+		for _, pkt := range pkts {
+			data, err := pkt.Encode()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			start := buf.Len()
+			if err = pkt.EncodeTo(buf); err != nil {
+				t.Error(err)
+				return
+			}
+			if !bytes.Equal(buf.Bytes()[start:], data) {
+				t.Errorf("unexpected EncodeTo of %s", pkt.Type())
+			}
+		}
+		for _, pkt := range pkts {
+			decoded, err := DecodeFromReader(buf)
+			if err != nil {
+				t.Errorf("decode %s err: %s", pkt.Type(), err)
+				return
+			}
+			if decoded.Type() != pkt.Type() || decoded.ID() != pkt.ID() {
+				t.Errorf("unexpected packet decoded: %s, expected: %s", decoded.Type(), pkt.Type())
+			}
+		}
+	}
+}
+
+func BenchmarkEncode(b *testing.B) {
+	pf := NewPacketFactory(id.NewIDCounter(id.Even))
+	pkts := map[string]Packet{
+		"session": pf.NewSessionPacket(1, true, []byte("meta"), "peer"),
+		"stream":  pf.NewStreamPacketWithSessionID(2, make([]byte, 1024)),
+	}
+	for name, pkt := range pkts {
+		pkt := pkt
+		b.Run(name+"/Encode", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := pkt.Encode(); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		})
+		b.Run(name+"/EncodeToWriter", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if err := EncodeToWriter(pkt, io.Discard); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		})
+	}
+}
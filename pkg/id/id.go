@@ -2,6 +2,7 @@ package id
 
 import (
 	"crypto/rand"
+	"encoding/binary"
 	"io"
 	"math"
 	"sync"
@@ -24,7 +25,8 @@ var (
 
 type IDCounter struct {
 	counter uint32
-	once    *sync.Once
+	// set once any ID reserved, the counting modes skip the reserved ones
+	reserved int32
 
 	ids  map[uint64]struct{}
 	mtx  sync.RWMutex
@@ -34,13 +36,15 @@ type IDCounter struct {
 func NewIDCounter(mode Mode) *IDCounter {
 	idCounter := &IDCounter{
 		counter: 0,
-		once:    new(sync.Once),
 		ids:     make(map[uint64]struct{}),
 		mode:    mode,
 	}
 	if mode == Even || mode == Odd || mode == Inc {
 		idCounter.counter = randomUint32()
 	}
+	if mode == Odd {
+		idCounter.counter++
+	}
 	return idCounter
 }
 
@@ -48,22 +52,18 @@ func (idCounter *IDCounter) ReserveID(id uint64) {
 	idCounter.mtx.Lock()
 	defer idCounter.mtx.Unlock()
 	idCounter.ids[id] = struct{}{}
+	atomic.StoreInt32(&idCounter.reserved, 1)
 }
 
 func (idCounter *IDCounter) GetID() uint64 {
 	switch idCounter.mode {
-	case Even:
-		return uint64(time.Now().Unix()<<32) +
-			uint64(atomic.AddUint32(&idCounter.counter, 2))
-	case Odd:
-		idCounter.once.Do(func() {
-			atomic.AddUint32(&idCounter.counter, 1)
-		})
-		return uint64(time.Now().Unix()<<32) +
-			uint64(atomic.AddUint32(&idCounter.counter, 2))
-	case Inc:
-		return uint64(time.Now().Unix()<<32) +
-			uint64(atomic.AddUint32(&idCounter.counter, 1))
+	case Even, Odd, Inc:
+		for {
+			id := idCounter.nextID()
+			if !idCounter.isReserved(id) {
+				return id
+			}
+		}
 	case Unique:
 		idCounter.mtx.Lock()
 		for i := uint64(1); i < math.MaxUint64; i++ {
@@ -79,23 +79,100 @@ func (idCounter *IDCounter) GetID() uint64 {
 	return 0
 }
 
-func (idCounter *IDCounter) GetIDByMeta(meta []byte) (uint64, error) {
-	return idCounter.GetID(), nil
+func (idCounter *IDCounter) nextID() uint64 {
+	delta := uint32(2)
+	if idCounter.mode == Inc {
+		delta = 1
+	}
+	return uint64(time.Now().Unix()<<32) +
+		uint64(atomic.AddUint32(&idCounter.counter, delta))
 }
 
-func (idCounter *IDCounter) DelID(i uint64) {
+func (idCounter *IDCounter) isReserved(id uint64) bool {
+	if atomic.LoadInt32(&idCounter.reserved) == 0 {
+		return false
+	}
+	idCounter.mtx.RLock()
+	defer idCounter.mtx.RUnlock()
+	_, ok := idCounter.ids[id]
+	return ok
+}
+
+// PeekID returns the ID the next GetID would return without consuming it,
+// the time part is of the moment peeking, and a concurrent GetID may take
+// the ID first.
+func (idCounter *IDCounter) PeekID() uint64 {
 	switch idCounter.mode {
+	case Even, Odd:
+		return uint64(time.Now().Unix()<<32) +
+			uint64(atomic.LoadUint32(&idCounter.counter)+2)
+	case Inc:
+		return uint64(time.Now().Unix()<<32) +
+			uint64(atomic.LoadUint32(&idCounter.counter)+1)
 	case Unique:
-		idCounter.mtx.Lock()
-		delete(idCounter.ids, i)
-		idCounter.mtx.Unlock()
+		idCounter.mtx.RLock()
+		defer idCounter.mtx.RUnlock()
+		for i := uint64(1); i < math.MaxUint64; i++ {
+			_, ok := idCounter.ids[i]
+			if !ok {
+				return i
+			}
+		}
 	}
+	return 0
+}
+
+// CurrentID returns the position of the counter, which is the ID
+// the last GetID returned, the time part is of the moment calling. For
+// the Unique mode, it's the greatest ID in use.
+func (idCounter *IDCounter) CurrentID() uint64 {
+	switch idCounter.mode {
+	case Even, Odd, Inc:
+		return uint64(time.Now().Unix()<<32) +
+			uint64(atomic.LoadUint32(&idCounter.counter))
+	case Unique:
+		idCounter.mtx.RLock()
+		defer idCounter.mtx.RUnlock()
+		max := uint64(0)
+		for i := range idCounter.ids {
+			if i > max {
+				max = i
+			}
+		}
+		return max
+	}
+	return 0
+}
+
+func (idCounter *IDCounter) GetIDByMeta(meta []byte) (uint64, error) {
+	return idCounter.GetID(), nil
+}
+
+// DelID releases the ID got in the Unique mode, or the reserved one
+func (idCounter *IDCounter) DelID(i uint64) {
+	idCounter.mtx.Lock()
+	delete(idCounter.ids, i)
+	idCounter.mtx.Unlock()
 }
 
 func (idCounter *IDCounter) Close() {
 	idCounter.ids = nil
 }
 
+// RandomUint64 returns a non-zero random number
+func RandomUint64() uint64 {
+	var b [8]byte
+	_, err := io.ReadFull(rand.Reader, b[:])
+	if err != nil {
+		return uint64(time.Now().UnixNano()) | 1
+	}
+	num := binary.BigEndian.Uint64(b[:])
+	if num == 0 {
+		num = 1
+	}
+	return num
+}
+
 func randomUint32() uint32 {
 	var b [4]byte
 	_, err := io.ReadFull(rand.Reader, b[:])
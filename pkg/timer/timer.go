@@ -0,0 +1,119 @@
+package timer
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/singchia/go-timer/v2"
+)
+
+const (
+	defaultWatchInterval = time.Second
+	// the shared timer missing this many heartbeats is taken as failed
+	missedBeats = 3
+)
+
+// Timer wraps the shared timer and watches it by heartbeats, while the
+// shared timer is failing to fire them, like stuck in contention or closed
+// under the feet, the ticks are added to a fallback timer of its own, so the
+// timeouts never silently stop working. The fallback is a timer rather than
+// time.AfterFunc since the tick options can't be seen through.
+type Timer struct {
+	timer.Timer
+	interval time.Duration
+
+	// unix nano of the last heartbeat fired by the shared timer
+	lastBeat  int64
+	fallbacks uint64
+
+	mtx      sync.Mutex
+	fallback timer.Timer
+	stopped  bool
+	stopCh   chan struct{}
+}
+
+// New wraps the tmr, and the heartbeats are added every interval, which is
+// 1s if not positive.
+func New(tmr timer.Timer, interval time.Duration) *Timer {
+	if interval <= 0 {
+		interval = defaultWatchInterval
+	}
+	t := &Timer{
+		Timer:    tmr,
+		interval: interval,
+		lastBeat: time.Now().UnixNano(),
+		stopCh:   make(chan struct{}),
+	}
+	go t.watch()
+	return t
+}
+
+func (t *Timer) watch() {
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			// a heartbeat errored, like the shared timer closed, isn't counted
+			t.Timer.Add(t.interval, timer.WithHandler(func(event *timer.Event) {
+				if event.Error == nil {
+					atomic.StoreInt64(&t.lastBeat, time.Now().UnixNano())
+				}
+			}))
+		case <-t.stopCh:
+			return
+		}
+	}
+}
+
+func (t *Timer) failing() bool {
+	lastBeat := atomic.LoadInt64(&t.lastBeat)
+	// a heartbeat fires an interval after being added an interval later
+	return time.Since(time.Unix(0, lastBeat)) > (missedBeats+1)*t.interval
+}
+
+func (t *Timer) Add(d time.Duration, opts ...timer.TickOption) timer.Tick {
+	if !t.failing() {
+		return t.Timer.Add(d, opts...)
+	}
+	t.mtx.Lock()
+	if t.stopped {
+		t.mtx.Unlock()
+		return t.Timer.Add(d, opts...)
+	}
+	if t.fallback == nil {
+		t.fallback = timer.NewTimer()
+	}
+	fallback := t.fallback
+	t.mtx.Unlock()
+	atomic.AddUint64(&t.fallbacks, 1)
+	return fallback.Add(d, opts...)
+}
+
+// Fallbacks returns how many ticks were added to the fallback timer
+func (t *Timer) Fallbacks() uint64 {
+	return atomic.LoadUint64(&t.fallbacks)
+}
+
+// Stop stops watching and closes the fallback timer, the shared timer is
+// left to its owner.
+func (t *Timer) Stop() {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if t.stopped {
+		return
+	}
+	t.stopped = true
+	close(t.stopCh)
+	if t.fallback != nil {
+		t.fallback.Close()
+		t.fallback = nil
+	}
+}
+
+// Close stops watching and closes both the fallback and the shared timer
+func (t *Timer) Close() {
+	t.Stop()
+	t.Timer.Close()
+}
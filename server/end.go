@@ -10,7 +10,6 @@ import (
 	"github.com/singchia/geminio/multiplexer"
 	"github.com/singchia/geminio/packet"
 	"github.com/singchia/geminio/pkg/id"
-	"github.com/singchia/go-timer/v2"
 )
 
 type ServerEnd struct {
@@ -31,7 +30,7 @@ func new(netcn net.Conn, opts ...*EndOptions) (geminio.End, error) {
 		opts: eo,
 	}
 	if eo.Timer == nil {
-		eo.Timer = timer.NewTimer()
+		eo.Timer = eo.newTimer()
 		eo.TimerOwner = se
 	}
 	var (
@@ -39,6 +38,7 @@ func new(netcn net.Conn, opts ...*EndOptions) (geminio.End, error) {
 		// connection
 		cn     conn.Conn
 		cnOpts []conn.ServerConnOption
+		cnDlgt conn.ServerConnDelegate
 		// multiplexer
 		mp       multiplexer.Multiplexer
 		mpOpts   []multiplexer.MultiplexerOption
@@ -51,16 +51,44 @@ func new(netcn net.Conn, opts ...*EndOptions) (geminio.End, error) {
 	// we share packet factory, log, timer and delegate for follow 3 layers.
 
 	// connection layer
+	cnDlgt = eo.Delegate
+	if eo.Sessions != nil {
+		cnDlgt = &sessionDelegate{ServerConnDelegate: cnDlgt, sessions: eo.Sessions}
+	}
 	cnOpts = []conn.ServerConnOption{
 		conn.OptionServerConnPacketFactory(eo.PacketFactory),
-		conn.OptionServerConnDelegate(eo.Delegate),
+		conn.OptionServerConnDelegate(cnDlgt),
 		conn.OptionServerConnLogger(eo.Log),
 		conn.OptionServerConnTimer(eo.Timer),
 	}
 	if eo.ClientID != nil {
 		cnOpts = append(cnOpts, conn.OptionServerConnClientID(*eo.ClientID))
 	}
+	if eo.BandwidthLimit != nil {
+		cnOpts = append(cnOpts, conn.OptionServerConnBandwidthLimit(
+			eo.BandwidthLimit.BytesPerSec, eo.BandwidthLimit.Burst))
+	}
+	if eo.DropObserver != nil {
+		cnOpts = append(cnOpts, conn.OptionServerConnDropObserver(eo.DropObserver))
+	}
+	if eo.Capabilities != nil {
+		cnOpts = append(cnOpts, conn.OptionServerConnCapabilities(eo.Capabilities...))
+	}
+	if eo.Compression != nil {
+		cnOpts = append(cnOpts, conn.OptionServerConnCompression(eo.Compression.Threshold,
+			eo.Compression.Compressors...))
+	}
+	if eo.FailureDetector != nil {
+		cnOpts = append(cnOpts, conn.OptionServerConnFailureDetector(eo.FailureDetector))
+	}
+	if eo.Handshakes != nil {
+		// throttle the handshakes in case of reconnection storms
+		eo.Handshakes <- struct{}{}
+	}
 	cn, err = conn.NewServerConn(netcn, cnOpts...)
+	if eo.Handshakes != nil {
+		<-eo.Handshakes
+	}
 	if err != nil {
 		goto ERR
 	}
@@ -90,6 +118,19 @@ func new(netcn net.Conn, opts ...*EndOptions) (geminio.End, error) {
 	if eo.ClosedStreamFunc != nil {
 		mpOpts = append(mpOpts, multiplexer.OptionMultiplexerClosedFunc(closedfn))
 	}
+	if eo.WriteCoalesce != nil {
+		mpOpts = append(mpOpts, multiplexer.OptionMultiplexerWriteCoalesce(
+			eo.WriteCoalesce.Delay, eo.WriteCoalesce.Size))
+	}
+	if eo.AuditSink != nil {
+		mpOpts = append(mpOpts, multiplexer.OptionMultiplexerAuditSink(eo.AuditSink))
+	}
+	if eo.DropObserver != nil {
+		mpOpts = append(mpOpts, multiplexer.OptionMultiplexerDropObserver(eo.DropObserver))
+	}
+	if eo.SessionIDAllocator != nil {
+		mpOpts = append(mpOpts, multiplexer.OptionMultiplexerSessionIDAllocator(eo.SessionIDAllocator))
+	}
 	mp, err = multiplexer.NewDialogueMgr(cn, mpOpts...)
 	if err != nil {
 		goto ERR
@@ -112,11 +153,38 @@ func new(netcn net.Conn, opts ...*EndOptions) (geminio.End, error) {
 	if eo.RemoteMethodCheck {
 		epOpts = append(epOpts, application.OptionWithRemoteRPCCheck())
 	}
+	if eo.WorkerPool != nil {
+		epOpts = append(epOpts, application.OptionWorkerPool(eo.WorkerPool.Size,
+			eo.WorkerPool.Queue, eo.WorkerPool.Policy))
+	}
+	if eo.FiniGrace != nil {
+		epOpts = append(epOpts, application.OptionFiniGrace(*eo.FiniGrace))
+	}
+	if eo.ConnIdleTimeout != nil {
+		epOpts = append(epOpts, application.OptionConnIdleTimeout(*eo.ConnIdleTimeout))
+	}
+	if eo.DropObserver != nil {
+		epOpts = append(epOpts, application.OptionDropObserver(eo.DropObserver))
+	}
+	if eo.AckAggregation != nil {
+		epOpts = append(epOpts, application.OptionAckAggregation(eo.AckAggregation.Count,
+			eo.AckAggregation.Interval))
+	}
+	if eo.MessageRetransmit != nil {
+		epOpts = append(epOpts, application.OptionMessageRetransmit(eo.MessageRetransmit.Interval,
+			eo.MessageRetransmit.Attempts))
+	}
+	if eo.Authorizer != nil {
+		epOpts = append(epOpts, application.OptionAuthorizer(eo.Authorizer))
+	}
 	ep, err = application.NewEnd(cn, mp, epOpts...)
 	if err != nil {
 		goto ERR
 	}
 	se.End = ep
+	if eo.Sessions != nil {
+		eo.Sessions.bind(cn, se)
+	}
 	return se, nil
 ERR:
 	if eo.TimerOwner == se {
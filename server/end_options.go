@@ -1,10 +1,15 @@
 package server
 
 import (
+	"time"
+
 	"github.com/jumboframes/armorigo/log"
 
 	"github.com/singchia/geminio"
+	"github.com/singchia/geminio/application"
+	"github.com/singchia/geminio/conn"
 	"github.com/singchia/geminio/delegate"
+	"github.com/singchia/geminio/multiplexer"
 	"github.com/singchia/geminio/packet"
 	"github.com/singchia/go-timer/v2"
 )
@@ -22,6 +27,70 @@ type EndOptions struct {
 	// If set AcceptStreamFunc, the AcceptStream should never be called
 	AcceptStreamFunc func(geminio.Stream)
 	ClosedStreamFunc func(geminio.Stream)
+	WorkerPool       *WorkerPool
+	// Handshakes bounds the in-progress handshakes of all ends sharing it
+	Handshakes        chan struct{}
+	WriteCoalesce     *WriteCoalesce
+	AckAggregation    *AckAggregation
+	MessageRetransmit *MessageRetransmit
+	FiniGrace         *time.Duration
+	ConnIdleTimeout   *time.Duration
+	BandwidthLimit    *BandwidthLimit
+	TimerGranularity  *time.Duration
+	AuditSink         multiplexer.AuditSink
+	DropObserver      packet.DropObserver
+	Capabilities      []string
+	Compression       *Compression
+	Authorizer        func(clientID uint64, method string) error
+	// SessionIDAllocator assigns the streamIDs, nil means the local counter
+	SessionIDAllocator multiplexer.SessionIDAllocator
+	// Sessions applies the SessionPerClient policy to all ends sharing it
+	Sessions *Sessions
+	// FailureDetector creates the detector of every conn, nil means the
+	// missed heartbeat counter
+	FailureDetector conn.NewFailureDetector
+}
+
+// AckAggregation batches the acks of received messages, they are flushed
+// once Count of them pending or Interval passed since the first pending.
+type AckAggregation struct {
+	Count    int
+	Interval time.Duration
+}
+
+// MessageRetransmit resends the unacked messages every Interval, until sent
+// Attempts times in total.
+type MessageRetransmit struct {
+	Interval time.Duration
+	Attempts int
+}
+
+// Compression is negotiated with the peer at connecting, the best of the
+// Compressors in common compresses the message data reaching Threshold.
+type Compression struct {
+	Threshold   int
+	Compressors []byte
+}
+
+// WriteCoalesce holds data packets of the bulk streams for at most Delay,
+// and writes them down together, Size limits the packets of a batch.
+type WriteCoalesce struct {
+	Delay time.Duration
+	Size  int
+}
+
+// BandwidthLimit caps the bytes written per second of the conn, Burst is
+// the bytes allowed at once.
+type BandwidthLimit struct {
+	BytesPerSec int
+	Burst       int
+}
+
+// WorkerPool bounds the goroutines running local RPCs
+type WorkerPool struct {
+	Size   int
+	Queue  int
+	Policy application.WorkerPoolPolicy
 }
 
 func (eo *EndOptions) SetTimer(timer timer.Timer) {
@@ -29,6 +98,20 @@ func (eo *EndOptions) SetTimer(timer timer.Timer) {
 	eo.TimerOwner = nil
 }
 
+// SetTimerGranularity sets the tick granularity of the timer created by the
+// End, the default is 10ms, it takes no effect with SetTimer. Timeouts are
+// rounded up to whole ticks and fire within one tick past due.
+func (eo *EndOptions) SetTimerGranularity(granularity time.Duration) {
+	eo.TimerGranularity = &granularity
+}
+
+func (eo *EndOptions) newTimer() timer.Timer {
+	if eo.TimerGranularity == nil || *eo.TimerGranularity <= 0 {
+		return timer.NewTimer()
+	}
+	return timer.NewTimer(timer.WithTimeInterval(*eo.TimerGranularity))
+}
+
 func (eo *EndOptions) SetPacketFactory(packetFactory packet.PacketFactory) {
 	eo.PacketFactory = packetFactory
 }
@@ -65,6 +148,136 @@ func (eo *EndOptions) SetClosedStreamFunc(fn func(geminio.Stream)) {
 	eo.ClosedStreamFunc = fn
 }
 
+// SetWorkerPool sets local RPCs to be run by size workers, at most queue
+// requests wait for a free worker, and the policy decides whether to block
+// the stream or reply application.ErrServerBusy when the queue is full.
+func (eo *EndOptions) SetWorkerPool(size, queue int, policy application.WorkerPoolPolicy) {
+	eo.WorkerPool = &WorkerPool{
+		Size:   size,
+		Queue:  queue,
+		Policy: policy,
+	}
+}
+
+// SetMaxConcurrentHandshakes bounds the in-progress handshakes, including
+// the delegate's GetClientID, of all ends created by the options to n.
+// Handshakes beyond it are queued until a former one finishes.
+func (eo *EndOptions) SetMaxConcurrentHandshakes(n int) {
+	eo.Handshakes = make(chan struct{}, n)
+}
+
+// SetSessionPerClient applies the policy to the ends of the same clientID
+// created by the options, the default allows multiple. Under
+// SessionReplaceOld the former end is closed gracefully after the new one
+// created, and under SessionRejectNew the new conn fails with
+// ErrSessionExists at handshake.
+func (eo *EndOptions) SetSessionPerClient(policy SessionPerClient) {
+	if policy == SessionAllowMultiple {
+		eo.Sessions = nil
+		return
+	}
+	eo.Sessions = newSessions(policy)
+}
+
+// SetAckAggregation batches the acks of received messages into one ack
+// packet, the batch is flushed once count acks pending or interval passed
+// since the first pending, whichever comes first. The peer must know the
+// batched acks.
+func (eo *EndOptions) SetAckAggregation(count int, interval time.Duration) {
+	eo.AckAggregation = &AckAggregation{
+		Count:    count,
+		Interval: interval,
+	}
+}
+
+// SetMessageRetransmit resends the at-least-once messages not acked in
+// interval, the publish fails after attempts sends in total, a non-positive
+// attempts means no limit but the publish's timeout. The consumer may see
+// a message more than once.
+func (eo *EndOptions) SetMessageRetransmit(interval time.Duration, attempts int) {
+	eo.MessageRetransmit = &MessageRetransmit{
+		Interval: interval,
+		Attempts: attempts,
+	}
+}
+
+// SetWriteCoalesce sets data packets of streams to be held for at most delay
+// and written down together, a batch reaching size packets is written at
+// once, streams opened with SetInteractive are never coalesced.
+func (eo *EndOptions) SetWriteCoalesce(delay time.Duration, size int) {
+	eo.WriteCoalesce = &WriteCoalesce{
+		Delay: delay,
+		Size:  size,
+	}
+}
+
+// SetBandwidthLimit caps the aggregate bytes written per second across all
+// streams of the End, conn and session control packets are exempt.
+func (eo *EndOptions) SetBandwidthLimit(bytesPerSec, burst int) {
+	eo.BandwidthLimit = &BandwidthLimit{
+		BytesPerSec: bytesPerSec,
+		Burst:       burst,
+	}
+}
+
+// SetAuditSink records every stream opened and closed of the End to sink,
+// the default stream excluded, it's off by default.
+func (eo *EndOptions) SetAuditSink(sink multiplexer.AuditSink) {
+	eo.AuditSink = sink
+}
+
+// SetDropObserver notifies observer of every packet dropped intentionally,
+// along with the reason, direction and streamID.
+func (eo *EndOptions) SetDropObserver(observer packet.DropObserver) {
+	eo.DropObserver = observer
+}
+
+// SetAuthorizer consults authorize before dispatching every local RPC with
+// the caller's clientID, the calls it returns error get ErrForbidden.
+func (eo *EndOptions) SetAuthorizer(authorize func(clientID uint64, method string) error) {
+	eo.Authorizer = authorize
+}
+
+// SetCapabilities advertises the capabilities to the clients at connecting.
+func (eo *EndOptions) SetCapabilities(capabilities ...string) {
+	eo.Capabilities = capabilities
+}
+
+// SetCompression compresses the message data reaching threshold by the best
+// of the compressors the client supports too, it's advertised along with
+// the capabilities. The delegate sees the one negotiated by Compression.
+func (eo *EndOptions) SetCompression(threshold int, compressors ...byte) {
+	eo.Compression = &Compression{
+		Threshold:   threshold,
+		Compressors: compressors,
+	}
+}
+
+// SetFailureDetector decides if a client is dead by the detectors created
+// by newDetector, rather than 2 heartbeats in a row missed.
+func (eo *EndOptions) SetFailureDetector(newDetector conn.NewFailureDetector) {
+	eo.FailureDetector = newDetector
+}
+
+// SetSessionIDAllocator assigns streamIDs from allocator instead of the
+// End's local counter, the IDs must be unique within the End.
+func (eo *EndOptions) SetSessionIDAllocator(allocator multiplexer.SessionIDAllocator) {
+	eo.SessionIDAllocator = allocator
+}
+
+// SetFiniGrace keeps buffered data of a dismissed stream readable for at
+// most grace before the stream finishes.
+func (eo *EndOptions) SetFiniGrace(grace time.Duration) {
+	eo.FiniGrace = &grace
+}
+
+// SetConnIdleTimeout closes the conn after it has had no streams but the
+// default one and no traffic for timeout, the Delegate's ConnOffline is
+// called as usual.
+func (eo *EndOptions) SetConnIdleTimeout(timeout time.Duration) {
+	eo.ConnIdleTimeout = &timeout
+}
+
 func NewEndOptions() *EndOptions {
 	return &EndOptions{}
 }
@@ -104,6 +317,57 @@ func MergeEndOptions(opts ...*EndOptions) *EndOptions {
 		if opt.ClosedStreamFunc != nil {
 			eo.ClosedStreamFunc = opt.ClosedStreamFunc
 		}
+		if opt.WorkerPool != nil {
+			eo.WorkerPool = opt.WorkerPool
+		}
+		if opt.WriteCoalesce != nil {
+			eo.WriteCoalesce = opt.WriteCoalesce
+		}
+		if opt.AckAggregation != nil {
+			eo.AckAggregation = opt.AckAggregation
+		}
+		if opt.MessageRetransmit != nil {
+			eo.MessageRetransmit = opt.MessageRetransmit
+		}
+		if opt.FiniGrace != nil {
+			eo.FiniGrace = opt.FiniGrace
+		}
+		if opt.ConnIdleTimeout != nil {
+			eo.ConnIdleTimeout = opt.ConnIdleTimeout
+		}
+		if opt.BandwidthLimit != nil {
+			eo.BandwidthLimit = opt.BandwidthLimit
+		}
+		if opt.TimerGranularity != nil {
+			eo.TimerGranularity = opt.TimerGranularity
+		}
+		if opt.AuditSink != nil {
+			eo.AuditSink = opt.AuditSink
+		}
+		if opt.DropObserver != nil {
+			eo.DropObserver = opt.DropObserver
+		}
+		if opt.Capabilities != nil {
+			eo.Capabilities = opt.Capabilities
+		}
+		if opt.Compression != nil {
+			eo.Compression = opt.Compression
+		}
+		if opt.Authorizer != nil {
+			eo.Authorizer = opt.Authorizer
+		}
+		if opt.SessionIDAllocator != nil {
+			eo.SessionIDAllocator = opt.SessionIDAllocator
+		}
+		if opt.Handshakes != nil {
+			eo.Handshakes = opt.Handshakes
+		}
+		if opt.Sessions != nil {
+			eo.Sessions = opt.Sessions
+		}
+		if opt.FailureDetector != nil {
+			eo.FailureDetector = opt.FailureDetector
+		}
 	}
 	return eo
 }
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"crypto/tls"
 	"net"
 
 	"github.com/singchia/geminio"
@@ -38,10 +39,24 @@ func Listen(network, address string, opts ...*EndOptions) (Listener, error) {
 	if err != nil {
 		return nil, err
 	}
+	return newListener(ln, opts...), nil
+}
+
+// ListenTLS accepts the TLS connections with the config, which must contain
+// at least one certificate or else set GetCertificate.
+func ListenTLS(network, address string, config *tls.Config, opts ...*EndOptions) (Listener, error) {
+	ln, err := tls.Listen(network, address, config)
+	if err != nil {
+		return nil, err
+	}
+	return newListener(ln, opts...), nil
+}
+
+func newListener(ln net.Listener, opts ...*EndOptions) *listener {
 	return &listener{
 		ln:   ln,
 		opts: opts,
-		ch:   make(chan *ret, 128)}, nil
+		ch:   make(chan *ret, 128)}
 }
 
 func (ln *listener) AcceptEnd() (geminio.End, error) {
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/singchia/geminio/conn"
+	"github.com/singchia/geminio/delegate"
+)
+
+// SessionPerClient is the policy on the ends of the same clientID
+type SessionPerClient int
+
+const (
+	// a client may have any number of ends online
+	SessionAllowMultiple SessionPerClient = iota
+	// the former end of the client is closed after the new one is created
+	SessionReplaceOld
+	// the new conn of a client still online is refused at handshake
+	SessionRejectNew
+)
+
+var ErrSessionExists = errors.New("session exists")
+
+// Sessions tracks the online ends by clientID for the policy, it's shared
+// by all ends created by the options.
+type Sessions struct {
+	policy SessionPerClient
+
+	mtx sync.Mutex
+	// key: clientID
+	online map[uint64]*session
+}
+
+type session struct {
+	cn delegate.ConnDescriber
+	// nil before the end created
+	end *ServerEnd
+	// the sessions to be closed once the end created
+	replaced *session
+}
+
+func newSessions(policy SessionPerClient) *Sessions {
+	return &Sessions{
+		policy: policy,
+		online: make(map[uint64]*session),
+	}
+}
+
+// the latest conn online holds the place of the client
+func (sessions *Sessions) connOnline(cn delegate.ConnDescriber) error {
+	sessions.mtx.Lock()
+	defer sessions.mtx.Unlock()
+	old, ok := sessions.online[cn.ClientID()]
+	if ok && sessions.policy == SessionRejectNew {
+		return ErrSessionExists
+	}
+	sessions.online[cn.ClientID()] = &session{cn: cn, replaced: old}
+	return nil
+}
+
+func (sessions *Sessions) connOffline(cn delegate.ConnDescriber) {
+	sessions.mtx.Lock()
+	defer sessions.mtx.Unlock()
+	if current, ok := sessions.online[cn.ClientID()]; ok && current.cn == cn {
+		delete(sessions.online, cn.ClientID())
+	}
+}
+
+// bind the created end, and dismiss the replaced ones gracefully
+func (sessions *Sessions) bind(cn delegate.ConnDescriber, end *ServerEnd) {
+	sessions.mtx.Lock()
+	current, ok := sessions.online[cn.ClientID()]
+	if !ok || current.cn != cn {
+		sessions.mtx.Unlock()
+		// replaced by a newer conn or offline before created
+		end.opts.Log.Infof("session replaced before created, clientID: %d", cn.ClientID())
+		end.Close()
+		return
+	}
+	current.end = end
+	replaced := current.replaced
+	current.replaced = nil
+	sessions.mtx.Unlock()
+
+	// the ones still being created close themselves at binding
+	for ; replaced != nil; replaced = replaced.replaced {
+		if replaced.end != nil {
+			end.opts.Log.Infof("session replaced, clientID: %d", cn.ClientID())
+			replaced.end.Close()
+		}
+	}
+}
+
+// sessionDelegate consults the sessions before the delegate's ConnOnline
+type sessionDelegate struct {
+	conn.ServerConnDelegate
+	sessions *Sessions
+}
+
+func (dlgt *sessionDelegate) ConnOnline(cn delegate.ConnDescriber) error {
+	if err := dlgt.sessions.connOnline(cn); err != nil {
+		return err
+	}
+	if dlgt.ServerConnDelegate == nil {
+		return nil
+	}
+	err := dlgt.ServerConnDelegate.ConnOnline(cn)
+	if err != nil {
+		// the ConnOffline won't come
+		dlgt.sessions.connOffline(cn)
+	}
+	return err
+}
+
+func (dlgt *sessionDelegate) ConnOffline(cn delegate.ConnDescriber) error {
+	dlgt.sessions.connOffline(cn)
+	if dlgt.ServerConnDelegate == nil {
+		return nil
+	}
+	return dlgt.ServerConnDelegate.ConnOffline(cn)
+}
+
+func (dlgt *sessionDelegate) Heartbeat(cn delegate.ConnDescriber) error {
+	if dlgt.ServerConnDelegate == nil {
+		return nil
+	}
+	return dlgt.ServerConnDelegate.Heartbeat(cn)
+}
+
+func (dlgt *sessionDelegate) GetClientID(meta []byte) (uint64, error) {
+	if dlgt.ServerConnDelegate == nil {
+		return 0, nil
+	}
+	return dlgt.ServerConnDelegate.GetClientID(meta)
+}
@@ -36,7 +36,12 @@ func GetEndStream() (geminio.Stream, geminio.Stream, error) {
 }
 
 func GetEndPair() (geminio.End, geminio.End, error) {
-	sConn, cConn, err := GetTCPConnectionPair(12345)
+	return GetEndPairWithOptions(nil, nil)
+}
+
+func GetEndPairWithOptions(sOpt *server.EndOptions, cOpt *client.EndOptions) (
+	geminio.End, geminio.End, error) {
+	sConn, cConn, err := GetTCPConnectionPair(0)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -45,12 +50,12 @@ func GetEndPair() (geminio.End, geminio.End, error) {
 	var sErr error
 	done := make(chan struct{})
 	go func() {
-		sEnd, sErr = server.NewEndWithConn(sConn)
+		sEnd, sErr = server.NewEndWithConn(sConn, sOpt)
 		close(done)
 	}()
 
 	dialer := func() (net.Conn, error) { return cConn, nil }
-	cEnd, err := client.NewEndWithDialer(dialer)
+	cEnd, err := client.NewEndWithDialer(dialer, cOpt)
 	if err != nil {
 		return nil, nil, err
 	}
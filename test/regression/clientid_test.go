@@ -0,0 +1,75 @@
+package regression
+
+import (
+	"net"
+	"testing"
+
+	"github.com/singchia/geminio"
+	"github.com/singchia/geminio/client"
+	"github.com/singchia/geminio/delegate"
+	"github.com/singchia/geminio/server"
+)
+
+type clientIDDelegate struct {
+	*delegate.UnimplementedDelegate
+	clientID uint64
+}
+
+func (dlgt *clientIDDelegate) GetClientID(meta []byte) (uint64, error) {
+	return dlgt.clientID, nil
+}
+
+func TestClientID(t *testing.T) {
+	// the server assigns, and the client sets
+	testClientID(t, 424242, 0, 424242)
+	testClientID(t, 424242, 777, 777)
+}
+
+func testClientID(t *testing.T, assigned, wanted, expected uint64) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	ends := make(chan geminio.End, 1)
+	go func() {
+		netconn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		opt := server.NewEndOptions()
+		opt.SetDelegate(&clientIDDelegate{
+			UnimplementedDelegate: &delegate.UnimplementedDelegate{},
+			clientID:              assigned,
+		})
+		end, err := server.NewEndWithConn(netconn, opt)
+		if err != nil {
+			close(ends)
+			return
+		}
+		ends <- end
+	}()
+
+	opt := client.NewEndOptions()
+	if wanted != 0 {
+		opt.SetClientID(wanted)
+	}
+	cEnd, err := client.NewEnd("tcp", ln.Addr().String(), opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cEnd.Close()
+	sEnd, ok := <-ends
+	if !ok {
+		t.Fatal("server end failed")
+	}
+	defer sEnd.Close()
+
+	if cEnd.ClientID() != expected {
+		t.Errorf("unexpected client side clientID: %d, expected: %d", cEnd.ClientID(), expected)
+	}
+	if sEnd.ClientID() != expected {
+		t.Errorf("unexpected server side clientID: %d, expected: %d", sEnd.ClientID(), expected)
+	}
+}
@@ -0,0 +1,159 @@
+package regression
+
+import (
+	"bytes"
+	"context"
+	"sync/atomic"
+	"testing"
+
+	"github.com/singchia/geminio/client"
+	"github.com/singchia/geminio/delegate"
+	"github.com/singchia/geminio/packet"
+	"github.com/singchia/geminio/server"
+	"github.com/singchia/geminio/test"
+)
+
+// countCompressor counts the compressions of the built-in snappy
+type countCompressor struct {
+	packet.Compressor
+	compressed int32
+}
+
+func (compressor *countCompressor) ID() byte {
+	return packet.CompressorSnappy
+}
+
+func (compressor *countCompressor) Compress(data []byte) ([]byte, error) {
+	atomic.AddInt32(&compressor.compressed, 1)
+	return compressor.Compressor.Compress(data)
+}
+
+type compressionDelegate struct {
+	*delegate.UnimplementedDelegate
+	compression chan string
+}
+
+func (dlgt *compressionDelegate) ConnOnline(cn delegate.ConnDescriber) error {
+	dlgt.compression <- cn.Compression()
+	return nil
+}
+
+func TestCompressionNegotiation(t *testing.T) {
+	compressor := &countCompressor{Compressor: packet.SnappyCompressor()}
+	packet.RegisterCompressor(compressor)
+	defer packet.RegisterCompressor(packet.SnappyCompressor())
+
+	// the client doesn't take zstd, snappy is the best in common
+	dlgt := &compressionDelegate{
+		UnimplementedDelegate: &delegate.UnimplementedDelegate{},
+		compression:           make(chan string, 1),
+	}
+	sOpt := server.NewEndOptions()
+	sOpt.SetDelegate(dlgt)
+	sOpt.SetCompression(128, packet.CompressorGzip, packet.CompressorSnappy, packet.CompressorZstd)
+	cOpt := client.NewEndOptions()
+	cOpt.SetCompression(128, packet.CompressorGzip, packet.CompressorSnappy)
+
+	sEnd, cEnd, err := test.GetEndPairWithOptions(sOpt, cOpt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sEnd.Close()
+	defer cEnd.Close()
+
+	if got := <-dlgt.compression; got != "snappy" {
+		t.Errorf("unexpected server compression: %s", got)
+	}
+	if got := cEnd.(interface{ Compression() string }).Compression(); got != "snappy" {
+		t.Errorf("unexpected client compression: %s", got)
+	}
+
+	data := bytes.Repeat([]byte("compressed"), 64)
+	// the ack comes after the message done
+	pub, err := cEnd.PublishAsync(context.TODO(), cEnd.NewMessage(data), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := sEnd.Receive(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.Done()
+	<-pub.Done
+	if pub.Error != nil {
+		t.Errorf("publish err: %s", pub.Error)
+	}
+	if !bytes.Equal(msg.Data(), data) {
+		t.Errorf("unexpected message data, length: %d", len(msg.Data()))
+	}
+	if atomic.LoadInt32(&compressor.compressed) == 0 {
+		t.Error("message not compressed")
+	}
+}
+
+func TestCompressionZstd(t *testing.T) {
+	sOpt := server.NewEndOptions()
+	sOpt.SetCompression(128, packet.CompressorGzip, packet.CompressorZstd)
+	cOpt := client.NewEndOptions()
+	cOpt.SetCompression(128, packet.CompressorSnappy, packet.CompressorZstd)
+	sEnd, cEnd, err := test.GetEndPairWithOptions(sOpt, cOpt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sEnd.Close()
+	defer cEnd.Close()
+	if got := cEnd.(interface{ Compression() string }).Compression(); got != "zstd" {
+		t.Errorf("unexpected client compression: %s", got)
+	}
+
+	data := bytes.Repeat([]byte("zstd"), 256)
+	pub, err := cEnd.PublishAsync(context.TODO(), cEnd.NewMessage(data), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := sEnd.Receive(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.Done()
+	<-pub.Done
+	if pub.Error != nil {
+		t.Errorf("publish err: %s", pub.Error)
+	}
+	if !bytes.Equal(msg.Data(), data) {
+		t.Errorf("unexpected message data, length: %d", len(msg.Data()))
+	}
+}
+
+func TestCompressionNoneInCommon(t *testing.T) {
+	// the server without compression set advertises none
+	cOpt := client.NewEndOptions()
+	cOpt.SetCompression(0, packet.CompressorGzip)
+	sEnd, cEnd, err := test.GetEndPairWithOptions(nil, cOpt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sEnd.Close()
+	defer cEnd.Close()
+	if got := cEnd.(interface{ Compression() string }).Compression(); got != packet.CompressionNone {
+		t.Errorf("unexpected client compression: %s", got)
+	}
+
+	// the messages still go uncompressed
+	pub, err := cEnd.PublishAsync(context.TODO(), cEnd.NewMessage([]byte("plain")), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := sEnd.Receive(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.Done()
+	<-pub.Done
+	if pub.Error != nil {
+		t.Errorf("publish err: %s", pub.Error)
+	}
+	if string(msg.Data()) != "plain" {
+		t.Errorf("unexpected message data: %s", string(msg.Data()))
+	}
+}
@@ -0,0 +1,105 @@
+package regression
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/singchia/geminio"
+	"github.com/singchia/geminio/client"
+	"github.com/singchia/geminio/delegate"
+	"github.com/singchia/geminio/server"
+)
+
+type slowClientIDDelegate struct {
+	*delegate.UnimplementedDelegate
+	running int32
+	max     int32
+}
+
+func (dlgt *slowClientIDDelegate) GetClientID(meta []byte) (uint64, error) {
+	running := atomic.AddInt32(&dlgt.running, 1)
+	defer atomic.AddInt32(&dlgt.running, -1)
+	for {
+		max := atomic.LoadInt32(&dlgt.max)
+		if running <= max || atomic.CompareAndSwapInt32(&dlgt.max, max, running) {
+			break
+		}
+	}
+	// like a database call
+	time.Sleep(50 * time.Millisecond)
+	return 0, nil
+}
+
+func TestMaxConcurrentHandshakes(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	limit, count := 3, 20
+	dlgt := &slowClientIDDelegate{
+		UnimplementedDelegate: &delegate.UnimplementedDelegate{},
+	}
+	opt := server.NewEndOptions()
+	opt.SetDelegate(dlgt)
+	opt.SetMaxConcurrentHandshakes(limit)
+
+	sEnds := make(chan geminio.End, count)
+	go func() {
+		for {
+			netconn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				end, err := server.NewEndWithConn(netconn, opt)
+				if err != nil {
+					t.Error(err)
+					netconn.Close()
+					return
+				}
+				sEnds <- end
+			}()
+		}
+	}()
+
+	// reconnection storm
+	wg := sync.WaitGroup{}
+	cEnds := make(chan geminio.End, count)
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			end, err := client.NewEnd("tcp", ln.Addr().String())
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			cEnds <- end
+		}()
+	}
+	wg.Wait()
+	close(cEnds)
+	for end := range cEnds {
+		end.Close()
+	}
+	for i := 0; i < count; i++ {
+		select {
+		case end := <-sEnds:
+			end.Close()
+		case <-time.After(time.Second):
+			t.Fatal("wait for server end timeout")
+		}
+	}
+	max := atomic.LoadInt32(&dlgt.max)
+	if max > int32(limit) {
+		t.Errorf("concurrent GetClientID: %d exceeds the limit: %d", max, limit)
+	}
+	if max == 0 {
+		t.Error("GetClientID never called")
+	}
+}
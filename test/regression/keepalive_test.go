@@ -0,0 +1,152 @@
+package regression
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/singchia/geminio"
+	"github.com/singchia/geminio/client"
+	"github.com/singchia/geminio/delegate"
+	"github.com/singchia/geminio/server"
+	"github.com/singchia/geminio/test"
+)
+
+// silentConn swallows all writes after being silent, like a gone peer
+type silentConn struct {
+	net.Conn
+	silent int32
+	reads  int32
+}
+
+func (cn *silentConn) Read(b []byte) (int, error) {
+	n, err := cn.Conn.Read(b)
+	if n > 0 {
+		atomic.AddInt32(&cn.reads, 1)
+	}
+	return n, err
+}
+
+func (cn *silentConn) Write(b []byte) (int, error) {
+	if atomic.LoadInt32(&cn.silent) == 1 {
+		return len(b), nil
+	}
+	return cn.Conn.Write(b)
+}
+
+func TestKeepalive(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	type accepted struct {
+		end geminio.End
+		cn  *silentConn
+	}
+	accepts := make(chan accepted, 2)
+	go func() {
+		for {
+			netconn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			cn := &silentConn{Conn: netconn}
+			end, err := server.NewEndWithConn(cn)
+			if err != nil {
+				continue
+			}
+			accepts <- accepted{end, cn}
+		}
+	}()
+
+	opt := client.NewRetryEndOptions()
+	opt.SetKeepalive(100*time.Millisecond, 300*time.Millisecond, []byte("keepalive"))
+	dialer := func() (net.Conn, error) {
+		return net.Dial("tcp", ln.Addr().String())
+	}
+	cEnd, err := client.NewRetryEndWithDialer(dialer, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cEnd.Close()
+
+	var first accepted
+	select {
+	case first = <-accepts:
+		defer first.end.Close()
+	case <-time.After(10 * time.Second):
+		t.Fatal("wait for connecting timeout")
+	}
+	// the keepalive fires while idle, and is answered
+	time.Sleep(200 * time.Millisecond)
+	reads := atomic.LoadInt32(&first.cn.reads)
+	time.Sleep(time.Second)
+	if atomic.LoadInt32(&first.cn.reads) == reads {
+		t.Error("no keepalive while idle")
+	}
+	select {
+	case <-accepts:
+		t.Fatal("reconnected while the keepalive answered")
+	default:
+	}
+	// the internal method is not the user's
+	if _, ok := first.end.MethodStats()["__ping"]; ok {
+		t.Error("keepalive in the method stats")
+	}
+	// the server stops responding, and the client should reconnect
+	atomic.StoreInt32(&first.cn.silent, 1)
+	select {
+	case second := <-accepts:
+		second.end.Close()
+	case <-time.After(10 * time.Second):
+		t.Error("wait for reconnecting timeout")
+	}
+}
+
+type offlineDelegate struct {
+	delegate.UnimplementedDelegate
+	offline chan struct{}
+}
+
+func (dlgt *offlineDelegate) ConnOffline(delegate.ConnDescriber) error {
+	close(dlgt.offline)
+	return nil
+}
+
+func TestConnIdleTimeout(t *testing.T) {
+	dlgt := &offlineDelegate{offline: make(chan struct{})}
+	sOpt := server.NewEndOptions()
+	sOpt.SetDelegate(dlgt)
+	sOpt.SetConnIdleTimeout(200 * time.Millisecond)
+	sEnd, cEnd, err := test.GetEndPairWithOptions(sOpt, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sEnd.Close()
+	defer cEnd.Close()
+
+	stream, err := cEnd.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// an open stream keeps the conn
+	select {
+	case <-dlgt.offline:
+		t.Fatal("conn reaped with a stream open")
+	case <-time.After(400 * time.Millisecond):
+	}
+	closed := time.Now()
+	stream.Close()
+
+	select {
+	case <-dlgt.offline:
+		if idle := time.Since(closed); idle < 150*time.Millisecond {
+			t.Fatalf("conn reaped after %s idle", idle)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("idle conn not reaped")
+	}
+}
@@ -0,0 +1,317 @@
+package regression
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/singchia/geminio"
+	"github.com/singchia/geminio/application"
+	"github.com/singchia/geminio/client"
+	"github.com/singchia/geminio/options"
+	"github.com/singchia/geminio/server"
+	"github.com/singchia/geminio/test"
+)
+
+func TestMessageIdempotencyKey(t *testing.T) {
+	sEnd, cEnd, err := test.GetEndPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sEnd.Close()
+	defer cEnd.Close()
+
+	// the consumer is paused while publishing
+	pubs := []*geminio.Publish{}
+	for i := 0; i < 2; i++ {
+		msg := cEnd.NewMessage([]byte("once"))
+		msg.SetIdempotencyKey("order-1")
+		pub, err := cEnd.PublishAsync(context.TODO(), msg, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pubs = append(pubs, pub)
+	}
+	// a message without key is never deduplicated
+	_, err = cEnd.PublishAsync(context.TODO(), cEnd.NewMessage([]byte("last")), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// resume the consumer
+	msg, err := sEnd.Receive(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg.Data()) != "once" || msg.IdempotencyKey() != "order-1" {
+		t.Errorf("unexpected message, data: %s, idempotencyKey: %s", string(msg.Data()), msg.IdempotencyKey())
+	}
+	msg.Done()
+	msg, err = sEnd.Receive(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg.Data()) != "last" {
+		t.Errorf("duplicate message delivered, data: %s", string(msg.Data()))
+	}
+	msg.Done()
+
+	// both the original and the duplicate are acked
+	for _, pub := range pubs {
+		select {
+		case <-pub.Done:
+			if pub.Error != nil {
+				t.Errorf("publish err: %s", pub.Error)
+			}
+		case <-time.After(time.Second):
+			t.Error("wait for publish ack timeout")
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.TODO(), 100*time.Millisecond)
+	defer cancel()
+	msg, err = sEnd.Receive(ctx)
+	if err == nil {
+		t.Errorf("unexpected message, data: %s", string(msg.Data()))
+	}
+}
+
+// writeCountConn counts the writes, a packet is written at once
+type writeCountConn struct {
+	net.Conn
+	writes int32
+}
+
+func (cn *writeCountConn) Write(b []byte) (int, error) {
+	atomic.AddInt32(&cn.writes, 1)
+	return cn.Conn.Write(b)
+}
+
+func TestMessageAckAggregation(t *testing.T) {
+	sConn, cConn, err := test.GetTCPConnectionPair(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counted := &writeCountConn{Conn: sConn}
+	interval := 100 * time.Millisecond
+	sOpt := server.NewEndOptions()
+	sOpt.SetAckAggregation(10, interval)
+	var sEnd geminio.End
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sEnd, err = server.NewEndWithConn(counted, sOpt)
+	}()
+	cEnd, cerr := client.NewEndWithDialer(func() (net.Conn, error) { return cConn, nil })
+	if cerr != nil {
+		t.Fatal(cerr)
+	}
+	defer cEnd.Close()
+	<-done
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sEnd.Close()
+
+	// 2 batches by the count, and the rest by the interval
+	pubs := []*geminio.Publish{}
+	for i := 0; i < 25; i++ {
+		pub, err := cEnd.PublishAsync(context.TODO(), cEnd.NewMessage([]byte(strconv.Itoa(i))), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pubs = append(pubs, pub)
+	}
+	base := atomic.LoadInt32(&counted.writes)
+	for i := 0; i < 25; i++ {
+		msg, err := sEnd.Receive(context.TODO())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = msg.Done(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	acked := time.Now()
+	for i, pub := range pubs {
+		select {
+		case <-pub.Done:
+			if pub.Error != nil {
+				t.Errorf("publish %d err: %s", i, pub.Error)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("publish %d not acked", i)
+		}
+	}
+	if elapsed := time.Since(acked); elapsed < interval/2 {
+		t.Errorf("the rest acked before the interval: %s", elapsed)
+	}
+	if writes := atomic.LoadInt32(&counted.writes) - base; writes != 3 {
+		t.Errorf("unexpected ack packets written: %d", writes)
+	}
+}
+
+func TestMessageAckStream(t *testing.T) {
+	sEnd, cEnd, err := test.GetEndPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sEnd.Close()
+	defer cEnd.Close()
+
+	acks := cEnd.AckStream()
+	ids := []uint64{}
+	for i := 0; i < 5; i++ {
+		msg := cEnd.NewMessage([]byte(strconv.Itoa(i)))
+		if _, err = cEnd.PublishAsync(context.TODO(), msg, nil); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, msg.ID())
+	}
+	received := map[string]geminio.Message{}
+	for i := 0; i < 5; i++ {
+		msg, err := sEnd.Receive(context.TODO())
+		if err != nil {
+			t.Fatal(err)
+		}
+		received[string(msg.Data())] = msg
+	}
+	// acked out of order, the stream advances over the contiguous prefix
+	steps := []struct {
+		ack     int
+		advance int
+	}{
+		{1, -1},
+		{0, 1},
+		{3, -1},
+		{4, -1},
+		{2, 4},
+	}
+	for _, step := range steps {
+		if err = received[strconv.Itoa(step.ack)].Done(); err != nil {
+			t.Fatal(err)
+		}
+		if step.advance < 0 {
+			select {
+			case id := <-acks:
+				t.Fatalf("advanced to %d past the gap at acking %d", id, step.ack)
+			case <-time.After(50 * time.Millisecond):
+			}
+			continue
+		}
+		select {
+		case id := <-acks:
+			if id != ids[step.advance] {
+				t.Errorf("unexpected advance at acking %d: %d, expected: %d", step.ack, id, ids[step.advance])
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("not advanced at acking %d", step.ack)
+		}
+	}
+}
+
+func TestMessageRetransmit(t *testing.T) {
+	cOpt := client.NewEndOptions()
+	cOpt.SetMessageRetransmit(50*time.Millisecond, 3)
+	sEnd, cEnd, err := test.GetEndPairWithOptions(nil, cOpt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sEnd.Close()
+	defer cEnd.Close()
+
+	// the first delivery's ack is dropped, the redelivery acked
+	msg := cEnd.NewMessage([]byte("redelivered"))
+	published := make(chan error, 1)
+	go func() {
+		published <- cEnd.Publish(context.TODO(), msg)
+	}()
+	first, err := sEnd.Receive(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := sEnd.Receive(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.ID() != first.ID() || string(second.Data()) != "redelivered" {
+		t.Fatalf("unexpected redelivery, id: %d, data: %s", second.ID(), second.Data())
+	}
+	if err = second.Done(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err = <-published:
+		if err != nil {
+			t.Errorf("publish err: %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("publish not acked after redelivery")
+	}
+
+	// never acked, the publish fails after all attempts
+	go func() {
+		published <- cEnd.Publish(context.TODO(), cEnd.NewMessage([]byte("unacked")))
+	}()
+	for i := 0; i < 3; i++ {
+		if _, err = sEnd.Receive(context.TODO()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case err = <-published:
+		if err != application.ErrRetransmitExhausted {
+			t.Errorf("unexpected publish err: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("publish not failed after attempts")
+	}
+}
+
+func TestMessagePeek(t *testing.T) {
+	sEnd, cEnd, err := test.GetEndPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sEnd.Close()
+	defer cEnd.Close()
+
+	pub, err := cEnd.PublishAsync(context.TODO(), cEnd.NewMessage([]byte("peeked")), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opt := options.Receive()
+	opt.SetVisibility(100 * time.Millisecond)
+	peeked, err := sEnd.Receive(context.TODO(), opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// not acked in the visibility, so it's redelivered
+	ctx, cancel := context.WithTimeout(context.TODO(), time.Second)
+	defer cancel()
+	msg, err := sEnd.Receive(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.ID() != peeked.ID() || string(msg.Data()) != "peeked" {
+		t.Errorf("unexpected redelivered message, id: %d, data: %s", msg.ID(), string(msg.Data()))
+	}
+	select {
+	case <-pub.Done:
+		t.Error("peeked message acked")
+	default:
+	}
+	if err = peeked.Done(); err != application.ErrVisibilityExpired {
+		t.Errorf("unexpected peeked message done err: %v", err)
+	}
+	if err = msg.Done(); err != nil {
+		t.Fatal(err)
+	}
+	<-pub.Done
+	if pub.Error != nil {
+		t.Errorf("publish err: %s", pub.Error)
+	}
+}
@@ -0,0 +1,76 @@
+package regression
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/singchia/geminio"
+	"github.com/singchia/geminio/application"
+	"github.com/singchia/geminio/test"
+)
+
+func TestQuiesce(t *testing.T) {
+	sEnd, cEnd, err := test.GetEndPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sEnd.Close()
+	defer cEnd.Close()
+
+	echo := func(ctx context.Context, req geminio.Request, rsp geminio.Response) {
+		rsp.SetData(req.Data())
+	}
+	if err = sEnd.Register(context.TODO(), "echo", echo); err != nil {
+		t.Fatal(err)
+	}
+	accepted := make(chan geminio.Stream)
+	go func() {
+		for {
+			ss, err := sEnd.AcceptStream()
+			if err != nil {
+				close(accepted)
+				return
+			}
+			accepted <- ss
+		}
+	}()
+	// an existing stream before quiescing
+	cs, err := cEnd.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// register after the stream is ready at both sides
+	ss := <-accepted
+	if err = ss.Register(context.TODO(), "echo", echo); err != nil {
+		t.Fatal(err)
+	}
+
+	sEnd.Quiesce()
+	_, err = cEnd.OpenStream()
+	if !errors.Is(err, application.ErrQuiescing) {
+		t.Errorf("unexpected open stream err: %v", err)
+	}
+	_, err = cEnd.Call(context.TODO(), "echo", cEnd.NewRequest([]byte("new work")))
+	if !errors.Is(err, application.ErrQuiescing) {
+		t.Errorf("unexpected call err: %v", err)
+	}
+	rsp, err := cs.Call(context.TODO(), "echo", cs.NewRequest([]byte("existing")))
+	if err != nil {
+		t.Errorf("call on existing stream err: %s", err)
+	} else if string(rsp.Data()) != "existing" {
+		t.Errorf("unexpected response data: %s", string(rsp.Data()))
+	}
+
+	sEnd.Unquiesce()
+	_, err = cEnd.Call(context.TODO(), "echo", cEnd.NewRequest([]byte("new work")))
+	if err != nil {
+		t.Errorf("call after unquiescing err: %s", err)
+	}
+	_, err = cEnd.OpenStream()
+	if err != nil {
+		t.Errorf("open stream after unquiescing err: %s", err)
+		return
+	}
+	<-accepted
+}
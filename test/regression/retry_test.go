@@ -0,0 +1,453 @@
+package regression
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/singchia/geminio"
+	"github.com/singchia/geminio/client"
+	"github.com/singchia/geminio/delegate"
+	"github.com/singchia/geminio/options"
+	"github.com/singchia/geminio/server"
+)
+
+func TestRetryEndMetaFunc(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	ends := make(chan geminio.End, 2)
+	go func() {
+		for {
+			netconn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			end, err := server.NewEndWithConn(netconn)
+			if err != nil {
+				continue
+			}
+			ends <- end
+		}
+	}()
+
+	token := int32(0)
+	opt := client.NewRetryEndOptions()
+	opt.SetMetaFunc(func() []byte {
+		return []byte("token-" + strconv.Itoa(int(atomic.AddInt32(&token, 1))))
+	})
+	dialer := func() (net.Conn, error) {
+		return net.Dial("tcp", ln.Addr().String())
+	}
+	cEnd, err := client.NewRetryEndWithDialer(dialer, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cEnd.Close()
+
+	for i := 1; i <= 2; i++ {
+		select {
+		case sEnd := <-ends:
+			if string(sEnd.Meta()) != "token-"+strconv.Itoa(i) {
+				t.Errorf("unexpected meta: %s", string(sEnd.Meta()))
+			}
+			// kick the client to reconnect
+			sEnd.Close()
+		case <-time.After(10 * time.Second):
+			t.Errorf("wait for connecting %d timeout", i)
+			return
+		}
+	}
+}
+
+func TestRetryEndMigrate(t *testing.T) {
+	// two in-process servers, counting the requests served and the messages
+	// received by the streams
+	served, received := [2]int32{}, [2]int32{}
+	ends := [2]chan geminio.End{make(chan geminio.End, 1), make(chan geminio.End, 1)}
+	dialers := [2]client.Dialer{}
+	for i := 0; i < 2; i++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		i := i
+		slow := func(ctx context.Context, req geminio.Request, rsp geminio.Response) {
+			time.Sleep(20 * time.Millisecond)
+			atomic.AddInt32(&served[i], 1)
+			rsp.SetData(req.Data())
+		}
+		go func() {
+			netconn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			end, err := server.NewEndWithConn(netconn)
+			if err != nil {
+				return
+			}
+			end.Register(context.TODO(), "slow", slow)
+			ends[i] <- end
+			for {
+				sm, err := end.AcceptStream()
+				if err != nil {
+					return
+				}
+				go func() {
+					for {
+						msg, err := sm.Receive(context.TODO())
+						if err != nil {
+							return
+						}
+						// keep the publishes in flight for a while
+						time.Sleep(5 * time.Millisecond)
+						atomic.AddInt32(&received[i], 1)
+						msg.Done()
+					}
+				}()
+			}
+		}()
+		dialers[i] = func() (net.Conn, error) {
+			return net.Dial("tcp", ln.Addr().String())
+		}
+	}
+
+	cEnd, err := client.NewRetryEndWithDialer(dialers[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cEnd.Close()
+	sEnd1 := <-ends[0]
+	defer sEnd1.Close()
+	ping := func(ctx context.Context, req geminio.Request, rsp geminio.Response) {
+		rsp.SetData([]byte("pong"))
+	}
+	if err = cEnd.Register(context.TODO(), "ping", ping); err != nil {
+		t.Fatal(err)
+	}
+	feed, err := cEnd.OpenStream(&options.OpenStreamOptions{Meta: []byte("feed")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// keep calling across the migration
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	succeeds, fails := int32(0), int32(0)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				_, err := cEnd.Call(context.TODO(), "slow", cEnd.NewRequest([]byte("migrate")))
+				if err != nil {
+					t.Logf("call err: %s", err)
+					atomic.AddInt32(&fails, 1)
+					continue
+				}
+				atomic.AddInt32(&succeeds, 1)
+			}
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+	// and messages in flight while migrating
+	n := 50
+	publishes := make(chan *geminio.Publish, n)
+	for i := 0; i < n; i++ {
+		_, err := feed.PublishAsync(context.TODO(), feed.NewMessage([]byte("migrate")), publishes)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = cEnd.(*client.RetryEnd).Migrate(context.TODO(), dialers[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	sEnd2 := <-ends[1]
+	defer sEnd2.Close()
+	time.Sleep(100 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+
+	for i := 0; i < n; i++ {
+		if publish := <-publishes; publish.Error != nil {
+			t.Errorf("message lost across the migration: %s", publish.Error)
+		}
+	}
+	if got := atomic.LoadInt32(&received[0]); got != int32(n) {
+		t.Errorf("unexpected messages received by the old conn: %d", got)
+	}
+	// the stream is reopened to the new conn
+	var reopened geminio.Stream
+	for _, sm := range cEnd.ListStreams() {
+		if string(sm.Meta()) == "feed" {
+			reopened = sm
+		}
+	}
+	if reopened == nil {
+		t.Fatal("stream not reopened after the migration")
+	}
+	if err = reopened.Publish(context.TODO(), reopened.NewMessage([]byte("migrated"))); err != nil {
+		t.Errorf("publish to the reopened stream err: %s", err)
+	}
+	if got := atomic.LoadInt32(&received[1]); got != 1 {
+		t.Errorf("unexpected messages received by the new conn: %d", got)
+	}
+
+	if fails != 0 {
+		t.Errorf("requests lost across the migration: %d", fails)
+	}
+	if served[0] == 0 || served[1] == 0 || served[0]+served[1] != succeeds {
+		t.Errorf("unexpected served, old: %d, new: %d, succeeds: %d", served[0], served[1], succeeds)
+	}
+	// the registration is replayed to the new conn
+	rsp, err := sEnd2.Call(context.TODO(), "ping", sEnd2.NewRequest(nil))
+	if err != nil || string(rsp.Data()) != "pong" {
+		t.Errorf("registration not migrated, err: %v", err)
+	}
+}
+
+func TestRetryEndReconnectDecider(t *testing.T) {
+	errPermanent := errors.New("auth rejected")
+	errTransient := errors.New("network unreachable")
+
+	// the first dial connects, the failures of later dials are given by fail
+	reconnect := func(t *testing.T, fail func(dials int32) error) (geminio.End, chan geminio.End) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { ln.Close() })
+		ends := make(chan geminio.End, 2)
+		go func() {
+			for {
+				netconn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				end, err := server.NewEndWithConn(netconn)
+				if err != nil {
+					continue
+				}
+				ends <- end
+			}
+		}()
+
+		dials := int32(0)
+		dialer := func() (net.Conn, error) {
+			if err := fail(atomic.AddInt32(&dials, 1)); err != nil {
+				return nil, err
+			}
+			return net.Dial("tcp", ln.Addr().String())
+		}
+		opt := client.NewRetryEndOptions()
+		opt.SetReconnectDecider(func(err error) bool {
+			return !errors.Is(err, errPermanent)
+		})
+		cEnd, err := client.NewRetryEndWithDialer(dialer, opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { cEnd.Close() })
+		// kick the client to reconnect
+		sEnd := <-ends
+		sEnd.Close()
+		return cEnd, ends
+	}
+
+	t.Run("permanent", func(t *testing.T) {
+		dials := int32(0)
+		cEnd, _ := reconnect(t, func(n int32) error {
+			atomic.StoreInt32(&dials, n)
+			if n > 1 {
+				return errPermanent
+			}
+			return nil
+		})
+		// a reconnect attempt is taken after 3 seconds
+		time.Sleep(5 * time.Second)
+		_, err := cEnd.OpenStream()
+		if !errors.Is(err, errPermanent) {
+			t.Errorf("unexpected open err: %v", err)
+		}
+		time.Sleep(4 * time.Second)
+		if n := atomic.LoadInt32(&dials); n != 2 {
+			t.Errorf("unexpected dials after given up: %d", n)
+		}
+	})
+
+	t.Run("transient", func(t *testing.T) {
+		cEnd, ends := reconnect(t, func(n int32) error {
+			if n == 2 {
+				return errTransient
+			}
+			return nil
+		})
+		select {
+		case sEnd := <-ends:
+			defer sEnd.Close()
+		case <-time.After(15 * time.Second):
+			t.Fatal("not reconnected after a transient error")
+		}
+		time.Sleep(2 * time.Second)
+		sm, err := cEnd.OpenStream()
+		if err != nil {
+			t.Fatalf("open after reconnected err: %s", err)
+		}
+		sm.Close()
+	})
+}
+
+type resumeDelegate struct {
+	*delegate.UnimplementedDelegate
+	resumed chan uint64
+}
+
+func (dlgt *resumeDelegate) ResumeDialogue(oldID uint64, meta []byte) (bool, error) {
+	dlgt.resumed <- oldID
+	return string(meta) == "resumable", nil
+}
+
+type reonlineDelegate struct {
+	*delegate.UnimplementedDelegate
+	reonline chan struct{}
+}
+
+func (dlgt *reonlineDelegate) EndReOnline(delegate.ClientDescriber) {
+	dlgt.reonline <- struct{}{}
+}
+
+func TestRetryEndResumeStreams(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	sDlgt := &resumeDelegate{
+		UnimplementedDelegate: &delegate.UnimplementedDelegate{},
+		resumed:               make(chan uint64, 2),
+	}
+	ends := make(chan geminio.End, 2)
+	netconns := make(chan net.Conn, 2)
+	go func() {
+		for {
+			netconn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			netconns <- netconn
+			opt := server.NewEndOptions()
+			opt.SetDelegate(sDlgt)
+			end, err := server.NewEndWithConn(netconn, opt)
+			if err != nil {
+				continue
+			}
+			ends <- end
+		}
+	}()
+
+	cDlgt := &reonlineDelegate{
+		UnimplementedDelegate: &delegate.UnimplementedDelegate{},
+		reonline:              make(chan struct{}, 1),
+	}
+	opt := client.NewRetryEndOptions()
+	opt.SetResumeStreams(true)
+	opt.SetDelegate(cDlgt)
+	dialer := func() (net.Conn, error) {
+		return net.Dial("tcp", ln.Addr().String())
+	}
+	cEnd, err := client.NewRetryEndWithDialer(dialer, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cEnd.Close()
+	sEnd := <-ends
+
+	resumable, err := cEnd.OpenStream(&options.OpenStreamOptions{Meta: []byte("resumable")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	refused, err := cEnd.OpenStream(&options.OpenStreamOptions{Meta: []byte("refused")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed, err := cEnd.OpenStream(&options.OpenStreamOptions{Meta: []byte("resumable")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	// drop the conn rather than closing the end, which dismisses the streams
+	(<-netconns).Close()
+	defer sEnd.Close()
+	select {
+	case sEnd = <-ends:
+		defer sEnd.Close()
+	case <-time.After(10 * time.Second):
+		t.Fatal("not reconnected")
+	}
+	select {
+	case <-cDlgt.reonline:
+	case <-time.After(10 * time.Second):
+		t.Fatal("not online again")
+	}
+	if len(sDlgt.resumed) != 2 {
+		t.Errorf("unexpected resumes asked: %d", len(sDlgt.resumed))
+	}
+
+	streamIDs := map[uint64]string{}
+	for _, sm := range cEnd.ListStreams() {
+		streamIDs[sm.StreamID()] = string(sm.Meta())
+	}
+	if streamIDs[resumable.StreamID()] != "resumable" {
+		t.Errorf("stream not resumed with the same ID: %d, streams: %v", resumable.StreamID(), streamIDs)
+	}
+	if _, ok := streamIDs[refused.StreamID()]; ok {
+		t.Errorf("refused stream resumed with the same ID: %d", refused.StreamID())
+	}
+	if _, ok := streamIDs[closed.StreamID()]; ok {
+		t.Errorf("closed stream resumed: %d", closed.StreamID())
+	}
+	// the refused one is reopened with a new ID, besides the default stream
+	if len(streamIDs) != 3 {
+		t.Errorf("unexpected streams after resumed: %v", streamIDs)
+	}
+	// the server accepts the resumed stream with the same ID
+	accepted := make(chan uint64, 2)
+	go func() {
+		for {
+			sm, err := sEnd.AcceptStream()
+			if err != nil {
+				return
+			}
+			accepted <- sm.StreamID()
+		}
+	}()
+	for i := 0; i < 2; i++ {
+		select {
+		case streamID := <-accepted:
+			delete(streamIDs, streamID)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("resumed streams not accepted: %v", streamIDs)
+		}
+	}
+	if _, ok := streamIDs[resumable.StreamID()]; ok {
+		t.Errorf("server didn't accept the resumed stream: %d", resumable.StreamID())
+	}
+}
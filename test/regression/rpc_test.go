@@ -0,0 +1,798 @@
+package regression
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"hash"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/singchia/geminio"
+	"github.com/singchia/geminio/application"
+	"github.com/singchia/geminio/client"
+	"github.com/singchia/geminio/options"
+	"github.com/singchia/geminio/packet"
+	"github.com/singchia/geminio/server"
+	"github.com/singchia/geminio/test"
+)
+
+func TestCallNilData(t *testing.T) {
+	sEnd, cEnd, err := test.GetEndPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sEnd.Close()
+	defer cEnd.Close()
+
+	reqData := make(chan []byte, 1)
+	nilServer := func(ctx context.Context, req geminio.Request, rsp geminio.Response) {
+		reqData <- req.Data()
+		rsp.SetData(nil)
+	}
+	err = sEnd.Register(context.TODO(), "nil", nilServer)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	rsp, err := cEnd.Call(context.TODO(), "nil", cEnd.NewRequest(nil))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	data := <-reqData
+	if data == nil || len(data) != 0 {
+		t.Errorf("unexpected request data: %v", data)
+	}
+	if rsp.Data() == nil || len(rsp.Data()) != 0 {
+		t.Errorf("unexpected response data: %v", rsp.Data())
+	}
+
+	// empty body goes the same way
+	rsp, err = cEnd.Call(context.TODO(), "nil", cEnd.NewRequest([]byte{}))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	data = <-reqData
+	if data == nil || len(data) != 0 {
+		t.Errorf("unexpected request data: %v", data)
+	}
+	if rsp.Data() == nil || len(rsp.Data()) != 0 {
+		t.Errorf("unexpected response data: %v", rsp.Data())
+	}
+}
+
+func TestMethodStats(t *testing.T) {
+	sEnd, cEnd, err := test.GetEndPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sEnd.Close()
+	defer cEnd.Close()
+
+	echo := func(ctx context.Context, req geminio.Request, rsp geminio.Response) {
+		rsp.SetData(req.Data())
+	}
+	fail := func(ctx context.Context, req geminio.Request, rsp geminio.Response) {
+		rsp.SetError(errors.New("failed"))
+	}
+	if err = sEnd.Register(context.TODO(), "echo", echo); err != nil {
+		t.Fatal(err)
+	}
+	if err = sEnd.Register(context.TODO(), "fail", fail); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		_, err = cEnd.Call(context.TODO(), "echo", cEnd.NewRequest([]byte("stat")))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	for i := 0; i < 3; i++ {
+		_, err = cEnd.Call(context.TODO(), "fail", cEnd.NewRequest([]byte("stat")))
+		if err == nil {
+			t.Error("unexpected nil err")
+			return
+		}
+	}
+	stats := sEnd.MethodStats()
+	if stat := stats["echo"]; stat.Total != 10 || stat.Errors != 0 || stat.InFlight != 0 {
+		t.Errorf("unexpected echo stat: %+v", stat)
+	}
+	if stat := stats["fail"]; stat.Total != 3 || stat.Errors != 3 || stat.InFlight != 0 {
+		t.Errorf("unexpected fail stat: %+v", stat)
+	}
+}
+
+func TestWorkerPool(t *testing.T) {
+	const workers, queue, calls = 4, 4, 32
+	testWorkerPool(t, application.WorkerPoolBlock, workers, queue, calls)
+	testWorkerPool(t, application.WorkerPoolReject, workers, queue, calls)
+}
+
+func testWorkerPool(t *testing.T, policy application.WorkerPoolPolicy, workers, queue, calls int) {
+	sOpt := server.NewEndOptions()
+	sOpt.SetWorkerPool(workers, queue, policy)
+	sEnd, cEnd, err := test.GetEndPairWithOptions(sOpt, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sEnd.Close()
+	defer cEnd.Close()
+
+	running, maxRunning := int32(0), int32(0)
+	slow := func(ctx context.Context, req geminio.Request, rsp geminio.Response) {
+		cur := atomic.AddInt32(&running, 1)
+		for {
+			max := atomic.LoadInt32(&maxRunning)
+			if cur <= max || atomic.CompareAndSwapInt32(&maxRunning, max, cur) {
+				break
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+	}
+	if err = sEnd.Register(context.TODO(), "slow", slow); err != nil {
+		t.Fatal(err)
+	}
+
+	succeeds, busies := int32(0), int32(0)
+	wg := sync.WaitGroup{}
+	for i := 0; i < calls; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := cEnd.Call(context.TODO(), "slow", cEnd.NewRequest([]byte("flood")))
+			switch {
+			case err == nil:
+				atomic.AddInt32(&succeeds, 1)
+			case errors.Is(err, application.ErrServerBusy):
+				atomic.AddInt32(&busies, 1)
+			default:
+				t.Errorf("unexpected call err: %s, policy: %s", err, policy)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if maxRunning > int32(workers) {
+		t.Errorf("workers not bounded, max running: %d, policy: %s", maxRunning, policy)
+	}
+	switch policy {
+	case application.WorkerPoolBlock:
+		if succeeds != int32(calls) {
+			t.Errorf("unexpected succeeds: %d, policy: %s", succeeds, policy)
+		}
+	case application.WorkerPoolReject:
+		// at least the workers and the queue are filled
+		if succeeds < int32(workers+queue) || busies == 0 || succeeds+busies != int32(calls) {
+			t.Errorf("unexpected succeeds: %d, busies: %d, policy: %s", succeeds, busies, policy)
+		}
+	}
+}
+
+func TestDefaultRequestTimeout(t *testing.T) {
+	sEnd, cEnd, err := test.GetEndPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sEnd.Close()
+	defer cEnd.Close()
+
+	release := make(chan struct{})
+	defer close(release)
+	hang := func(ctx context.Context, req geminio.Request, rsp geminio.Response) {
+		<-release
+	}
+	if err = sEnd.Register(context.TODO(), "hang", hang); err != nil {
+		t.Fatal(err)
+	}
+
+	timeout := 300 * time.Millisecond
+	cEnd.SetDefaultRequestTimeout(timeout)
+	start := time.Now()
+	_, err = cEnd.Call(context.TODO(), "hang", cEnd.NewRequest([]byte("default")))
+	elapsed := time.Since(start)
+	if err == nil {
+		t.Fatal("call without timeout returned")
+	}
+	if elapsed < timeout/2 || elapsed > 3*timeout {
+		t.Errorf("unexpected elapsed with the default timeout: %s", elapsed)
+	}
+
+	// the per-request timeout overrides the default
+	opt := options.Call()
+	opt.SetTimeout(50 * time.Millisecond)
+	start = time.Now()
+	_, err = cEnd.Call(context.TODO(), "hang", cEnd.NewRequest([]byte("override")), opt)
+	elapsed = time.Since(start)
+	if err == nil {
+		t.Fatal("call with timeout returned")
+	}
+	if elapsed > timeout {
+		t.Errorf("per-request timeout not override the default, elapsed: %s", elapsed)
+	}
+}
+
+// chunkWriter hashes the written data and remembers the largest write
+type chunkWriter struct {
+	hash     hash.Hash
+	total    int
+	maxWrite int
+}
+
+func (cw *chunkWriter) Write(p []byte) (int, error) {
+	cw.total += len(p)
+	if len(p) > cw.maxWrite {
+		cw.maxWrite = len(p)
+	}
+	return cw.hash.Write(p)
+}
+
+func TestCallTo(t *testing.T) {
+	sEnd, cEnd, err := test.GetEndPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sEnd.Close()
+	defer cEnd.Close()
+
+	body := make([]byte, 10*1024*1024)
+	for i := range body {
+		body[i] = byte(i % 251)
+	}
+	download := func(ctx context.Context, req geminio.Request, rsp geminio.Response) {
+		rsp.SetData(body)
+	}
+	if err = sEnd.Register(context.TODO(), "download", download); err != nil {
+		t.Fatal(err)
+	}
+	// the body generated and written piece by piece, what the callee holds
+	// is bounded by the chunk size
+	held := 0
+	generate := func(ctx context.Context, req geminio.Request, rsp geminio.Response) {
+		piece := make([]byte, 4096)
+		for off := 0; off < len(body); off += len(piece) {
+			for i := range piece {
+				piece[i] = byte((off + i) % 251)
+			}
+			if _, err := rsp.Write(piece); err != nil {
+				return
+			}
+			if len(rsp.Data()) > held {
+				held = len(rsp.Data())
+			}
+		}
+	}
+	if err = sEnd.Register(context.TODO(), "generate", generate); err != nil {
+		t.Fatal(err)
+	}
+
+	cw := &chunkWriter{hash: sha256.New()}
+	err = cEnd.CallTo(context.TODO(), "download", cEnd.NewRequest([]byte("10MB")), cw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cw.total != len(body) {
+		t.Fatalf("unexpected downloaded length: %d", cw.total)
+	}
+	expected := sha256.Sum256(body)
+	if !bytes.Equal(cw.hash.Sum(nil), expected[:]) {
+		t.Error("mismatch downloaded body")
+	}
+	// the body arrives in chunks, never as a whole
+	if cw.maxWrite >= len(body)/10 {
+		t.Errorf("response not chunked, max write: %d", cw.maxWrite)
+	}
+	// write err aborts the download and leaves the stream usable
+	werr := errors.New("disk full")
+	err = cEnd.CallTo(context.TODO(), "download", cEnd.NewRequest([]byte("10MB")), failWriter{werr})
+	if err != werr {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	cw = &chunkWriter{hash: sha256.New()}
+	err = cEnd.CallTo(context.TODO(), "download", cEnd.NewRequest([]byte("10MB")), cw)
+	if err != nil || cw.total != len(body) {
+		t.Errorf("download after write err, err: %v, length: %d", err, cw.total)
+	}
+
+	cw = &chunkWriter{hash: sha256.New()}
+	err = cEnd.CallTo(context.TODO(), "generate", cEnd.NewRequest([]byte("10MB")), cw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cw.total != len(body) || !bytes.Equal(cw.hash.Sum(nil), expected[:]) {
+		t.Errorf("mismatch generated body, length: %d", cw.total)
+	}
+	if held == 0 || held > 128*1024 {
+		t.Errorf("unexpected body held by the callee: %d", held)
+	}
+}
+
+type failWriter struct {
+	err error
+}
+
+func (fw failWriter) Write(p []byte) (int, error) {
+	return 0, fw.err
+}
+
+func TestCallDedup(t *testing.T) {
+	sEnd, cEnd, err := test.GetEndPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sEnd.Close()
+	defer cEnd.Close()
+
+	served := int32(0)
+	arrived := make(chan struct{}, 1)
+	release := make(chan struct{})
+	slow := func(ctx context.Context, req geminio.Request, rsp geminio.Response) {
+		atomic.AddInt32(&served, 1)
+		arrived <- struct{}{}
+		<-release
+		rsp.SetData(append([]byte("cached "), req.Data()...))
+	}
+	if err = sEnd.Register(context.TODO(), "slow", slow); err != nil {
+		t.Fatal(err)
+	}
+
+	callers := 10
+	var wg sync.WaitGroup
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rsp, err := cEnd.CallDedup(context.TODO(), "slow", cEnd.NewRequest([]byte("key")))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if string(rsp.Data()) != "cached key" {
+				t.Errorf("unexpected response: %s", rsp.Data())
+			}
+		}()
+	}
+	<-arrived
+	// let the rest callers join the call in flight
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if n := atomic.LoadInt32(&served); n != 1 {
+		t.Errorf("identical calls not coalesced, served: %d", n)
+	}
+
+	// the next call after the flight landed goes to the wire again
+	go func() { <-arrived }()
+	if _, err = cEnd.CallDedup(context.TODO(), "slow", cEnd.NewRequest([]byte("key"))); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&served); n != 2 {
+		t.Errorf("call after the flight not served, served: %d", n)
+	}
+}
+
+func TestRPCAuthorizer(t *testing.T) {
+	const clientA, clientB = 1001, 1002
+	sOpt := server.NewEndOptions()
+	sOpt.SetAuthorizer(func(clientID uint64, method string) error {
+		if method == "tenant" && clientID != clientA {
+			return errors.New("tenant of client A only")
+		}
+		return nil
+	})
+	echo := func(_ context.Context, req geminio.Request, rsp geminio.Response) {
+		rsp.SetData(req.Data())
+	}
+
+	call := func(clientID uint64) error {
+		cOpt := client.NewEndOptions()
+		cOpt.SetClientID(clientID)
+		sEnd, cEnd, err := test.GetEndPairWithOptions(sOpt, cOpt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sEnd.Close()
+		defer cEnd.Close()
+		if err = sEnd.Register(context.TODO(), "tenant", echo); err != nil {
+			t.Fatal(err)
+		}
+		_, err = cEnd.Call(context.TODO(), "tenant", cEnd.NewRequest([]byte("data")))
+		return err
+	}
+	if err := call(clientA); err != nil {
+		t.Errorf("client A unexpected err: %v", err)
+	}
+	if err := call(clientB); !errors.Is(err, application.ErrForbidden) {
+		t.Errorf("client B unexpected err: %v", err)
+	}
+}
+
+func TestCallStream(t *testing.T) {
+	sEnd, cEnd, err := test.GetEndPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sEnd.Close()
+	defer cEnd.Close()
+
+	sum := func(ctx context.Context, stream geminio.StreamResponse) error {
+		total := 0
+		for {
+			data, err := stream.RecvMsg()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			n, err := strconv.Atoi(string(data))
+			if err != nil {
+				return err
+			}
+			total += n
+			if err = stream.SendMsg([]byte(strconv.Itoa(total))); err != nil {
+				return err
+			}
+		}
+	}
+	if err = sEnd.RegisterStream(context.TODO(), "sum", sum); err != nil {
+		t.Fatal(err)
+	}
+
+	stream, err := cEnd.CallStream(context.TODO(), "sum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for i := 1; i <= 100; i++ {
+			stream.SendMsg([]byte(strconv.Itoa(i)))
+		}
+		stream.CloseSend()
+	}()
+	totals := []int{}
+	for {
+		data, err := stream.RecvMsg()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		total, _ := strconv.Atoi(string(data))
+		totals = append(totals, total)
+	}
+	if len(totals) != 100 || totals[99] != 5050 {
+		t.Fatalf("unexpected totals: %v", totals)
+	}
+	// the ended call keeps returning io.EOF
+	if _, err = stream.RecvMsg(); err != io.EOF {
+		t.Errorf("unexpected err after end: %v", err)
+	}
+	if err = stream.SendMsg([]byte("1")); err != io.EOF {
+		t.Errorf("unexpected send err after end: %v", err)
+	}
+
+	// the callee's error ends the call
+	stream, err = cEnd.CallStream(context.TODO(), "sum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.SendMsg([]byte("NaN"))
+	for {
+		_, err = stream.RecvMsg()
+		if err != nil {
+			break
+		}
+	}
+	if err == io.EOF || err == nil {
+		t.Errorf("expected the callee's err, got: %v", err)
+	}
+}
+
+func TestCallStreamClose(t *testing.T) {
+	sEnd, cEnd, err := test.GetEndPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sEnd.Close()
+	defer cEnd.Close()
+
+	errCount := errors.New("count too large")
+	// counts down from the first message, a negative one is an error
+	countdown := func(ctx context.Context, stream geminio.StreamResponse) error {
+		data, err := stream.RecvMsg()
+		if err != nil {
+			return err
+		}
+		n, _ := strconv.Atoi(string(data))
+		if n > 3 {
+			return stream.Close(errCount)
+		}
+		for ; n > 0; n-- {
+			stream.SendMsg([]byte(strconv.Itoa(n)))
+		}
+		stream.Close(nil)
+		if err = stream.SendMsg([]byte("0")); err != application.ErrSendClosed {
+			t.Errorf("unexpected send err after close: %v", err)
+		}
+		// the returned error is too late for the caller
+		return errors.New("returned after close")
+	}
+	if err = sEnd.RegisterStream(context.TODO(), "countdown", countdown); err != nil {
+		t.Fatal(err)
+	}
+
+	call := func(n int) ([]string, error) {
+		stream, err := cEnd.CallStream(context.TODO(), "countdown")
+		if err != nil {
+			return nil, err
+		}
+		stream.SendMsg([]byte(strconv.Itoa(n)))
+		msgs := []string{}
+		for {
+			data, err := stream.RecvMsg()
+			if err != nil {
+				return msgs, err
+			}
+			msgs = append(msgs, string(data))
+		}
+	}
+	msgs, err := call(3)
+	if err != io.EOF {
+		t.Errorf("unexpected err of clean close: %v", err)
+	}
+	if strings.Join(msgs, ",") != "3,2,1" {
+		t.Errorf("unexpected messages: %v", msgs)
+	}
+	_, err = call(4)
+	if err == nil || err == io.EOF || err.Error() != errCount.Error() {
+		t.Errorf("unexpected err of close with err: %v", err)
+	}
+}
+
+func TestCallStreamBacklog(t *testing.T) {
+	sEnd, cEnd, err := test.GetEndPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sEnd.Close()
+	defer cEnd.Close()
+
+	// both sides send all before receiving any
+	backlog := func(ctx context.Context, stream geminio.StreamResponse) error {
+		for i := 0; i < 100; i++ {
+			if err := stream.SendMsg([]byte(strconv.Itoa(i))); err != nil {
+				return err
+			}
+		}
+		for {
+			_, err := stream.RecvMsg()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if err = sEnd.RegisterStream(context.TODO(), "backlog", backlog); err != nil {
+		t.Fatal(err)
+	}
+	echo := func(_ context.Context, req geminio.Request, rsp geminio.Response) {
+		rsp.SetData(req.Data())
+	}
+	if err = sEnd.Register(context.TODO(), "echo", echo); err != nil {
+		t.Fatal(err)
+	}
+
+	stream, err := cEnd.CallStream(context.TODO(), "backlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 300; i++ {
+		if err = stream.SendMsg([]byte(strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the backlogged call doesn't hold up the others
+	ctx, cancel := context.WithTimeout(context.TODO(), time.Second)
+	defer cancel()
+	rsp, err := cEnd.Call(ctx, "echo", cEnd.NewRequest([]byte("unblocked")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rsp.Data()) != "unblocked" {
+		t.Errorf("unexpected response: %s", string(rsp.Data()))
+	}
+
+	if err = stream.CloseSend(); err != nil {
+		t.Fatal(err)
+	}
+	received := 0
+	for {
+		data, err := stream.RecvMsg()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != strconv.Itoa(received) {
+			t.Fatalf("unexpected message: %s, want: %d", string(data), received)
+		}
+		received++
+	}
+	if received != 100 {
+		t.Errorf("unexpected messages received: %d", received)
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	recorder := &dropRecorder{}
+	cOpt := client.NewEndOptions()
+	cOpt.SetDropObserver(recorder)
+	sEnd, cEnd, err := test.GetEndPairWithOptions(nil, cOpt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sEnd.Close()
+	defer cEnd.Close()
+
+	returned := make(chan error, 1)
+	slow := func(ctx context.Context, req geminio.Request, rsp geminio.Response) {
+		if req.Timeout() != 100*time.Millisecond {
+			t.Errorf("unexpected request timeout at callee: %s", req.Timeout())
+		}
+		// the handler ignores the context
+		time.Sleep(300 * time.Millisecond)
+		rsp.SetData([]byte("late"))
+		returned <- ctx.Err()
+	}
+	if err = sEnd.Register(context.TODO(), "slow", slow); err != nil {
+		t.Fatal(err)
+	}
+
+	req := cEnd.NewRequest([]byte("slow"))
+	req.SetTimeout(100 * time.Millisecond)
+	if _, err = cEnd.Call(context.TODO(), "slow", req); err == nil {
+		t.Fatal("unexpected nil err")
+	}
+	// the context is canceled at the timeout, and the late response dropped
+	// by the callee rather than the caller
+	if err = <-returned; err == nil {
+		t.Error("context not canceled at the timeout")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n, records := recorder.count(packet.DropReasonNoWaiting); n != 0 {
+		t.Errorf("late response delivered, drops: %v", records)
+	}
+	if stat := sEnd.MethodStats()["slow"]; stat.Total != 1 || stat.Errors != 1 || stat.InFlight != 0 {
+		t.Errorf("unexpected slow stat: %+v", stat)
+	}
+}
+
+func TestCallErrors(t *testing.T) {
+	sEnd, cEnd, err := test.GetEndPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sEnd.Close()
+	defer cEnd.Close()
+
+	errRemote := errors.New("remote failure")
+	failing := func(ctx context.Context, req geminio.Request, rsp geminio.Response) {
+		rsp.SetError(errRemote)
+	}
+	release := make(chan struct{})
+	defer close(release)
+	hang := func(ctx context.Context, req geminio.Request, rsp geminio.Response) {
+		<-release
+	}
+	if err = sEnd.Register(context.TODO(), "failing", failing); err != nil {
+		t.Fatal(err)
+	}
+	if err = sEnd.Register(context.TODO(), "hang", hang); err != nil {
+		t.Fatal(err)
+	}
+
+	timeout := options.Call()
+	timeout.SetTimeout(50 * time.Millisecond)
+	canceled, cancel := context.WithCancel(context.TODO())
+	cancel()
+	cases := []struct {
+		name   string
+		call   func() error
+		kind   error
+		cause  error
+		reason string
+	}{
+		{
+			name: "remote",
+			call: func() error {
+				_, err := cEnd.Call(context.TODO(), "failing", cEnd.NewRequest([]byte("data")))
+				return err
+			},
+			kind:   application.ErrCallRemote,
+			reason: errRemote.Error(),
+		},
+		{
+			name: "method not found",
+			call: func() error {
+				_, err := cEnd.Call(context.TODO(), "absent", cEnd.NewRequest([]byte("data")))
+				return err
+			},
+			kind:  application.ErrCallMethodNotFound,
+			cause: application.ErrNoSuchRPC,
+		},
+		{
+			name: "timeout",
+			call: func() error {
+				_, err := cEnd.Call(context.TODO(), "hang", cEnd.NewRequest([]byte("data")), timeout)
+				return err
+			},
+			kind: application.ErrCallTimeout,
+		},
+		{
+			name: "canceled",
+			call: func() error {
+				_, err := cEnd.Call(canceled, "hang", cEnd.NewRequest([]byte("data")))
+				return err
+			},
+			kind:  application.ErrCallCanceled,
+			cause: context.Canceled,
+		},
+		{
+			name: "async remote",
+			call: func() error {
+				call, err := cEnd.CallAsync(context.TODO(), "failing", cEnd.NewRequest([]byte("data")), nil)
+				if err != nil {
+					return err
+				}
+				return (<-call.Done).Error
+			},
+			kind:   application.ErrCallRemote,
+			reason: errRemote.Error(),
+		},
+	}
+	for _, c := range cases {
+		err := c.call()
+		if !errors.Is(err, c.kind) {
+			t.Errorf("%s: unexpected err: %v", c.name, err)
+			continue
+		}
+		callErr := &application.CallError{}
+		if !errors.As(err, &callErr) || callErr.Kind != c.kind || callErr.Err == nil {
+			t.Errorf("%s: unexpected call error: %+v", c.name, callErr)
+			continue
+		}
+		if c.cause != nil && !errors.Is(err, c.cause) {
+			t.Errorf("%s: cause not reachable: %v", c.name, err)
+		}
+		if c.reason != "" && callErr.Err.Error() != c.reason {
+			t.Errorf("%s: unexpected cause: %s", c.name, callErr.Err)
+		}
+	}
+
+	// the stream closed ahead, io.EOF or the force closed in flight
+	sm, err := cEnd.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sm.Close()
+	_, err = sm.Call(context.TODO(), "failing", sm.NewRequest([]byte("data")))
+	if !errors.Is(err, application.ErrCallTransport) {
+		t.Errorf("unexpected err on closed stream: %v", err)
+	}
+}
@@ -0,0 +1,105 @@
+package regression
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/singchia/geminio"
+	"github.com/singchia/geminio/client"
+	"github.com/singchia/geminio/server"
+)
+
+func TestSessionPerClient(t *testing.T) {
+	t.Run("allow multiple", func(t *testing.T) {
+		sEnds, cEnds, err := openSessions(t, server.SessionAllowMultiple)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(sEnds) != 2 || len(cEnds) != 2 {
+			t.Fatalf("unexpected sessions: %d, %d", len(sEnds), len(cEnds))
+		}
+		if ended(sEnds[0]) {
+			t.Error("the former session closed")
+		}
+	})
+	t.Run("replace old", func(t *testing.T) {
+		sEnds, cEnds, err := openSessions(t, server.SessionReplaceOld)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(sEnds) != 2 || len(cEnds) != 2 {
+			t.Fatalf("unexpected sessions: %d, %d", len(sEnds), len(cEnds))
+		}
+		if !ended(sEnds[0]) {
+			t.Error("the former session not closed")
+		}
+		if ended(sEnds[1]) {
+			t.Error("the new session closed")
+		}
+	})
+	t.Run("reject new", func(t *testing.T) {
+		sEnds, cEnds, err := openSessions(t, server.SessionRejectNew)
+		if err == nil || err.Error() != server.ErrSessionExists.Error() {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if len(sEnds) != 1 || len(cEnds) != 1 {
+			t.Fatalf("unexpected sessions: %d, %d", len(sEnds), len(cEnds))
+		}
+		if ended(sEnds[0]) {
+			t.Error("the former session closed")
+		}
+	})
+}
+
+// openSessions opens two sessions of the same clientID one after another,
+// the ends got before the err are returned
+func openSessions(t *testing.T, policy server.SessionPerClient) ([]geminio.End, []geminio.End, error) {
+	opt := server.NewEndOptions()
+	opt.SetSessionPerClient(policy)
+	ln, err := server.Listen("tcp", "127.0.0.1:0", opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	accepted := make(chan geminio.End)
+	go func() {
+		for {
+			end, err := ln.AcceptEnd()
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if err != nil {
+				// the refused one
+				continue
+			}
+			accepted <- end
+		}
+	}()
+
+	sEnds, cEnds := []geminio.End{}, []geminio.End{}
+	for i := 0; i < 2; i++ {
+		cOpt := client.NewEndOptions()
+		cOpt.SetClientID(20240601)
+		cEnd, err := client.NewEnd("tcp", ln.Addr().String(), cOpt)
+		if err != nil {
+			return sEnds, cEnds, err
+		}
+		t.Cleanup(func() { cEnd.Close() })
+		sEnd := <-accepted
+		t.Cleanup(func() { sEnd.Close() })
+		sEnds, cEnds = append(sEnds, sEnd), append(cEnds, cEnd)
+	}
+	return sEnds, cEnds, nil
+}
+
+// ended tells if the end's default stream is closed
+func ended(end geminio.End) bool {
+	ctx, cancel := context.WithTimeout(context.TODO(), 100*time.Millisecond)
+	defer cancel()
+	_, err := end.Receive(ctx)
+	return err == io.EOF
+}
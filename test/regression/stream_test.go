@@ -0,0 +1,281 @@
+package regression
+
+import (
+	"context"
+	"io"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/singchia/geminio"
+	"github.com/singchia/geminio/client"
+	"github.com/singchia/geminio/packet"
+	"github.com/singchia/geminio/server"
+	"github.com/singchia/geminio/test"
+)
+
+func TestStreamCallInterleaved(t *testing.T) {
+	ss, cs, err := test.GetEndStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ss.Close()
+	defer cs.Close()
+
+	echo := func(ctx context.Context, req geminio.Request, rsp geminio.Response) {
+		rsp.SetData(req.Data())
+	}
+	err = ss.Register(context.TODO(), "echo", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	count := 10
+	data := []byte("stream data")
+	done := make(chan error, 1)
+	go func() {
+		buf := make([]byte, len(data)*count)
+		_, err := io.ReadFull(ss, buf)
+		if err == nil {
+			for i := 0; i < count; i++ {
+				if string(buf[i*len(data):(i+1)*len(data)]) != string(data) {
+					err = io.ErrUnexpectedEOF
+					break
+				}
+			}
+		}
+		done <- err
+	}()
+
+	for i := 0; i < count; i++ {
+		_, err = cs.Write(data)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		value := "call-" + strconv.Itoa(i)
+		rsp, err := cs.Call(context.TODO(), "echo", cs.NewRequest([]byte(value)))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if string(rsp.Data()) != value {
+			t.Errorf("unexpected response: %s", string(rsp.Data()))
+		}
+	}
+	if err = <-done; err != nil {
+		t.Errorf("stream data broken: %s", err)
+	}
+}
+
+func TestStreamEmptyWrite(t *testing.T) {
+	ss, cs, err := test.GetEndStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ss.Close()
+
+	if _, err = cs.Write([]byte{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = cs.Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 8)
+	// the empty data packet is read as 0 with nil error rather than EOF
+	n, err := ss.Read(buf)
+	if n != 0 || err != nil {
+		t.Fatalf("unexpected empty read, n: %d, err: %v", n, err)
+	}
+	n, err = ss.Read(buf)
+	if err != nil || string(buf[:n]) != "x" {
+		t.Fatalf("unexpected read, data: %s, err: %v", string(buf[:n]), err)
+	}
+	cs.Close()
+	if n, err = ss.Read(buf); err != io.EOF {
+		t.Errorf("unexpected read after close, n: %d, err: %v", n, err)
+	}
+}
+
+func TestStreamFiniGrace(t *testing.T) {
+	sOpt := server.NewEndOptions()
+	sOpt.SetFiniGrace(time.Second)
+	sEnd, cEnd, err := test.GetEndPairWithOptions(sOpt, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sEnd.Close()
+	defer cEnd.Close()
+
+	accepted := make(chan geminio.Stream, 1)
+	go func() {
+		ss, err := sEnd.AcceptStream()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- ss
+	}()
+	cs, err := cEnd.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss, ok := <-accepted
+	if !ok {
+		t.Fatal("accept stream failed")
+	}
+
+	count := 3
+	for i := 0; i < count; i++ {
+		if _, err = cs.Write([]byte(strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cs.Close()
+	// wait for the dismiss done
+	time.Sleep(200 * time.Millisecond)
+
+	buf := make([]byte, 8)
+	for i := 0; i < count; i++ {
+		n, err := ss.Read(buf)
+		if err != nil {
+			t.Fatalf("buffered read err: %s, read: %d", err, i)
+		}
+		if string(buf[:n]) != strconv.Itoa(i) {
+			t.Errorf("unexpected buffered read: %s", string(buf[:n]))
+		}
+	}
+	if _, err = ss.Read(buf); err != io.EOF {
+		t.Errorf("unexpected read after drained, err: %v", err)
+	}
+}
+
+func TestStreamBandwidthLimit(t *testing.T) {
+	limit := 1024 * 1024
+	opt := client.NewEndOptions()
+	opt.SetBandwidthLimit(limit, 64*1024)
+	sEnd, cEnd, err := test.GetEndPairWithOptions(nil, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sEnd.Close()
+	defer cEnd.Close()
+
+	streams, each := 2, 256*1024
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < streams; i++ {
+		cs, err := cEnd.OpenStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ss, err := sEnd.AcceptStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			chunk := make([]byte, 16*1024)
+			for written := 0; written < each; written += len(chunk) {
+				if _, err := cs.Write(chunk); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if _, err := io.ReadFull(ss, make([]byte, each)); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	// the burst is excluded, and the packet headers are counted as well
+	rate := float64(streams*each) / elapsed.Seconds()
+	if rate > float64(limit)*1.25 {
+		t.Errorf("aggregate throughput not capped, rate: %.0f B/s, limit: %d B/s", rate, limit)
+	}
+	if rate < float64(limit)/2 {
+		t.Errorf("aggregate throughput too low, rate: %.0f B/s, limit: %d B/s", rate, limit)
+	}
+}
+
+type dropRecord struct {
+	reason     string
+	direction  packet.Direction
+	dialogueID uint64
+}
+
+type dropRecorder struct {
+	mtx     sync.Mutex
+	records []dropRecord
+}
+
+func (dr *dropRecorder) OnDrop(pkt packet.Packet, reason string, direction packet.Direction, dialogueID uint64) {
+	dr.mtx.Lock()
+	defer dr.mtx.Unlock()
+	dr.records = append(dr.records, dropRecord{reason, direction, dialogueID})
+}
+
+func (dr *dropRecorder) count(reason string) (int, []dropRecord) {
+	dr.mtx.Lock()
+	defer dr.mtx.Unlock()
+	n := 0
+	for _, record := range dr.records {
+		if record.reason == reason {
+			n++
+		}
+	}
+	return n, append([]dropRecord(nil), dr.records...)
+}
+
+func TestStreamDropObserver(t *testing.T) {
+	recorder := &dropRecorder{}
+	opt := server.NewEndOptions()
+	opt.SetDropObserver(recorder)
+	sEnd, cEnd, err := test.GetEndPairWithOptions(opt, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sEnd.Close()
+	defer cEnd.Close()
+
+	cs, err := cEnd.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss, err := sEnd.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the server side never reads, packets beyond the buffer are dropped
+	total := 1024 + 16
+	for i := 0; i < total; i++ {
+		if _, err := cs.Write([]byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		n, records := recorder.count(packet.DropReasonBufferFull)
+		if n == total-1024 {
+			for _, record := range records {
+				if record.direction != packet.DirectionIn {
+					t.Fatalf("unexpected direction: %s", record.direction)
+				}
+				if record.dialogueID != ss.StreamID() {
+					t.Fatalf("unexpected dialogueID: %d, expected: %d", record.dialogueID, ss.StreamID())
+				}
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected drops: %d, expected: %d, records: %v", n, total-1024, records)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
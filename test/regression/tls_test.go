@@ -0,0 +1,170 @@
+package regression
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/singchia/geminio"
+	"github.com/singchia/geminio/client"
+	"github.com/singchia/geminio/server"
+)
+
+func TestTLSSessionResumption(t *testing.T) {
+	serverCfg, clientCfg, err := getTLSConfigs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, resumption := range []bool{true, false} {
+		didResumes, err := reconnectTLS(serverCfg, clientCfg, resumption)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if didResumes[0] {
+			t.Errorf("first connection resumed, resumption: %v", resumption)
+		}
+		if didResumes[1] != resumption {
+			t.Errorf("unexpected second connection resumed: %v, resumption: %v",
+				didResumes[1], resumption)
+		}
+	}
+}
+
+func TestTLSEnd(t *testing.T) {
+	serverCfg, clientCfg, err := getTLSConfigs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := server.ListenTLS("tcp", "127.0.0.1:0", serverCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			end, err := ln.AcceptEnd()
+			if err != nil {
+				return
+			}
+			end.Register(context.TODO(), "echo", func(_ context.Context, req geminio.Request, rsp geminio.Response) {
+				rsp.SetData(req.Data())
+			})
+		}
+	}()
+
+	cEnd, err := client.NewEndWithTLS("tcp", ln.Addr().String(), clientCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cEnd.Close()
+	rsp, err := cEnd.Call(context.TODO(), "echo", cEnd.NewRequest([]byte("over tls")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rsp.Data()) != "over tls" {
+		t.Errorf("unexpected response: %s", rsp.Data())
+	}
+
+	// the self-signed cert isn't trusted without the CA
+	_, err = client.NewEndWithTLS("tcp", ln.Addr().String(), nil)
+	var unknown x509.UnknownAuthorityError
+	if !errors.As(err, &unknown) {
+		t.Errorf("unexpected err of untrusted cert: %v", err)
+	}
+}
+
+// reconnectTLS returns whether the first and the reconnected TLS sessions
+// were resumed, from the server side view.
+func reconnectTLS(serverCfg, clientCfg *tls.Config, resumption bool) ([2]bool, error) {
+	didResumes := [2]bool{}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", serverCfg)
+	if err != nil {
+		return didResumes, err
+	}
+	defer ln.Close()
+
+	states := make(chan tls.ConnectionState, 2)
+	go func() {
+		for {
+			netconn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			end, err := server.NewEndWithConn(netconn)
+			if err != nil {
+				continue
+			}
+			// the TLS handshake is done while the end is established
+			states <- netconn.(*tls.Conn).ConnectionState()
+			// kick the client to reconnect
+			end.Close()
+		}
+	}()
+
+	dialer := client.NewTLSDialer("tcp", ln.Addr().String(), clientCfg, resumption)
+	cEnd, err := client.NewRetryEndWithDialer(dialer)
+	if err != nil {
+		return didResumes, err
+	}
+	defer cEnd.Close()
+
+	for i := range didResumes {
+		select {
+		case state := <-states:
+			didResumes[i] = state.DidResume
+		case <-time.After(10 * time.Second):
+			return didResumes, net.ErrClosed
+		}
+	}
+	return didResumes, nil
+}
+
+// getTLSConfigs returns configs with a self-signed test CA
+func getTLSConfigs() (*tls.Config, *tls.Config, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "geminio test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	serverCfg := &tls.Config{
+		Certificates: []tls.Certificate{{
+			Certificate: [][]byte{der},
+			PrivateKey:  key,
+		}},
+	}
+	clientCfg := &tls.Config{
+		RootCAs: pool,
+	}
+	return serverCfg, clientCfg, nil
+}